@@ -34,6 +34,7 @@ import (
 type InQConfig struct {
 	MaxCount int    `json:"maxCount"`
 	MaxSize  uint64 `json:"maxSize"`
+	Overflow string `json:"overflow,omitempty"`
 }
 
 type LogConfig struct {
@@ -84,8 +85,11 @@ type InOutConfig struct {
 	Type        string             `json:"type,omitempty"`
 	Name        string             `json:"name,omitempty"`
 	Description string             `json:"description,omitempty"`
+	Tag         string             `json:"tag,omitempty"`
+	Match       string             `json:"match,omitempty"`
 	Filter      string             `json:"filter,omitempty"`
 	Params      []inOutParamConfig `json:"params,omitempty"`
+	Secondary   *InOutConfig       `json:"secondary,omitempty"`
 }
 
 type InputsConfig struct {
@@ -100,6 +104,7 @@ type OutQConfig struct {
 	ChunkSize          int           `json:"chunkSize"`
 	MaxCount           int           `json:"maxCount"`
 	WaitPopForMillisec time.Duration `json:"waitPopForMillisec"`
+	Overflow           string        `json:"overflow,omitempty"`
 }
 
 type OutputsConfig struct {
@@ -334,7 +339,7 @@ func (cfg *InOutConfig) GetParamsMap() map[string]interface{} {
 		return make(map[string]interface{}, 0)
 	}
 
-	params := make(map[string]interface{}, len(cfg.Params)+2)
+	params := make(map[string]interface{}, len(cfg.Params)+5)
 
 	name := strings.TrimSpace(cfg.Name)
 	if name != "" {
@@ -346,6 +351,21 @@ func (cfg *InOutConfig) GetParamsMap() map[string]interface{} {
 		params["@description"] = description
 	}
 
+	tag := strings.TrimSpace(cfg.Tag)
+	if tag != "" {
+		params["@tag"] = tag
+	}
+
+	match := strings.TrimSpace(cfg.Match)
+	if match != "" {
+		params["@match"] = match
+	}
+
+	filter := strings.TrimSpace(cfg.Filter)
+	if filter != "" {
+		params["@filter"] = filter
+	}
+
 	for _, p := range cfg.Params {
 		params[p.Name] = p.Value
 	}
@@ -374,6 +394,20 @@ func (cfg *InQConfig) GetMaxParams() (maxCount int, maxSize uint64) {
 	return
 }
 
+func (cfg *InQConfig) GetOverflow() string {
+	if cfg != nil {
+		return strings.ToLower(strings.TrimSpace(cfg.Overflow))
+	}
+	return ""
+}
+
+func (cfg *OutQConfig) GetOverflow() string {
+	if cfg != nil {
+		return strings.ToLower(strings.TrimSpace(cfg.Overflow))
+	}
+	return ""
+}
+
 func (cfg *OutQConfig) GetParams() (chunkSize, maxCount int, waitPopForMillisec time.Duration) {
 	if cfg != nil {
 		chunkSize = cfg.ChunkSize
@@ -104,6 +104,14 @@ func getInputs(ctx *fasthttp.RequestCtx) {
 	obj := make(map[string]interface{})
 	obj["inputs"] = ins
 
+	if filter := ioman.GetInputsFilter(); filter != nil {
+		obj["filter"] = filter
+	}
+
+	if queue := ioman.GetInputsQueue(); queue != nil {
+		obj["queue"] = queue
+	}
+
 	data, err := json.Marshal(obj)
 	if err != nil {
 		http.SetRestError(ctx, err, 503)
@@ -169,6 +177,18 @@ func getOutputs(ctx *fasthttp.RequestCtx) {
 	obj := make(map[string]interface{})
 	obj["outputs"] = outs
 
+	if filter := ioman.GetOutputsFilter(); filter != nil {
+		obj["filter"] = filter
+	}
+
+	if queue := ioman.GetOutputsQueue(); queue != nil {
+		obj["queue"] = queue
+	}
+
+	if buffer := ioman.GetBufferInfo(); buffer != nil {
+		obj["buffer"] = buffer
+	}
+
 	data, err := json.Marshal(obj)
 	if err != nil {
 		http.SetRestError(ctx, err, 503)
@@ -100,9 +100,17 @@ func start(config *config.FluentConfig, logger log.Logger, quitSignal <-chan boo
 		logger.Println(msg)
 	}
 
+	iom, err := inout.NewInOutManager(mode, config, logger, quitSignal)
+	if err != nil {
+		logger.Println(err)
+		fmt.Printf("* Unable to start service: %s\n", err)
+		os.Exit(1)
+	}
+
+	ioman = iom
+
 	startAdminModule(config, logger, quitSignal)
 
-	ioman = inout.NewInOutManager(mode, config, logger, quitSignal)
 	if ioman != nil {
 		ioman.Process()
 	}
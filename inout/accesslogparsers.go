@@ -0,0 +1,225 @@
+//	The MIT License (MIT)
+//
+//	Copyright (c) 2016, Cagatay Dogan
+//
+//	Permission is hereby granted, free of charge, to any person obtaining a copy
+//	of this software and associated documentation files (the "Software"), to deal
+//	in the Software without restriction, including without limitation the rights
+//	to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+//	copies of the Software, and to permit persons to whom the Software is
+//	furnished to do so, subject to the following conditions:
+//
+//		The above copyright notice and this permission notice shall be included in
+//		all copies or substantial portions of the Software.
+//
+//		THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+//		IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+//		FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+//		AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+//		LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+//		OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+//		THE SOFTWARE.
+
+package inout
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/ocdogan/fluentgo/config"
+	"github.com/ocdogan/fluentgo/lib"
+)
+
+const (
+	apacheTimeLayout = "02/Jan/2006:15:04:05 -0700"
+
+	// Apache common and combined formats, nginx default format is the same as combined
+	apacheExpression = `^(?P<remote>\S+) (?P<ident>\S+) (?P<user>\S+) \[(?P<time>[^\]]+)\] ` +
+		`"(?P<request>(?:[^"\\]|\\.)*)" (?P<status>\d{3}|-) (?P<bytes>\d+|-)` +
+		`(?: "(?P<referer>(?:[^"\\]|\\.)*)" "(?P<agent>(?:[^"\\]|\\.)*)")?`
+
+	elbExpression = `^(?P<time>\S+) (?P<elb>\S+) ` +
+		`(?P<client_ip>\S+):(?P<client_port>\d+) (?:(?P<backend_ip>\S+):(?P<backend_port>\d+)|-) ` +
+		`(?P<request_processing_time>\S+) (?P<backend_processing_time>\S+) (?P<response_processing_time>\S+) ` +
+		`(?P<elb_status_code>\S+) (?P<backend_status_code>\S+) (?P<received_bytes>\d+) (?P<sent_bytes>\d+) ` +
+		`"(?P<request>[^"]*)" "(?P<user_agent>[^"]*)" (?P<ssl_cipher>\S+) (?P<ssl_protocol>\S+)`
+
+	albExpression = `^(?P<type>\S+) (?P<time>\S+) (?P<elb>\S+) ` +
+		`(?P<client_ip>\S+):(?P<client_port>\d+) (?:(?P<target_ip>\S+):(?P<target_port>\d+)|-) ` +
+		`(?P<request_processing_time>\S+) (?P<target_processing_time>\S+) (?P<response_processing_time>\S+) ` +
+		`(?P<elb_status_code>\S+) (?P<target_status_code>\S+) (?P<received_bytes>\d+) (?P<sent_bytes>\d+) ` +
+		`"(?P<request>[^"]*)" "(?P<user_agent>[^"]*)" (?P<ssl_cipher>\S+) (?P<ssl_protocol>\S+)` +
+		`(?: (?P<target_group_arn>\S+) "(?P<trace_id>[^"]*)" "(?P<domain_name>[^"]*)" ` +
+		`"(?P<chosen_cert_arn>[^"]*)" (?P<matched_rule_priority>\S+) (?P<request_creation_time>\S+) ` +
+		`"(?P<actions_executed>[^"]*)" "(?P<redirect_url>[^"]*)" "(?P<error_reason>[^"]*)")?`
+)
+
+const (
+	apacheTypes = "status:int,bytes:int,time:time:" + apacheTimeLayout
+
+	elbTypes = "time:time,client_port:int,backend_port:int,target_port:int," +
+		"request_processing_time:float,backend_processing_time:float," +
+		"target_processing_time:float,response_processing_time:float," +
+		"elb_status_code:int,backend_status_code:int,target_status_code:int," +
+		"received_bytes:int,sent_bytes:int,request_creation_time:time"
+
+	nginxJsonTypes = "status:int,body_bytes_sent:int,bytes_sent:int,request_length:int," +
+		"request_time:float,upstream_response_time:float,upstream_connect_time:float," +
+		"upstream_header_time:float,msec:time:unix,time_iso8601:time,time_local:time:" + apacheTimeLayout
+)
+
+// accessLogParser parses the access log lines with a predefined expression
+// and splits the request line into its method, path and protocol
+type accessLogParser struct {
+	regex   *regexParser
+	pathKey string
+}
+
+// nginxJsonParser converts the string values of the nginx JSON log_format
+// output into their types, leaving the values it cannot convert as they are
+type nginxJsonParser struct {
+	types      map[string]*fieldType
+	timeFormat string
+}
+
+func init() {
+	RegisterParser("apache", newApacheParser)
+	RegisterParser("apache_common", newApacheParser)
+	RegisterParser("apache_combined", newApacheParser)
+	RegisterParser("nginx", newApacheParser)
+	RegisterParser("nginx_json", newNginxJsonParser)
+	RegisterParser("elb", newELBParser)
+	RegisterParser("alb", newALBParser)
+}
+
+func newApacheParser(params map[string]interface{}) (Parser, error) {
+	return newAccessLogParser(params, apacheExpression, apacheTypes, "path")
+}
+
+func newELBParser(params map[string]interface{}) (Parser, error) {
+	return newAccessLogParser(params, elbExpression, elbTypes, "url")
+}
+
+func newALBParser(params map[string]interface{}) (Parser, error) {
+	return newAccessLogParser(params, albExpression, elbTypes, "url")
+}
+
+// parserTypes returns the default field types overridden by the types parameter
+func parserTypes(params map[string]interface{}, defaults string) (map[string]*fieldType, error) {
+	types, err := parseFieldTypes(defaults)
+	if err != nil {
+		return nil, err
+	}
+
+	custom, err := parseFieldTypes(params["types"])
+	if err != nil {
+		return nil, err
+	}
+
+	for name, ft := range custom {
+		types[name] = ft
+	}
+	return types, nil
+}
+
+func newAccessLogParser(params map[string]interface{}, expression, defaultTypes, pathKey string) (Parser, error) {
+	types, err := parserTypes(params, defaultTypes)
+	if err != nil {
+		return nil, err
+	}
+
+	timeFormat, _ := config.ParamAsString(params, "timeFormat")
+
+	regex, err := newRegexParserWith(expression, types, timeFormat)
+	if err != nil {
+		return nil, err
+	}
+
+	return &accessLogParser{
+		regex:   regex,
+		pathKey: pathKey,
+	}, nil
+}
+
+func (ap *accessLogParser) Parse(data []byte) (map[string]interface{}, error) {
+	record, err := ap.regex.Parse(data)
+	if err != nil {
+		return nil, err
+	}
+
+	splitRequest(record, ap.pathKey)
+	return record, nil
+}
+
+// splitRequest replaces a "METHOD path PROTOCOL" request line with its
+// parts, leaving the request as it is if it is not in that form
+func splitRequest(record map[string]interface{}, pathKey string) {
+	request, ok := record["request"].(string)
+	if !ok {
+		return
+	}
+
+	parts := strings.Fields(request)
+	if len(parts) < 2 || len(parts) > 3 {
+		return
+	}
+
+	record["method"] = parts[0]
+	record[pathKey] = parts[1]
+	if len(parts) == 3 {
+		record["protocol"] = parts[2]
+	}
+	delete(record, "request")
+}
+
+func newNginxJsonParser(params map[string]interface{}) (Parser, error) {
+	types, err := parserTypes(params, nginxJsonTypes)
+	if err != nil {
+		return nil, err
+	}
+
+	timeFormat, _ := config.ParamAsString(params, "timeFormat")
+	timeFormat = strings.TrimSpace(timeFormat)
+	if timeFormat == "" {
+		timeFormat = lib.ISO8601Time
+	}
+
+	return &nginxJsonParser{
+		types:      types,
+		timeFormat: timeFormat,
+	}, nil
+}
+
+func (np *nginxJsonParser) Parse(data []byte) (map[string]interface{}, error) {
+	var record map[string]interface{}
+
+	err := json.Unmarshal(data, &record)
+	if err != nil {
+		return nil, err
+	}
+	if record == nil {
+		return nil, fmt.Errorf("Data is not a JSON object.")
+	}
+
+	for name, ft := range np.types {
+		s, ok := record[name].(string)
+		if !ok {
+			continue
+		}
+
+		value, ok, err := ft.convert(s, np.timeFormat)
+		if err != nil {
+			continue
+		}
+
+		if ok {
+			record[name] = value
+		} else {
+			delete(record, name)
+		}
+	}
+
+	splitRequest(record, "path")
+	return record, nil
+}
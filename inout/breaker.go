@@ -0,0 +1,196 @@
+//	The MIT License (MIT)
+//
+//	Copyright (c) 2016, Cagatay Dogan
+//
+//	Permission is hereby granted, free of charge, to any person obtaining a copy
+//	of this software and associated documentation files (the "Software"), to deal
+//	in the Software without restriction, including without limitation the rights
+//	to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+//	copies of the Software, and to permit persons to whom the Software is
+//	furnished to do so, subject to the following conditions:
+//
+//		The above copyright notice and this permission notice shall be included in
+//		all copies or substantial portions of the Software.
+//
+//		THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+//		IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+//		FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+//		AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+//		LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+//		OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+//		THE SOFTWARE.
+
+package inout
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ocdogan/fluentgo/config"
+)
+
+const (
+	CircuitClosed   = "closed"
+	CircuitOpen     = "open"
+	CircuitHalfOpen = "half_open"
+)
+
+const (
+	defaultBreakerThreshold = 5
+	defaultBreakerOpenWait  = 30 * time.Second
+)
+
+var errCircuitOpen = errors.New("Output circuit is open, messages are held back.")
+
+// circuitBreaker stops the sends to an output after consecutive failures,
+// then lets a single trial through once the open period passes and the
+// health probe, if any, succeeds
+type circuitBreaker struct {
+	sync.Mutex
+	state     string
+	failures  int
+	opens     uint64
+	threshold int
+	openWait  time.Duration
+	openedAt  time.Time
+	probing   bool
+}
+
+func newCircuitBreaker(params map[string]interface{}) *circuitBreaker {
+	// 0 disables the breaker
+	threshold, ok := config.ParamAsIntWithLimit(params, "breakerThreshold", 0, 10000)
+	if !ok {
+		threshold = defaultBreakerThreshold
+	}
+
+	openWait, ok := config.ParamAsDurationWithLimit(params, "breakerOpenSec", 1, 3600)
+	if ok {
+		openWait *= time.Second
+	} else {
+		openWait = defaultBreakerOpenWait
+	}
+
+	return &circuitBreaker{
+		state:     CircuitClosed,
+		threshold: threshold,
+		openWait:  openWait,
+	}
+}
+
+func (cb *circuitBreaker) enabled() bool {
+	return cb != nil && cb.threshold > 0
+}
+
+func (cb *circuitBreaker) State() string {
+	if !cb.enabled() {
+		return CircuitClosed
+	}
+
+	cb.Lock()
+	defer cb.Unlock()
+	return cb.state
+}
+
+// allow returns true if a send can be attempted, runs the probe before
+// the trial when the open period is over
+func (cb *circuitBreaker) allow(probe func() error) bool {
+	if !cb.enabled() {
+		return true
+	}
+
+	cb.Lock()
+	if cb.state == CircuitClosed {
+		cb.Unlock()
+		return true
+	}
+
+	// Only one trial or probe at a time until the circuit closes
+	if cb.probing || time.Now().Sub(cb.openedAt) < cb.openWait {
+		cb.Unlock()
+		return false
+	}
+
+	cb.probing = true
+	cb.Unlock()
+
+	err := runProbe(probe)
+
+	cb.Lock()
+	defer cb.Unlock()
+
+	cb.probing = false
+	cb.openedAt = time.Now()
+
+	if err != nil {
+		cb.state = CircuitOpen
+		return false
+	}
+
+	cb.state = CircuitHalfOpen
+	return true
+}
+
+func runProbe(probe func() error) (err error) {
+	if probe != nil {
+		defer func() {
+			if e := recover(); e != nil && err == nil {
+				err = fmt.Errorf("%v", e)
+			}
+		}()
+		err = probe()
+	}
+	return err
+}
+
+// success returns true if the circuit is closed by this call
+func (cb *circuitBreaker) success() bool {
+	if !cb.enabled() {
+		return false
+	}
+
+	cb.Lock()
+	defer cb.Unlock()
+
+	cb.failures = 0
+	if cb.state != CircuitClosed {
+		cb.state = CircuitClosed
+		return true
+	}
+	return false
+}
+
+// failure returns true if the circuit is opened by this call
+func (cb *circuitBreaker) failure() bool {
+	if !cb.enabled() {
+		return false
+	}
+
+	cb.Lock()
+	defer cb.Unlock()
+
+	cb.failures++
+	if cb.state == CircuitHalfOpen || (cb.state == CircuitClosed && cb.failures >= cb.threshold) {
+		cb.state = CircuitOpen
+		cb.openedAt = time.Now()
+		cb.opens++
+		return true
+	}
+	return false
+}
+
+func (cb *circuitBreaker) Info() *CircuitInfo {
+	if !cb.enabled() {
+		return nil
+	}
+
+	cb.Lock()
+	defer cb.Unlock()
+
+	return &CircuitInfo{
+		State:    cb.state,
+		Failures: cb.failures,
+		Opens:    cb.opens,
+	}
+}
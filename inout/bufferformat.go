@@ -0,0 +1,491 @@
+//	The MIT License (MIT)
+//
+//	Copyright (c) 2016, Cagatay Dogan
+//
+//	Permission is hereby granted, free of charge, to any person obtaining a copy
+//	of this software and associated documentation files (the "Software"), to deal
+//	in the Software without restriction, including without limitation the rights
+//	to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+//	copies of the Software, and to permit persons to whom the Software is
+//	furnished to do so, subject to the following conditions:
+//
+//		The above copyright notice and this permission notice shall be included in
+//		all copies or substantial portions of the Software.
+//
+//		THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+//		IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+//		FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+//		AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+//		LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+//		OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+//		THE SOFTWARE.
+
+package inout
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"time"
+
+	"github.com/klauspost/crc32"
+	"github.com/ocdogan/fluentgo/lib"
+)
+
+// Buffer files written since version 2 start with BufHeader and BufVersion.
+// Each record is framed as RecStart, payload length, payload and RecStop,
+// where the payload is an encoded Event. Since version 3 the CRC32 of the
+// payload is written before RecStop. Files without the header are legacy
+// files holding raw (optionally tagged) messages.
+
+const (
+	legacyBufVersion   uint32 = 1
+	crcBufVersion      uint32 = 3
+	maxEventHeaderSize        = 64 * 1024
+	resyncWindowSize          = 64 * 1024
+)
+
+type bufferReader struct {
+	r           io.ReaderAt
+	offset      int64
+	end         int64
+	version     uint32
+	corrupted   int
+	corruptFunc func(offset int64, segment []byte)
+}
+
+var errCorruptRecord = errors.New("Corrupt buffer record.")
+
+// bufferVersionError is returned for the files of an unknown or newer
+// format, which can neither be replayed nor deleted
+type bufferVersionError struct {
+	version uint32
+}
+
+func (e *bufferVersionError) Error() string {
+	return fmt.Sprintf("Unsupported buffer file version: %d.", e.version)
+}
+
+func writeBufferHeader(w io.Writer) (int, error) {
+	header := make([]byte, 8)
+	binary.BigEndian.PutUint32(header, lib.BufHeader)
+	binary.BigEndian.PutUint32(header[4:], lib.BufVersion)
+
+	return w.Write(header)
+}
+
+func encodeEvent(e *Event) []byte {
+	var meta []byte
+	if len(e.Metadata) > 0 {
+		meta, _ = json.Marshal(e.Metadata)
+	}
+
+	id := e.ID[:lib.MinInt(len(e.ID), math.MaxUint16)]
+	tag := e.Tag[:lib.MinInt(len(e.Tag), math.MaxUint16)]
+
+	payload := make([]byte, 2+len(id)+2+len(tag)+16+4+len(meta)+4+len(e.Record))
+
+	pos := 0
+	binary.BigEndian.PutUint16(payload[pos:], uint16(len(id)))
+	pos += 2
+	pos += copy(payload[pos:], id)
+
+	binary.BigEndian.PutUint16(payload[pos:], uint16(len(tag)))
+	pos += 2
+	pos += copy(payload[pos:], tag)
+
+	binary.BigEndian.PutUint64(payload[pos:], uint64(e.Time.UnixNano()))
+	pos += 8
+	binary.BigEndian.PutUint64(payload[pos:], uint64(e.IngestTime.UnixNano()))
+	pos += 8
+
+	binary.BigEndian.PutUint32(payload[pos:], uint32(len(meta)))
+	pos += 4
+	pos += copy(payload[pos:], meta)
+
+	binary.BigEndian.PutUint32(payload[pos:], uint32(len(e.Record)))
+	pos += 4
+	copy(payload[pos:], e.Record)
+
+	return payload
+}
+
+func decodeEvent(payload []byte) (*Event, error) {
+	var (
+		ln  int
+		pos int
+	)
+
+	invalid := fmt.Errorf("Invalid buffer record.")
+	size := len(payload)
+
+	readLen := func(width int) bool {
+		if pos+width > size {
+			return false
+		}
+
+		if width == 2 {
+			ln = int(binary.BigEndian.Uint16(payload[pos:]))
+		} else {
+			ln = int(binary.BigEndian.Uint32(payload[pos:]))
+		}
+		pos += width
+
+		return ln >= 0 && pos+ln <= size
+	}
+
+	e := &Event{}
+
+	if !readLen(2) {
+		return nil, invalid
+	}
+	e.ID = string(payload[pos : pos+ln])
+	pos += ln
+
+	if !readLen(2) {
+		return nil, invalid
+	}
+	e.Tag = string(payload[pos : pos+ln])
+	pos += ln
+
+	if pos+16 > size {
+		return nil, invalid
+	}
+	e.Time = time.Unix(0, int64(binary.BigEndian.Uint64(payload[pos:])))
+	e.IngestTime = time.Unix(0, int64(binary.BigEndian.Uint64(payload[pos+8:])))
+	pos += 16
+
+	if !readLen(4) {
+		return nil, invalid
+	}
+	if ln > 0 {
+		if err := json.Unmarshal(payload[pos:pos+ln], &e.Metadata); err != nil {
+			return nil, invalid
+		}
+	}
+	pos += ln
+
+	if !readLen(4) {
+		return nil, invalid
+	}
+	if ln > 0 {
+		e.Record = ByteArray(payload[pos : pos+ln])
+	}
+
+	return e, nil
+}
+
+func writeEvent(w io.Writer, e *Event) (int, error) {
+	payload := encodeEvent(e)
+
+	rec := make([]byte, 0, len(payload)+16)
+	rec = append(rec, lib.RecStartBytes()...)
+
+	stamp := make([]byte, 4)
+	binary.BigEndian.PutUint32(stamp, uint32(len(payload)))
+
+	rec = append(rec, stamp...)
+	rec = append(rec, payload...)
+
+	binary.BigEndian.PutUint32(stamp, crc32.ChecksumIEEE(payload))
+
+	rec = append(rec, stamp...)
+	rec = append(rec, lib.RecStopBytes()...)
+
+	return w.Write(rec)
+}
+
+func writeBufferEnd(w io.Writer) (int, error) {
+	stamp := make([]byte, 4)
+	binary.BigEndian.PutUint32(stamp, math.MaxUint32)
+
+	return w.Write(stamp)
+}
+
+// writeBufferFile writes the events into a complete buffer file, the file
+// is written under a temporary name and renamed when it is complete
+func writeBufferFile(filename string, events []*Event) (err error) {
+	tmpName := filename + ".tmp"
+
+	f, err := os.OpenFile(tmpName, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			os.Remove(tmpName)
+		}
+	}()
+
+	w := bufio.NewWriter(f)
+
+	_, err = writeBufferHeader(w)
+	for _, e := range events {
+		if err != nil {
+			break
+		}
+		_, err = writeEvent(w, e)
+	}
+
+	if err == nil {
+		_, err = writeBufferEnd(w)
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmpName, filename)
+	}
+	return err
+}
+
+func newBufferReader(r io.ReaderAt, size int64) (*bufferReader, error) {
+	br := &bufferReader{
+		r:       r,
+		end:     size,
+		version: legacyBufVersion,
+	}
+
+	if size >= 8 {
+		header := make([]byte, 8)
+		if _, err := r.ReadAt(header, 0); err != nil {
+			return nil, err
+		}
+
+		if binary.BigEndian.Uint32(header) == lib.BufHeader {
+			br.version = binary.BigEndian.Uint32(header[4:])
+			if br.version < 2 || br.version > lib.BufVersion {
+				return nil, &bufferVersionError{version: br.version}
+			}
+			br.offset = 8
+		}
+	}
+
+	// Files closed properly end with the FILE_END stamp
+	if size-br.offset >= 4 {
+		if stamp, err := br.readUint32(size - 4); err == nil && stamp == math.MaxUint32 {
+			br.end = size - 4
+		}
+	}
+
+	return br, nil
+}
+
+func (br *bufferReader) Version() uint32 {
+	return br.version
+}
+
+func (br *bufferReader) Offset() int64 {
+	return br.offset
+}
+
+// SeekRecord moves the reader to the given record offset if it is in the data range
+func (br *bufferReader) SeekRecord(offset int64) bool {
+	if offset > br.offset && offset <= br.end {
+		br.offset = offset
+		return true
+	}
+	return false
+}
+
+func (br *bufferReader) Corrupted() int {
+	return br.corrupted
+}
+
+func (br *bufferReader) readUint32(at int64) (uint32, error) {
+	stamp := make([]byte, 4)
+	if _, err := br.r.ReadAt(stamp, at); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(stamp), nil
+}
+
+func (br *bufferReader) readBytes(at int64, ln int64) ([]byte, error) {
+	data := make([]byte, ln)
+	if ln > 0 {
+		if _, err := br.r.ReadAt(data, at); err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+// readRecord reads the record starting at the given offset and returns the
+// offset of the next record
+func (br *bufferReader) readRecord(at int64) (*Event, int64, error) {
+	if at+4 > br.end {
+		return nil, at, errCorruptRecord
+	}
+
+	start, err := br.readUint32(at)
+	if err != nil {
+		return nil, at, err
+	}
+	at += 4
+
+	var tag string
+
+	if br.version == legacyBufVersion && start == lib.RecTagStart {
+		if at+4 > br.end {
+			return nil, at, errCorruptRecord
+		}
+
+		ln, err := br.readUint32(at)
+		if err != nil {
+			return nil, at, err
+		}
+		at += 4
+
+		if int64(ln) > lib.InvalidMessageSize || at+int64(ln) > br.end {
+			return nil, at, errCorruptRecord
+		}
+
+		tagBytes, err := br.readBytes(at, int64(ln))
+		if err != nil {
+			return nil, at, err
+		}
+		tag = string(tagBytes)
+		at += int64(ln)
+	} else if start != lib.RecStart {
+		return nil, at, errCorruptRecord
+	}
+
+	if at+4 > br.end {
+		return nil, at, errCorruptRecord
+	}
+
+	ln, err := br.readUint32(at)
+	if err != nil {
+		return nil, at, err
+	}
+	at += 4
+
+	maxLen := int64(lib.InvalidMessageSize)
+	if br.version != legacyBufVersion {
+		maxLen += maxEventHeaderSize
+	}
+
+	trailer := int64(4)
+	if br.version >= crcBufVersion {
+		trailer += 4
+	}
+
+	if int64(ln) > maxLen || at+int64(ln)+trailer > br.end {
+		return nil, at, errCorruptRecord
+	}
+
+	data, err := br.readBytes(at, int64(ln))
+	if err != nil {
+		return nil, at, err
+	}
+	at += int64(ln)
+
+	if br.version >= crcBufVersion {
+		sum, err := br.readUint32(at)
+		if err != nil {
+			return nil, at, err
+		}
+		at += 4
+
+		if sum != crc32.ChecksumIEEE(data) {
+			return nil, at, errCorruptRecord
+		}
+	}
+
+	stop, err := br.readUint32(at)
+	if err != nil {
+		return nil, at, err
+	}
+	at += 4
+
+	if stop != lib.RecStop {
+		return nil, at, errCorruptRecord
+	}
+
+	if br.version == legacyBufVersion {
+		return NewEvent(data, tag, nil), at, nil
+	}
+
+	e, err := decodeEvent(data)
+	if err != nil {
+		return nil, at, errCorruptRecord
+	}
+	return e, at, nil
+}
+
+// resync scans for the next offset holding a valid record
+func (br *bufferReader) resync(from int64) int64 {
+	markers := [][]byte{lib.RecStartBytes()}
+	if br.version == legacyBufVersion {
+		tagStart := make([]byte, 4)
+		binary.BigEndian.PutUint32(tagStart, lib.RecTagStart)
+
+		markers = append(markers, tagStart)
+	}
+
+	window := make([]byte, resyncWindowSize)
+
+	for from+4 <= br.end {
+		ln := lib.MinInt64(int64(len(window)), br.end-from)
+
+		n, err := br.r.ReadAt(window[:ln], from)
+		if n < 4 || (err != nil && err != io.EOF) {
+			break
+		}
+
+		chunk := window[:n]
+		for i := 0; i+4 <= len(chunk); i++ {
+			for _, marker := range markers {
+				if bytes.Equal(chunk[i:i+4], marker) {
+					if _, _, err := br.readRecord(from + int64(i)); err == nil {
+						return from + int64(i)
+					}
+				}
+			}
+		}
+
+		// Overlap the windows by 3 bytes not to miss a marker on the boundary
+		from += int64(n - 3)
+	}
+	return br.end
+}
+
+// Next returns the next valid record, skipping over the corrupt segments
+func (br *bufferReader) Next() (*Event, error) {
+	for br.offset < br.end {
+		e, next, err := br.readRecord(br.offset)
+		if err == nil {
+			br.offset = next
+			return e, nil
+		}
+
+		if err != errCorruptRecord {
+			return nil, err
+		}
+
+		next = br.resync(br.offset + 1)
+		br.corrupted++
+
+		if br.corruptFunc != nil {
+			if segment, err := br.readBytes(br.offset, next-br.offset); err == nil {
+				br.corruptFunc(br.offset, segment)
+			}
+		}
+		br.offset = next
+	}
+	return nil, io.EOF
+}
@@ -0,0 +1,181 @@
+//	The MIT License (MIT)
+//
+//	Copyright (c) 2016, Cagatay Dogan
+//
+//	Permission is hereby granted, free of charge, to any person obtaining a copy
+//	of this software and associated documentation files (the "Software"), to deal
+//	in the Software without restriction, including without limitation the rights
+//	to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+//	copies of the Software, and to permit persons to whom the Software is
+//	furnished to do so, subject to the following conditions:
+//
+//		The above copyright notice and this permission notice shall be included in
+//		all copies or substantial portions of the Software.
+//
+//		THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+//		IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+//		FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+//		AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+//		LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+//		OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+//		THE SOFTWARE.
+
+package inout
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// bufferCheckpoint keeps the offsets up to which the buffer files are
+// delivered to each output, so the replay of a file can resume from there
+// after a restart
+type bufferCheckpoint struct {
+	sync.Mutex
+	filename string
+	offsets  map[string]map[string]int64
+	dirty    bool
+}
+
+func newBufferCheckpoint(filename string) *bufferCheckpoint {
+	cp := &bufferCheckpoint{
+		filename: filename,
+		offsets:  make(map[string]map[string]int64),
+	}
+	cp.load()
+
+	return cp
+}
+
+func (cp *bufferCheckpoint) load() {
+	defer recover()
+
+	data, err := ioutil.ReadFile(cp.filename)
+	if err != nil || len(data) == 0 {
+		return
+	}
+
+	var offsets map[string]map[string]int64
+	if err = json.Unmarshal(data, &offsets); err == nil && offsets != nil {
+		cp.offsets = offsets
+	}
+}
+
+// Offsets returns the offsets of the file for each output
+func (cp *bufferCheckpoint) Offsets(filename string) map[string]int64 {
+	if cp == nil {
+		return nil
+	}
+
+	cp.Lock()
+	defer cp.Unlock()
+
+	outputs := cp.offsets[filepath.Base(filename)]
+	if len(outputs) == 0 {
+		return nil
+	}
+
+	offsets := make(map[string]int64, len(outputs))
+	for output, offset := range outputs {
+		offsets[output] = offset
+	}
+	return offsets
+}
+
+func (cp *bufferCheckpoint) Set(filename, output string, offset int64) {
+	if cp != nil {
+		cp.Lock()
+		defer cp.Unlock()
+
+		name := filepath.Base(filename)
+
+		outputs, ok := cp.offsets[name]
+		if !ok {
+			outputs = make(map[string]int64)
+			cp.offsets[name] = outputs
+		}
+
+		if outputs[output] != offset {
+			outputs[output] = offset
+			cp.dirty = true
+		}
+	}
+}
+
+func (cp *bufferCheckpoint) Remove(filename string) {
+	if cp != nil {
+		cp.Lock()
+		defer cp.Unlock()
+
+		name := filepath.Base(filename)
+		if _, ok := cp.offsets[name]; ok {
+			delete(cp.offsets, name)
+			cp.dirty = true
+		}
+	}
+}
+
+// Prune removes the offsets of the files not found in the given directory
+func (cp *bufferCheckpoint) Prune(dir string) {
+	if cp != nil {
+		cp.Lock()
+		defer cp.Unlock()
+
+		for name := range cp.offsets {
+			if _, err := os.Stat(dir + name); os.IsNotExist(err) {
+				delete(cp.offsets, name)
+				cp.dirty = true
+			}
+		}
+	}
+}
+
+// Flush writes the offsets into the checkpoint file if they are changed,
+// the file is fsynced before it replaces the previous one
+func (cp *bufferCheckpoint) Flush() error {
+	if cp == nil {
+		return nil
+	}
+
+	cp.Lock()
+	defer cp.Unlock()
+
+	if !cp.dirty {
+		return nil
+	}
+
+	data, err := json.Marshal(cp.offsets)
+	if err != nil {
+		return err
+	}
+
+	tmpName := cp.filename + ".tmp"
+
+	f, err := os.OpenFile(tmpName, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmpName, cp.filename)
+	}
+
+	if err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+
+	cp.dirty = false
+	return nil
+}
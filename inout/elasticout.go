@@ -40,6 +40,28 @@ type elasticOut struct {
 	client      *elastic.Client
 }
 
+// elasticPutError reports the messages of the chunk which could not be indexed,
+// so only they are sent again
+type elasticPutError struct {
+	failed []int
+	err    error
+}
+
+func (e *elasticPutError) Error() string {
+	return fmt.Sprintf("ELASTICOUT failed to index %d messages: %s", len(e.failed), e.err)
+}
+
+func (e *elasticPutError) Failed() []int {
+	return e.failed
+}
+
+func (e *elasticPutError) add(indexes []int, err error) {
+	e.failed = append(e.failed, indexes...)
+	if e.err == nil {
+		e.err = err
+	}
+}
+
 func init() {
 	RegisterOut("elastic", newElasticOut)
 	RegisterOut("elasticsearch", newElasticOut)
@@ -211,45 +233,90 @@ func (eo *elasticOut) getIndexName(prefix string) string {
 	return fmt.Sprintf("%d.%02d.%02d", t.Year(), t.Month(), t.Day())
 }
 
-func (eo *elasticOut) putMessages(messages []ByteArray, indexName, indexType string) {
+func (eo *elasticOut) putMessages(messages []ByteArray, indexes []int, indexName, indexType string) error {
 	if len(messages) == 0 {
-		return
+		return nil
 	}
-	defer recover()
 
-	doSend := false
 	bulkRequest := eo.client.Bulk()
 
-	for _, msg := range messages {
+	// positions in the chunk of the messages added to the request
+	var requested []int
+
+	for i, msg := range messages {
 		if len(msg) > 0 {
-			doSend = true
+			requested = append(requested, indexes[i])
 
 			req := elastic.NewBulkIndexRequest().Index(indexName).Type(indexType).Doc(string(msg))
 			bulkRequest = bulkRequest.Add(req)
 		}
 	}
 
-	if doSend {
-		bulkRequest.Do()
+	if len(requested) == 0 {
+		return nil
 	}
+
+	result := &elasticPutError{}
+
+	resp, err := bulkRequest.Do()
+	if err != nil {
+		result.add(requested, err)
+		return result
+	}
+
+	if resp != nil && resp.Errors {
+		err = fmt.Errorf("ELASTICOUT bulk request to '%s' has failed items.", indexName)
+
+		// items of the response are in the order of the request
+		if len(resp.Items) != len(requested) {
+			result.add(requested, err)
+			return result
+		}
+
+		for i, item := range resp.Items {
+			for _, res := range item {
+				if res == nil || res.Status < 200 || res.Status > 299 {
+					result.add(requested[i:i+1], err)
+					break
+				}
+			}
+		}
+
+		if len(result.failed) > 0 {
+			return result
+		}
+	}
+	return nil
 }
 
-func (eo *elasticOut) funcPutMessages(messages []ByteArray, filename string) {
+func (eo *elasticOut) funcPutMessages(messages []ByteArray, filename string) error {
 	if len(messages) == 0 {
-		return
+		return nil
 	}
-	defer recover()
 
-	indexPrefixes := eo.groupMessages(messages, eo.indexPrefix, eo.indexType)
+	indexPrefixes := eo.groupMessageIndexes(messages, eo.indexPrefix, eo.indexType)
 	if indexPrefixes == nil {
-		return
+		return fmt.Errorf("Cannot resolve ELASTICOUT index for messages.")
 	}
 
+	result := &elasticPutError{}
 	for indexPrefix, indexPrefixMap := range indexPrefixes {
 		indexName := eo.getIndexName(indexPrefix)
 
-		for indexType, msgs := range indexPrefixMap {
-			eo.putMessages(msgs, indexName, indexType)
+		for indexType, indexes := range indexPrefixMap {
+			msgs := make([]ByteArray, len(indexes))
+			for i, index := range indexes {
+				msgs[i] = messages[index]
+			}
+
+			if pe, ok := eo.putMessages(msgs, indexes, indexName, indexType).(*elasticPutError); ok {
+				result.add(pe.failed, pe.err)
+			}
 		}
 	}
+
+	if len(result.failed) > 0 {
+		return result
+	}
+	return nil
 }
@@ -0,0 +1,152 @@
+//	The MIT License (MIT)
+//
+//	Copyright (c) 2016, Cagatay Dogan
+//
+//	Permission is hereby granted, free of charge, to any person obtaining a copy
+//	of this software and associated documentation files (the "Software"), to deal
+//	in the Software without restriction, including without limitation the rights
+//	to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+//	copies of the Software, and to permit persons to whom the Software is
+//	furnished to do so, subject to the following conditions:
+//
+//		The above copyright notice and this permission notice shall be included in
+//		all copies or substantial portions of the Software.
+//
+//		THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+//		IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+//		FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+//		AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+//		LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+//		OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+//		THE SOFTWARE.
+
+package inout
+
+import (
+	"time"
+
+	"github.com/ocdogan/fluentgo/lib"
+)
+
+type Event struct {
+	ID         string
+	Tag        string
+	Time       time.Time
+	IngestTime time.Time
+	Record     ByteArray
+	Metadata   map[string]interface{}
+	tracker    *fileTracker
+	seq        int
+	buffered   func(ok bool)
+}
+
+func NewEvent(record []byte, tag string, metadata map[string]interface{}) *Event {
+	now := time.Now()
+
+	var id string
+	if uuid, err := lib.NewUUID(); err == nil {
+		id = uuid.String()
+	}
+
+	return &Event{
+		ID:         id,
+		Tag:        tag,
+		Time:       now,
+		IngestTime: now,
+		Record:     ByteArray(record),
+		Metadata:   metadata,
+	}
+}
+
+func (e *Event) Len() int {
+	if e == nil {
+		return 0
+	}
+	return len(e.Record)
+}
+
+// OnBuffered sets the callback which is called once the event is written
+// into the disk buffer, or with false if it is dropped before
+func (e *Event) OnBuffered(fn func(ok bool)) {
+	if e != nil {
+		e.buffered = fn
+	}
+}
+
+func (e *Event) bufferDone(ok bool) {
+	if e != nil && e.buffered != nil {
+		fn := e.buffered
+		e.buffered = nil
+
+		fn(ok)
+	}
+}
+
+func (e *Event) track(n int) {
+	if e != nil {
+		e.tracker.add(n)
+	}
+}
+
+// ack releases a reference on the event
+func (e *Event) ack(ok bool) {
+	if e != nil {
+		e.tracker.done(ok)
+	}
+}
+
+// ackOutput releases the reference of the output the event is sent to
+func (e *Event) ackOutput(output string, ok bool) {
+	if e != nil {
+		if ok {
+			e.tracker.recordDone(output, e.seq)
+		}
+		e.tracker.done(ok)
+	}
+}
+
+// skipOutput marks the event as done for an output it is not sent to
+func (e *Event) skipOutput(output string) {
+	if e != nil {
+		e.tracker.recordDone(output, e.seq)
+	}
+}
+
+func (e *Event) deliveredTo(output string) bool {
+	return e != nil && e.tracker != nil && e.tracker.deliveredTo(output, e.seq)
+}
+
+// complete marks the event as done for all outputs and releases the
+// reference on it, used for the events dropped before they are sent
+func (e *Event) complete() {
+	if e != nil {
+		e.tracker.recordDoneAll(e.seq)
+		e.tracker.done(true)
+	}
+}
+
+func ackEvents(events []*Event, ok bool) {
+	for _, e := range events {
+		e.ack(ok)
+	}
+}
+
+func completeEvents(events []*Event) {
+	for _, e := range events {
+		e.complete()
+	}
+}
+
+func EventRecords(events []*Event) []ByteArray {
+	if events == nil {
+		return nil
+	}
+
+	records := make([]ByteArray, 0, len(events))
+	for _, e := range events {
+		if e != nil && len(e.Record) > 0 {
+			records = append(records, e.Record)
+		}
+	}
+	return records
+}
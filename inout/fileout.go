@@ -320,9 +320,13 @@ func (fo *fileOut) funcGetObjectName() string {
 	return "fileout"
 }
 
-func (fo *fileOut) writeToLog(msg ByteArray) {
+func (fo *fileOut) writeToLog(msg ByteArray) (err error) {
 	if len(msg) > 0 {
-		defer recover()
+		defer func() {
+			if e := recover(); e != nil && err == nil {
+				err = fmt.Errorf("FILEOUT cannot write message: %v", e)
+			}
+		}()
 
 		fo.Lock()
 		defer fo.Unlock()
@@ -349,7 +353,7 @@ func (fo *fileOut) writeToLog(msg ByteArray) {
 
 				ln = len(data)
 				if ln == 0 {
-					return
+					return nil
 				}
 			}
 		}
@@ -357,18 +361,25 @@ func (fo *fileOut) writeToLog(msg ByteArray) {
 		fo.prepareFile(ln)
 
 		ofile := fo.ofile
+		if ofile == nil || ofile.file == nil {
+			return fmt.Errorf("FILEOUT has no file to write.")
+		}
 
 		if ofile != nil {
 			f := ofile.file
 
 			if f != nil {
 				defer f.Sync()
-				f.Write(data)
+				if _, err = f.Write(data); err != nil {
+					return err
+				}
 
 				var nln []byte
 				if fo.multiLog {
 					nln = lib.NewLine()
-					f.Write(nln)
+					if _, err = f.Write(nln); err != nil {
+						return err
+					}
 				}
 
 				ofile.size += ln + len(nln)
@@ -380,19 +391,22 @@ func (fo *fileOut) writeToLog(msg ByteArray) {
 			}
 		}
 	}
+	return nil
 }
 
-func (fo *fileOut) funcPutMessages(messages []ByteArray, channel string) {
+func (fo *fileOut) funcPutMessages(messages []ByteArray, channel string) error {
 	if len(messages) == 0 {
-		return
+		return nil
 	}
-	defer recover()
 
 	for _, msg := range messages {
 		if len(msg) > 0 {
-			fo.writeToLog(msg)
+			if err := fo.writeToLog(msg); err != nil {
+				return err
+			}
 		}
 	}
+	return nil
 }
 
 func (fo *fileOut) Connect() error {
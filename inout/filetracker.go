@@ -0,0 +1,199 @@
+//	The MIT License (MIT)
+//
+//	Copyright (c) 2016, Cagatay Dogan
+//
+//	Permission is hereby granted, free of charge, to any person obtaining a copy
+//	of this software and associated documentation files (the "Software"), to deal
+//	in the Software without restriction, including without limitation the rights
+//	to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+//	copies of the Software, and to permit persons to whom the Software is
+//	furnished to do so, subject to the following conditions:
+//
+//		The above copyright notice and this permission notice shall be included in
+//		all copies or substantial portions of the Software.
+//
+//		THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+//		IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+//		FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+//		AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+//		LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+//		OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+//		THE SOFTWARE.
+
+package inout
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/ocdogan/fluentgo/lib"
+)
+
+// fileTracker counts the deliveries still pending for the events read from a
+// buffer file. The file is released when every target output has confirmed
+// its events, or kept for replay when any of them has failed.
+//
+// The tracker also follows the end offsets of the records in read order, so
+// the offset up to which every record is delivered to an output can be
+// checkpointed for each output separately.
+type fileTracker struct {
+	filename   string
+	pending    int64
+	failed     int32
+	onComplete func(ft *fileTracker)
+	onProgress func(ft *fileTracker, output string, offset int64)
+	recordsMux sync.Mutex
+	ends       []int64
+	progress   map[string]*recordProgress
+}
+
+type recordProgress struct {
+	delivered map[int]struct{}
+	next      int
+	offset    int64
+}
+
+func newFileTracker(filename string, outputs []string, onComplete func(ft *fileTracker)) *fileTracker {
+	progress := make(map[string]*recordProgress, len(outputs))
+	for _, output := range outputs {
+		progress[output] = &recordProgress{
+			delivered: make(map[int]struct{}),
+		}
+	}
+
+	return &fileTracker{
+		filename:   filename,
+		pending:    1,
+		onComplete: onComplete,
+		progress:   progress,
+	}
+}
+
+func (ft *fileTracker) add(n int) {
+	if ft != nil && n > 0 {
+		atomic.AddInt64(&ft.pending, int64(n))
+	}
+}
+
+func (ft *fileTracker) done(ok bool) {
+	if ft == nil {
+		return
+	}
+
+	if !ok {
+		atomic.StoreInt32(&ft.failed, 1)
+	}
+
+	if atomic.AddInt64(&ft.pending, -1) == 0 && ft.onComplete != nil {
+		ft.onComplete(ft)
+	}
+}
+
+func (ft *fileTracker) Failed() bool {
+	return atomic.LoadInt32(&ft.failed) != 0
+}
+
+func (ft *fileTracker) Offset(output string) int64 {
+	ft.recordsMux.Lock()
+	defer ft.recordsMux.Unlock()
+
+	if p, ok := ft.progress[output]; ok {
+		return p.offset
+	}
+	return 0
+}
+
+// setOffsets sets the offsets the outputs are resuming from, the reader
+// starts from the given offset which is the smallest of them
+func (ft *fileTracker) setOffsets(offsets map[string]int64, start int64) {
+	ft.recordsMux.Lock()
+	defer ft.recordsMux.Unlock()
+
+	for output, p := range ft.progress {
+		p.offset = lib.MaxInt64(start, offsets[output])
+	}
+}
+
+// addRecord registers the next record read from the file with its end
+// offset and returns its sequence number
+func (ft *fileTracker) addRecord(end int64) int {
+	ft.recordsMux.Lock()
+	defer ft.recordsMux.Unlock()
+
+	ft.ends = append(ft.ends, end)
+	return len(ft.ends) - 1
+}
+
+// deliveredTo returns true if the record is delivered to the output before
+func (ft *fileTracker) deliveredTo(output string, seq int) bool {
+	ft.recordsMux.Lock()
+	defer ft.recordsMux.Unlock()
+
+	p, ok := ft.progress[output]
+	return ok && seq >= 0 && seq < len(ft.ends) && ft.ends[seq] <= p.offset
+}
+
+// recordDone marks the record delivered to the output and moves the output's
+// offset over the delivered records following it
+func (ft *fileTracker) recordDone(output string, seq int) {
+	if ft == nil || seq < 0 {
+		return
+	}
+
+	ft.recordsMux.Lock()
+
+	offset, moved := ft.advance(output, seq)
+	ft.recordsMux.Unlock()
+
+	if moved && ft.onProgress != nil {
+		ft.onProgress(ft, output, offset)
+	}
+}
+
+// recordDoneAll marks the record as done for all outputs, used for the
+// records which are dropped before they are sent
+func (ft *fileTracker) recordDoneAll(seq int) {
+	if ft == nil || seq < 0 {
+		return
+	}
+
+	ft.recordsMux.Lock()
+
+	offsets := make(map[string]int64)
+	for output := range ft.progress {
+		if offset, moved := ft.advance(output, seq); moved {
+			offsets[output] = offset
+		}
+	}
+	ft.recordsMux.Unlock()
+
+	if ft.onProgress != nil {
+		for output, offset := range offsets {
+			ft.onProgress(ft, output, offset)
+		}
+	}
+}
+
+func (ft *fileTracker) advance(output string, seq int) (int64, bool) {
+	p, ok := ft.progress[output]
+	if !ok {
+		return 0, false
+	}
+
+	p.delivered[seq] = struct{}{}
+
+	moved := false
+	for {
+		if _, ok := p.delivered[p.next]; !ok {
+			break
+		}
+
+		delete(p.delivered, p.next)
+		if end := ft.ends[p.next]; end > p.offset {
+			p.offset = end
+			moved = true
+		}
+		p.next++
+	}
+	return p.offset, moved
+}
@@ -0,0 +1,123 @@
+//	The MIT License (MIT)
+//
+//	Copyright (c) 2016, Cagatay Dogan
+//
+//	Permission is hereby granted, free of charge, to any person obtaining a copy
+//	of this software and associated documentation files (the "Software"), to deal
+//	in the Software without restriction, including without limitation the rights
+//	to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+//	copies of the Software, and to permit persons to whom the Software is
+//	furnished to do so, subject to the following conditions:
+//
+//		The above copyright notice and this permission notice shall be included in
+//		all copies or substantial portions of the Software.
+//
+//		THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+//		IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+//		FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+//		AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+//		LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+//		OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+//		THE SOFTWARE.
+
+package inout
+
+import (
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/ocdogan/fluentgo/lib"
+)
+
+// Fluent Forward protocol v1 message types and options
+const (
+	forwardHelo = "HELO"
+	forwardPing = "PING"
+	forwardPong = "PONG"
+
+	forwardOptChunk      = "chunk"
+	forwardOptCompressed = "compressed"
+	forwardOptAck        = "ack"
+
+	forwardGzip = "gzip"
+
+	forwardMaxChunkSize = 16 * 1024 * 1024
+)
+
+// forwardDigest returns the hex encoded SHA512 digest of the shared key
+// handshake, as sha512(salt + hostname + nonce + sharedKey)
+func forwardDigest(salt, hostname string, nonce []byte, sharedKey string) string {
+	h := sha512.New()
+	h.Write([]byte(salt))
+	h.Write([]byte(hostname))
+	h.Write(nonce)
+	h.Write([]byte(sharedKey))
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func forwardString(v interface{}) (string, bool) {
+	switch s := v.(type) {
+	case string:
+		return s, true
+	case []byte:
+		return string(s), true
+	}
+	return "", false
+}
+
+// forwardTime converts the event time which is either an EventTime extension
+// or the seconds since epoch
+func forwardTime(v interface{}) (time.Time, bool) {
+	switch t := v.(type) {
+	case lib.MsgpackExt:
+		return t.Time()
+	case int64:
+		return time.Unix(t, 0), true
+	case uint64:
+		return time.Unix(int64(t), 0), true
+	case float64:
+		sec, frac := math.Modf(t)
+		return time.Unix(int64(sec), int64(frac*1e9)), true
+	}
+	return time.Time{}, false
+}
+
+// forwardRecordToJSON converts the decoded msgpack record into JSON, the
+// binaries are converted to strings as the clients use them for strings
+func forwardRecordToJSON(v interface{}) ([]byte, error) {
+	record, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Forward record is not a map.")
+	}
+	return json.Marshal(forwardJSONValue(record))
+}
+
+func forwardJSONValue(v interface{}) interface{} {
+	switch val := v.(type) {
+	case []byte:
+		return string(val)
+	case lib.MsgpackExt:
+		if t, ok := val.Time(); ok {
+			return t.Format(time.RFC3339Nano)
+		}
+		return val.Data
+	case float64:
+		if math.IsNaN(val) || math.IsInf(val, 0) {
+			return nil
+		}
+	case []interface{}:
+		for i, item := range val {
+			val[i] = forwardJSONValue(item)
+		}
+	case map[string]interface{}:
+		for k, item := range val {
+			val[k] = forwardJSONValue(item)
+		}
+	}
+	return v
+}
@@ -0,0 +1,554 @@
+//	The MIT License (MIT)
+//
+//	Copyright (c) 2016, Cagatay Dogan
+//
+//	Permission is hereby granted, free of charge, to any person obtaining a copy
+//	of this software and associated documentation files (the "Software"), to deal
+//	in the Software without restriction, including without limitation the rights
+//	to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+//	copies of the Software, and to permit persons to whom the Software is
+//	furnished to do so, subject to the following conditions:
+//
+//		The above copyright notice and this permission notice shall be included in
+//		all copies or substantial portions of the Software.
+//
+//		THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+//		IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+//		FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+//		AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+//		LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+//		OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+//		THE SOFTWARE.
+
+package inout
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ocdogan/fluentgo/config"
+	"github.com/ocdogan/fluentgo/lib"
+)
+
+const (
+	forwardReadBufSize  = 64 * 1024
+	forwardWriteTimeout = 10 * time.Second
+)
+
+// forwardIn receives the events of the fluentd and fluent-bit clients over
+// the Fluent Forward protocol v1, the chunks asking for acknowledgement are
+// acked once all their records are written into the disk buffer
+type forwardIn struct {
+	inHandler
+	tcpUDPIO
+	sharedKey    string
+	selfHostname string
+	maxChunkSize int
+	lck          sync.Mutex
+	connections  []net.Conn
+	listener     *net.Listener
+}
+
+type forwardConn struct {
+	sync.Mutex
+	conn   net.Conn
+	source map[string]interface{}
+}
+
+// forwardChunk counts the records of a chunk not buffered yet, it starts
+// with an extra count released after all records are pushed
+type forwardChunk struct {
+	pending int32
+	failed  int32
+	ackFunc func()
+}
+
+func init() {
+	RegisterIn("forward", newForwardIn)
+	RegisterIn("forwardin", newForwardIn)
+}
+
+func newForwardIn(manager InOutManager, params map[string]interface{}) InProvider {
+	tuio := newTCPUDPIO(manager, params)
+	if tuio == nil {
+		return nil
+	}
+
+	ih := newInHandler(manager, params)
+	if ih == nil {
+		return nil
+	}
+
+	sharedKey, _ := config.ParamAsString(params, "sharedKey")
+
+	selfHostname, _ := config.ParamAsString(params, "selfHostname")
+	if selfHostname == "" {
+		selfHostname, _ = os.Hostname()
+	}
+
+	maxChunkSize, ok := config.ParamAsIntWithLimit(params, "maxChunkSize", 1024, 1024*1024*1024)
+	if !ok {
+		maxChunkSize = forwardMaxChunkSize
+	}
+
+	// Keep the forward tags of the records unless a tag is set
+	ih.useSourceTag()
+
+	fin := &forwardIn{
+		inHandler:    *ih,
+		tcpUDPIO:     *tuio,
+		sharedKey:    sharedKey,
+		selfHostname: selfHostname,
+		maxChunkSize: maxChunkSize,
+	}
+
+	fin.iotype = "FORWARDIN"
+	fin.setTagSource("host", tuio.host)
+
+	fin.runFunc = fin.funcReceive
+	fin.afterCloseFunc = fin.funcAfterClose
+	fin.loadTLSFunc = fin.loadServerCert
+
+	return fin
+}
+
+func (fin *forwardIn) funcAfterClose() {
+	defer recover()
+
+	if fin.listener != nil {
+		listener := *fin.listener
+		fin.listener = nil
+
+		listener.Close()
+	}
+
+	fin.lck.Lock()
+	conns := fin.connections
+	fin.connections = nil
+	fin.lck.Unlock()
+
+	for _, conn := range conns {
+		fin.tryToCloseConn(conn)
+	}
+}
+
+func (fin *forwardIn) loadServerCert() (secure bool, config *tls.Config, err error) {
+	config, err = lib.LoadServerCert(fin.certFile, fin.keyFile, fin.caFile, fin.verifySsl)
+	secure = (err == nil) && (config != nil)
+	return
+}
+
+func (fin *forwardIn) funcReceive() {
+	defer fin.InformStop()
+	fin.InformStart()
+
+	err := fin.loadCert()
+	if err != nil {
+		return
+	}
+
+	completed := false
+	var (
+		chanOpen    bool
+		listenEnded chan bool
+	)
+
+	for !completed {
+		if !chanOpen {
+			listenEnded = make(chan bool)
+		}
+		go fin.listen(listenEnded)
+
+		select {
+		case <-fin.completed:
+			completed = true
+			fin.Close()
+			return
+		case _, chanOpen = <-listenEnded:
+			if completed {
+				return
+			}
+		}
+	}
+}
+
+func (fin *forwardIn) listen(listenEnded chan bool) {
+	lg := fin.logger
+	if lg != nil {
+		defer lg.Printf("'FORWARDIN' completed listening at '%s'.\n", fin.host)
+		lg.Printf("'FORWARDIN' starting to listen at '%s'...\n", fin.host)
+	}
+
+	var (
+		err      error
+		listener net.Listener
+	)
+
+	if fin.secure && fin.tlsConfig != nil {
+		listener, err = tls.Listen("tcp", fin.host, fin.tlsConfig)
+	} else {
+		listener, err = net.Listen("tcp", fin.host)
+	}
+
+	if err != nil {
+		if lg != nil {
+			lg.Printf("'FORWARDIN' cannot listen at '%s': %s\n", fin.host, err)
+		}
+
+		time.Sleep(time.Second)
+		close(listenEnded)
+		return
+	}
+
+	// Close the listener when the application closes.
+	defer func(l net.Listener, ch chan bool) {
+		defer recover()
+		l.Close()
+		close(ch)
+	}(listener, listenEnded)
+
+	fin.listener = &listener
+	fin.accept(listener)
+}
+
+func (fin *forwardIn) accept(listener net.Listener) {
+	tcpL, _ := listener.(*net.TCPListener)
+
+	lg := fin.logger
+	for fin.Processing() {
+		if tcpL != nil {
+			tcpL.SetDeadline(time.Now().Add(10 * time.Second))
+		}
+
+		conn, err := listener.Accept()
+		if err != nil {
+			errStr := err.Error()
+			if _, ok := err.(*net.OpError); ok {
+				if strings.Contains(errStr, "closed network") {
+					return
+				}
+				if strings.Contains(errStr, "accept") && strings.Contains(errStr, "timeout") {
+					continue
+				}
+			}
+
+			if lg != nil {
+				lg.Println("Error on 'FORWARDIN' accepting: ", errStr)
+			}
+			continue
+		}
+
+		if conn != nil {
+			fin.lck.Lock()
+			fin.connections = append(fin.connections, conn)
+			fin.lck.Unlock()
+
+			go fin.onNewConnection(conn)
+		}
+	}
+}
+
+func (fin *forwardIn) remove(conn net.Conn) {
+	fin.lck.Lock()
+	defer fin.lck.Unlock()
+
+	for index, c := range fin.connections {
+		if c == conn {
+			fin.connections = append(fin.connections[:index], fin.connections[index+1:]...)
+			break
+		}
+	}
+}
+
+func (fin *forwardIn) onNewConnection(conn net.Conn) {
+	defer func() {
+		recover()
+		fin.tryToCloseConn(conn)
+		fin.remove(conn)
+	}()
+
+	fc := &forwardConn{
+		conn:   conn,
+		source: map[string]interface{}{"remote": conn.RemoteAddr().String()},
+	}
+
+	lg := fin.logger
+	dec := lib.NewMsgpackDecoder(bufio.NewReaderSize(conn, forwardReadBufSize), fin.maxChunkSize)
+
+	if fin.sharedKey != "" {
+		// The heartbeats of the clients connect and close without a PING
+		if err := fin.handshake(fc, dec); err != nil {
+			if lg != nil && err != io.EOF {
+				lg.Printf("Handshake failed on 'FORWARDIN' %s: %s\n", conn.RemoteAddr(), err)
+			}
+			return
+		}
+	}
+
+	for fin.Processing() {
+		msg, err := dec.Decode()
+		if err == nil {
+			err = fin.handleMessage(fc, msg)
+		}
+
+		if err != nil {
+			if lg != nil {
+				if err == io.EOF {
+					lg.Printf("Closing connection on 'FORWARDIN' %s\n", conn.LocalAddr())
+				} else {
+					lg.Printf("Error on 'FORWARDIN' reading, closing connection %s: %s\n", conn.LocalAddr(), err)
+				}
+			}
+			return
+		}
+	}
+}
+
+// handshake authenticates the client with the shared key, sending HELO and
+// replying to its PING with PONG
+func (fin *forwardIn) handshake(fc *forwardConn, dec *lib.MsgpackDecoder) error {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+
+	helo := []interface{}{
+		forwardHelo,
+		map[string]interface{}{
+			"nonce":     nonce,
+			"auth":      []byte{},
+			"keepalive": true,
+		},
+	}
+	if err := fc.send(helo); err != nil {
+		return err
+	}
+
+	msg, err := dec.Decode()
+	if err != nil {
+		return err
+	}
+
+	ping, ok := msg.([]interface{})
+	if !ok || len(ping) < 4 {
+		return fmt.Errorf("Invalid PING message.")
+	}
+
+	if typ, _ := forwardString(ping[0]); typ != forwardPing {
+		return fmt.Errorf("Invalid PING message.")
+	}
+
+	hostname, _ := forwardString(ping[1])
+	salt, _ := forwardString(ping[2])
+	digest, _ := forwardString(ping[3])
+
+	if digest != forwardDigest(salt, hostname, nonce, fin.sharedKey) {
+		fc.send([]interface{}{forwardPong, false, "shared_key mismatch", "", ""})
+		return fmt.Errorf("Shared key mismatch from '%s'.", hostname)
+	}
+
+	pong := []interface{}{
+		forwardPong,
+		true,
+		"",
+		fin.selfHostname,
+		forwardDigest(salt, fin.selfHostname, nonce, fin.sharedKey),
+	}
+	return fc.send(pong)
+}
+
+// handleMessage handles the Message, Forward, PackedForward and
+// CompressedPackedForward modes
+func (fin *forwardIn) handleMessage(fc *forwardConn, msg interface{}) error {
+	arr, ok := msg.([]interface{})
+	if !ok || len(arr) < 2 {
+		return fmt.Errorf("Invalid forward message.")
+	}
+
+	tag, ok := forwardString(arr[0])
+	if !ok {
+		return fmt.Errorf("Invalid forward message tag.")
+	}
+
+	var (
+		entries []interface{}
+		option  map[string]interface{}
+	)
+
+	switch mode := arr[1].(type) {
+	case []interface{}:
+		// Forward mode: [tag, [[time, record], ...], option]
+		entries = mode
+		option = forwardOption(arr, 2)
+	case string, []byte:
+		// PackedForward mode: [tag, msgpack stream of [time, record], option]
+		option = forwardOption(arr, 2)
+
+		packed, err := fin.unpackEntries(mode, option)
+		if err != nil {
+			return err
+		}
+		entries = packed
+	default:
+		// Message mode: [tag, time, record, option]
+		if len(arr) < 3 {
+			return fmt.Errorf("Invalid forward message.")
+		}
+		entries = []interface{}{[]interface{}{arr[1], arr[2]}}
+		option = forwardOption(arr, 3)
+	}
+
+	var chunk *forwardChunk
+	if id, ok := forwardString(option[forwardOptChunk]); ok && id != "" {
+		chunk = &forwardChunk{
+			pending: 1,
+			ackFunc: func() {
+				fc.send(map[string]interface{}{forwardOptAck: id})
+			},
+		}
+	}
+
+	fin.pushEntries(fc, tag, entries, chunk)
+	return nil
+}
+
+func forwardOption(arr []interface{}, index int) map[string]interface{} {
+	if len(arr) > index {
+		if option, ok := arr[index].(map[string]interface{}); ok {
+			return option
+		}
+	}
+	return nil
+}
+
+func (fin *forwardIn) unpackEntries(packed interface{}, option map[string]interface{}) ([]interface{}, error) {
+	var data []byte
+	switch p := packed.(type) {
+	case string:
+		data = []byte(p)
+	case []byte:
+		data = p
+	}
+
+	var (
+		r       io.Reader = bytes.NewReader(data)
+		limited *io.LimitedReader
+	)
+
+	if compressed, _ := forwardString(option[forwardOptCompressed]); compressed == forwardGzip {
+		gr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		defer gr.Close()
+
+		// Read one byte more than the limit to tell an oversize chunk
+		limited = &io.LimitedReader{R: gr, N: int64(fin.maxChunkSize) + 1}
+		r = limited
+	}
+
+	var entries []interface{}
+
+	dec := lib.NewMsgpackDecoder(r, fin.maxChunkSize)
+	for {
+		entry, err := dec.Decode()
+		if limited != nil && limited.N <= 0 {
+			return nil, fmt.Errorf("Decompressed chunk exceeds the size limit %d.", fin.maxChunkSize)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func (fin *forwardIn) pushEntries(fc *forwardConn, tag string, entries []interface{}, chunk *forwardChunk) {
+	source := make(map[string]interface{}, len(fc.source)+1)
+	for k, v := range fc.source {
+		source[k] = v
+	}
+	source[sourceTagKey] = tag
+
+	var buffered func(ok bool)
+	if chunk != nil {
+		buffered = chunk.done
+	}
+
+	maxMessageSize := fin.getMaxMessageSize()
+
+	for _, entry := range entries {
+		if !fin.Processing() {
+			break
+		}
+
+		pair, ok := entry.([]interface{})
+		if !ok || len(pair) < 2 {
+			continue
+		}
+
+		data, err := forwardRecordToJSON(pair[1])
+		if err != nil || len(data) == 0 || (maxMessageSize > 0 && len(data) > maxMessageSize) {
+			continue
+		}
+
+		eventTime, _ := forwardTime(pair[0])
+
+		if chunk != nil {
+			chunk.add()
+		}
+		fin.pushRecordAt(data, source, eventTime, buffered)
+	}
+
+	if chunk != nil {
+		chunk.done(fin.Processing())
+	}
+}
+
+func (fc *forwardConn) send(v interface{}) error {
+	data, err := lib.MsgpackMarshal(v)
+	if err != nil {
+		return err
+	}
+
+	fc.Lock()
+	defer fc.Unlock()
+
+	fc.conn.SetWriteDeadline(time.Now().Add(forwardWriteTimeout))
+	_, err = fc.conn.Write(data)
+	return err
+}
+
+func (fc *forwardChunk) add() {
+	atomic.AddInt32(&fc.pending, 1)
+}
+
+// done acks the chunk when all of its records are buffered successfully,
+// the client sends the chunk again if it is not acked
+func (fc *forwardChunk) done(ok bool) {
+	if !ok {
+		atomic.StoreInt32(&fc.failed, 1)
+	}
+
+	if atomic.AddInt32(&fc.pending, -1) == 0 && atomic.LoadInt32(&fc.failed) == 0 {
+		// Not to block the buffer writer with the network
+		go func() {
+			defer recover()
+			fc.ackFunc()
+		}()
+	}
+}
@@ -0,0 +1,707 @@
+//	The MIT License (MIT)
+//
+//	Copyright (c) 2016, Cagatay Dogan
+//
+//	Permission is hereby granted, free of charge, to any person obtaining a copy
+//	of this software and associated documentation files (the "Software"), to deal
+//	in the Software without restriction, including without limitation the rights
+//	to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+//	copies of the Software, and to permit persons to whom the Software is
+//	furnished to do so, subject to the following conditions:
+//
+//		The above copyright notice and this permission notice shall be included in
+//		all copies or substantial portions of the Software.
+//
+//		THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+//		IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+//		FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+//		AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+//		LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+//		OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+//		THE SOFTWARE.
+
+package inout
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ocdogan/fluentgo/config"
+	"github.com/ocdogan/fluentgo/lib"
+)
+
+const (
+	forwardOutAckTimeout       = 30 * time.Second
+	forwardOutConnTimeout      = 10 * time.Second
+	forwardOutHeartbeatSec     = 1
+	forwardOutHeartbeatFailMax = 3
+)
+
+// forwardOut sends the events to fluentd or FluentGO aggregators over the
+// Fluent Forward protocol v1 as PackedForward chunks, balancing the chunks
+// over the weighted servers which are alive by their heartbeats
+type forwardOut struct {
+	outHandler
+	servers           []*forwardServer
+	sharedKey         string
+	selfHostname      string
+	requireAck        bool
+	ackTimeout        time.Duration
+	connTimeout       time.Duration
+	heartbeatInterval time.Duration
+}
+
+// forwardSendError reports the events of the chunk which could not be sent,
+// so only they are sent again
+type forwardSendError struct {
+	failed []int
+	err    error
+}
+
+func (e *forwardSendError) Error() string {
+	return fmt.Sprintf("FORWARDOUT failed to send %d events: %s", len(e.failed), e.err)
+}
+
+func (e *forwardSendError) Failed() []int {
+	return e.failed
+}
+
+func (e *forwardSendError) add(indexes []int, err error) {
+	e.failed = append(e.failed, indexes...)
+	if e.err == nil {
+		e.err = err
+	}
+}
+
+type forwardServer struct {
+	sync.Mutex
+	host     string
+	weight   int
+	standby  bool
+	alive    int32
+	failures int32
+	conn     net.Conn
+	dec      *lib.MsgpackDecoder
+}
+
+func init() {
+	RegisterOut("forward", newForwardOut)
+	RegisterOut("forwardout", newForwardOut)
+}
+
+func newForwardOut(manager InOutManager, params map[string]interface{}) OutSender {
+	servers := parseForwardServers(params, "servers", false)
+	if len(servers) == 0 {
+		return nil
+	}
+	servers = append(servers, parseForwardServers(params, "standbyServers", true)...)
+
+	oh := newOutHandler(manager, params)
+	if oh == nil {
+		return nil
+	}
+
+	// PackedForward chunks are compressed with gzip unless disabled
+	if _, ok := params["compressed"]; !ok {
+		oh.compressed = true
+	}
+
+	sharedKey, _ := config.ParamAsString(params, "sharedKey")
+
+	selfHostname, _ := config.ParamAsString(params, "selfHostname")
+	if selfHostname == "" {
+		selfHostname, _ = os.Hostname()
+	}
+
+	requireAck, ok := config.ParamAsBool(params, "requireAck")
+	if !ok {
+		requireAck = true
+	}
+
+	ackTimeout, ok := config.ParamAsDurationWithLimit(params, "ackTimeoutSec", 1, 3600)
+	if ok {
+		ackTimeout *= time.Second
+	} else {
+		ackTimeout = forwardOutAckTimeout
+	}
+
+	connTimeout, ok := config.ParamAsDurationWithLimit(params, "connTimeoutSec", 1, 60)
+	if ok {
+		connTimeout *= time.Second
+	} else {
+		connTimeout = forwardOutConnTimeout
+	}
+
+	heartbeatInterval, ok := config.ParamAsDurationWithLimit(params, "heartbeatIntervalSec", 0, 3600)
+	if !ok {
+		heartbeatInterval = forwardOutHeartbeatSec
+	}
+	heartbeatInterval *= time.Second
+
+	fo := &forwardOut{
+		outHandler:        *oh,
+		servers:           servers,
+		sharedKey:         sharedKey,
+		selfHostname:      selfHostname,
+		requireAck:        requireAck,
+		ackTimeout:        ackTimeout,
+		connTimeout:       connTimeout,
+		heartbeatInterval: heartbeatInterval,
+	}
+
+	fo.iotype = "FORWARDOUT"
+
+	fo.runFunc = fo.funcWait
+	fo.afterCloseFunc = fo.funcAfterClose
+
+	fo.getDestinationFunc = fo.funcGetDestination
+	fo.sendEventsFunc = fo.funcSendEvents
+	fo.healthCheckFunc = fo.funcHealthCheck
+	fo.loadTLSFunc = fo.loadClientCert
+
+	return fo
+}
+
+// parseForwardServers parses the servers separated by ';' as 'host:port' or
+// 'host:port*weight'
+func parseForwardServers(params map[string]interface{}, param string, standby bool) []*forwardServer {
+	var servers []*forwardServer
+
+	s, ok := config.ParamAsString(params, param)
+	if !ok || s == "" {
+		return nil
+	}
+
+	for _, host := range strings.Split(s, ";") {
+		host = strings.TrimSpace(host)
+		if host == "" {
+			continue
+		}
+
+		weight := 1
+		if pos := strings.LastIndex(host, "*"); pos > -1 {
+			w, err := strconv.Atoi(strings.TrimSpace(host[pos+1:]))
+			if err != nil || w < 0 {
+				continue
+			}
+
+			weight = w
+			host = strings.TrimSpace(host[:pos])
+		}
+
+		if host != "" && weight > 0 {
+			servers = append(servers, &forwardServer{
+				host:    host,
+				weight:  weight,
+				standby: standby,
+				alive:   1,
+			})
+		}
+	}
+	return servers
+}
+
+func (fo *forwardOut) funcGetDestination() string {
+	return "null"
+}
+
+func (fo *forwardOut) funcAfterClose() {
+	for _, server := range fo.servers {
+		server.Lock()
+		server.close()
+		server.Unlock()
+	}
+}
+
+func (fo *forwardOut) loadClientCert() (secure bool, config *tls.Config, err error) {
+	config, err = lib.LoadClientCert(fo.certFile, fo.keyFile, fo.caFile, fo.verifySsl)
+	secure = (err == nil) && (config != nil)
+	return
+}
+
+func (fo *forwardOut) funcWait() {
+	defer fo.InformStop()
+	fo.InformStart()
+
+	err := fo.loadCert()
+	if err != nil {
+		return
+	}
+
+	if fo.heartbeatInterval <= 0 {
+		<-fo.completed
+		return
+	}
+
+	ticker := time.NewTicker(fo.heartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-fo.completed:
+			return
+		case <-ticker.C:
+			fo.heartbeat()
+		}
+	}
+}
+
+// heartbeat checks the servers by connecting to them, a server is marked
+// as down after failing several heartbeats in a row and up again with the
+// first successful one
+func (fo *forwardOut) heartbeat() {
+	defer recover()
+
+	wg := lib.WorkGroup{}
+	for _, server := range fo.servers {
+		wg.Add(1)
+
+		go func(server *forwardServer) {
+			defer wg.Done()
+			defer recover()
+
+			conn, err := net.DialTimeout("tcp", server.host, fo.connTimeout)
+			if err == nil {
+				conn.Close()
+			}
+			fo.setAlive(server, err == nil)
+		}(server)
+	}
+	wg.Wait()
+}
+
+func (fo *forwardOut) setAlive(server *forwardServer, ok bool) {
+	l := fo.GetLogger()
+
+	if ok {
+		atomic.StoreInt32(&server.failures, 0)
+		if atomic.CompareAndSwapInt32(&server.alive, 0, 1) && l != nil {
+			l.Printf("* FORWARDOUT server '%s' is up.\n", server.host)
+		}
+		return
+	}
+
+	if atomic.AddInt32(&server.failures, 1) >= forwardOutHeartbeatFailMax {
+		fo.setDown(server)
+	}
+}
+
+func (fo *forwardOut) setDown(server *forwardServer) {
+	if atomic.CompareAndSwapInt32(&server.alive, 1, 0) {
+		l := fo.GetLogger()
+		if l != nil {
+			l.Printf("* FORWARDOUT server '%s' is down.\n", server.host)
+		}
+	}
+}
+
+// nextServer picks one of the alive servers by their weights, the standby
+// servers are used only if all others are down and the down servers only
+// if all servers are down
+func (fo *forwardOut) nextServer(tried map[*forwardServer]bool) *forwardServer {
+	candidates := []func(server *forwardServer) bool{
+		func(server *forwardServer) bool {
+			return !server.standby && atomic.LoadInt32(&server.alive) == 1
+		},
+		func(server *forwardServer) bool {
+			return atomic.LoadInt32(&server.alive) == 1
+		},
+		func(server *forwardServer) bool {
+			return true
+		},
+	}
+
+	for _, candidate := range candidates {
+		total := 0
+		for _, server := range fo.servers {
+			if !tried[server] && candidate(server) {
+				total += server.weight
+			}
+		}
+
+		if total == 0 {
+			continue
+		}
+
+		pick := 0
+		if n, err := rand.Int(rand.Reader, big.NewInt(int64(total))); err == nil {
+			pick = int(n.Int64())
+		}
+
+		for _, server := range fo.servers {
+			if !tried[server] && candidate(server) {
+				if pick < server.weight {
+					return server
+				}
+				pick -= server.weight
+			}
+		}
+	}
+	return nil
+}
+
+func (fo *forwardOut) funcHealthCheck() error {
+	var err error
+	for _, server := range fo.servers {
+		var conn net.Conn
+
+		conn, err = net.DialTimeout("tcp", server.host, fo.connTimeout)
+		if err == nil {
+			conn.Close()
+			fo.setAlive(server, true)
+			return nil
+		}
+	}
+	return err
+}
+
+func (fo *forwardOut) funcSendEvents(events []*Event, _ string) error {
+	if len(events) == 0 {
+		return nil
+	}
+
+	m := fo.GetManager()
+	if m == nil {
+		return errOutputStopped
+	}
+
+	// A PackedForward chunk carries the events of a single tag, the positions
+	// are counted over the events having a record as failedEvents expects
+	var (
+		tags     []string
+		position int
+	)
+
+	tagged := make(map[string][]*Event)
+	indexes := make(map[string][]int)
+
+	for _, e := range events {
+		if e != nil && len(e.Record) > 0 {
+			list, ok := tagged[e.Tag]
+			if !ok {
+				tags = append(tags, e.Tag)
+			}
+			tagged[e.Tag] = append(list, e)
+			indexes[e.Tag] = append(indexes[e.Tag], position)
+			position++
+		}
+	}
+
+	result := &forwardSendError{}
+
+	for i, tag := range tags {
+		if !(fo.Processing() && m.Processing()) {
+			return errOutputStopped
+		}
+
+		chunk, chunkID, invalid, err := fo.packChunk(tag, tagged[tag])
+		if err == nil && chunk != nil {
+			err = fo.sendPacked(chunk, chunkID)
+		}
+
+		if err != nil {
+			// the events of this and the following tags are not sent
+			for _, t := range tags[i:] {
+				result.add(indexes[t], err)
+			}
+			break
+		}
+
+		if len(invalid) > 0 {
+			failed := make([]int, len(invalid))
+			for j, k := range invalid {
+				failed[j] = indexes[tag][k]
+			}
+			result.add(failed, fmt.Errorf("FORWARDOUT records of tag '%s' are not json objects.", tag))
+		}
+	}
+
+	if len(result.failed) > 0 {
+		return result
+	}
+	return nil
+}
+
+// packChunk returns also the positions of the events whose records are not
+// json objects, they are not packed into the chunk
+func (fo *forwardOut) packChunk(tag string, events []*Event) (chunk []byte, chunkID string, invalid []int, err error) {
+	var (
+		count   int
+		entries []byte
+	)
+
+	for i, e := range events {
+		dec := json.NewDecoder(bytes.NewReader(e.Record))
+		dec.UseNumber()
+
+		var record map[string]interface{}
+		if dec.Decode(&record) != nil || record == nil {
+			invalid = append(invalid, i)
+			continue
+		}
+
+		eventTime := e.Time
+		if eventTime.IsZero() {
+			eventTime = time.Now()
+		}
+
+		entries, err = lib.AppendMsgpack(entries, []interface{}{lib.NewMsgpackEventTime(eventTime), record})
+		if err != nil {
+			return nil, "", invalid, err
+		}
+		count++
+	}
+
+	if count == 0 {
+		return nil, "", invalid, nil
+	}
+
+	option := map[string]interface{}{
+		"size": count,
+	}
+
+	if fo.compressed {
+		var buf bytes.Buffer
+
+		w := gzip.NewWriter(&buf)
+		if _, err = w.Write(entries); err == nil {
+			err = w.Close()
+		}
+		if err != nil {
+			return nil, "", invalid, err
+		}
+
+		entries = buf.Bytes()
+		option[forwardOptCompressed] = forwardGzip
+	}
+
+	if fo.requireAck {
+		id := make([]byte, 16)
+		if _, err = rand.Read(id); err != nil {
+			return nil, "", invalid, err
+		}
+
+		chunkID = base64.StdEncoding.EncodeToString(id)
+		option[forwardOptChunk] = chunkID
+	}
+
+	chunk, err = lib.MsgpackMarshal([]interface{}{tag, entries, option})
+	return chunk, chunkID, invalid, err
+}
+
+// sendPacked tries the alive servers in turn until one of them acks the chunk
+func (fo *forwardOut) sendPacked(chunk []byte, chunkID string) error {
+	var (
+		err   error
+		tried = make(map[*forwardServer]bool)
+	)
+
+	for {
+		server := fo.nextServer(tried)
+		if server == nil {
+			if err == nil {
+				err = fmt.Errorf("No FORWARDOUT server is available.")
+			}
+			return err
+		}
+		tried[server] = true
+
+		var reused bool
+		reused, err = fo.sendTo(server, chunk, chunkID)
+
+		// The idle connections can be closed by the server in the meantime
+		if err != nil && reused && !lib.IsTimeoutError(err) {
+			_, err = fo.sendTo(server, chunk, chunkID)
+		}
+
+		if err == nil {
+			return nil
+		}
+
+		l := fo.GetLogger()
+		if l != nil {
+			l.Printf("Cannot send FORWARDOUT chunk to '%s': %s\n", server.host, err)
+		}
+		fo.setDown(server)
+	}
+}
+
+func (fo *forwardOut) sendTo(server *forwardServer, chunk []byte, chunkID string) (reused bool, err error) {
+	server.Lock()
+	defer server.Unlock()
+
+	defer func() {
+		if e := recover(); e != nil && err == nil {
+			err = fmt.Errorf("%v", e)
+		}
+		if err != nil {
+			server.close()
+		}
+	}()
+
+	reused = server.conn != nil
+	if !reused {
+		if err = fo.connect(server); err != nil {
+			return reused, err
+		}
+	}
+
+	conn := server.conn
+
+	conn.SetWriteDeadline(time.Now().Add(fo.connTimeout))
+	if _, err = conn.Write(chunk); err != nil {
+		return reused, err
+	}
+
+	if chunkID == "" {
+		return reused, nil
+	}
+
+	conn.SetReadDeadline(time.Now().Add(fo.ackTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	resp, err := server.dec.Decode()
+	if err != nil {
+		return reused, err
+	}
+
+	if ack, ok := resp.(map[string]interface{}); ok {
+		if id, _ := forwardString(ack[forwardOptAck]); id == chunkID {
+			return reused, nil
+		}
+	}
+	return reused, fmt.Errorf("Invalid ack for chunk '%s'.", chunkID)
+}
+
+func (fo *forwardOut) connect(server *forwardServer) error {
+	var (
+		err  error
+		conn net.Conn
+	)
+
+	if fo.secure && fo.tlsConfig != nil {
+		d := net.Dialer{Timeout: fo.connTimeout}
+		conn, err = tls.DialWithDialer(&d, "tcp", server.host, fo.tlsConfig)
+	} else {
+		conn, err = net.DialTimeout("tcp", server.host, fo.connTimeout)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	server.conn = conn
+	server.dec = lib.NewMsgpackDecoder(bufio.NewReader(conn), forwardMaxChunkSize)
+
+	if fo.sharedKey != "" {
+		conn.SetDeadline(time.Now().Add(fo.connTimeout))
+		defer conn.SetDeadline(time.Time{})
+
+		return fo.handshake(server)
+	}
+	return nil
+}
+
+// handshake answers the HELO of the server with PING and validates its PONG
+func (fo *forwardOut) handshake(server *forwardServer) error {
+	msg, err := server.dec.Decode()
+	if err != nil {
+		return err
+	}
+
+	helo, ok := msg.([]interface{})
+	if !ok || len(helo) < 2 {
+		return fmt.Errorf("Invalid HELO message.")
+	}
+
+	if typ, _ := forwardString(helo[0]); typ != forwardHelo {
+		return fmt.Errorf("Invalid HELO message.")
+	}
+
+	options, _ := helo[1].(map[string]interface{})
+
+	var nonce []byte
+	switch n := options["nonce"].(type) {
+	case []byte:
+		nonce = n
+	case string:
+		nonce = []byte(n)
+	}
+
+	salt := make([]byte, 16)
+	if _, err = rand.Read(salt); err != nil {
+		return err
+	}
+	saltStr := hex.EncodeToString(salt)
+
+	ping := []interface{}{
+		forwardPing,
+		fo.selfHostname,
+		saltStr,
+		forwardDigest(saltStr, fo.selfHostname, nonce, fo.sharedKey),
+		"",
+		"",
+	}
+
+	data, err := lib.MsgpackMarshal(ping)
+	if err != nil {
+		return err
+	}
+
+	if _, err = server.conn.Write(data); err != nil {
+		return err
+	}
+
+	msg, err = server.dec.Decode()
+	if err != nil {
+		return err
+	}
+
+	pong, ok := msg.([]interface{})
+	if !ok || len(pong) < 5 {
+		return fmt.Errorf("Invalid PONG message.")
+	}
+
+	if typ, _ := forwardString(pong[0]); typ != forwardPong {
+		return fmt.Errorf("Invalid PONG message.")
+	}
+
+	if authOk, _ := pong[1].(bool); !authOk {
+		reason, _ := forwardString(pong[2])
+		return fmt.Errorf("Authentication failed: %s", reason)
+	}
+
+	hostname, _ := forwardString(pong[3])
+	digest, _ := forwardString(pong[4])
+
+	if digest != forwardDigest(saltStr, hostname, nonce, fo.sharedKey) {
+		return fmt.Errorf("Shared key mismatch with '%s'.", hostname)
+	}
+	return nil
+}
+
+func (server *forwardServer) close() {
+	conn := server.conn
+	server.conn = nil
+	server.dec = nil
+
+	if conn != nil {
+		defer recover()
+		conn.Close()
+	}
+}
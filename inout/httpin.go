@@ -0,0 +1,375 @@
+//	The MIT License (MIT)
+//
+//	Copyright (c) 2016, Cagatay Dogan
+//
+//	Permission is hereby granted, free of charge, to any person obtaining a copy
+//	of this software and associated documentation files (the "Software"), to deal
+//	in the Software without restriction, including without limitation the rights
+//	to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+//	copies of the Software, and to permit persons to whom the Software is
+//	furnished to do so, subject to the following conditions:
+//
+//		The above copyright notice and this permission notice shall be included in
+//		all copies or substantial portions of the Software.
+//
+//		THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+//		IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+//		FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+//		AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+//		LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+//		OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+//		THE SOFTWARE.
+
+package inout
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/ocdogan/fluentgo/config"
+	"github.com/ocdogan/fluentgo/lib"
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	httpInMaxBodySize   = 8 * 1024 * 1024
+	httpInRetryAfterSec = 1
+)
+
+var (
+	errInputStopped = errors.New("Input stopped.")
+	errBodyTooLarge = errors.New("Body exceeds the maximum body size.")
+)
+
+// httpIn accepts JSON objects, JSON arrays and NDJSON bodies posted to its
+// own listener, the tag of the records is derived from the URL path. A body
+// is queued only if all its records fit in the input queue, otherwise it is
+// answered with 429. The records answered with 200 can still be evicted by
+// the other inputs if the queue overflow policy is drop-oldest.
+type httpIn struct {
+	inHandler
+	tcpUDPIO
+	maxBodySize int
+	retryAfter  string
+	listener    net.Listener
+}
+
+func init() {
+	RegisterIn("http", newHTTPIn)
+	RegisterIn("httpin", newHTTPIn)
+}
+
+func newHTTPIn(manager InOutManager, params map[string]interface{}) InProvider {
+	tuio := newTCPUDPIO(manager, params)
+	if tuio == nil {
+		return nil
+	}
+
+	ih := newInHandler(manager, params)
+	if ih == nil {
+		return nil
+	}
+
+	maxBodySize, ok := config.ParamAsIntWithLimit(params, "maxBodySize", 1024, 1024*1024*1024)
+	if !ok {
+		maxBodySize = httpInMaxBodySize
+	}
+
+	retryAfter, ok := config.ParamAsIntWithLimit(params, "retryAfterSec", 1, 3600)
+	if !ok {
+		retryAfter = httpInRetryAfterSec
+	}
+
+	// Use the tag derived from the URL path unless a tag is set
+	ih.useSourceTag()
+
+	hin := &httpIn{
+		inHandler:   *ih,
+		tcpUDPIO:    *tuio,
+		maxBodySize: maxBodySize,
+		retryAfter:  strconv.Itoa(retryAfter),
+	}
+
+	hin.iotype = "HTTPIN"
+	hin.setTagSource("host", tuio.host)
+
+	hin.runFunc = hin.funcReceive
+	hin.afterCloseFunc = hin.funcAfterClose
+	hin.loadTLSFunc = hin.loadServerCert
+
+	return hin
+}
+
+func (hin *httpIn) funcAfterClose() {
+	if hin.listener != nil {
+		defer recover()
+
+		listener := hin.listener
+		hin.listener = nil
+
+		listener.Close()
+	}
+}
+
+func (hin *httpIn) loadServerCert() (secure bool, config *tls.Config, err error) {
+	config, err = lib.LoadServerCert(hin.certFile, hin.keyFile, hin.caFile, hin.verifySsl)
+	secure = (err == nil) && (config != nil)
+	return
+}
+
+func (hin *httpIn) funcReceive() {
+	defer hin.InformStop()
+	hin.InformStart()
+
+	err := hin.loadCert()
+	if err != nil {
+		return
+	}
+
+	lg := hin.logger
+
+	var listener net.Listener
+	if hin.secure && hin.tlsConfig != nil {
+		listener, err = tls.Listen("tcp", hin.host, hin.tlsConfig)
+	} else {
+		listener, err = net.Listen("tcp", hin.host)
+	}
+
+	if err != nil {
+		if lg != nil {
+			lg.Printf("'HTTPIN' cannot listen at '%s': %s\n", hin.host, err)
+		}
+		return
+	}
+
+	hin.listener = listener
+
+	if lg != nil {
+		defer lg.Printf("'HTTPIN' completed listening at '%s'.\n", hin.host)
+		lg.Printf("'HTTPIN' starting to listen at '%s'...\n", hin.host)
+	}
+
+	server := &fasthttp.Server{
+		Handler:            hin.handleRequest,
+		MaxRequestBodySize: hin.maxBodySize,
+	}
+
+	serveEnded := make(chan bool)
+	go func() {
+		defer close(serveEnded)
+		defer recover()
+
+		err := server.Serve(listener)
+		if err != nil && hin.Processing() && lg != nil {
+			lg.Printf("'HTTPIN' stopped serving at '%s': %s\n", hin.host, err)
+		}
+	}()
+
+	select {
+	case <-hin.completed:
+		hin.Close()
+	case <-serveEnded:
+	}
+}
+
+func (hin *httpIn) handleRequest(ctx *fasthttp.RequestCtx) {
+	defer func() {
+		if e := recover(); e != nil {
+			hin.reply(ctx, fasthttp.StatusInternalServerError, 0, fmt.Errorf("%v", e))
+		}
+	}()
+
+	if !ctx.IsPost() {
+		ctx.Response.Header.Set("Allow", "POST")
+		hin.reply(ctx, fasthttp.StatusMethodNotAllowed, 0, fmt.Errorf("Only POST is allowed."))
+		return
+	}
+
+	if !hin.Processing() {
+		hin.reply(ctx, fasthttp.StatusServiceUnavailable, 0, errInputStopped)
+		return
+	}
+
+	m := hin.GetManager()
+	if m == nil {
+		hin.reply(ctx, fasthttp.StatusServiceUnavailable, 0, errInputStopped)
+		return
+	}
+
+	q := m.GetInQueue()
+	if q == nil || q.Full() {
+		hin.tooManyRequests(ctx, 0)
+		return
+	}
+
+	var (
+		err  error
+		body []byte
+	)
+
+	if bytes.EqualFold(bytes.TrimSpace(ctx.Request.Header.Peek("Content-Encoding")), []byte("gzip")) {
+		body, err = hin.gunzip(ctx.PostBody())
+		if err == errBodyTooLarge {
+			hin.reply(ctx, fasthttp.StatusRequestEntityTooLarge, 0, err)
+			return
+		}
+		if err != nil {
+			hin.reply(ctx, fasthttp.StatusBadRequest, 0, fmt.Errorf("Invalid gzip body: %s", err))
+			return
+		}
+	} else {
+		body = ctx.PostBody()
+	}
+
+	records, err := splitHTTPRecords(body)
+	if err != nil {
+		hin.reply(ctx, fasthttp.StatusBadRequest, 0, err)
+		return
+	}
+
+	var size uint64
+
+	maxMsgSize := hin.getMaxMessageSize()
+	for _, record := range records {
+		if maxMsgSize > 0 && len(record) > maxMsgSize {
+			hin.reply(ctx, fasthttp.StatusRequestEntityTooLarge, 0,
+				fmt.Errorf("Record size exceeds the maximum message size %d.", maxMsgSize))
+			return
+		}
+		size += uint64(len(record))
+	}
+
+	// Do not queue a part of the body, so the client can send it again
+	if maxCount, maxSize := q.Limits(); (maxCount > 0 && len(records) > maxCount) ||
+		(maxSize > 0 && size > maxSize) {
+		hin.reply(ctx, fasthttp.StatusRequestEntityTooLarge, 0, fmt.Errorf("Body exceeds the input queue limits."))
+		return
+	}
+
+	if !q.Fits(len(records), size) {
+		hin.tooManyRequests(ctx, 0)
+		return
+	}
+
+	source := map[string]interface{}{
+		sourceTagKey: httpPathToTag(ctx.Path()),
+		"remote":     ctx.RemoteAddr().String(),
+	}
+
+	for i, record := range records {
+		if !hin.Processing() {
+			hin.reply(ctx, fasthttp.StatusServiceUnavailable, i, errInputStopped)
+			return
+		}
+
+		if !hin.pushRecord(record, source) {
+			hin.tooManyRequests(ctx, i)
+			return
+		}
+	}
+
+	hin.reply(ctx, fasthttp.StatusOK, len(records), nil)
+}
+
+// gunzip decompresses the body up to the maximum body size
+func (hin *httpIn) gunzip(body []byte) ([]byte, error) {
+	gr, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer gr.Close()
+
+	data, err := ioutil.ReadAll(io.LimitReader(gr, int64(hin.maxBodySize)+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) > hin.maxBodySize {
+		return nil, errBodyTooLarge
+	}
+	return data, nil
+}
+
+// tooManyRequests replies 429 with the number of the records queued, the
+// client sends the records from that index again after the retry wait
+func (hin *httpIn) tooManyRequests(ctx *fasthttp.RequestCtx, accepted int) {
+	ctx.Response.Header.Set("Retry-After", hin.retryAfter)
+	hin.reply(ctx, fasthttp.StatusTooManyRequests, accepted, fmt.Errorf("Input queue is full."))
+}
+
+func (hin *httpIn) reply(ctx *fasthttp.RequestCtx, status int, accepted int, err error) {
+	result := map[string]interface{}{
+		"accepted": accepted,
+	}
+	if err != nil {
+		result["error"] = err.Error()
+	}
+
+	data, _ := json.Marshal(result)
+
+	ctx.SetStatusCode(status)
+	ctx.SetContentType("application/json")
+	ctx.SetBody(data)
+}
+
+// httpPathToTag converts the URL path into a tag, as "/app/web" to "app.web"
+func httpPathToTag(path []byte) string {
+	tag := strings.Trim(string(path), "/")
+	return strings.Replace(tag, "/", ".", -1)
+}
+
+// splitHTTPRecords returns the JSON objects in the body which can be a single
+// object, an array of objects or the objects delimited by new lines (NDJSON)
+func splitHTTPRecords(body []byte) ([][]byte, error) {
+	body = bytes.TrimSpace(body)
+	if len(body) == 0 {
+		return nil, nil
+	}
+
+	var values []json.RawMessage
+
+	if body[0] == '[' {
+		err := json.Unmarshal(body, &values)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid JSON array: %s", err)
+		}
+	} else {
+		dec := json.NewDecoder(bytes.NewReader(body))
+		for {
+			var value json.RawMessage
+
+			err := dec.Decode(&value)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("Invalid JSON record at %d: %s", len(values)+1, err)
+			}
+			values = append(values, value)
+		}
+	}
+
+	records := make([][]byte, 0, len(values))
+	for i, value := range values {
+		value = bytes.TrimSpace(value)
+		if len(value) == 0 || value[0] != '{' {
+			return nil, fmt.Errorf("Record at %d is not a JSON object.", i+1)
+		}
+
+		buf := bytes.NewBuffer(make([]byte, 0, len(value)))
+		if err := json.Compact(buf, value); err != nil {
+			return nil, fmt.Errorf("Invalid JSON record at %d: %s", i+1, err)
+		}
+		records = append(records, buf.Bytes())
+	}
+	return records, nil
+}
@@ -18,18 +18,25 @@ type InAndOuts struct {
 	quitSignal <-chan bool
 }
 
-func NewInOutManager(mode lib.ServiceMode, config *config.FluentConfig, logger log.Logger, quitSignal <-chan bool) *InAndOuts {
+func NewInOutManager(mode lib.ServiceMode, config *config.FluentConfig, logger log.Logger, quitSignal <-chan bool) (*InAndOuts, error) {
 	var (
+		err  error
 		iman *InManager
 		oman *OutManager
 	)
 
 	if mode == lib.SmIn || mode == lib.SmInOut {
-		iman = NewInManager(config, logger)
+		iman, err = NewInManager(config, logger)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	if mode == lib.SmOut || mode == lib.SmInOut {
-		oman = NewOutManager(config, logger)
+		oman, err = NewOutManager(config, logger)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	return &InAndOuts{
@@ -38,7 +45,7 @@ func NewInOutManager(mode lib.ServiceMode, config *config.FluentConfig, logger l
 		mode:       mode,
 		logger:     logger,
 		quitSignal: quitSignal,
-	}
+	}, nil
 }
 
 func (iao *InAndOuts) Process() {
@@ -115,6 +122,20 @@ func (iao *InAndOuts) GetInputsWithType(typ string) []InOutInfo {
 	return nil
 }
 
+func (iao *InAndOuts) GetInputsFilter() *lib.FilterInfo {
+	if iao != nil && iao.iman != nil {
+		return iao.iman.GetFilter().Info()
+	}
+	return nil
+}
+
+func (iao *InAndOuts) GetInputsQueue() *QueueInfo {
+	if iao != nil && iao.iman != nil {
+		return iao.iman.GetQueueInfo()
+	}
+	return nil
+}
+
 func (iao *InAndOuts) GetOutputs() []InOutInfo {
 	if iao != nil && iao.oman != nil {
 		return iao.oman.GetOutputs()
@@ -129,6 +150,27 @@ func (iao *InAndOuts) GetOutputsWithType(typ string) []InOutInfo {
 	return nil
 }
 
+func (iao *InAndOuts) GetOutputsFilter() *lib.FilterInfo {
+	if iao != nil && iao.oman != nil {
+		return iao.oman.GetFilter().Info()
+	}
+	return nil
+}
+
+func (iao *InAndOuts) GetOutputsQueue() *QueueInfo {
+	if iao != nil && iao.oman != nil {
+		return iao.oman.GetQueueInfo()
+	}
+	return nil
+}
+
+func (iao *InAndOuts) GetBufferInfo() *BufferInfo {
+	if iao != nil && iao.oman != nil {
+		return iao.oman.GetBufferInfo()
+	}
+	return nil
+}
+
 func (iao *InAndOuts) FindInput(id string) IOClient {
 	if iao != nil && iao.iman != nil {
 		return iao.iman.FindInput(id)
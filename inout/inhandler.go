@@ -22,10 +22,22 @@
 
 package inout
 
-import "github.com/ocdogan/fluentgo/lib"
+import (
+	"time"
+
+	"github.com/ocdogan/fluentgo/config"
+	"github.com/ocdogan/fluentgo/lib"
+)
+
+// sourceTagKey is the metadata key of the tags sent by the clients
+const sourceTagKey = "tag"
 
 type inHandler struct {
 	ioHandler
+	tagPath   *lib.JsonPath
+	tagSource map[string]interface{}
+	parser    *inputParser
+	multiline *multilineStage
 }
 
 func newInHandler(manager InOutManager, params map[string]interface{}) *inHandler {
@@ -34,9 +46,93 @@ func newInHandler(manager InOutManager, params map[string]interface{}) *inHandle
 		return nil
 	}
 
+	var tag *lib.JsonPath
+
+	s, ok := config.ParamAsString(params, "@tag")
+	if ok && s != "" {
+		tag = lib.NewJsonPath(s)
+	}
+
+	parser, err := newInputParser(params)
+	if err != nil {
+		return nil
+	}
+
+	// The combined lines are left to the parser if there is one
+	multiline, err := newMultilineStage(params, parser == nil)
+	if err != nil {
+		return nil
+	}
+
+	if multiline != nil {
+		ioh.beforeCloseFunc = func() {
+			multiline.Flush(true)
+		}
+	}
+
 	return &inHandler{
 		ioHandler: *ioh,
+		tagPath:   tag,
+		tagSource: make(map[string]interface{}),
+		parser:    parser,
+		multiline: multiline,
+	}
+}
+
+// useSourceTag tags the records with the tags sent by the clients unless
+// a tag is set, the set tag can still refer to it as %{$.tag}%
+func (ih *inHandler) useSourceTag() {
+	if ih.tagPath == nil {
+		ih.tagPath = lib.NewJsonPath("%{$." + sourceTagKey + "}%")
+	}
+}
+
+func (ih *inHandler) setTagSource(name string, value interface{}) {
+	if ih.tagSource == nil {
+		ih.tagSource = make(map[string]interface{})
+	}
+	ih.tagSource[name] = value
+}
+
+func (ih *inHandler) getMetadata(source map[string]interface{}) map[string]interface{} {
+	if len(source) == 0 {
+		return ih.tagSource
+	}
+
+	merged := make(map[string]interface{}, len(ih.tagSource)+len(source))
+	for k, v := range ih.tagSource {
+		merged[k] = v
+	}
+	for k, v := range source {
+		merged[k] = v
+	}
+	return merged
+}
+
+func (ih *inHandler) getTag(metadata map[string]interface{}) string {
+	tag := ih.tagPath
+	if tag == nil {
+		return ""
+	}
+
+	defer recover()
+
+	var data interface{}
+	if !tag.IsStatic() {
+		data = metadata
+	}
+
+	result, err := tag.Eval(data, true)
+	if err == nil && result != nil {
+		if s, ok := result.(string); ok {
+			return s
+		}
 	}
+	return ""
+}
+
+func (ih *inHandler) GetParserInfo() *ParserInfo {
+	return ih.parser.Info()
 }
 
 func (ih *inHandler) getMaxMessageSize() int {
@@ -47,25 +143,151 @@ func (ih *inHandler) getMaxMessageSize() int {
 	return lib.MinInt(lib.InvalidMessageSize, lib.MaxInt(-1, msgSize))
 }
 
+// waitForQueue holds the pull based inputs from fetching while the queue
+// is full under the block overflow policy
+func (ih *inHandler) waitForQueue() bool {
+	m := ih.GetManager()
+	if m == nil {
+		return ih.Processing()
+	}
+
+	q := m.GetInQueue()
+	if q == nil {
+		return ih.Processing()
+	}
+
+	i := 0
+	for ih.Processing() && !q.HasRoom() {
+		i++
+		time.Sleep(time.Duration(i) * time.Millisecond)
+		if i >= 25 {
+			i = 0
+		}
+	}
+	return ih.Processing()
+}
+
 func (ih *inHandler) queueMessage(data []byte, maxMsgSize int) {
+	ih.queueMessageFrom(data, maxMsgSize, nil)
+}
+
+// queueMessageAsync queues the message in the background unless the lines
+// should be kept in order to be combined
+func (ih *inHandler) queueMessageAsync(data []byte, maxMsgSize int) {
+	if ih.multiline != nil {
+		ih.queueMessage(data, maxMsgSize)
+	} else {
+		go ih.queueMessage(data, maxMsgSize)
+	}
+}
+
+func (ih *inHandler) queueMessageFrom(data []byte, maxMsgSize int, source map[string]interface{}) {
 	ln := len(data)
 	if ln > 0 && (maxMsgSize < 1 || ln <= maxMsgSize) {
 		defer recover()
 
-		m := ih.GetManager()
-		if m != nil {
-			q := m.GetInQueue()
-
-			if q != nil {
-				if ih.compressed {
-					decdata := lib.Decompress(data, ih.compressType)
-					if decdata != nil {
-						q.Push(decdata)
-						return
-					}
-				}
-				q.Push(data)
+		if ih.compressed {
+			decdata := lib.Decompress(data, ih.compressType)
+			if decdata != nil {
+				data = decdata
 			}
 		}
+
+		if ih.multiline != nil {
+			ih.multiline.Add(data, source, ih.pushRecordBuffered, nil)
+			return
+		}
+
+		ih.pushRecord(data, source)
+	}
+}
+
+// queueMessageBuffered queues the message as queueMessageFrom does and calls
+// buffered once its record is written into the disk buffer, the lines kept
+// to be combined are called back with the result of their combined record
+func (ih *inHandler) queueMessageBuffered(data []byte, maxMsgSize int, source map[string]interface{}, buffered func(ok bool)) {
+	ln := len(data)
+	if ln == 0 || (maxMsgSize > 0 && ln > maxMsgSize) {
+		buffered(true)
+		return
+	}
+
+	defer func() {
+		if e := recover(); e != nil {
+			buffered(false)
+		}
+	}()
+
+	if ih.compressed {
+		decdata := lib.Decompress(data, ih.compressType)
+		if decdata != nil {
+			data = decdata
+		}
+	}
+
+	if ih.multiline != nil {
+		ih.multiline.Add(data, source, ih.pushRecordBuffered, buffered)
+		return
+	}
+
+	ih.pushRecordAt(data, source, time.Time{}, buffered)
+}
+
+// pushRecord returns false only if the record could not be queued, the
+// records skipped by the parser, filters or limits count as consumed
+func (ih *inHandler) pushRecord(data []byte, source map[string]interface{}) bool {
+	return ih.pushRecordAt(data, source, time.Time{}, nil)
+}
+
+func (ih *inHandler) pushRecordBuffered(data []byte, source map[string]interface{}, buffered func(ok bool)) bool {
+	return ih.pushRecordAt(data, source, time.Time{}, buffered)
+}
+
+// pushRecordAt pushes the record with its own event time unless it is zero,
+// buffered is called once with the result of writing it into the disk buffer
+func (ih *inHandler) pushRecordAt(data []byte, source map[string]interface{},
+	eventTime time.Time, buffered func(ok bool)) (accepted bool) {
+	owned := false
+	defer func() {
+		if e := recover(); e != nil {
+			accepted = false
+		}
+
+		// The event calls back itself once it is handed to the queue
+		if buffered != nil && !owned {
+			buffered(accepted)
+		}
+	}()
+
+	m := ih.GetManager()
+	if m != nil {
+		q := m.GetInQueue()
+
+		if q != nil {
+			var ok bool
+			if data, ok = ih.parser.Parse(data); !ok {
+				return true
+			}
+
+			if !(m.GetFilter().Match(data) && ih.filter.Match(data)) {
+				return true
+			}
+
+			if !ih.limiter.Allow(data, ih.Processing) {
+				return true
+			}
+
+			metadata := ih.getMetadata(source)
+
+			event := NewEvent(data, ih.getTag(metadata), metadata)
+			if !eventTime.IsZero() {
+				event.Time = eventTime
+			}
+			event.OnBuffered(buffered)
+
+			owned = true
+			return q.Push(event)
+		}
 	}
+	return false
 }
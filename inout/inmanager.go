@@ -23,7 +23,6 @@
 package inout
 
 import (
-	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"math"
@@ -42,6 +41,7 @@ import (
 
 type InProvider interface {
 	IOClient
+	GetParserInfo() *ParserInfo
 }
 
 type FuncNewIn func(manage InOutManager, params map[string]interface{}) InProvider
@@ -72,6 +72,7 @@ type InManager struct {
 	orphanDelete      bool
 	orphanLastXDays   int
 	inputs            map[lib.UUID]InProvider
+	filter            *lib.Filter
 	logger            log.Logger
 	inQ               *InQueue
 	bufFile           *bufferFile
@@ -114,11 +115,16 @@ func UnregisterIn(providerType string) {
 	}
 }
 
-func NewInManager(config *config.FluentConfig, logger log.Logger) *InManager {
+func NewInManager(config *config.FluentConfig, logger log.Logger) (*InManager, error) {
 	if logger == nil {
 		logger = log.NewDummyLogger()
 	}
 
+	filter, err := lib.NewFilter(config.Inputs.Filter)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid inputs filter. %s", err)
+	}
+
 	inputDir := (&config.Inputs.Buffer).GetPath()
 	outputDir := inputDir + "completed" + string(os.PathSeparator)
 
@@ -134,6 +140,7 @@ func NewInManager(config *config.FluentConfig, logger log.Logger) *InManager {
 		lastFlushTime:   time.Now(),
 		lastProcessTime: time.Now(),
 		inputs:          make(map[lib.UUID]InProvider),
+		filter:          filter,
 		prefix:          (&config.Inputs.Buffer).GetPrefix(),
 		extension:       (&config.Inputs.Buffer).GetExtension(),
 		flushSize:       (&config.Inputs.Buffer).GetFlushSize(),
@@ -148,9 +155,15 @@ func NewInManager(config *config.FluentConfig, logger log.Logger) *InManager {
 		watchDog:        newBufferWatchDog(config, logger),
 	}
 
-	manager.setInputs(&config.Inputs)
+	manager.inQ.overflow = ParseOverflowPolicy((&config.Inputs.Queue).GetOverflow(), OverflowDropOldest)
+	manager.inQ.spillFunc = manager.spillToBuffer
+
+	err = manager.setInputs(&config.Inputs)
+	if err != nil {
+		return nil, err
+	}
 
-	return manager
+	return manager, nil
 }
 
 func (m *InManager) FindInput(id string) IOClient {
@@ -183,6 +196,9 @@ func (m *InManager) GetInputs() []InOutInfo {
 				IOType:      in.GetIOType(),
 				Enabled:     in.Enabled(),
 				Processing:  in.Processing(),
+				Filter:      in.GetFilter().Info(),
+				RateLimit:   in.GetRateLimitInfo(),
+				Parser:      in.GetParserInfo(),
 			})
 		}
 		return inputs
@@ -211,6 +227,9 @@ func (m *InManager) GetInputsWithType(typ string) []InOutInfo {
 						IOType:      itype,
 						Enabled:     in.Enabled(),
 						Processing:  in.Processing(),
+						Filter:      in.GetFilter().Info(),
+						RateLimit:   in.GetRateLimitInfo(),
+						Parser:      in.GetParserInfo(),
 					})
 				}
 			}
@@ -228,10 +247,21 @@ func (m *InManager) GetMaxMessageSize() int {
 	return m.maxMessageSize
 }
 
+func (m *InManager) GetFilter() *lib.Filter {
+	return m.filter
+}
+
 func (m *InManager) GetInQueue() *InQueue {
 	return m.inQ
 }
 
+func (m *InManager) GetQueueInfo() *QueueInfo {
+	if m != nil && m.inQ != nil {
+		return m.inQ.Info()
+	}
+	return nil
+}
+
 func (m *InManager) GetOutQueue() *OutQueue {
 	return nil
 }
@@ -329,7 +359,7 @@ func (m *InManager) signalCompleted() {
 	}
 }
 
-func (m *InManager) setInputs(config *config.InputsConfig) {
+func (m *InManager) setInputs(config *config.InputsConfig) error {
 	if config != nil {
 		ins := m.inputs
 		if ins == nil {
@@ -340,8 +370,20 @@ func (m *InManager) setInputs(config *config.InputsConfig) {
 		for _, p := range config.Producers {
 			t := strings.ToLower(p.Type)
 
+			if _, err := lib.NewFilter(p.Filter); err != nil {
+				return fmt.Errorf("Invalid filter for input '%s' (%s). %s", p.Name, p.Type, err)
+			}
+
+			params := p.GetParamsMap()
+			if _, err := newInputParser(params); err != nil {
+				return fmt.Errorf("Invalid parser for input '%s' (%s). %s", p.Name, p.Type, err)
+			}
+
+			if _, err := newMultilineStage(params, true); err != nil {
+				return fmt.Errorf("Invalid multiline for input '%s' (%s). %s", p.Name, p.Type, err)
+			}
+
 			if fn, ok := inputMethods[t]; ok {
-				params := p.GetParamsMap()
 				in := fn(m, params)
 
 				if in != nil {
@@ -356,6 +398,7 @@ func (m *InManager) setInputs(config *config.InputsConfig) {
 			}
 		}
 	}
+	return nil
 }
 
 func (m *InManager) appendTimestamp(data []byte) []byte {
@@ -394,29 +437,51 @@ func (m *InManager) processQueue() {
 	defer recover()
 	defer atomic.StoreInt32(&m.poppingQueue, 0)
 
+	m.Lock()
 	m.prepareBuffer(0)
+	m.Unlock()
+
 	m.lastProcessTime = time.Now()
 
 	var (
-		data []byte
-		ok   bool
-		ln   int
+		event *Event
+		ok    bool
+		ln    int
 	)
 
 	for m.Processing() {
-		data, ok = m.inQ.Pop()
+		event, ok = m.inQ.Pop()
 		if !ok {
 			break
 		}
 
-		ln = len(data)
+		ln = event.Len()
 		if ln > 0 && (m.maxMessageSize < 1 || ln <= m.maxMessageSize) {
-			data = m.appendTimestamp(data)
-			m.writeToBuffer(data)
+			event.Record = m.appendTimestamp(event.Record)
+			m.writeToBuffer(event)
+		} else {
+			event.bufferDone(false)
 		}
 	}
 }
 
+// spillToBuffer writes the event directly into the buffer file when the
+// queue overflows under the spill policy
+func (m *InManager) spillToBuffer(event *Event) bool {
+	if !m.Processing() {
+		return false
+	}
+
+	ln := event.Len()
+	if ln > 0 && (m.maxMessageSize < 1 || ln <= m.maxMessageSize) {
+		event.Record = m.appendTimestamp(event.Record)
+		m.writeToBuffer(event)
+	} else {
+		event.bufferDone(false)
+	}
+	return true
+}
+
 func (m *InManager) nextBufferFile() string {
 	t := time.Now()
 	prefix := m.prefix + fmt.Sprintf("%d%02d%02dT%02dx", t.Year(), t.Month(), t.Day(), t.Hour())
@@ -554,13 +619,16 @@ func (m *InManager) doFileCompleted(bf *bufferFile) {
 		file.Close()
 	}()
 
-	lnBytes := make([]byte, 4)
-	binary.BigEndian.PutUint32(lnBytes, math.MaxUint32)
-	file.Write(lnBytes)
+	writeBufferEnd(file)
 }
 
-func (m *InManager) writeToBuffer(data []byte) {
-	ln := len(data)
+func (m *InManager) writeToBuffer(event *Event) {
+	written := false
+	defer func() {
+		event.bufferDone(written)
+	}()
+
+	ln := event.Len()
 	if ln == 0 {
 		return
 	}
@@ -582,24 +650,16 @@ func (m *InManager) writeToBuffer(data []byte) {
 		return
 	}
 
-	// Record start
-	f.Write(lib.RecStartBytes())
-
-	// Record lebgth
-	stamp := make([]byte, 4)
-	binary.BigEndian.PutUint32(stamp, uint32(ln))
-	f.Write(stamp)
-
-	// Record
-	f.Write(data)
+	n, err := writeEvent(f, event)
 
-	// Record stop
-	f.Write(lib.RecStopBytes())
-
-	fi.size += ln + 12
+	fi.size += n
 	fi.count++
+
+	written = err == nil
 }
 
+// prepareBuffer is called under the manager lock as writeToBuffer does, so
+// the replaced file is completed only after its last write
 func (m *InManager) prepareBuffer(dataLen int) {
 	if !atomic.CompareAndSwapInt32(&m.preparing, 0, 1) {
 		return
@@ -609,7 +669,7 @@ func (m *InManager) prepareBuffer(dataLen int) {
 	bf := m.bufFile
 	dataLen = lib.MaxInt(0, dataLen)
 
-	changeFile := bf == nil || (bf.size > 0 &&
+	changeFile := bf == nil || (bf.count > 0 &&
 		((m.flushSize > 0 && bf.size+dataLen > m.flushSize) ||
 			(m.flushCount > 0 && bf.count+1 > m.flushCount) ||
 			(time.Now().Sub(m.lastFlushTime) >= m.flushOnEverySec)))
@@ -645,9 +705,14 @@ func (m *InManager) prepareBuffer(dataLen int) {
 		}
 	}
 
-	m.bufFile = &bufferFile{
+	newBf := &bufferFile{
 		file: file,
 	}
+
+	if file != nil {
+		newBf.size, _ = writeBufferHeader(file)
+	}
+	m.bufFile = newBf
 }
 
 func (m *InManager) processInputs() {
@@ -660,6 +725,7 @@ func (m *InManager) processInputs() {
 
 		recover()
 		atomic.StoreInt32(&m.processing, 0)
+		m.inQ.Release()
 
 		if m.logger != nil {
 			m.logger.Println("* Stopping 'IN' manager...")
@@ -696,7 +762,10 @@ func (m *InManager) processInputs() {
 			}
 		}
 	}
+
+	m.Lock()
 	m.prepareBuffer(0)
+	m.Unlock()
 
 	for !completed {
 		select {
@@ -1,10 +1,69 @@
 package inout
 
+import "github.com/ocdogan/fluentgo/lib"
+
 type InOutInfo struct {
-	ID          string `json:"id,omitempty"`
-	Name        string `json:"name,omitempty"`
-	Description string `json:"description,omitempty"`
-	IOType      string `json:"iotype,omitempty"`
-	Enabled     bool   `json:"enabled"`
-	Processing  bool   `json:"processing"`
+	ID          string          `json:"id,omitempty"`
+	Name        string          `json:"name,omitempty"`
+	Description string          `json:"description,omitempty"`
+	IOType      string          `json:"iotype,omitempty"`
+	Enabled     bool            `json:"enabled"`
+	Processing  bool            `json:"processing"`
+	Filter      *lib.FilterInfo `json:"filter,omitempty"`
+	RateLimit   *RateLimitInfo  `json:"rateLimit,omitempty"`
+	Parser      *ParserInfo     `json:"parser,omitempty"`
+	Delivery    *DeliveryInfo   `json:"delivery,omitempty"`
+	State       string          `json:"state,omitempty"`
+	Circuit     *CircuitInfo    `json:"circuit,omitempty"`
+	Secondary   *InOutInfo      `json:"secondary,omitempty"`
+}
+
+type DeliveryInfo struct {
+	Retries        uint64 `json:"retries"`
+	DeadLetters    uint64 `json:"deadLetters"`
+	DeadLetterPath string `json:"deadLetterPath,omitempty"`
+	Queued         int    `json:"queued"`
+	Rejected       uint64 `json:"rejected"`
+}
+
+type CircuitInfo struct {
+	State    string `json:"state"`
+	Failures int    `json:"failures"`
+	Opens    uint64 `json:"opens"`
+}
+
+type RateLimitInfo struct {
+	Mode          string                  `json:"mode"`
+	RecordsPerSec float64                 `json:"recordsPerSec,omitempty"`
+	BytesPerSec   float64                 `json:"bytesPerSec,omitempty"`
+	Key           string                  `json:"key,omitempty"`
+	Passed        uint64                  `json:"passed"`
+	Delayed       uint64                  `json:"delayed"`
+	Dropped       uint64                  `json:"dropped"`
+	DelayedMSec   int64                   `json:"delayedMSec"`
+	Keys          map[string]*RateKeyInfo `json:"keys,omitempty"`
+}
+
+type RateKeyInfo struct {
+	Delayed uint64 `json:"delayed"`
+	Dropped uint64 `json:"dropped"`
+}
+
+type ParserInfo struct {
+	Type      string `json:"type"`
+	Parsed    uint64 `json:"parsed"`
+	Failed    uint64 `json:"failed"`
+	ErrorPath string `json:"errorPath,omitempty"`
+}
+
+type BufferInfo struct {
+	CorruptRecords uint64 `json:"corruptRecords"`
+	QuarantinePath string `json:"quarantinePath,omitempty"`
+}
+
+type QueueInfo struct {
+	Overflow string `json:"overflow"`
+	Count    int    `json:"count"`
+	Dropped  uint64 `json:"dropped"`
+	Spilled  uint64 `json:"spilled"`
 }
@@ -22,12 +22,16 @@
 
 package inout
 
-import "github.com/ocdogan/fluentgo/log"
+import (
+	"github.com/ocdogan/fluentgo/lib"
+	"github.com/ocdogan/fluentgo/log"
+)
 
 type InOutManager interface {
 	Close()
 	GetLogger() log.Logger
 	GetMaxMessageSize() int
+	GetFilter() *lib.Filter
 	GetInQueue() *InQueue
 	GetOutQueue() *OutQueue
 	Process(signal chan<- bool)
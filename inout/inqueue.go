@@ -25,31 +25,41 @@ package inout
 import (
 	"math"
 	"sync"
+	"sync/atomic"
 )
 
 type inQNode struct {
-	id   uint32
-	prev *inQNode
-	next *inQNode
-	data []byte
+	id    uint32
+	prev  *inQNode
+	next  *inQNode
+	event *Event
 }
 
 type InQueue struct {
 	sync.Mutex
-	idgen    uint32
-	cnt      int
-	maxCount int
-	sz       uint64
-	maxSize  uint64
-	head     *inQNode
-	tail     *inQNode
+	idgen     uint32
+	cnt       int
+	maxCount  int
+	sz        uint64
+	maxSize   uint64
+	head      *inQNode
+	tail      *inQNode
+	overflow  OverflowPolicy
+	spillFunc func(event *Event) bool
+	dropped   uint64
+	spilled   uint64
+	released  int32
+	room      *sync.Cond
 }
 
 func NewInQueue(maxCount int, maxSize uint64) *InQueue {
-	return &InQueue{
+	q := &InQueue{
 		maxCount: maxCount,
 		maxSize:  maxSize,
 	}
+	q.room = sync.NewCond(&q.Mutex)
+
+	return q
 }
 
 func (q *InQueue) nextID() uint32 {
@@ -62,18 +72,110 @@ func (q *InQueue) nextID() uint32 {
 	return id
 }
 
-func (q *InQueue) Push(data []byte) {
+// Push returns false when the event is dropped by the overflow policy
+func (q *InQueue) Push(event *Event) bool {
+	if event == nil {
+		return false
+	}
+
+	ln := uint64(event.Len())
+
+	q.Lock()
+	if q.overflow == OverflowBlock {
+		q.waitForRoom(ln)
+	} else if (q.overflow == OverflowDropNewest || q.overflow == OverflowSpill) && q.full(ln) {
+		q.Unlock()
+		return q.overflowed(event)
+	}
+
+	defer q.Unlock()
+	q.put(event)
+	return true
+}
+
+func (q *InQueue) full(ln uint64) bool {
+	return (q.maxSize > 0 && q.cnt > 0 && q.sz+ln > q.maxSize) ||
+		(q.maxCount > 0 && q.cnt > 0 && q.cnt >= q.maxCount)
+}
+
+func (q *InQueue) overflowed(event *Event) bool {
+	if q.overflow == OverflowSpill && q.spillFunc != nil && q.spillFunc(event) {
+		atomic.AddUint64(&q.spilled, 1)
+		return true
+	}
+	atomic.AddUint64(&q.dropped, 1)
+	event.bufferDone(false)
+	return false
+}
+
+// Full reports if the queue reached its limits regardless of the overflow
+// policy, so the push based inputs can ask their clients to retry later
+func (q *InQueue) Full() bool {
+	if q.overflow == OverflowSpill || atomic.LoadInt32(&q.released) != 0 {
+		return false
+	}
+
+	q.Lock()
+	defer q.Unlock()
+
+	return q.full(0)
+}
+
+// Fits reports if the given number of events of the given total size can be
+// pushed without reaching the limits, so the push based inputs can reject
+// a batch as a whole instead of dropping or evicting a part of it
+func (q *InQueue) Fits(count int, size uint64) bool {
+	if q.overflow == OverflowSpill || atomic.LoadInt32(&q.released) != 0 {
+		return true
+	}
+
+	q.Lock()
+	defer q.Unlock()
+
+	return !((q.maxCount > 0 && q.cnt+count > q.maxCount) ||
+		(q.maxSize > 0 && q.sz+size > q.maxSize))
+}
+
+// Limits returns the maximum count and size of the queue, 0 means no limit
+func (q *InQueue) Limits() (maxCount int, maxSize uint64) {
+	return q.maxCount, q.maxSize
+}
+
+// HasRoom returns false while the queue is full and applies backpressure
+func (q *InQueue) HasRoom() bool {
+	if q.overflow != OverflowBlock || atomic.LoadInt32(&q.released) != 0 {
+		return true
+	}
+
 	q.Lock()
 	defer q.Unlock()
 
-	q.put(data)
+	return !q.full(0)
+}
+
+// waitForRoom is called under the queue lock, so the event is put in the
+// room found without another pusher taking it first
+func (q *InQueue) waitForRoom(ln uint64) {
+	for q.full(ln) && atomic.LoadInt32(&q.released) == 0 {
+		q.room.Wait()
+	}
 }
 
-func (q *InQueue) put(data []byte) {
+// Release stops the pushers waiting for room, so they can complete
+// when the queue is not consumed anymore
+func (q *InQueue) Release() {
+	atomic.StoreInt32(&q.released, 1)
+
+	q.Lock()
+	q.room.Broadcast()
+	q.Unlock()
+}
+
+func (q *InQueue) put(event *Event) {
 	n := &inQNode{
-		id:   q.nextID(),
-		data: data,
-		prev: q.tail,
+		id:    q.nextID(),
+		event: event,
+		prev:  q.tail,
 	}
 
 	if q.tail == nil {
@@ -82,24 +184,34 @@ func (q *InQueue) put(data []byte) {
 		q.tail.next, q.tail = n, n
 	}
 	q.cnt++
-	if data != nil {
-		q.sz += uint64(len(data))
+	q.sz += uint64(event.Len())
+
+	// A blocking queue makes room by waiting, it never evicts the buffered
+	if q.overflow == OverflowBlock {
+		return
 	}
 
 	for (q.maxSize > 0 && q.sz > q.maxSize) ||
 		(q.maxCount > 0 && q.cnt > 1 && q.cnt > q.maxCount) {
-		q.popData()
+		if dropped, ok := q.popData(); ok {
+			atomic.AddUint64(&q.dropped, 1)
+			dropped.bufferDone(false)
+		}
 	}
 }
 
-func (q *InQueue) Pop() (data []byte, ok bool) {
+func (q *InQueue) Pop() (event *Event, ok bool) {
 	q.Lock()
 	defer q.Unlock()
 
-	return q.popData()
+	event, ok = q.popData()
+	if ok && q.overflow == OverflowBlock {
+		q.room.Broadcast()
+	}
+	return event, ok
 }
 
-func (q *InQueue) popData() (data []byte, ok bool) {
+func (q *InQueue) popData() (event *Event, ok bool) {
 	if q.head != nil {
 		n := q.head
 
@@ -120,21 +232,34 @@ func (q *InQueue) popData() (data []byte, ok bool) {
 			q.head, q.tail = nil, nil
 		}
 
-		data = n.data
-		n.data = nil
+		event = n.event
+		n.event = nil
 
-		if data != nil {
-			q.sz -= uint64(len(data))
-			if q.sz < 0 {
-				q.sz = 0
-			}
+		ln := uint64(event.Len())
+		if ln > q.sz {
+			q.sz = 0
+		} else {
+			q.sz -= ln
 		}
 
-		return data, true
+		return event, true
 	}
 	return nil, false
 }
 
+func (q *InQueue) Overflow() OverflowPolicy {
+	return q.overflow
+}
+
+func (q *InQueue) Info() *QueueInfo {
+	return &QueueInfo{
+		Overflow: q.overflow.String(),
+		Count:    q.Count(),
+		Dropped:  atomic.LoadUint64(&q.dropped),
+		Spilled:  atomic.LoadUint64(&q.spilled),
+	}
+}
+
 func (q *InQueue) Count() int {
 	q.Lock()
 	count := q.cnt
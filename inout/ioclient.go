@@ -29,6 +29,8 @@ type IOClient interface {
 	Run()
 	Enabled() bool
 	GetIOType() string
+	GetFilter() *lib.Filter
+	GetRateLimitInfo() *RateLimitInfo
 	Processing() bool
 	Close()
 	Name() string
@@ -22,11 +22,18 @@
 
 package inout
 
-import "sync/atomic"
+import (
+	"sync/atomic"
+
+	"github.com/ocdogan/fluentgo/config"
+	"github.com/ocdogan/fluentgo/lib"
+)
 
 type ioHandler struct {
 	tlsIO
 	baseIO
+	filter          *lib.Filter
+	limiter         *rateLimiter
 	runFunc         func()
 	beforeCloseFunc func()
 	afterCloseFunc  func()
@@ -44,13 +51,34 @@ func newIOHandler(manager InOutManager, params map[string]interface{}) *ioHandle
 		return nil
 	}
 
+	var filter *lib.Filter
+
+	s, ok := config.ParamAsString(params, "@filter")
+	if ok && s != "" {
+		var err error
+		filter, err = lib.NewFilter(s)
+		if err != nil {
+			return nil
+		}
+	}
+
 	return &ioHandler{
 		tlsIO:     *tio,
 		baseIO:    *bio,
+		filter:    filter,
+		limiter:   newRateLimiter(params),
 		completed: make(chan bool),
 	}
 }
 
+func (ioh *ioHandler) GetFilter() *lib.Filter {
+	return ioh.filter
+}
+
+func (ioh *ioHandler) GetRateLimitInfo() *RateLimitInfo {
+	return ioh.limiter.Info()
+}
+
 func (ioh *ioHandler) Close() {
 	defer func() {
 		recover()
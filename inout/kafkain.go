@@ -23,15 +23,40 @@
 package inout
 
 import (
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/ocdogan/fluentgo/config"
 	"github.com/optiopay/kafka"
+	"github.com/optiopay/kafka/proto"
 )
 
+const (
+	kafkaCommitInterval = time.Second
+	kafkaRetryLimit     = 4
+)
+
+// kafkaIn consumes a list of or all partitions of the topic, with a consumer
+// group the offsets are committed once their records are in the disk buffer
+// and the consumption continues from the committed offsets on restart
 type kafkaIn struct {
 	inHandler
 	kafkaIO
-	consumer *kafka.Consumer
+	partitions     []int32
+	allPartitions  bool
+	consumerGroup  string
+	startTime      int64
+	commitInterval time.Duration
+	consumerLck    sync.Mutex
+	consumer       *kafka.Mx
+	consumerStop   chan struct{}
+	coordinator    kafka.OffsetCoordinator
+	offsets        *kafkaOffsets
 }
 
 func init() {
@@ -50,24 +75,111 @@ func newKafkaIn(manager InOutManager, params map[string]interface{}) InProvider
 		return nil
 	}
 
+	partitions, allPartitions, ok := parseKafkaPartitions(params, kio.partition)
+	if !ok {
+		return nil
+	}
+
+	consumerGroup, _ := config.ParamAsString(params, "consumerGroup")
+	consumerGroup = strings.TrimSpace(consumerGroup)
+
+	startTime, ok := parseKafkaStartTime(params)
+	if !ok {
+		return nil
+	}
+
+	commitInterval, ok := config.ParamAsDurationWithLimit(params, "commitIntervalMSec", 10, 60000)
+	if ok {
+		commitInterval *= time.Millisecond
+	} else {
+		commitInterval = kafkaCommitInterval
+	}
+
 	kin := &kafkaIn{
-		inHandler: *ih,
-		kafkaIO:   *kio,
+		inHandler:      *ih,
+		kafkaIO:        *kio,
+		partitions:     partitions,
+		allPartitions:  allPartitions,
+		consumerGroup:  consumerGroup,
+		startTime:      startTime,
+		commitInterval: commitInterval,
+		offsets:        newKafkaOffsets(),
 	}
 
+	kin.setTagSource("topic", kio.topic)
+	kin.setTagSource("partition", float64(kio.partition))
+
 	kin.runFunc = kin.funcReceive
 	kin.afterCloseFunc = kin.funcAfterClose
 
 	return kin
 }
 
+// parseKafkaPartitions parses the partitions param which is either 'all' or
+// a comma separated list of partitions, defaulting to the single partition
+func parseKafkaPartitions(params map[string]interface{}, partition int32) ([]int32, bool, bool) {
+	s, ok := config.ParamAsString(params, "partitions")
+	s = strings.TrimSpace(s)
+
+	if !ok || s == "" {
+		return []int32{partition}, false, true
+	}
+
+	if strings.ToLower(s) == "all" {
+		return nil, true, true
+	}
+
+	var (
+		partitions []int32
+		seen       = make(map[int32]bool)
+	)
+
+	for _, p := range strings.Split(s, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+
+		id, err := strconv.ParseInt(p, 10, 32)
+		if err != nil || id < 0 {
+			return nil, false, false
+		}
+
+		if !seen[int32(id)] {
+			seen[int32(id)] = true
+			partitions = append(partitions, int32(id))
+		}
+	}
+	return partitions, false, len(partitions) > 0
+}
+
+// parseKafkaStartTime parses the startTime param as RFC3339 or as Unix
+// time in milliseconds
+func parseKafkaStartTime(params map[string]interface{}) (int64, bool) {
+	if s, ok := config.ParamAsString(params, "startTime"); ok && s != "" {
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return 0, false
+		}
+		return t.UnixNano() / int64(time.Millisecond), true
+	}
+
+	if ms, ok := config.ParamAsInt64WithLimit(params, "startTime", 0, math.MaxInt64); ok {
+		return ms, true
+	}
+	return 0, true
+}
+
 func (kin *kafkaIn) funcAfterClose() {
-	if kin.broker != nil {
-		defer recover()
+	defer recover()
 
+	kin.closeConsumer()
+	kin.commit()
+
+	if kin.broker != nil {
 		broker := *kin.broker
 		kin.broker = nil
-		kin.consumer = nil
+		kin.coordinator = nil
 
 		broker.Close()
 	}
@@ -80,9 +192,35 @@ func (kin *kafkaIn) funcReceive() {
 	consumeCompleted := make(chan bool)
 	go kin.consume(consumeCompleted)
 
+	if kin.consumerGroup != "" {
+		go kin.commitLoop(consumeCompleted)
+	}
+
 	<-consumeCompleted
 }
 
+// commitLoop commits the buffered offsets periodically, and interrupts the
+// consumer blocked waiting for messages if a record could not be buffered
+func (kin *kafkaIn) commitLoop(consumeCompleted chan bool) {
+	defer recover()
+
+	ticker := time.NewTicker(kin.commitInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-consumeCompleted:
+			return
+		case <-ticker.C:
+			kin.commit()
+
+			if kin.offsets.hasFailed() {
+				kin.interruptConsumer()
+			}
+		}
+	}
+}
+
 func (kin *kafkaIn) consume(consumeCompleted chan bool) {
 	defer func() {
 		recover()
@@ -110,17 +248,37 @@ func (kin *kafkaIn) consume(consumeCompleted chan bool) {
 				return
 			}
 
-			kin.Connect()
+			// Stop fetching while the queue applies backpressure
+			if !kin.waitForQueue() {
+				continue
+			}
+
+			if kin.Connect() != nil {
+				time.Sleep(time.Second)
+				continue
+			}
 
-			consumer := kin.consumer
+			consumer := kin.getConsumer()
 			if consumer == nil {
 				completed = true
 				return
 			}
 
-			msg, err := (*consumer).Consume()
+			msg, err := consumer.Consume()
+
+			// Consume again the records which could not be buffered
+			if kin.consumerGroup != "" && kin.offsets.rewind() {
+				if l != nil {
+					l.Printf("KAFKAIN could not buffer %q topic messages, consuming again from the first not buffered.\n", kin.topic)
+				}
+				kin.closeConsumer()
+				continue
+			}
+
 			if err != nil {
-				if err != kafka.ErrNoData {
+				if err == kafka.ErrMxClosed {
+					kin.closeConsumer()
+				} else if err != kafka.ErrNoData {
 					l.Printf("Cannot consume KAFKAIN %q topic message: %s\n", kin.topic, err)
 				} else {
 					time.Sleep(10 * time.Microsecond)
@@ -128,8 +286,8 @@ func (kin *kafkaIn) consume(consumeCompleted chan bool) {
 				continue
 			}
 
-			if msg != nil && len(msg.Value) > 0 {
-				kin.queueMessage(msg.Value, maxMessageSize)
+			if msg != nil {
+				kin.queueKafkaMessage(msg, maxMessageSize)
 			}
 
 			loop++
@@ -141,9 +299,81 @@ func (kin *kafkaIn) consume(consumeCompleted chan bool) {
 	}
 }
 
+func (kin *kafkaIn) queueKafkaMessage(msg *proto.Message, maxMessageSize int) {
+	source := map[string]interface{}{
+		"partition": float64(msg.Partition),
+	}
+
+	if kin.consumerGroup == "" {
+		kin.queueMessageFrom(msg.Value, maxMessageSize, source)
+		return
+	}
+
+	kin.offsets.consumed(msg.Partition, msg.Offset)
+	kin.queueMessageBuffered(msg.Value, maxMessageSize, source,
+		kin.offsets.bufferedFunc(msg.Partition, msg.Offset))
+}
+
+func (kin *kafkaIn) getConsumer() *kafka.Mx {
+	kin.consumerLck.Lock()
+	defer kin.consumerLck.Unlock()
+
+	return kin.consumer
+}
+
+func (kin *kafkaIn) closeConsumer() {
+	kin.consumerLck.Lock()
+	consumer := kin.consumer
+	kin.consumer = nil
+
+	if kin.consumerStop != nil {
+		close(kin.consumerStop)
+		kin.consumerStop = nil
+	}
+	kin.consumerLck.Unlock()
+
+	if consumer != nil {
+		defer recover()
+		consumer.Close()
+	}
+}
+
+// interruptConsumer closes the consumer without releasing it, so the
+// consume loop returns from waiting and recreates it
+func (kin *kafkaIn) interruptConsumer() {
+	consumer := kin.getConsumer()
+	if consumer != nil {
+		defer recover()
+		consumer.Close()
+	}
+}
+
+// commit commits the offsets of the records written into the disk buffer
+func (kin *kafkaIn) commit() {
+	coordinator := kin.coordinator
+	if coordinator == nil {
+		return
+	}
+
+	defer recover()
+
+	l := kin.GetLogger()
+	for partition, offset := range kin.offsets.commits() {
+		err := coordinator.Commit(kin.topic, partition, offset)
+		if err != nil {
+			if l != nil {
+				l.Printf("Cannot commit KAFKAIN offset %d for '%s:%d': %s\n", offset, kin.topic, partition, err)
+			}
+			continue
+		}
+		kin.offsets.committed(partition, offset)
+	}
+}
+
 func (kin *kafkaIn) Connect() error {
 	if kin.broker == nil {
-		kin.consumer = nil
+		kin.closeConsumer()
+		kin.coordinator = nil
 
 		err := kin.dial()
 		if err != nil {
@@ -155,28 +385,211 @@ func (kin *kafkaIn) Connect() error {
 		}
 	}
 
-	if kin.consumer == nil {
-		conf := kafka.NewConsumerConf(kin.topic, kin.partition)
-		conf.StartOffset = int64(kin.offset)
+	if kin.consumerGroup != "" && kin.coordinator == nil {
+		conf := kafka.NewOffsetCoordinatorConf(kin.consumerGroup)
 
-		consumer, err := kin.broker.Consumer(conf)
+		coordinator, err := kin.broker.OffsetCoordinator(conf)
 		if err != nil {
 			l := kin.GetLogger()
 			if l != nil {
-				l.Printf("Cannot create KAFKAIN consumer for '%s:%d', error: %s\n", kin.topic, kin.partition, err)
+				l.Printf("Cannot create KAFKAIN offset coordinator for group '%s': %s\n", kin.consumerGroup, err)
 			}
 			return err
 		}
+		kin.coordinator = coordinator
+	}
 
-		if consumer == nil {
+	if kin.getConsumer() == nil {
+		partitions, err := kin.getPartitions()
+		if err != nil {
 			l := kin.GetLogger()
 			if l != nil {
-				l.Printf("Cannot create KAFKAIN consumer for '%s:%d'\n", kin.topic, kin.partition)
+				l.Printf("Cannot get KAFKAIN partitions of '%s': %s\n", kin.topic, err)
 			}
 			return err
 		}
 
-		kin.consumer = &consumer
+		stop := make(chan struct{})
+
+		consumers := make([]kafka.Consumer, 0, len(partitions))
+		for _, partition := range partitions {
+			consumer, err := kin.newConsumer(partition, stop)
+			if err != nil {
+				l := kin.GetLogger()
+				if l != nil {
+					l.Printf("Cannot create KAFKAIN consumer for '%s:%d', error: %s\n", kin.topic, partition, err)
+				}
+				return err
+			}
+			consumers = append(consumers, consumer)
+		}
+
+		kin.consumerLck.Lock()
+		kin.consumer = kafka.Merge(consumers...)
+		kin.consumerStop = stop
+		kin.consumerLck.Unlock()
 	}
 	return nil
 }
+
+func (kin *kafkaIn) getPartitions() ([]int32, error) {
+	if !kin.allPartitions {
+		return kin.partitions, nil
+	}
+
+	count, err := kin.broker.PartitionCount(kin.topic)
+	if err != nil {
+		return nil, err
+	}
+
+	partitions := make([]int32, count)
+	for i := range partitions {
+		partitions[i] = int32(i)
+	}
+	return partitions, nil
+}
+
+// newConsumer creates the consumer of the partition starting from the offset
+// it is left, the committed offset, the start time or the offset param
+func (kin *kafkaIn) newConsumer(partition int32, stop chan struct{}) (kafka.Consumer, error) {
+	conf := kafka.NewConsumerConf(kin.topic, partition)
+	conf.StartOffset = int64(kin.offset)
+	conf.RetryLimit = kafkaRetryLimit
+
+	if offset, ok := kin.offsets.startOffset(partition); ok {
+		conf.StartOffset = offset
+	} else if offset, ok := kin.committedOffset(partition); ok {
+		conf.StartOffset = offset
+	} else if kin.startTime > 0 {
+		offset, err := kin.offsetForTime(partition, kin.startTime)
+		if err != nil {
+			return nil, err
+		}
+		conf.StartOffset = offset
+	}
+
+	consumer, err := kin.broker.Consumer(conf)
+	if err == nil && consumer == nil {
+		err = fmt.Errorf("Consumer cannot be created.")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &kafkaPartitionConsumer{Consumer: consumer, stop: stop}, nil
+}
+
+// kafkaPartitionConsumer keeps waiting for the messages of the partition
+// until it is stopped, since a consumer without a retry limit never returns
+// and keeps fetching after the consumers are recreated
+type kafkaPartitionConsumer struct {
+	kafka.Consumer
+	stop chan struct{}
+}
+
+func (pc *kafkaPartitionConsumer) Consume() (*proto.Message, error) {
+	for {
+		msg, err := pc.Consumer.Consume()
+		if err != kafka.ErrNoData {
+			return msg, err
+		}
+
+		select {
+		case <-pc.stop:
+			return nil, err
+		default:
+		}
+	}
+}
+
+// committedOffset returns the offset committed for the consumer group, as
+// Kafka returns -1 and some servers 0 if there is none, 0 is ignored too
+func (kin *kafkaIn) committedOffset(partition int32) (int64, bool) {
+	if kin.coordinator == nil {
+		return 0, false
+	}
+
+	offset, _, err := kin.coordinator.Offset(kin.topic, partition)
+	if err != nil || offset < 1 {
+		return 0, false
+	}
+
+	kin.offsets.committed(partition, offset)
+	return offset, true
+}
+
+// offsetForTime asks the partition leader for the offset of the time, which
+// is the first offset of the last log segment created before the time
+func (kin *kafkaIn) offsetForTime(partition int32, timems int64) (int64, error) {
+	meta, err := kin.broker.Metadata()
+	if err != nil {
+		return 0, err
+	}
+
+	leader := int32(-1)
+	for _, topic := range meta.Topics {
+		if topic.Name == kin.topic {
+			for _, p := range topic.Partitions {
+				if p.ID == partition {
+					leader = p.Leader
+				}
+			}
+		}
+	}
+
+	addr := ""
+	for _, node := range meta.Brokers {
+		if node.NodeID == leader {
+			addr = net.JoinHostPort(node.Host, strconv.Itoa(int(node.Port)))
+		}
+	}
+
+	if addr == "" {
+		return 0, fmt.Errorf("Cannot find the leader of '%s:%d'.", kin.topic, partition)
+	}
+
+	conn, err := net.DialTimeout("tcp", addr, kin.brokerConf.DialTimeout)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(kin.brokerConf.ReadTimeout))
+
+	req := &proto.OffsetReq{
+		ClientID:  kin.brokerConf.ClientID,
+		ReplicaID: -1,
+		Topics: []proto.OffsetReqTopic{
+			{
+				Name: kin.topic,
+				Partitions: []proto.OffsetReqPartition{
+					{ID: partition, TimeMs: timems, MaxOffsets: 1},
+				},
+			},
+		},
+	}
+
+	if _, err = req.WriteTo(conn); err != nil {
+		return 0, err
+	}
+
+	resp, err := proto.ReadOffsetResp(conn)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, topic := range resp.Topics {
+		for _, p := range topic.Partitions {
+			if p.ID == partition {
+				if p.Err != nil {
+					return 0, p.Err
+				}
+				if len(p.Offsets) > 0 {
+					return p.Offsets[0], nil
+				}
+			}
+		}
+	}
+
+	// No segment is created before the time
+	return kin.broker.OffsetEarliest(kin.topic, partition)
+}
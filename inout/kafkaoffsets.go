@@ -0,0 +1,188 @@
+//	The MIT License (MIT)
+//
+//	Copyright (c) 2016, Cagatay Dogan
+//
+//	Permission is hereby granted, free of charge, to any person obtaining a copy
+//	of this software and associated documentation files (the "Software"), to deal
+//	in the Software without restriction, including without limitation the rights
+//	to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+//	copies of the Software, and to permit persons to whom the Software is
+//	furnished to do so, subject to the following conditions:
+//
+//		The above copyright notice and this permission notice shall be included in
+//		all copies or substantial portions of the Software.
+//
+//		THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+//		IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+//		FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+//		AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+//		LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+//		OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+//		THE SOFTWARE.
+
+package inout
+
+import (
+	"sync"
+)
+
+// kafkaOffsets tracks the consumed offsets of the partitions until their
+// records are written into the disk buffer, so the offsets committed never
+// pass a record which is not buffered yet
+type kafkaOffsets struct {
+	sync.Mutex
+	partitions map[int32]*kafkaPartitionOffsets
+}
+
+type kafkaPartitionOffsets struct {
+	gen       int
+	pending   []int64
+	done      map[int64]bool
+	next      int64
+	ready     int64
+	committed int64
+	failed    bool
+}
+
+func newKafkaOffsets() *kafkaOffsets {
+	return &kafkaOffsets{
+		partitions: make(map[int32]*kafkaPartitionOffsets),
+	}
+}
+
+func (ko *kafkaOffsets) get(partition int32) *kafkaPartitionOffsets {
+	po, ok := ko.partitions[partition]
+	if !ok {
+		po = &kafkaPartitionOffsets{
+			done:      make(map[int64]bool),
+			next:      -1,
+			ready:     -1,
+			committed: -1,
+		}
+		ko.partitions[partition] = po
+	}
+	return po
+}
+
+// consumed adds the offset as waiting for its record to be buffered
+func (ko *kafkaOffsets) consumed(partition int32, offset int64) {
+	ko.Lock()
+	defer ko.Unlock()
+
+	po := ko.get(partition)
+	po.pending = append(po.pending, offset)
+	po.next = offset + 1
+}
+
+func (ko *kafkaOffsets) buffered(partition int32, gen int, offset int64, ok bool) {
+	ko.Lock()
+	defer ko.Unlock()
+
+	// The record is consumed before the partition is rewound
+	po := ko.get(partition)
+	if gen != po.gen {
+		return
+	}
+
+	if !ok {
+		po.failed = true
+		return
+	}
+
+	po.done[offset] = true
+	for len(po.pending) > 0 && po.done[po.pending[0]] {
+		delete(po.done, po.pending[0])
+
+		po.ready = po.pending[0] + 1
+		po.pending = po.pending[1:]
+	}
+}
+
+// bufferedFunc returns the callback of the event of the offset
+func (ko *kafkaOffsets) bufferedFunc(partition int32, offset int64) func(ok bool) {
+	ko.Lock()
+	gen := ko.get(partition).gen
+	ko.Unlock()
+
+	return func(ok bool) {
+		ko.buffered(partition, gen, offset, ok)
+	}
+}
+
+// hasFailed returns true if any record of the partitions could not be buffered
+func (ko *kafkaOffsets) hasFailed() bool {
+	ko.Lock()
+	defer ko.Unlock()
+
+	for _, po := range ko.partitions {
+		if po.failed {
+			return true
+		}
+	}
+	return false
+}
+
+// rewind moves the partitions failed to buffer a record back to their first
+// record not buffered, and returns true if the consumers should restart, the
+// callbacks of the records consumed before are ignored
+func (ko *kafkaOffsets) rewind() bool {
+	ko.Lock()
+	defer ko.Unlock()
+
+	rewound := false
+	for _, po := range ko.partitions {
+		if po.failed {
+			if len(po.pending) > 0 {
+				po.next = po.pending[0]
+			}
+
+			po.gen++
+			po.pending = nil
+			po.done = make(map[int64]bool)
+			po.failed = false
+
+			rewound = true
+		}
+	}
+	return rewound
+}
+
+// startOffset returns the offset to consume the partition from after
+// a reconnect or a rewind
+func (ko *kafkaOffsets) startOffset(partition int32) (int64, bool) {
+	ko.Lock()
+	defer ko.Unlock()
+
+	if po, ok := ko.partitions[partition]; ok && po.next > -1 {
+		return po.next, true
+	}
+	return 0, false
+}
+
+// commits returns the offsets of the partitions to be committed, which are
+// the offsets of the next records to consume as Kafka expects
+func (ko *kafkaOffsets) commits() map[int32]int64 {
+	ko.Lock()
+	defer ko.Unlock()
+
+	var result map[int32]int64
+	for partition, po := range ko.partitions {
+		if po.ready > po.committed {
+			if result == nil {
+				result = make(map[int32]int64)
+			}
+			result[partition] = po.ready
+		}
+	}
+	return result
+}
+
+func (ko *kafkaOffsets) committed(partition int32, offset int64) {
+	ko.Lock()
+	defer ko.Unlock()
+
+	po := ko.get(partition)
+	if offset > po.committed {
+		po.committed = offset
+	}
+}
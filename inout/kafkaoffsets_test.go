@@ -0,0 +1,226 @@
+//	The MIT License (MIT)
+//
+//	Copyright (c) 2016, Cagatay Dogan
+//
+//	Permission is hereby granted, free of charge, to any person obtaining a copy
+//	of this software and associated documentation files (the "Software"), to deal
+//	in the Software without restriction, including without limitation the rights
+//	to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+//	copies of the Software, and to permit persons to whom the Software is
+//	furnished to do so, subject to the following conditions:
+//
+//		The above copyright notice and this permission notice shall be included in
+//		all copies or substantial portions of the Software.
+//
+//		THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+//		IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+//		FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+//		AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+//		LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+//		OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+//		THE SOFTWARE.
+
+package inout
+
+import (
+	"testing"
+)
+
+type kafkaOffsetsStep struct {
+	consume []int64 // offsets consumed, their callbacks are kept
+	buffer  []int64 // the last callbacks of the offsets are called with true
+	fail    []int64 // the last callbacks of the offsets are called with false
+	stale   []int64 // the first callbacks of the offsets are called with true
+	stalef  []int64 // the first callbacks of the offsets are called with false
+	rewind  bool
+}
+
+func TestKafkaOffsets(t *testing.T) {
+	tests := []struct {
+		name     string
+		steps    []kafkaOffsetsStep
+		failed   bool
+		rewound  bool
+		commit   int64 // -1 if there is nothing to commit
+		start    int64
+		hasStart bool
+	}{
+		{
+			name:   "nothing buffered",
+			steps:  []kafkaOffsetsStep{{consume: []int64{10, 11, 12}}},
+			commit: -1, start: 13, hasStart: true,
+		},
+		{
+			name: "in order",
+			steps: []kafkaOffsetsStep{
+				{consume: []int64{10, 11, 12}},
+				{buffer: []int64{10, 11, 12}},
+			},
+			commit: 13, start: 13, hasStart: true,
+		},
+		{
+			name: "out of order waits for the first",
+			steps: []kafkaOffsetsStep{
+				{consume: []int64{10, 11, 12}},
+				{buffer: []int64{12, 11}},
+			},
+			commit: -1, start: 13, hasStart: true,
+		},
+		{
+			name: "out of order then the first",
+			steps: []kafkaOffsetsStep{
+				{consume: []int64{10, 11, 12}},
+				{buffer: []int64{12, 10}},
+			},
+			commit: 11, start: 13, hasStart: true,
+		},
+		{
+			name: "failure holds the commit",
+			steps: []kafkaOffsetsStep{
+				{consume: []int64{10, 11, 12}},
+				{buffer: []int64{10, 12}, fail: []int64{11}},
+			},
+			failed: true, commit: 11, start: 13, hasStart: true,
+		},
+		{
+			name: "failure then rewind",
+			steps: []kafkaOffsetsStep{
+				{consume: []int64{10, 11, 12}},
+				{buffer: []int64{10, 12}, fail: []int64{11}},
+				{rewind: true},
+			},
+			rewound: true, commit: 11, start: 11, hasStart: true,
+		},
+		{
+			name: "rewind then consumed again",
+			steps: []kafkaOffsetsStep{
+				{consume: []int64{10, 11, 12}},
+				{buffer: []int64{10}, fail: []int64{11}},
+				{rewind: true},
+				{consume: []int64{11, 12}},
+				{buffer: []int64{11, 12}},
+			},
+			rewound: true, commit: 13, start: 13, hasStart: true,
+		},
+		{
+			name: "stale success after rewind",
+			steps: []kafkaOffsetsStep{
+				{consume: []int64{10, 11, 12}},
+				{fail: []int64{10}},
+				{rewind: true},
+				{consume: []int64{10, 11, 12}},
+				{stale: []int64{11, 12}},
+				{buffer: []int64{10}},
+			},
+			rewound: true, commit: 11, start: 13, hasStart: true,
+		},
+		{
+			name: "stale failure after rewind",
+			steps: []kafkaOffsetsStep{
+				{consume: []int64{10, 11, 12}},
+				{fail: []int64{10}},
+				{rewind: true},
+				{consume: []int64{10, 11, 12}},
+				{stalef: []int64{11, 12}},
+				{buffer: []int64{10, 11, 12}},
+			},
+			rewound: true, commit: 13, start: 13, hasStart: true,
+		},
+		{
+			name: "rewind without failure",
+			steps: []kafkaOffsetsStep{
+				{consume: []int64{10, 11}},
+				{buffer: []int64{10}},
+				{rewind: true},
+			},
+			commit: 11, start: 12, hasStart: true,
+		},
+	}
+
+	const partition = int32(0)
+
+	for _, tt := range tests {
+		ko := newKafkaOffsets()
+		callbacks := make(map[int64][]func(ok bool))
+
+		call := func(offset int64, first, ok bool) {
+			list := callbacks[offset]
+			if len(list) == 0 {
+				t.Fatalf("%s: no callback for offset %d", tt.name, offset)
+			}
+
+			if first {
+				list[0](ok)
+				callbacks[offset] = list[1:]
+			} else {
+				list[len(list)-1](ok)
+				callbacks[offset] = list[:len(list)-1]
+			}
+		}
+
+		rewound := false
+		for _, step := range tt.steps {
+			for _, offset := range step.consume {
+				ko.consumed(partition, offset)
+				callbacks[offset] = append(callbacks[offset], ko.bufferedFunc(partition, offset))
+			}
+			for _, offset := range step.buffer {
+				call(offset, false, true)
+			}
+			for _, offset := range step.fail {
+				call(offset, false, false)
+			}
+			for _, offset := range step.stale {
+				call(offset, true, true)
+			}
+			for _, offset := range step.stalef {
+				call(offset, true, false)
+			}
+			if step.rewind && ko.rewind() {
+				rewound = true
+			}
+		}
+
+		if failed := ko.hasFailed(); failed != tt.failed {
+			t.Errorf("%s: failed %v, want %v", tt.name, failed, tt.failed)
+		}
+
+		if rewound != tt.rewound {
+			t.Errorf("%s: rewound %v, want %v", tt.name, rewound, tt.rewound)
+		}
+
+		commit, ok := ko.commits()[partition]
+		if !ok {
+			commit = -1
+		}
+		if commit != tt.commit {
+			t.Errorf("%s: commit %d, want %d", tt.name, commit, tt.commit)
+		}
+
+		start, ok := ko.startOffset(partition)
+		if ok != tt.hasStart || start != tt.start {
+			t.Errorf("%s: start offset %d/%v, want %d/%v", tt.name, start, ok, tt.start, tt.hasStart)
+		}
+	}
+}
+
+func TestKafkaOffsetsCommitted(t *testing.T) {
+	ko := newKafkaOffsets()
+	ko.consumed(0, 10)
+	ko.bufferedFunc(0, 10)(true)
+
+	if commits := ko.commits(); commits[0] != 11 {
+		t.Errorf("commit %d, want 11", commits[0])
+	}
+
+	ko.committed(0, 11)
+	if commits := ko.commits(); len(commits) != 0 {
+		t.Errorf("commits %v after commit, want none", commits)
+	}
+
+	// an older commit does not move the committed offset back
+	ko.committed(0, 5)
+	if commits := ko.commits(); len(commits) != 0 {
+		t.Errorf("commits %v after older commit, want none", commits)
+	}
+}
@@ -25,17 +25,98 @@ package inout
 import (
 	"encoding/json"
 	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/ocdogan/fluentgo/config"
 	"github.com/ocdogan/fluentgo/lib"
 	"github.com/optiopay/kafka"
 	"github.com/optiopay/kafka/proto"
 )
 
+type kafkaPartitioner int
+
+const (
+	partitionerFixed kafkaPartitioner = iota
+	partitionerHash
+	partitionerRoundRobin
+	partitionerRandom
+)
+
+const (
+	kafkaBatchSize  = 500
+	kafkaNoKeyGroup = int32(-1)
+)
+
 type kafkaOut struct {
+	sync.Mutex
 	outHandler
 	kafkaIO
-	producer  *kafka.Producer
-	topicPath *lib.JsonPath
+	producer     *kafka.Producer
+	producerConf kafka.ProducerConf
+	topicPath    *lib.JsonPath
+	keyPath      *lib.JsonPath
+	partitioner  kafkaPartitioner
+	batchSize    int
+	topics       map[string]*kafkaTopicProducer
+}
+
+// kafkaTopicProducer distributes the messages of a topic over its partitions,
+// the messages without a key are distributed round-robin by the hash partitioner
+type kafkaTopicProducer struct {
+	partitions  int32
+	distributor kafka.DistributingProducer
+	noKey       kafka.DistributingProducer
+}
+
+// kafkaMessageError reports a message which could not be produced, index
+// is the position of the message in the chunk
+type kafkaMessageError struct {
+	index int
+	topic string
+	key   []byte
+	err   error
+}
+
+// kafkaProduceError reports the messages of the chunk which could not be
+// produced, so only they are sent again
+type kafkaProduceError struct {
+	failed []kafkaMessageError
+}
+
+func (e *kafkaProduceError) Error() string {
+	if len(e.failed) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("Cannot send %d KAFKAOUT messages to '%s': %s", len(e.failed), e.failed[0].topic, e.failed[0].err)
+}
+
+func (e *kafkaProduceError) Failed() []int {
+	failed := make([]int, 0, len(e.failed))
+	for _, me := range e.failed {
+		failed = append(failed, me.index)
+	}
+	return failed
+}
+
+func (e *kafkaProduceError) add(topic string, index int, msg *proto.Message, err error) {
+	e.failed = append(e.failed, kafkaMessageError{
+		index: index,
+		topic: topic,
+		key:   msg.Key,
+		err:   err,
+	})
+}
+
+// failAll reports all messages failed with the error
+func (e *kafkaProduceError) failAll(topic string, messages []*proto.Message, indexes []int, err error) *kafkaProduceError {
+	for i, msg := range messages {
+		e.add(topic, indexes[i], msg, err)
+	}
+	return e
 }
 
 func init() {
@@ -59,10 +140,40 @@ func newKafkaOut(manager InOutManager, params map[string]interface{}) OutSender
 		return nil
 	}
 
+	var keyPath *lib.JsonPath
+
+	key, ok := config.ParamAsString(params, "key")
+	if ok && key != "" {
+		keyPath = lib.NewJsonPath(key)
+		if keyPath == nil {
+			return nil
+		}
+	}
+
+	partitioner, ok := parseKafkaPartitioner(params, keyPath != nil)
+	if !ok {
+		return nil
+	}
+
+	producerConf, ok := parseKafkaProducerConf(params, oh.compressed)
+	if !ok {
+		return nil
+	}
+
+	batchSize, ok := config.ParamAsIntWithLimit(params, "batchSize", 1, 10000)
+	if !ok {
+		batchSize = kafkaBatchSize
+	}
+
 	ko := &kafkaOut{
-		outHandler: *oh,
-		kafkaIO:    *kio,
-		topicPath:  topicPath,
+		outHandler:   *oh,
+		kafkaIO:      *kio,
+		producerConf: producerConf,
+		topicPath:    topicPath,
+		keyPath:      keyPath,
+		partitioner:  partitioner,
+		batchSize:    batchSize,
+		topics:       make(map[string]*kafkaTopicProducer),
 	}
 
 	ko.iotype = "KAFKAOUT"
@@ -71,10 +182,91 @@ func newKafkaOut(manager InOutManager, params map[string]interface{}) OutSender
 	ko.afterCloseFunc = ko.funcAfterClose
 	ko.getDestinationFunc = ko.funcGetObjectName
 	ko.sendChunkFunc = ko.funcPutMessages
+	ko.healthCheckFunc = ko.funcHealthCheck
 
 	return ko
 }
 
+// parseKafkaPartitioner parses the partitioner param, which defaults to hash
+// if a key is given and to the fixed partition param otherwise
+func parseKafkaPartitioner(params map[string]interface{}, hasKey bool) (kafkaPartitioner, bool) {
+	s, _ := config.ParamAsString(params, "partitioner")
+
+	switch strings.ToLower(s) {
+	case "":
+		if hasKey {
+			return partitionerHash, true
+		}
+		return partitionerFixed, true
+	case "fixed":
+		return partitionerFixed, true
+	case "hash":
+		return partitionerHash, hasKey
+	case "roundrobin", "round-robin":
+		return partitionerRoundRobin, true
+	case "random":
+		return partitionerRandom, true
+	}
+	return partitionerFixed, false
+}
+
+// parseKafkaProducerConf parses the compression, requiredAcks and ack timeout
+// params, the compressed param of the older configs maps to gzip since Kafka
+// compresses the message sets itself
+func parseKafkaProducerConf(params map[string]interface{}, compressed bool) (kafka.ProducerConf, bool) {
+	conf := kafka.NewProducerConf()
+
+	s, _ := config.ParamAsString(params, "compression")
+	switch strings.ToLower(s) {
+	case "":
+		if compressed {
+			conf.Compression = proto.CompressionGzip
+		}
+	case "none":
+		conf.Compression = proto.CompressionNone
+	case "gzip":
+		conf.Compression = proto.CompressionGzip
+	case "snappy":
+		conf.Compression = proto.CompressionSnappy
+	default:
+		return conf, false
+	}
+
+	if f, ok := params["requiredAcks"].(float64); ok {
+		if f < -1 || f > 1000 {
+			return conf, false
+		}
+		conf.RequiredAcks = int16(f)
+	} else if s, ok := config.ParamAsString(params, "requiredAcks"); ok && s != "" {
+		switch strings.ToLower(s) {
+		case "all":
+			conf.RequiredAcks = proto.RequiredAcksAll
+		case "local", "leader":
+			conf.RequiredAcks = proto.RequiredAcksLocal
+		case "none":
+			conf.RequiredAcks = proto.RequiredAcksNone
+		default:
+			acks, err := strconv.ParseInt(s, 10, 16)
+			if err != nil || acks < -1 {
+				return conf, false
+			}
+			conf.RequiredAcks = int16(acks)
+		}
+	}
+
+	ackTimeout, ok := config.ParamAsDurationWithLimit(params, "ackTimeoutMSec", 10, 300000)
+	if ok {
+		conf.RequestTimeout = ackTimeout * time.Millisecond
+	}
+
+	retryLimit, ok := config.ParamAsIntWithLimit(params, "produceRetryLimit", 1, 100)
+	if ok {
+		conf.RetryLimit = retryLimit
+	}
+
+	return conf, true
+}
+
 func (ko *kafkaOut) funcAfterClose() {
 	if ko.broker != nil {
 		defer recover()
@@ -82,72 +274,264 @@ func (ko *kafkaOut) funcAfterClose() {
 		broker := *ko.broker
 		ko.broker = nil
 		ko.producer = nil
+		ko.resetTopics()
 
 		broker.Close()
 	}
 }
 
+func (ko *kafkaOut) funcHealthCheck() error {
+	err := ko.Connect()
+	if err != nil {
+		return err
+	}
+
+	_, err = ko.broker.Metadata()
+	if err != nil {
+		// Drop the broker to dial again on the next use
+		ko.funcAfterClose()
+	}
+	return err
+}
+
 func (ko *kafkaOut) funcGetObjectName() string {
 	return "null"
 }
 
-func (ko *kafkaOut) putMessages(messages []ByteArray, topic string) {
+func (ko *kafkaOut) resetTopics() {
+	ko.Lock()
+	defer ko.Unlock()
+
+	ko.topics = make(map[string]*kafkaTopicProducer)
+}
+
+// topicProducer returns the distributing producers of the topic, the
+// partition count is read again after a produce error
+func (ko *kafkaOut) topicProducer(topic string) (*kafkaTopicProducer, error) {
+	ko.Lock()
+	defer ko.Unlock()
+
+	tp, ok := ko.topics[topic]
+	if ok {
+		return tp, nil
+	}
+
+	partitions, err := ko.broker.PartitionCount(topic)
+	if err != nil {
+		return nil, err
+	}
+
+	producer := *ko.producer
+	tp = &kafkaTopicProducer{
+		partitions: partitions,
+		noKey:      kafka.NewRoundRobinProducer(producer, partitions),
+	}
+
+	switch ko.partitioner {
+	case partitionerHash:
+		tp.distributor = kafka.NewHashProducer(producer, lib.MaxInt32(1, partitions))
+	case partitionerRoundRobin:
+		tp.distributor = tp.noKey
+	case partitionerRandom:
+		tp.distributor = kafka.NewRandomProducer(producer, partitions)
+	}
+
+	ko.topics[topic] = tp
+	return tp, nil
+}
+
+func (ko *kafkaOut) dropTopicProducer(topic string) {
+	ko.Lock()
+	defer ko.Unlock()
+
+	delete(ko.topics, topic)
+}
+
+// kafkaHashPartition computes the partition of the key the same way as the
+// hash producer, so the messages of a batch never hash to different partitions
+func kafkaHashPartition(key []byte, partitions int32) int32 {
+	if partitions < 2 {
+		return 0
+	}
+
+	hasher := fnv.New32a()
+	hasher.Write(key)
+
+	sum := int32(hasher.Sum32())
+	if sum < 0 {
+		sum = -sum
+	}
+	return sum % partitions
+}
+
+// putMessages produces the messages, indexes are the positions of the
+// messages in the chunk which are reported for the failed messages
+func (ko *kafkaOut) putMessages(messages []*proto.Message, indexes []int, topic string) error {
 	if len(messages) == 0 {
-		return
+		return nil
 	}
-	defer recover()
+
+	result := &kafkaProduceError{}
 
 	err := ko.Connect()
-	if err != nil || ko.producer == nil {
-		return
+	if err != nil {
+		return result.failAll(topic, messages, indexes, err)
+	}
+
+	if ko.producer == nil {
+		err = fmt.Errorf("Cannot create KAFKAOUT producer for '%s'.", topic)
+		return result.failAll(topic, messages, indexes, err)
+	}
+
+	var tp *kafkaTopicProducer
+	if ko.partitioner != partitionerFixed {
+		tp, err = ko.topicProducer(topic)
+		if err != nil {
+			l := ko.GetLogger()
+			if l != nil {
+				l.Printf("Cannot get KAFKAOUT partitions of '%s': %s\n", topic, err)
+			}
+			return result.failAll(topic, messages, indexes, err)
+		}
+	}
+
+	var groups map[int32][]int
+
+	// Group the message indexes by the partition they are sent to
+	switch ko.partitioner {
+	case partitionerFixed:
+		groups = map[int32][]int{ko.partition: nil}
+	case partitionerHash:
+		groups = make(map[int32][]int)
+	default:
+		groups = map[int32][]int{kafkaNoKeyGroup: nil}
+	}
+
+	for i, msg := range messages {
+		partition := ko.partition
+		switch ko.partitioner {
+		case partitionerHash:
+			partition = kafkaNoKeyGroup
+			if len(msg.Key) > 0 {
+				partition = kafkaHashPartition(msg.Key, tp.partitions)
+			}
+		case partitionerRoundRobin, partitionerRandom:
+			partition = kafkaNoKeyGroup
+		}
+		groups[partition] = append(groups[partition], i)
 	}
 
+	for partition, group := range groups {
+		for start := 0; start < len(group); start += ko.batchSize {
+			if !(ko.Processing() && ko.GetManager() != nil) {
+				return errOutputStopped
+			}
+
+			end := lib.MinInt(start+ko.batchSize, len(group))
+
+			batch := make([]*proto.Message, 0, end-start)
+			for _, i := range group[start:end] {
+				batch = append(batch, messages[i])
+			}
+
+			if err := ko.produce(tp, topic, partition, batch); err != nil {
+				for _, i := range group[start:end] {
+					result.add(topic, indexes[i], messages[i], err)
+				}
+			}
+		}
+	}
+
+	if len(result.failed) == 0 {
+		return nil
+	}
+
+	// The partition count may be changed
+	ko.dropTopicProducer(topic)
+
 	l := ko.GetLogger()
-	producer := *ko.producer
+	if l != nil {
+		for _, me := range result.failed {
+			l.Printf("Cannot send KAFKAOUT message %d to '%s' (key '%s'): %s\n", me.index, topic, me.key, me.err)
+		}
+	}
+	return result
+}
+
+// produce sends the batch in a single request with the producer of the partitioner
+func (ko *kafkaOut) produce(tp *kafkaTopicProducer, topic string, partition int32, batch []*proto.Message) error {
+	var err error
+
+	switch {
+	case ko.partitioner == partitionerFixed:
+		_, err = (*ko.producer).Produce(topic, partition, batch...)
+	case ko.partitioner == partitionerHash && partition == kafkaNoKeyGroup:
+		_, err = tp.noKey.Distribute(topic, batch...)
+	default:
+		_, err = tp.distributor.Distribute(topic, batch...)
+	}
+	return err
+}
 
-	for _, msg := range messages {
-		if len(msg) > 0 {
-			data := []byte(msg)
-			if ko.compressed {
-				data = lib.Compress(data, ko.compressType)
+// newKafkaMessage creates the message with the key evaluated from the
+// message data, data is nil if the message is not parsed yet
+func (ko *kafkaOut) newKafkaMessage(msg ByteArray, data interface{}) *proto.Message {
+	kmsg := &proto.Message{Value: []byte(msg)}
+
+	if ko.keyPath != nil {
+		if data == nil && !ko.keyPath.IsStatic() {
+			if err := json.Unmarshal([]byte(msg), &data); err != nil {
+				return kmsg
 			}
+		}
 
-			kmsg := &proto.Message{Value: data}
-			if _, err := producer.Produce(topic, ko.partition, kmsg); err != nil && l != nil {
-				l.Printf("Cannot send KAFKAOUT message to %s:%d: %s", ko.topic, ko.partition, err)
+		epath, err := ko.keyPath.Eval(data, true)
+		if err == nil && epath != nil {
+			if key, ok := epath.(string); ok && len(key) > 0 {
+				kmsg.Key = []byte(key)
 			}
 		}
 	}
+	return kmsg
 }
 
-func (ko *kafkaOut) funcPutMessages(messages []ByteArray, topic string) {
+func (ko *kafkaOut) funcPutMessages(messages []ByteArray, topic string) error {
 	if len(messages) == 0 {
-		return
+		return nil
 	}
-	defer recover()
 
 	if ko.topicPath.IsStatic() {
 		epath, err := ko.topicPath.Eval(nil, true)
 		if err != nil {
-			return
+			return err
 		}
 
 		if epath != nil {
 			topic, ok := epath.(string)
 			if ok {
-				ko.putMessages(messages, topic)
+				kmsgs := make([]*proto.Message, 0, len(messages))
+				indexes := make([]int, 0, len(messages))
+				for i, msg := range messages {
+					if len(msg) > 0 {
+						kmsgs = append(kmsgs, ko.newKafkaMessage(msg, nil))
+						indexes = append(indexes, i)
+					}
+				}
+				return ko.putMessages(kmsgs, indexes, topic)
 			}
 		}
+		return fmt.Errorf("Cannot resolve KAFKAOUT topic.")
 	} else {
 		var (
 			topic     string
-			topicList []ByteArray
+			topicList []*proto.Message
 			epath     interface{}
 		)
 
-		topics := make(map[string][]ByteArray)
+		topics := make(map[string][]*proto.Message)
+		topicIndexes := make(map[string][]int)
 
-		for _, msg := range messages {
+		for i, msg := range messages {
 			if len(msg) > 0 {
 				var data interface{}
 
@@ -165,21 +549,36 @@ func (ko *kafkaOut) funcPutMessages(messages []ByteArray, topic string) {
 					topic, ok := epath.(string)
 					if ok {
 						topicList, _ = topics[topic]
-						topics[topic] = append(topicList, msg)
+						topics[topic] = append(topicList, ko.newKafkaMessage(msg, data))
+						topicIndexes[topic] = append(topicIndexes[topic], i)
 					}
 				}
 			}
 		}
 
+		result := &kafkaProduceError{}
 		for topic, topicList = range topics {
-			ko.putMessages(messages, topic)
+			err := ko.putMessages(topicList, topicIndexes[topic], topic)
+			if err == errOutputStopped {
+				return err
+			}
+
+			if pe, ok := err.(*kafkaProduceError); ok {
+				result.failed = append(result.failed, pe.failed...)
+			}
+		}
+
+		if len(result.failed) > 0 {
+			return result
 		}
+		return nil
 	}
 }
 
 func (ko *kafkaOut) Connect() error {
 	if ko.broker == nil {
 		ko.producer = nil
+		ko.resetTopics()
 
 		err := ko.dial()
 		if err != nil {
@@ -192,9 +591,9 @@ func (ko *kafkaOut) Connect() error {
 	}
 
 	if ko.producer == nil {
-		producer := ko.broker.Producer(kafka.NewProducerConf())
+		producer := ko.broker.Producer(ko.producerConf)
 		if producer == nil {
-			err := fmt.Errorf("Cannot create KAFKAOUT producer for '%s:%d'", ko.topic, ko.partition)
+			err := fmt.Errorf("Cannot create KAFKAOUT producer for '%s'.", ko.topic)
 
 			l := ko.GetLogger()
 			if l != nil {
@@ -0,0 +1,294 @@
+//	The MIT License (MIT)
+//
+//	Copyright (c) 2016, Cagatay Dogan
+//
+//	Permission is hereby granted, free of charge, to any person obtaining a copy
+//	of this software and associated documentation files (the "Software"), to deal
+//	in the Software without restriction, including without limitation the rights
+//	to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+//	copies of the Software, and to permit persons to whom the Software is
+//	furnished to do so, subject to the following conditions:
+//
+//		The above copyright notice and this permission notice shall be included in
+//		all copies or substantial portions of the Software.
+//
+//		THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+//		IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+//		FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+//		AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+//		LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+//		OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+//		THE SOFTWARE.
+
+package inout
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+type kinesisCheckpoint struct {
+	Sequence string `json:"sequence,omitempty"`
+	Closed   bool   `json:"closed,omitempty"`
+}
+
+// kinesisCheckpointer keeps the sequence numbers of the shards up to which
+// the records are buffered, a closed shard is read to its end, Get returns
+// an error if it cannot tell whether the shard has a checkpoint
+type kinesisCheckpointer interface {
+	Get(shardID string) (kinesisCheckpoint, bool, error)
+	Set(shardID string, sequence string, closed bool)
+	Flush() error
+}
+
+func kinesisCheckpointKey(streamName, shardID string) string {
+	return streamName + "/" + shardID
+}
+
+// kinesisFileCheckpointer keeps the checkpoints of the stream in a local file
+type kinesisFileCheckpointer struct {
+	sync.Mutex
+	filename    string
+	streamName  string
+	checkpoints map[string]*kinesisCheckpoint
+	dirty       bool
+}
+
+func newKinesisFileCheckpointer(filename, streamName string) *kinesisFileCheckpointer {
+	cp := &kinesisFileCheckpointer{
+		filename:    filename,
+		streamName:  streamName,
+		checkpoints: make(map[string]*kinesisCheckpoint),
+	}
+	cp.load()
+
+	return cp
+}
+
+func (cp *kinesisFileCheckpointer) load() {
+	defer recover()
+
+	data, err := ioutil.ReadFile(cp.filename)
+	if err != nil || len(data) == 0 {
+		return
+	}
+
+	var checkpoints map[string]*kinesisCheckpoint
+	if err = json.Unmarshal(data, &checkpoints); err == nil && checkpoints != nil {
+		cp.checkpoints = checkpoints
+	}
+}
+
+func (cp *kinesisFileCheckpointer) Get(shardID string) (kinesisCheckpoint, bool, error) {
+	cp.Lock()
+	defer cp.Unlock()
+
+	c, ok := cp.checkpoints[kinesisCheckpointKey(cp.streamName, shardID)]
+	if !ok || c == nil {
+		return kinesisCheckpoint{}, false, nil
+	}
+	return *c, true, nil
+}
+
+func (cp *kinesisFileCheckpointer) Set(shardID string, sequence string, closed bool) {
+	cp.Lock()
+	defer cp.Unlock()
+
+	key := kinesisCheckpointKey(cp.streamName, shardID)
+
+	c, ok := cp.checkpoints[key]
+	if !ok || c == nil {
+		c = &kinesisCheckpoint{}
+		cp.checkpoints[key] = c
+	}
+
+	if sequence == "" {
+		sequence = c.Sequence
+	}
+
+	if c.Sequence != sequence || c.Closed != closed {
+		c.Sequence = sequence
+		c.Closed = closed
+		cp.dirty = true
+	}
+}
+
+// Flush writes the checkpoints into the file if they are changed, the file
+// is fsynced before it replaces the previous one
+func (cp *kinesisFileCheckpointer) Flush() error {
+	cp.Lock()
+	defer cp.Unlock()
+
+	if !cp.dirty {
+		return nil
+	}
+
+	data, err := json.Marshal(cp.checkpoints)
+	if err != nil {
+		return err
+	}
+
+	os.MkdirAll(filepath.Dir(cp.filename), 0777)
+
+	tmpName := cp.filename + ".tmp"
+
+	f, err := os.OpenFile(tmpName, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmpName, cp.filename)
+	}
+
+	if err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+
+	cp.dirty = false
+	return nil
+}
+
+// kinesisDynamoCheckpointer keeps the checkpoints in a DynamoDB table with
+// the string hash key 'shardId', which is set to 'streamName/shardId'
+type kinesisDynamoCheckpointer struct {
+	sync.Mutex
+	client      *dynamodb.DynamoDB
+	table       string
+	streamName  string
+	checkpoints map[string]*kinesisCheckpoint
+	dirty       map[string]bool
+}
+
+func newKinesisDynamoCheckpointer(client *dynamodb.DynamoDB, table, streamName string) *kinesisDynamoCheckpointer {
+	return &kinesisDynamoCheckpointer{
+		client:      client,
+		table:       table,
+		streamName:  streamName,
+		checkpoints: make(map[string]*kinesisCheckpoint),
+		dirty:       make(map[string]bool),
+	}
+}
+
+func (cp *kinesisDynamoCheckpointer) Get(shardID string) (kinesisCheckpoint, bool, error) {
+	key := kinesisCheckpointKey(cp.streamName, shardID)
+
+	cp.Lock()
+	c, ok := cp.checkpoints[key]
+	cp.Unlock()
+
+	if ok {
+		return *c, true, nil
+	}
+
+	resp, err := cp.client.GetItem(&dynamodb.GetItemInput{
+		TableName:      aws.String(cp.table),
+		ConsistentRead: aws.Bool(true),
+		Key: map[string]*dynamodb.AttributeValue{
+			"shardId": {S: aws.String(key)},
+		},
+	})
+	if err != nil {
+		return kinesisCheckpoint{}, false, err
+	}
+	if resp == nil || len(resp.Item) == 0 {
+		return kinesisCheckpoint{}, false, nil
+	}
+
+	c = &kinesisCheckpoint{}
+	if v, ok := resp.Item["sequenceNumber"]; ok && v.S != nil {
+		c.Sequence = *v.S
+	}
+	if v, ok := resp.Item["closed"]; ok && v.BOOL != nil {
+		c.Closed = *v.BOOL
+	}
+
+	cp.Lock()
+	defer cp.Unlock()
+
+	// Keep the checkpoint set while the item is read
+	if current, ok := cp.checkpoints[key]; ok {
+		return *current, true, nil
+	}
+
+	cp.checkpoints[key] = c
+	return *c, true, nil
+}
+
+func (cp *kinesisDynamoCheckpointer) Set(shardID string, sequence string, closed bool) {
+	cp.Lock()
+	defer cp.Unlock()
+
+	key := kinesisCheckpointKey(cp.streamName, shardID)
+
+	c, ok := cp.checkpoints[key]
+	if !ok {
+		c = &kinesisCheckpoint{}
+		cp.checkpoints[key] = c
+	}
+
+	if sequence == "" {
+		sequence = c.Sequence
+	}
+
+	if c.Sequence != sequence || c.Closed != closed {
+		c.Sequence = sequence
+		c.Closed = closed
+		cp.dirty[key] = true
+	}
+}
+
+// Flush puts the changed checkpoints into the table without holding the
+// lock, the ones failed or changed meanwhile stay dirty for the next flush
+func (cp *kinesisDynamoCheckpointer) Flush() error {
+	cp.Lock()
+	changed := make(map[string]kinesisCheckpoint, len(cp.dirty))
+	for key := range cp.dirty {
+		changed[key] = *cp.checkpoints[key]
+	}
+	cp.Unlock()
+
+	var result error
+	for key, c := range changed {
+		item := map[string]*dynamodb.AttributeValue{
+			"shardId": {S: aws.String(key)},
+			"closed":  {BOOL: aws.Bool(c.Closed)},
+		}
+		if c.Sequence != "" {
+			item["sequenceNumber"] = &dynamodb.AttributeValue{S: aws.String(c.Sequence)}
+		}
+
+		_, err := cp.client.PutItem(&dynamodb.PutItemInput{
+			TableName: aws.String(cp.table),
+			Item:      item,
+		})
+		if err != nil {
+			if result == nil {
+				result = err
+			}
+			continue
+		}
+
+		cp.Lock()
+		if current, ok := cp.checkpoints[key]; ok && *current == c {
+			delete(cp.dirty, key)
+		}
+		cp.Unlock()
+	}
+	return result
+}
@@ -23,21 +23,70 @@
 package inout
 
 import (
+	"math"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/kinesis"
 	"github.com/ocdogan/fluentgo/config"
 	"github.com/ocdogan/fluentgo/lib"
 )
 
+const (
+	kinesisShardRefresh       = 30 * time.Second
+	kinesisCheckpointInterval = time.Second
+	kinesisIdleWait           = time.Second
+	kinesisRecordsWait        = 200 * time.Millisecond
+)
+
+// kinesisIn reads every shard of the stream with a reader per shard, the
+// child shards are read after their parents are read to their ends
 type kinesisIn struct {
+	sync.Mutex
 	kinesisIO
 	inHandler
-	streamName    string
-	shardIterator string
-	limit         int64
+	streamName         string
+	startPosition      string
+	startTimestamp     time.Time
+	limit              int64
+	shardRefresh       time.Duration
+	checkpointInterval time.Duration
+	idleWait           time.Duration
+	checkpoint         kinesisCheckpointer
+	readers            map[string]*kinesisShardReader
+	finished           map[string]bool // true if the shard was followed
+	readersWG          sync.WaitGroup
+}
+
+// kinesisShardReader tracks the records of the shard consumed until they
+// are written into the disk buffer
+type kinesisShardReader struct {
+	sync.Mutex
+	gen          int
+	shardID      string
+	iterator     *string
+	iteratorType string
+	sequence     string
+	lastSequence string
+	pending      []*kinesisPendingRecord
+	ready        string
+	failed       bool
+	ended        bool
+
+	// The shard is followed from its start, a checkpoint or while it is
+	// open, so its children are read from their start
+	followed bool
+}
+
+type kinesisPendingRecord struct {
+	sequence string
+	done     bool
 }
 
 func init() {
@@ -61,118 +110,548 @@ func newKinesisIn(manager InOutManager, params map[string]interface{}) InProvide
 		return nil
 	}
 
-	shardIterator, ok := config.ParamAsString(params, "shardIterator")
-	if !ok || shardIterator == "" {
+	startPosition, startTimestamp, ok := parseKinesisStartPosition(params)
+	if !ok {
 		return nil
 	}
 
 	limit, _ := config.ParamAsInt64(params, "limit")
-	limit = lib.MaxInt64(limit, 1)
+	limit = lib.MinInt64(10000, lib.MaxInt64(limit, 1))
+
+	shardRefresh, ok := config.ParamAsDurationWithLimit(params, "shardRefreshSec", 1, 3600)
+	if ok {
+		shardRefresh *= time.Second
+	} else {
+		shardRefresh = kinesisShardRefresh
+	}
+
+	checkpointInterval, ok := config.ParamAsDurationWithLimit(params, "checkpointIntervalMSec", 100, 300000)
+	if ok {
+		checkpointInterval *= time.Millisecond
+	} else {
+		checkpointInterval = kinesisCheckpointInterval
+	}
+
+	idleWait, ok := config.ParamAsDurationWithLimit(params, "idleWaitMSec", 200, 60000)
+	if ok {
+		idleWait *= time.Millisecond
+	} else {
+		idleWait = kinesisIdleWait
+	}
 
 	ki := &kinesisIn{
-		kinesisIO:     *kio,
-		inHandler:     *ih,
-		limit:         limit,
-		shardIterator: shardIterator,
+		kinesisIO:          *kio,
+		inHandler:          *ih,
+		limit:              limit,
+		streamName:         streamName,
+		startPosition:      startPosition,
+		startTimestamp:     startTimestamp,
+		shardRefresh:       shardRefresh,
+		checkpointInterval: checkpointInterval,
+		idleWait:           idleWait,
+		readers:            make(map[string]*kinesisShardReader),
+		finished:           make(map[string]bool),
+	}
+
+	checkpointTable, _ := config.ParamAsString(params, "checkpointTable")
+	if checkpointTable != "" {
+		client := dynamodb.New(session.New(), kio.getAwsConfig())
+		ki.checkpoint = newKinesisDynamoCheckpointer(client, checkpointTable, streamName)
+	} else {
+		checkpointFile, _ := config.ParamAsString(params, "checkpointFile")
+		if checkpointFile != "" {
+			ki.checkpoint = newKinesisFileCheckpointer(lib.PrepareFile(checkpointFile), streamName)
+		}
 	}
 
 	ki.iotype = "KINESISIN"
+	ki.setTagSource("stream", streamName)
 
 	ki.runFunc = ki.funcReceive
+	ki.afterCloseFunc = ki.funcAfterClose
 
 	return ki
 }
 
+// parseKinesisStartPosition parses the startPosition param, the shardIterator
+// param of the older configs is used if it is one of the positions
+func parseKinesisStartPosition(params map[string]interface{}) (string, time.Time, bool) {
+	position, _ := config.ParamAsString(params, "startPosition")
+	if position == "" {
+		position, _ = config.ParamAsString(params, "shardIterator")
+		position = strings.ToUpper(position)
+
+		if !(position == kinesis.ShardIteratorTypeTrimHorizon ||
+			position == kinesis.ShardIteratorTypeLatest) {
+			position = kinesis.ShardIteratorTypeLatest
+		}
+	}
+
+	var timestamp time.Time
+
+	switch strings.ToUpper(position) {
+	case kinesis.ShardIteratorTypeTrimHorizon:
+		return kinesis.ShardIteratorTypeTrimHorizon, timestamp, true
+	case kinesis.ShardIteratorTypeLatest:
+		return kinesis.ShardIteratorTypeLatest, timestamp, true
+	case kinesis.ShardIteratorTypeAtTimestamp:
+		if s, ok := config.ParamAsString(params, "startTimestamp"); ok && s != "" {
+			t, err := time.Parse(time.RFC3339, s)
+			if err != nil {
+				return "", timestamp, false
+			}
+			return kinesis.ShardIteratorTypeAtTimestamp, t, true
+		}
+
+		ms, ok := config.ParamAsInt64WithLimit(params, "startTimestamp", 1, math.MaxInt64)
+		if !ok {
+			return "", timestamp, false
+		}
+		return kinesis.ShardIteratorTypeAtTimestamp, time.Unix(0, ms*int64(time.Millisecond)), true
+	}
+	return "", timestamp, false
+}
+
+func (ki *kinesisIn) funcAfterClose() {
+	ki.flushCheckpoint()
+}
+
+func (ki *kinesisIn) flushCheckpoint() {
+	if ki.checkpoint != nil {
+		defer recover()
+
+		if err := ki.checkpoint.Flush(); err != nil {
+			l := ki.GetLogger()
+			if l != nil {
+				l.Printf("Cannot save KINESISIN checkpoints of '%s': %s\n", ki.streamName, err)
+			}
+		}
+	}
+}
+
 func (ki *kinesisIn) funcReceive() {
 	defer ki.InformStop()
 	ki.InformStart()
 
-	completed := false
+	completed := ki.completed
 
-	maxMessageSize := ki.getMaxMessageSize()
+	shardTicker := time.NewTicker(ki.shardRefresh)
+	defer shardTicker.Stop()
 
-	params := &kinesis.GetRecordsInput{
-		ShardIterator: aws.String(ki.shardIterator), // Required
-		Limit:         aws.Int64(ki.limit),
-	}
+	checkpointTicker := time.NewTicker(ki.checkpointInterval)
+	defer checkpointTicker.Stop()
 
-	loop := 0
-	l := ki.GetLogger()
+	defer func() {
+		ki.readersWG.Wait()
+		ki.flushCheckpoint()
+	}()
+
+	ki.refreshShards(completed)
 
-	for !completed {
+	for {
 		select {
-		case <-ki.completed:
-			completed = true
+		case <-completed:
 			ki.Close()
 			return
-		default:
-			if completed {
-				return
-			}
+		case <-shardTicker.C:
+			ki.refreshShards(completed)
+		case <-checkpointTicker.C:
+			ki.flushCheckpoint()
+		}
 
-			ki.Connect()
+		if !ki.Processing() {
+			return
+		}
+	}
+}
 
-			client := ki.client
-			if client == nil {
-				completed = true
-				return
-			}
+// refreshShards lists the shards of the stream and starts the readers of
+// the shards not read yet whose parents are read to their ends
+func (ki *kinesisIn) refreshShards(completed chan bool) {
+	defer recover()
+
+	client := ki.Connect()
+	if client == nil {
+		return
+	}
+
+	var shards []*kinesis.Shard
+
+	err := client.DescribeStreamPages(&kinesis.DescribeStreamInput{
+		StreamName: aws.String(ki.streamName),
+	}, func(page *kinesis.DescribeStreamOutput, lastPage bool) bool {
+		if page.StreamDescription != nil {
+			shards = append(shards, page.StreamDescription.Shards...)
+		}
+		return true
+	})
 
-			resp, err := client.GetRecords(params)
+	if err != nil {
+		l := ki.GetLogger()
+		if l != nil {
+			l.Printf("Cannot list KINESISIN shards of '%s': %s\n", ki.streamName, err)
+		}
+		return
+	}
+
+	listed := make(map[string]bool, len(shards))
+	for _, shard := range shards {
+		listed[aws.StringValue(shard.ShardId)] = true
+	}
+
+	ki.Lock()
+	defer ki.Unlock()
+
+	for _, shard := range shards {
+		shardID := aws.StringValue(shard.ShardId)
+		if shardID == "" || ki.readers[shardID] != nil {
+			continue
+		}
+		if _, ok := ki.finished[shardID]; ok {
+			continue
+		}
+
+		var checkpoint kinesisCheckpoint
+		if ki.checkpoint != nil {
+			// Reading without the checkpoint would start the shard over
+			cp, ok, err := ki.checkpoint.Get(shardID)
 			if err != nil {
+				l := ki.GetLogger()
 				if l != nil {
-					l.Println(err)
+					l.Printf("Cannot get KINESISIN checkpoint of shard '%s', it will be retried: %s\n", shardID, err)
 				}
-				time.Sleep(100 * time.Microsecond)
 				continue
 			}
 
-			if resp == nil {
-				time.Sleep(100 * time.Microsecond)
+			if ok && cp.Closed {
+				ki.finished[shardID] = true
 				continue
 			}
+			checkpoint = cp
+		}
 
-			params.ShardIterator = resp.NextShardIterator
-			if params.ShardIterator == nil {
-				time.Sleep(100 * time.Microsecond)
+		// The parents expired out of the stream are not waited for
+		parentsFollowed, waitParents := false, false
+		for _, parent := range []*string{shard.ParentShardId, shard.AdjacentParentShardId} {
+			parentID := aws.StringValue(parent)
+			if parentID == "" || !listed[parentID] {
 				continue
 			}
 
-			if len(resp.Records) == 0 {
-				time.Sleep(100 * time.Microsecond)
+			if followed, ok := ki.finished[parentID]; !ok {
+				waitParents = true
+			} else if followed {
+				parentsFollowed = true
+			}
+		}
+
+		if waitParents {
+			continue
+		}
+
+		r := &kinesisShardReader{
+			shardID:      shardID,
+			iteratorType: ki.startPosition,
+		}
+
+		if checkpoint.Sequence != "" {
+			r.iteratorType = kinesis.ShardIteratorTypeAfterSequenceNumber
+			r.sequence = checkpoint.Sequence
+			r.ready = checkpoint.Sequence
+		} else if parentsFollowed {
+			// Continue from where the parents end, the parents which were
+			// closed before the start position leave it to the children
+			r.iteratorType = kinesis.ShardIteratorTypeTrimHorizon
+		}
+		r.followed = r.iteratorType == kinesis.ShardIteratorTypeAfterSequenceNumber ||
+			r.iteratorType == kinesis.ShardIteratorTypeTrimHorizon
+
+		ki.readers[shardID] = r
+
+		ki.readersWG.Add(1)
+		go ki.readShard(r, completed)
+	}
+}
+
+func (ki *kinesisIn) shardFinished(r *kinesisShardReader) {
+	ki.Lock()
+	defer ki.Unlock()
+
+	delete(ki.readers, r.shardID)
+	ki.finished[r.shardID] = r.followed
+}
+
+func (ki *kinesisIn) readShard(r *kinesisShardReader, completed chan bool) {
+	defer func() {
+		recover()
+		ki.readersWG.Done()
+	}()
+
+	l := ki.GetLogger()
+	maxMessageSize := ki.getMaxMessageSize()
+
+	source := map[string]interface{}{
+		"shard": r.shardID,
+	}
+
+	for {
+		select {
+		case <-completed:
+			return
+		default:
+		}
+
+		if !ki.Processing() {
+			return
+		}
+
+		// Read again the records which could not be buffered
+		if r.rewind() && l != nil {
+			l.Printf("KINESISIN could not buffer '%s:%s' records, reading again from the first not buffered.\n", ki.streamName, r.shardID)
+		}
+
+		if r.isEnded() {
+			if sequence, drained := r.drained(); drained {
+				// Not to read the children from their start after a restart,
+				// a shard which was not followed is not checkpointed closed
+				if ki.checkpoint != nil && r.followed {
+					ki.checkpoint.Set(r.shardID, sequence, true)
+				}
+				ki.shardFinished(r)
+				return
+			}
+
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+
+		// Stop fetching while the queue applies backpressure
+		if !ki.waitForQueue() {
+			return
+		}
+
+		client := ki.Connect()
+		if client == nil {
+			return
+		}
+
+		if r.iterator == nil {
+			iterator, err := ki.getShardIterator(client, r)
+			if err != nil {
+				if l != nil {
+					l.Printf("Cannot get KINESISIN iterator of '%s:%s': %s\n", ki.streamName, r.shardID, err)
+				}
+				time.Sleep(ki.idleWait)
 				continue
 			}
+			r.iterator = iterator
+		}
 
-			var wg sync.WaitGroup
-			for _, r := range resp.Records {
-				wg.Add(1)
-				go func(kin *kinesisIn, rec *kinesis.Record, wg *sync.WaitGroup) {
-					defer wg.Done()
-
-					if err == nil {
-						kin.queueMessage(rec.Data, maxMessageSize)
-					} else {
-						l := ki.GetLogger()
-						if l != nil {
-							l.Println(err)
-						}
-					}
-				}(ki, r, &wg)
+		resp, err := client.GetRecords(&kinesis.GetRecordsInput{
+			ShardIterator: r.iterator,
+			Limit:         aws.Int64(ki.limit),
+		})
+
+		if err != nil {
+			if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "ExpiredIteratorException" {
+				r.continueAfterLast()
+			} else if l != nil {
+				l.Printf("Cannot read KINESISIN records of '%s:%s': %s\n", ki.streamName, r.shardID, err)
 			}
+			time.Sleep(ki.idleWait)
+			continue
+		}
+
+		for _, rec := range resp.Records {
+			buffered := r.consumed(aws.StringValue(rec.SequenceNumber), ki.checkpoint)
 
-			wg.Wait()
+			// Split the records aggregated by the producer
+			if records, ok := lib.KPLDeaggregate(rec.Data); ok {
+				if len(records) == 0 {
+					buffered(true)
+					continue
+				}
 
-			loop++
-			if loop%100 == 0 {
-				loop = 0
-				time.Sleep(time.Millisecond)
+				buffered = kinesisAggregateBuffered(len(records), buffered)
+				for _, ar := range records {
+					ki.queueMessageBuffered(ar.Data, maxMessageSize, source, buffered)
+				}
+				continue
 			}
+
+			ki.queueMessageBuffered(rec.Data, maxMessageSize, source, buffered)
+		}
+
+		// A shard closed before the start position ends at the first read
+		if len(resp.Records) > 0 || resp.NextShardIterator != nil {
+			r.followed = true
+		}
+
+		r.iterator = resp.NextShardIterator
+		if r.iterator == nil {
+			r.setEnded()
+			continue
+		}
+
+		if len(resp.Records) == 0 {
+			time.Sleep(ki.idleWait)
+		} else {
+			// Kinesis allows 5 reads per second on a shard
+			time.Sleep(kinesisRecordsWait)
 		}
 	}
 }
 
-func (ki *kinesisIn) Connect() {
-	if ki.client == nil && ki.connFunc == nil {
-		ki.connFunc()
+// kinesisAggregateBuffered returns the callback of the user records of an
+// aggregated record, which calls buffered once all of them are buffered
+func kinesisAggregateBuffered(count int, buffered func(ok bool)) func(ok bool) {
+	remaining := int32(count)
+	failed := int32(0)
+
+	return func(ok bool) {
+		if !ok {
+			atomic.StoreInt32(&failed, 1)
+		}
+
+		if atomic.AddInt32(&remaining, -1) == 0 {
+			buffered(atomic.LoadInt32(&failed) == 0)
+		}
 	}
 }
+
+func (ki *kinesisIn) getShardIterator(client *kinesis.Kinesis, r *kinesisShardReader) (*string, error) {
+	params := &kinesis.GetShardIteratorInput{
+		StreamName:        aws.String(ki.streamName),
+		ShardId:           aws.String(r.shardID),
+		ShardIteratorType: aws.String(r.iteratorType),
+	}
+
+	switch r.iteratorType {
+	case kinesis.ShardIteratorTypeAtSequenceNumber, kinesis.ShardIteratorTypeAfterSequenceNumber:
+		params.StartingSequenceNumber = aws.String(r.sequence)
+	case kinesis.ShardIteratorTypeAtTimestamp:
+		params.Timestamp = aws.Time(ki.startTimestamp)
+	}
+
+	resp, err := client.GetShardIterator(params)
+	if err != nil {
+		return nil, err
+	}
+	return resp.ShardIterator, nil
+}
+
+func (ki *kinesisIn) Connect() *kinesis.Kinesis {
+	if ki.client == nil && ki.connFunc != nil {
+		ki.Lock()
+		defer ki.Unlock()
+
+		if ki.client == nil {
+			ki.connFunc()
+		}
+	}
+	return ki.client
+}
+
+// consumed adds the record as waiting to be buffered, and returns its
+// callback which checkpoints the records buffered in order
+func (r *kinesisShardReader) consumed(sequence string, checkpoint kinesisCheckpointer) func(ok bool) {
+	r.Lock()
+	defer r.Unlock()
+
+	rec := &kinesisPendingRecord{sequence: sequence}
+
+	r.pending = append(r.pending, rec)
+	r.lastSequence = sequence
+
+	gen := r.gen
+	return func(ok bool) {
+		r.Lock()
+		defer r.Unlock()
+
+		// The record is read before the reader is rewound
+		if gen != r.gen {
+			return
+		}
+
+		if !ok {
+			r.failed = true
+			return
+		}
+
+		rec.done = true
+
+		ready := ""
+		for len(r.pending) > 0 && r.pending[0].done {
+			ready = r.pending[0].sequence
+			r.pending = r.pending[1:]
+		}
+
+		if ready != "" {
+			r.ready = ready
+			if checkpoint != nil {
+				checkpoint.Set(r.shardID, ready, false)
+			}
+		}
+	}
+}
+
+// rewind moves the reader back to the first record not buffered if any
+// record could not be buffered, the callbacks of the records read before
+// are ignored
+func (r *kinesisShardReader) rewind() bool {
+	r.Lock()
+	defer r.Unlock()
+
+	if !r.failed {
+		return false
+	}
+
+	if len(r.pending) > 0 {
+		r.iteratorType = kinesis.ShardIteratorTypeAtSequenceNumber
+		r.sequence = r.pending[0].sequence
+	}
+
+	r.gen++
+	r.iterator = nil
+	r.pending = nil
+	r.failed = false
+	r.ended = false
+
+	r.lastSequence = ""
+	return true
+}
+
+// continueAfterLast gets a new iterator after the last record read, as
+// the iterators expire in five minutes
+func (r *kinesisShardReader) continueAfterLast() {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.lastSequence != "" {
+		r.iteratorType = kinesis.ShardIteratorTypeAfterSequenceNumber
+		r.sequence = r.lastSequence
+	}
+	r.iterator = nil
+}
+
+func (r *kinesisShardReader) setEnded() {
+	r.Lock()
+	defer r.Unlock()
+
+	r.ended = true
+}
+
+func (r *kinesisShardReader) isEnded() bool {
+	r.Lock()
+	defer r.Unlock()
+
+	return r.ended
+}
+
+// drained returns the last sequence buffered if all records read are buffered
+func (r *kinesisShardReader) drained() (string, bool) {
+	r.Lock()
+	defer r.Unlock()
+
+	return r.ready, len(r.pending) == 0 && !r.failed
+}
@@ -0,0 +1,214 @@
+//	The MIT License (MIT)
+//
+//	Copyright (c) 2016, Cagatay Dogan
+//
+//	Permission is hereby granted, free of charge, to any person obtaining a copy
+//	of this software and associated documentation files (the "Software"), to deal
+//	in the Software without restriction, including without limitation the rights
+//	to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+//	copies of the Software, and to permit persons to whom the Software is
+//	furnished to do so, subject to the following conditions:
+//
+//		The above copyright notice and this permission notice shall be included in
+//		all copies or substantial portions of the Software.
+//
+//		THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+//		IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+//		FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+//		AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+//		LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+//		OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+//		THE SOFTWARE.
+
+package inout
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+type testCheckpointer struct {
+	sequence string
+}
+
+func (c *testCheckpointer) Get(shardID string) (kinesisCheckpoint, bool, error) {
+	return kinesisCheckpoint{Sequence: c.sequence}, c.sequence != "", nil
+}
+
+func (c *testCheckpointer) Set(shardID string, sequence string, closed bool) {
+	c.sequence = sequence
+}
+
+func (c *testCheckpointer) Flush() error {
+	return nil
+}
+
+type kinesisReaderStep struct {
+	consume []string // sequences read, their callbacks are kept
+	buffer  []string // the last callbacks of the sequences are called with true
+	fail    []string // the last callbacks of the sequences are called with false
+	stale   []string // the first callbacks of the sequences are called with true
+	stalef  []string // the first callbacks of the sequences are called with false
+	rewind  bool
+}
+
+func TestKinesisShardReader(t *testing.T) {
+	tests := []struct {
+		name       string
+		steps      []kinesisReaderStep
+		rewound    bool
+		checkpoint string
+		drained    bool
+		sequence   string // the sequence to read again from after a rewind
+	}{
+		{
+			name:  "nothing buffered",
+			steps: []kinesisReaderStep{{consume: []string{"1", "2", "3"}}},
+		},
+		{
+			name: "in order",
+			steps: []kinesisReaderStep{
+				{consume: []string{"1", "2", "3"}},
+				{buffer: []string{"1", "2", "3"}},
+			},
+			checkpoint: "3", drained: true,
+		},
+		{
+			name: "out of order waits for the first",
+			steps: []kinesisReaderStep{
+				{consume: []string{"1", "2", "3"}},
+				{buffer: []string{"3", "2"}},
+			},
+		},
+		{
+			name: "out of order then the first",
+			steps: []kinesisReaderStep{
+				{consume: []string{"1", "2", "3"}},
+				{buffer: []string{"3", "1"}},
+			},
+			checkpoint: "1",
+		},
+		{
+			name: "failure then rewind",
+			steps: []kinesisReaderStep{
+				{consume: []string{"1", "2", "3"}},
+				{buffer: []string{"1", "3"}, fail: []string{"2"}},
+				{rewind: true},
+			},
+			rewound: true, checkpoint: "1", drained: true, sequence: "2",
+		},
+		{
+			name: "rewind then read again",
+			steps: []kinesisReaderStep{
+				{consume: []string{"1", "2", "3"}},
+				{buffer: []string{"1"}, fail: []string{"2"}},
+				{rewind: true},
+				{consume: []string{"2", "3"}},
+				{buffer: []string{"2", "3"}},
+			},
+			rewound: true, checkpoint: "3", drained: true, sequence: "2",
+		},
+		{
+			name: "stale success after rewind",
+			steps: []kinesisReaderStep{
+				{consume: []string{"1", "2", "3"}},
+				{fail: []string{"1"}},
+				{rewind: true},
+				{consume: []string{"1", "2", "3"}},
+				{stale: []string{"2", "3"}},
+				{buffer: []string{"1"}},
+			},
+			rewound: true, checkpoint: "1", sequence: "1",
+		},
+		{
+			name: "stale failure after rewind",
+			steps: []kinesisReaderStep{
+				{consume: []string{"1", "2", "3"}},
+				{fail: []string{"1"}},
+				{rewind: true},
+				{consume: []string{"1", "2", "3"}},
+				{stalef: []string{"2", "3"}},
+				{buffer: []string{"1", "2", "3"}},
+			},
+			rewound: true, checkpoint: "3", drained: true, sequence: "1",
+		},
+		{
+			name: "rewind without failure",
+			steps: []kinesisReaderStep{
+				{consume: []string{"1", "2"}},
+				{buffer: []string{"1"}},
+				{rewind: true},
+			},
+			checkpoint: "1",
+		},
+	}
+
+	for _, tt := range tests {
+		cp := &testCheckpointer{}
+		r := &kinesisShardReader{
+			shardID:      "shardId-000000000000",
+			iteratorType: kinesis.ShardIteratorTypeTrimHorizon,
+		}
+		callbacks := make(map[string][]func(ok bool))
+
+		call := func(sequence string, first, ok bool) {
+			list := callbacks[sequence]
+			if len(list) == 0 {
+				t.Fatalf("%s: no callback for sequence %s", tt.name, sequence)
+			}
+
+			if first {
+				list[0](ok)
+				callbacks[sequence] = list[1:]
+			} else {
+				list[len(list)-1](ok)
+				callbacks[sequence] = list[:len(list)-1]
+			}
+		}
+
+		rewound := false
+		for _, step := range tt.steps {
+			for _, sequence := range step.consume {
+				callbacks[sequence] = append(callbacks[sequence], r.consumed(sequence, cp))
+			}
+			for _, sequence := range step.buffer {
+				call(sequence, false, true)
+			}
+			for _, sequence := range step.fail {
+				call(sequence, false, false)
+			}
+			for _, sequence := range step.stale {
+				call(sequence, true, true)
+			}
+			for _, sequence := range step.stalef {
+				call(sequence, true, false)
+			}
+			if step.rewind && r.rewind() {
+				rewound = true
+			}
+		}
+
+		if rewound != tt.rewound {
+			t.Errorf("%s: rewound %v, want %v", tt.name, rewound, tt.rewound)
+		}
+
+		if cp.sequence != tt.checkpoint {
+			t.Errorf("%s: checkpoint %q, want %q", tt.name, cp.sequence, tt.checkpoint)
+		}
+
+		ready, drained := r.drained()
+		if drained != tt.drained || ready != tt.checkpoint {
+			t.Errorf("%s: drained %q/%v, want %q/%v", tt.name, ready, drained, tt.checkpoint, tt.drained)
+		}
+
+		if tt.sequence != "" {
+			if r.iteratorType != kinesis.ShardIteratorTypeAtSequenceNumber || r.sequence != tt.sequence {
+				t.Errorf("%s: reads again from %s %q, want %s %q", tt.name, r.iteratorType, r.sequence,
+					kinesis.ShardIteratorTypeAtSequenceNumber, tt.sequence)
+			}
+		} else if r.iteratorType != kinesis.ShardIteratorTypeTrimHorizon {
+			t.Errorf("%s: iterator type %s, want %s", tt.name, r.iteratorType, kinesis.ShardIteratorTypeTrimHorizon)
+		}
+	}
+}
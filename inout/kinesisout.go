@@ -23,7 +23,9 @@
 package inout
 
 import (
+	"fmt"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/kinesis"
@@ -31,6 +33,15 @@ import (
 	"github.com/ocdogan/fluentgo/lib"
 )
 
+const (
+	kinesisMaxBatchCount    = 500
+	kinesisMaxBatchSize     = 5 * 1024 * 1024
+	kinesisAggregateMaxSize = 50 * 1024
+	kinesisPutRetryAttempts = 5
+	kinesisPutRetryWait     = 100 * time.Millisecond
+	kinesisPutRetryMaxWait  = 5 * time.Second
+)
+
 type kinesisOut struct {
 	outHandler
 	kinesisIO
@@ -38,6 +49,38 @@ type kinesisOut struct {
 	explicitHashKeys []string
 	streamName       *lib.JsonPath
 	partitionKey     *lib.JsonPath
+	aggregate        bool
+	aggregateMaxSize int
+	putRetry         *retryPolicy
+}
+
+// kinesisRecord is a record to put with the positions of its messages in
+// the chunk, an aggregated record carries more than one message
+type kinesisRecord struct {
+	entry   *kinesis.PutRecordsRequestEntry
+	indexes []int
+}
+
+// kinesisPutError reports the messages of the chunk which could not be put,
+// so only they are sent again
+type kinesisPutError struct {
+	failed []int
+	err    error
+}
+
+func (e *kinesisPutError) Error() string {
+	return fmt.Sprintf("KINESISOUT failed to put %d messages: %s", len(e.failed), e.err)
+}
+
+func (e *kinesisPutError) Failed() []int {
+	return e.failed
+}
+
+func (e *kinesisPutError) add(indexes []int, err error) {
+	e.failed = append(e.failed, indexes...)
+	if e.err == nil {
+		e.err = err
+	}
 }
 
 func init() {
@@ -91,12 +134,41 @@ func newKinesisOut(manager InOutManager, params map[string]interface{}) OutSende
 		return nil
 	}
 
+	aggregate, _ := config.ParamAsBool(params, "aggregate")
+
+	aggregateMaxSize, ok := config.ParamAsIntWithLimit(params, "aggregateMaxSize", 1024, lib.KPLMaxRecordSize)
+	if !ok {
+		aggregateMaxSize = kinesisAggregateMaxSize
+	}
+
+	// Retries of the records failed in a PutRecords call, as throttling
+	putRetry := &retryPolicy{
+		attempts:    kinesisPutRetryAttempts,
+		wait:        kinesisPutRetryWait,
+		maxWait:     kinesisPutRetryMaxWait,
+		budgetStart: time.Now(),
+	}
+
+	if attempts, ok := config.ParamAsIntWithLimit(params, "putRetryAttempts", 1, 100); ok {
+		putRetry.attempts = attempts
+	}
+
+	if wait, ok := config.ParamAsDurationWithLimit(params, "putRetryWaitMSec", 1, 60000); ok {
+		putRetry.wait = wait * time.Millisecond
+		if putRetry.maxWait < putRetry.wait {
+			putRetry.maxWait = putRetry.wait
+		}
+	}
+
 	ko := &kinesisOut{
 		outHandler:       *oh,
 		kinesisIO:        *kio,
 		explicitHashKeys: explicitHashKeys,
 		partitionKey:     partitionKey,
 		streamName:       streamName,
+		aggregate:        aggregate,
+		aggregateMaxSize: aggregateMaxSize,
+		putRetry:         putRetry,
 	}
 
 	ko.iotype = "KINESISOUT"
@@ -120,83 +192,219 @@ func (ko *kinesisOut) funcGetObjectName() string {
 	return "null"
 }
 
-func (ko *kinesisOut) putMessages(messages []ByteArray, partitionKey, streamName string) {
-	if len(messages) == 0 {
-		return
+func (ko *kinesisOut) nextHashKey() *string {
+	keyLen := int64(len(ko.explicitHashKeys))
+	if keyLen == 0 {
+		return nil
 	}
 
-	defer recover()
-
-	client := ko.getClient()
-	if client == nil {
-		return
+	if keyLen == 1 {
+		return aws.String(ko.explicitHashKeys[0])
 	}
 
+	hashKey := ko.explicitHashKeys[ko.hashKeyIndex]
+	ko.hashKeyIndex = (ko.hashKeyIndex + 1) % keyLen
+
+	return aws.String(hashKey)
+}
+
+func kinesisRecordSize(rec *kinesis.PutRecordsRequestEntry) int {
+	return len(rec.Data) + len(aws.StringValue(rec.PartitionKey))
+}
+
+// newRecords creates the records of the messages, the messages are packed
+// into aggregated records if aggregation is enabled
+func (ko *kinesisOut) newRecords(messages []ByteArray, indexes []int, partitionKey string) []*kinesisRecord {
 	var (
-		data    []byte
-		hashKey string
-		records []*kinesis.PutRecordsRequestEntry
+		records    []*kinesisRecord
+		aggregator *lib.KPLAggregator
+		aggregated []int
 	)
 
-	keyLen := int64(len(ko.explicitHashKeys))
+	if ko.aggregate {
+		aggregator = lib.NewKPLAggregator(partitionKey)
+	}
+
+	addRecord := func(data []byte, indexes []int) {
+		records = append(records, &kinesisRecord{
+			entry: &kinesis.PutRecordsRequestEntry{
+				Data:            data,                     // Required
+				PartitionKey:    aws.String(partitionKey), // Required
+				ExplicitHashKey: ko.nextHashKey(),
+			},
+			indexes: indexes,
+		})
+	}
 
-	for _, msg := range messages {
+	for i, msg := range messages {
 		if len(msg) > 0 {
-			data = []byte(msg)
+			data := []byte(msg)
 			if ko.compressed {
 				data = lib.Compress(data, ko.compressType)
 			}
 
-			rec := &kinesis.PutRecordsRequestEntry{
-				Data:         data,                     // Required
-				PartitionKey: aws.String(partitionKey), // Required
+			if aggregator == nil {
+				addRecord(data, []int{indexes[i]})
+				continue
 			}
 
-			if keyLen > 0 {
-				if keyLen == 1 {
-					rec.ExplicitHashKey = aws.String(ko.explicitHashKeys[0])
-				} else {
-					hashKey = ko.explicitHashKeys[ko.hashKeyIndex]
-					ko.hashKeyIndex = (ko.hashKeyIndex + 1) % keyLen
-
-					rec.ExplicitHashKey = aws.String(hashKey)
-				}
+			if aggregator.Count() > 0 && aggregator.SizeWith(data) > ko.aggregateMaxSize {
+				addRecord(aggregator.Bytes(), aggregated)
+				aggregator.Reset()
+				aggregated = nil
 			}
+			aggregator.Add(data)
+			aggregated = append(aggregated, indexes[i])
+		}
+	}
+
+	if aggregator != nil && aggregator.Count() > 0 {
+		addRecord(aggregator.Bytes(), aggregated)
+	}
+	return records
+}
+
+// putMessages puts the messages in batches within the PutRecords limits,
+// indexes are the positions of the messages in the chunk which are
+// reported for the failed messages
+func (ko *kinesisOut) putMessages(messages []ByteArray, indexes []int, partitionKey, streamName string) error {
+	if len(messages) == 0 {
+		return nil
+	}
+
+	result := &kinesisPutError{}
+
+	client := ko.getClient()
+	if client == nil {
+		result.add(indexes, fmt.Errorf("Cannot create KINESISOUT client."))
+		return result
+	}
+
+	var (
+		batch     []*kinesisRecord
+		batchSize int
+	)
 
-			records = append(records, rec)
+	putBatch := func() {
+		if err := ko.putRecords(client, batch, streamName); err != nil {
+			result.add(err.failed, err.err)
 		}
+		batch, batchSize = nil, 0
+	}
+
+	for _, rec := range ko.newRecords(messages, indexes, partitionKey) {
+		if !ko.Processing() {
+			return errOutputStopped
+		}
+
+		// A record over the limit is never accepted, so it is reported as
+		// failed to end up in the dead letter file
+		size := kinesisRecordSize(rec.entry)
+		if size > lib.KPLMaxRecordSize {
+			result.add(rec.indexes, fmt.Errorf("Record of %d bytes to '%s' exceeds the record size limit.", size, streamName))
+			continue
+		}
+
+		if len(batch) == kinesisMaxBatchCount || batchSize+size > kinesisMaxBatchSize {
+			putBatch()
+		}
+
+		batch = append(batch, rec)
+		batchSize += size
+	}
+
+	if len(batch) > 0 {
+		putBatch()
+	}
+
+	if len(result.failed) > 0 {
+		return result
 	}
+	return nil
+}
+
+// putRecords puts the records, and puts again the ones failed with backoff
+func (ko *kinesisOut) putRecords(client *kinesis.Kinesis, records []*kinesisRecord, streamName string) *kinesisPutError {
+	for retry := 1; ; retry++ {
+		entries := make([]*kinesis.PutRecordsRequestEntry, len(records))
+		for i, rec := range records {
+			entries[i] = rec.entry
+		}
 
-	if len(records) > 0 {
 		params := &kinesis.PutRecordsInput{
-			Records:    records,
+			Records:    entries,
 			StreamName: aws.String(streamName), // Required
 		}
-		client.PutRecords(params)
+
+		var failed []*kinesisRecord
+
+		resp, err := client.PutRecords(params)
+		if err != nil {
+			failed = records
+		} else if resp != nil && aws.Int64Value(resp.FailedRecordCount) > 0 {
+			for i, rr := range resp.Records {
+				if i < len(records) && rr != nil && aws.StringValue(rr.ErrorCode) != "" {
+					failed = append(failed, records[i])
+
+					if err == nil {
+						err = fmt.Errorf("%s: %s", aws.StringValue(rr.ErrorCode), aws.StringValue(rr.ErrorMessage))
+					}
+				}
+			}
+		}
+
+		if len(failed) == 0 {
+			return nil
+		}
+
+		if !ko.putRetry.waitFor(retry, ko.Processing) {
+			result := &kinesisPutError{}
+			for _, rec := range failed {
+				result.add(rec.indexes, fmt.Errorf("Cannot put records to '%s': %s", streamName, err))
+			}
+			return result
+		}
+		records = failed
 	}
 }
 
-func (ko *kinesisOut) funcPutMessages(messages []ByteArray, filename string) {
+func (ko *kinesisOut) funcPutMessages(messages []ByteArray, filename string) error {
 	if len(messages) == 0 {
-		return
+		return nil
 	}
 
-	defer recover()
-
-	partitionKeys := ko.groupMessages(messages, ko.partitionKey, ko.streamName)
+	partitionKeys := ko.groupMessageIndexes(messages, ko.partitionKey, ko.streamName)
 	if partitionKeys == nil {
-		return
+		return fmt.Errorf("Cannot resolve KINESISOUT stream for messages.")
 	}
 
+	result := &kinesisPutError{}
 	for partitionKey, partitionKeyMap := range partitionKeys {
-		for streamName, msgs := range partitionKeyMap {
-			ko.putMessages(msgs, partitionKey, streamName)
+		for streamName, indexes := range partitionKeyMap {
+			msgs := make([]ByteArray, len(indexes))
+			for i, index := range indexes {
+				msgs[i] = messages[index]
+			}
+
+			err := ko.putMessages(msgs, indexes, partitionKey, streamName)
+			if err == errOutputStopped {
+				return err
+			}
+
+			if pe, ok := err.(*kinesisPutError); ok {
+				result.add(pe.failed, pe.err)
+			}
 		}
 	}
+
+	if len(result.failed) > 0 {
+		return result
+	}
+	return nil
 }
 
 func (ko *kinesisOut) getClient() *kinesis.Kinesis {
-	if ko.client == nil && ko.connFunc == nil {
+	if ko.client == nil && ko.connFunc != nil {
 		return ko.connFunc()
 	}
 	return ko.client
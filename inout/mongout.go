@@ -24,6 +24,7 @@ package inout
 
 import (
 	"encoding/json"
+	"fmt"
 	"sync"
 	"time"
 
@@ -44,6 +45,50 @@ type mongOut struct {
 	session        *mgo.Session
 }
 
+// mongoInsertError reports the messages of the chunk which could not be inserted,
+// so only they are sent again
+type mongoInsertError struct {
+	failed []int
+	err    error
+}
+
+func (e *mongoInsertError) Error() string {
+	return fmt.Sprintf("MONGOUT failed to insert %d messages: %s", len(e.failed), e.err)
+}
+
+func (e *mongoInsertError) Failed() []int {
+	return e.failed
+}
+
+func (e *mongoInsertError) add(indexes []int, err error) {
+	e.failed = append(e.failed, indexes...)
+	if e.err == nil {
+		e.err = err
+	}
+}
+
+// insertFailed returns the positions in the chunk of the documents which
+// could not be inserted, all of them if the failed ones are not known
+func insertFailed(indexes []int, err error) []int {
+	be, ok := err.(*mgo.BulkError)
+	if !ok {
+		return indexes
+	}
+
+	var failed []int
+	for _, c := range be.Cases() {
+		if c.Index < 0 || c.Index >= len(indexes) {
+			return indexes
+		}
+		failed = append(failed, indexes[c.Index])
+	}
+
+	if len(failed) == 0 {
+		return indexes
+	}
+	return failed
+}
+
 func init() {
 	RegisterOut("mongo", newMongOut)
 	RegisterOut("mongout", newMongOut)
@@ -96,6 +141,7 @@ func newMongOut(manager InOutManager, params map[string]interface{}) OutSender {
 	mo.afterCloseFunc = mo.funcAfterClose
 	mo.getDestinationFunc = mo.funcGetObjectName
 	mo.sendChunkFunc = mo.funcPutMessages
+	mo.healthCheckFunc = mo.funcHealthCheck
 
 	return mo
 }
@@ -116,38 +162,59 @@ func (mo *mongOut) funcAfterClose() {
 	}
 }
 
+func (mo *mongOut) funcHealthCheck() error {
+	err := mo.Connect()
+	if err != nil {
+		return err
+	}
+
+	mo.Lock()
+	defer mo.Unlock()
+
+	if mo.session == nil {
+		return fmt.Errorf("Cannot create MONGOUT session.")
+	}
+
+	err = mo.session.Ping()
+	if err != nil {
+		// Let the session reconnect on the next use
+		mo.session.Refresh()
+	}
+	return err
+}
+
 func (mo *mongOut) funcGetObjectName() string {
 	return "null"
 }
 
-func (mo *mongOut) funcPutMessages(messages []ByteArray, _ string) {
+func (mo *mongOut) funcPutMessages(messages []ByteArray, _ string) error {
 	if len(messages) == 0 {
-		return
+		return nil
 	}
-	defer recover()
 
 	var (
 		collection     string
 		collectionList []interface{}
 		collections    = make(map[string][]interface{})
+		indexes        = make(map[string][]int)
 		useDefaultCol  = mo.collectionPath.IsStatic()
 	)
 
 	if useDefaultCol {
 		epath, err := mo.collectionPath.Eval(nil, true)
 		if err != nil || epath == nil {
-			return
+			return fmt.Errorf("Cannot resolve MONGOUT collection.")
 		}
 
 		col, ok := epath.(string)
 		if !ok || len(col) == 0 {
-			return
+			return fmt.Errorf("Cannot resolve MONGOUT collection.")
 		}
 
 		collection = col
 	}
 
-	for _, msg := range messages {
+	for index, msg := range messages {
 		if len(msg) > 0 {
 			var jsonMsg map[string]interface{}
 
@@ -161,7 +228,7 @@ func (mo *mongOut) funcPutMessages(messages []ByteArray, _ string) {
 
 				epath, err := mo.collectionPath.Eval(jsonMsg, true)
 				if err != nil || epath == nil {
-					return
+					continue
 				}
 
 				col, ok := epath.(string)
@@ -174,10 +241,13 @@ func (mo *mongOut) funcPutMessages(messages []ByteArray, _ string) {
 			if len(collection) > 0 {
 				collectionList, _ = collections[collection]
 				collections[collection] = append(collectionList, jsonMsg)
+				indexes[collection] = append(indexes[collection], index)
 			}
 		}
 	}
 
+	result := &mongoInsertError{}
+
 	if len(collections) > 0 {
 		err := mo.Connect()
 		if err != nil {
@@ -185,7 +255,7 @@ func (mo *mongOut) funcPutMessages(messages []ByteArray, _ string) {
 			if l != nil {
 				l.Printf("Unable to connect to server '%s' for MONGOUT message to %s:%s: %s", mo.servers, mo.db, collection, err)
 			}
-			return
+			return err
 		}
 
 		var (
@@ -196,7 +266,11 @@ func (mo *mongOut) funcPutMessages(messages []ByteArray, _ string) {
 		for collection, collectionList = range collections {
 			if len(collectionList) > 0 && len(collection) > 0 {
 				func() {
-					defer recover()
+					defer func() {
+						if e := recover(); e != nil {
+							result.add(indexes[collection], fmt.Errorf("Cannot send MONGOUT message to %s:%s: %v", mo.db, collection, e))
+						}
+					}()
 
 					if mgoCol == nil || mgoCol.Name != collection {
 						mgoCol = mgoDb.C(collection)
@@ -218,11 +292,18 @@ func (mo *mongOut) funcPutMessages(messages []ByteArray, _ string) {
 						if l != nil {
 							l.Printf("Cannot send MONGOUT message to %s:%s: %s", mo.db, collection, mgoErr)
 						}
+
+						result.add(insertFailed(indexes[collection], mgoErr), mgoErr)
 					}
 				}()
 			}
 		}
 	}
+
+	if len(result.failed) > 0 {
+		return result
+	}
+	return nil
 }
 
 func (mo *mongOut) Connect() error {
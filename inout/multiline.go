@@ -0,0 +1,369 @@
+//	The MIT License (MIT)
+//
+//	Copyright (c) 2016, Cagatay Dogan
+//
+//	Permission is hereby granted, free of charge, to any person obtaining a copy
+//	of this software and associated documentation files (the "Software"), to deal
+//	in the Software without restriction, including without limitation the rights
+//	to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+//	copies of the Software, and to permit persons to whom the Software is
+//	furnished to do so, subject to the following conditions:
+//
+//		The above copyright notice and this permission notice shall be included in
+//		all copies or substantial portions of the Software.
+//
+//		THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+//		IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+//		FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+//		AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+//		LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+//		OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+//		THE SOFTWARE.
+
+package inout
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ocdogan/fluentgo/config"
+)
+
+const (
+	defaultMultilineFlushWait = time.Second
+	defaultMultilineMaxLines  = 500
+	defaultMultilineMaxSize   = 1024 * 1024
+)
+
+type multilinePreset struct {
+	firstLine    string
+	continuation string
+}
+
+var multilinePresets = map[string]multilinePreset{
+	"java": {
+		continuation: `^(\s+at\s|\s+\.\.\.\s+\d+\s+more|\s*Caused by:|\s+Suppressed:|` +
+			`[a-zA-Z_$][\w$]*(\.[a-zA-Z_$][\w$]*)+(Exception|Error|Throwable)(:|$))`,
+	},
+	"python": {
+		continuation: `^(\s+|Traceback \(most recent call last\):|` +
+			`During handling of the above exception|The above exception was the direct cause|` +
+			`[\w.]*(Error|Exception|Warning|Exit|Interrupt)(:|$))`,
+	},
+	"go": {
+		continuation: `^(\s+|$|goroutine \d+ \[|created by |\[signal |exit status \d+|` +
+			`[\w./*()\-]+\(.*\)$)`,
+	},
+}
+
+// The keys of the source that separate the streams of an input
+var multilineStreamKeys = []string{"path", "remote", "channel"}
+
+type multilineBuffer struct {
+	lines    [][]byte
+	size     int
+	source   map[string]interface{}
+	last     time.Time
+	buffered []func(ok bool)
+}
+
+// multilineRecord is a combined record with the callbacks of its lines
+type multilineRecord struct {
+	record   []byte
+	source   map[string]interface{}
+	buffered []func(ok bool)
+}
+
+type multilinePushFunc func(data []byte, source map[string]interface{}, buffered func(ok bool)) bool
+
+// multilineStage combines the lines of a record, such as a stack trace,
+// which either start with the first line expression or are followed by
+// the lines matching the continuation expression
+type multilineStage struct {
+	sync.Mutex
+	firstLine    *regexp.Regexp
+	continuation *regexp.Regexp
+	flushWait    time.Duration
+	maxLines     int
+	maxSize      int
+	messageKey   string
+	wrap         bool
+	buffers      map[string]*multilineBuffer
+	pushFunc     multilinePushFunc
+	flushing     int32
+}
+
+// newMultilineStage creates the stage set by the "multiline" parameter of
+// an input, which is either a preset name or an object
+func newMultilineStage(params map[string]interface{}, wrap bool) (*multilineStage, error) {
+	value, ok := params["multiline"]
+	if !ok || value == nil {
+		return nil, nil
+	}
+
+	var mlParams map[string]interface{}
+
+	switch v := value.(type) {
+	case string:
+		mlParams = map[string]interface{}{"preset": v}
+	case map[string]interface{}:
+		mlParams = v
+	default:
+		return nil, fmt.Errorf("Multiline should be a preset name or an object.")
+	}
+
+	firstLine, _ := config.ParamAsString(mlParams, "firstline")
+	continuation, _ := config.ParamAsString(mlParams, "continuation")
+
+	presetName, _ := config.ParamAsString(mlParams, "preset")
+	presetName = strings.ToLower(strings.TrimSpace(presetName))
+
+	if presetName != "" {
+		preset, ok := multilinePresets[presetName]
+		if !ok {
+			return nil, fmt.Errorf("Unknown multiline preset '%s'.", presetName)
+		}
+
+		if strings.TrimSpace(firstLine) == "" {
+			firstLine = preset.firstLine
+		}
+		if strings.TrimSpace(continuation) == "" {
+			continuation = preset.continuation
+		}
+	}
+
+	ms := &multilineStage{
+		wrap:    wrap,
+		buffers: make(map[string]*multilineBuffer),
+	}
+
+	var err error
+
+	if strings.TrimSpace(firstLine) != "" {
+		if ms.firstLine, err = regexp.Compile(firstLine); err != nil {
+			return nil, fmt.Errorf("Invalid multiline firstline expression. %s", err)
+		}
+	}
+
+	if strings.TrimSpace(continuation) != "" {
+		if ms.continuation, err = regexp.Compile(continuation); err != nil {
+			return nil, fmt.Errorf("Invalid multiline continuation expression. %s", err)
+		}
+	}
+
+	if ms.firstLine == nil && ms.continuation == nil {
+		return nil, fmt.Errorf("Multiline needs a firstline or a continuation expression.")
+	}
+
+	ms.flushWait, ok = config.ParamAsDurationWithLimit(mlParams, "flushMSec", 10, 600000)
+	if ok {
+		ms.flushWait *= time.Millisecond
+	} else {
+		ms.flushWait = defaultMultilineFlushWait
+	}
+
+	ms.maxLines, ok = config.ParamAsIntWithLimit(mlParams, "maxLines", 1, 100000)
+	if !ok {
+		ms.maxLines = defaultMultilineMaxLines
+	}
+
+	ms.maxSize, ok = config.ParamAsIntWithLimit(mlParams, "maxSize", 1, 100*1024*1024)
+	if !ok {
+		ms.maxSize = defaultMultilineMaxSize
+	}
+
+	ms.messageKey, _ = config.ParamAsString(mlParams, "messageKey")
+	ms.messageKey = strings.TrimSpace(ms.messageKey)
+	if ms.messageKey == "" {
+		ms.messageKey = defaultParserMessageKey
+	}
+
+	return ms, nil
+}
+
+func multilineStreamKey(source map[string]interface{}) string {
+	if len(source) == 0 {
+		return ""
+	}
+
+	var key []string
+	for _, name := range multilineStreamKeys {
+		if v, ok := source[name]; ok {
+			key = append(key, fmt.Sprintf("%v", v))
+		}
+	}
+	return strings.Join(key, "|")
+}
+
+// startsRecord returns true if the line is not a part of the record before it
+func (ms *multilineStage) startsRecord(line []byte) bool {
+	if ms.firstLine != nil && ms.firstLine.Match(line) {
+		return true
+	}
+	if ms.continuation != nil {
+		return !ms.continuation.Match(line)
+	}
+	return false
+}
+
+// Add appends the line to the record of its stream, pushing the records
+// completed by the line with the push function, buffered is called once
+// the record of the line is buffered or dropped
+func (ms *multilineStage) Add(data []byte, source map[string]interface{},
+	pushFunc multilinePushFunc, buffered func(ok bool)) {
+	line := bytes.TrimRight(data, "\r\n")
+	key := multilineStreamKey(source)
+
+	var completed []multilineRecord
+
+	ms.Lock()
+
+	ms.pushFunc = pushFunc
+
+	buf, ok := ms.buffers[key]
+	if ok && (ms.startsRecord(line) || len(buf.lines) >= ms.maxLines ||
+		buf.size+len(line) > ms.maxSize) {
+		completed = append(completed, ms.complete(buf))
+		ok = false
+	}
+
+	if !ok {
+		buf = &multilineBuffer{source: source}
+		ms.buffers[key] = buf
+	}
+
+	// The line buffers of the inputs can be reused
+	lineCopy := make([]byte, len(line))
+	copy(lineCopy, line)
+
+	buf.lines = append(buf.lines, lineCopy)
+	buf.size += len(line) + 1
+	buf.last = time.Now()
+	if buffered != nil {
+		buf.buffered = append(buf.buffered, buffered)
+	}
+
+	ms.Unlock()
+
+	for _, r := range completed {
+		r.push(pushFunc)
+	}
+
+	ms.startFlushing()
+}
+
+func (ms *multilineStage) complete(buf *multilineBuffer) multilineRecord {
+	return multilineRecord{
+		record:   ms.combine(buf),
+		source:   buf.source,
+		buffered: buf.buffered,
+	}
+}
+
+// push resolves the callbacks of the lines with the result of buffering
+// the record, a record which cannot be combined counts as consumed
+func (r multilineRecord) push(pushFunc multilinePushFunc) {
+	var buffered func(ok bool)
+	if len(r.buffered) > 0 {
+		buffered = func(ok bool) {
+			for _, cb := range r.buffered {
+				cb(ok)
+			}
+		}
+	}
+
+	if r.record == nil || pushFunc == nil {
+		if buffered != nil {
+			buffered(r.record == nil)
+		}
+		return
+	}
+	pushFunc(r.record, r.source, buffered)
+}
+
+func (ms *multilineStage) combine(buf *multilineBuffer) []byte {
+	text := bytes.Join(buf.lines, []byte{'\n'})
+	if !ms.wrap {
+		return text
+	}
+
+	fields := map[string]interface{}{ms.messageKey: string(text)}
+	if path, ok := buf.source["path"]; ok {
+		fields["path"] = path
+	}
+
+	record, err := json.Marshal(fields)
+	if err != nil {
+		return nil
+	}
+	return record
+}
+
+// startFlushing pushes the records idle for the flush period until
+// there is no record left
+func (ms *multilineStage) startFlushing() {
+	if !atomic.CompareAndSwapInt32(&ms.flushing, 0, 1) {
+		return
+	}
+
+	go func() {
+		defer func() {
+			if e := recover(); e != nil {
+				atomic.StoreInt32(&ms.flushing, 0)
+			}
+		}()
+
+		for {
+			time.Sleep(ms.flushWait / 2)
+			if ms.Flush(false) > 0 {
+				continue
+			}
+
+			// A record added after the last flush could not start flushing
+			// while the flag was set, so keep flushing for it
+			atomic.StoreInt32(&ms.flushing, 0)
+			if ms.pending() == 0 || !atomic.CompareAndSwapInt32(&ms.flushing, 0, 1) {
+				return
+			}
+		}
+	}()
+}
+
+func (ms *multilineStage) pending() int {
+	ms.Lock()
+	defer ms.Unlock()
+
+	return len(ms.buffers)
+}
+
+// Flush pushes the idle records, or all of them if forced, and returns
+// the number of records left
+func (ms *multilineStage) Flush(force bool) int {
+	var flushed []multilineRecord
+
+	ms.Lock()
+
+	pushFunc := ms.pushFunc
+	now := time.Now()
+
+	for key, buf := range ms.buffers {
+		if force || now.Sub(buf.last) >= ms.flushWait {
+			delete(ms.buffers, key)
+			flushed = append(flushed, ms.complete(buf))
+		}
+	}
+
+	left := len(ms.buffers)
+	ms.Unlock()
+
+	for _, r := range flushed {
+		r.push(pushFunc)
+	}
+	return left
+}
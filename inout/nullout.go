@@ -58,5 +58,6 @@ func (nullo *nullOut) funcGetObjectName() string {
 	return "null"
 }
 
-func (nullo *nullOut) funcPutMessages(messages []ByteArray, indexName string) {
+func (nullo *nullOut) funcPutMessages(messages []ByteArray, indexName string) error {
+	return nil
 }
@@ -24,6 +24,14 @@ package inout
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/ocdogan/fluentgo/config"
 	"github.com/ocdogan/fluentgo/lib"
@@ -33,9 +41,31 @@ type outHandler struct {
 	ioHandler
 	chunkLength        int
 	concurrency        int
+	match              *lib.TagMatcher
+	retry              *retryPolicy
+	breaker            *circuitBreaker
+	deadLetterPath     string
+	retries            uint64
+	deadLetters        uint64
 	getDestinationFunc func() string
 	canSendFunc        func(messages []ByteArray) bool
-	sendChunkFunc      func(messages []ByteArray, destination string)
+	sendChunkFunc      func(messages []ByteArray, destination string) error
+	sendEventsFunc     func(events []*Event, destination string) error
+	healthCheckFunc    func() error
+}
+
+type sendResult struct {
+	sync.Mutex
+	err error
+}
+
+var errOutputStopped = errors.New("Output stopped before all messages are sent.")
+
+// partialSendError is returned by the outputs which sent a part of a chunk,
+// Failed returns the positions of the messages not sent in the chunk
+type partialSendError interface {
+	error
+	Failed() []int
 }
 
 func newOutHandler(manager InOutManager, params map[string]interface{}) *outHandler {
@@ -54,13 +84,62 @@ func newOutHandler(manager InOutManager, params map[string]interface{}) *outHand
 		concurrency = 1
 	}
 
+	var match *lib.TagMatcher
+
+	s, ok := config.ParamAsString(params, "@match")
+	if ok && s != "" {
+		match = lib.NewTagMatcher(s)
+	}
+
+	deadLetterPath, _ := config.ParamAsString(params, "deadLetterPath")
+	deadLetterPath = strings.TrimSpace(deadLetterPath)
+	if deadLetterPath != "" {
+		deadLetterPath = lib.PreparePath(deadLetterPath)
+	}
+
 	return &outHandler{
-		ioHandler:   *ioh,
-		chunkLength: chunkLength,
-		concurrency: lib.MinInt(20, lib.MaxInt(1, concurrency)),
+		ioHandler:      *ioh,
+		chunkLength:    chunkLength,
+		concurrency:    lib.MinInt(20, lib.MaxInt(1, concurrency)),
+		match:          match,
+		retry:          newRetryPolicy(params),
+		breaker:        newCircuitBreaker(params),
+		deadLetterPath: deadLetterPath,
+	}
+}
+
+func (sr *sendResult) set(err error) {
+	if err != nil {
+		sr.Lock()
+		if sr.err == nil {
+			sr.err = err
+		}
+		sr.Unlock()
 	}
 }
 
+func (sr *sendResult) get() error {
+	sr.Lock()
+	defer sr.Unlock()
+	return sr.err
+}
+
+func (o *outHandler) MatchTag(tag string) bool {
+	return o.match == nil || o.match.Match(tag)
+}
+
+func (o *outHandler) GetDeliveryInfo() *DeliveryInfo {
+	return &DeliveryInfo{
+		Retries:        atomic.LoadUint64(&o.retries),
+		DeadLetters:    atomic.LoadUint64(&o.deadLetters),
+		DeadLetterPath: o.deadLetterPath,
+	}
+}
+
+func (o *outHandler) GetCircuitInfo() *CircuitInfo {
+	return o.breaker.Info()
+}
+
 func (o *outHandler) GetDestination() string {
 	if o.getDestinationFunc != nil {
 		return o.getDestinationFunc()
@@ -75,90 +154,262 @@ func (o *outHandler) CanSend(messages []ByteArray) bool {
 	return len(messages) > 0
 }
 
-func (o *outHandler) sendChunkAsync(messages []ByteArray, destination string, wg *lib.WorkGroup) {
+func (o *outHandler) sendChunkAsync(events []*Event, destination string, wg *lib.WorkGroup, result *sendResult) {
 	defer wg.Done()
-	if o.sendChunkFunc != nil {
-		o.sendChunkFunc(messages, destination)
-	}
+	result.set(o.sendChunk(events, destination))
 }
 
-func (o *outHandler) sendChunk(messages []ByteArray, destination string) {
-	if o.sendChunkFunc != nil {
-		o.sendChunkFunc(messages, destination)
+func (o *outHandler) sendChunk(events []*Event, destination string) error {
+	err := o.trySendChunk(events, destination)
+	events = failedEvents(events, err)
+
+	for retry := 1; err != nil && err != errOutputStopped && err != errCircuitOpen; retry++ {
+		if o.retry == nil || !o.retry.waitFor(retry, o.Processing) {
+			break
+		}
+
+		atomic.AddUint64(&o.retries, 1)
+		err = o.trySendChunk(events, destination)
+		events = failedEvents(events, err)
+	}
+
+	if err != nil && err != errOutputStopped && err != errCircuitOpen {
+		err = o.toDeadLetter(events, err)
 	}
+	return err
 }
 
-func (o *outHandler) Send(messages []ByteArray) {
-	if !o.CanSend(messages) {
-		return
+// failedEvents returns the events not sent if the output sent a part of
+// them, the positions are of the records passed to the output
+func failedEvents(events []*Event, err error) []*Event {
+	pe, ok := err.(partialSendError)
+	if !ok {
+		return events
 	}
 
-	defer recover()
+	sent := make([]*Event, 0, len(events))
+	for _, e := range events {
+		if e != nil && len(e.Record) > 0 {
+			sent = append(sent, e)
+		}
+	}
 
-	mlen := len(messages)
-	if mlen > 0 {
-		chunkCount := mlen / o.chunkLength
-		if mlen%o.chunkLength > 0 {
-			chunkCount++
+	var failed []*Event
+	for _, i := range pe.Failed() {
+		if i >= 0 && i < len(sent) && sent[i] != nil {
+			failed = append(failed, sent[i])
+			sent[i] = nil
 		}
+	}
+	return failed
+}
 
-		var (
-			chunkLen, chunkStart, chunkEnd int
-		)
+func (o *outHandler) toDeadLetter(events []*Event, sendErr error) error {
+	if o.deadLetterPath == "" {
+		return sendErr
+	}
 
-		destination := o.GetDestination()
-		if o.concurrency > 1 && chunkCount > 1 {
-			wg := lib.WorkGroup{}
-			lastIndex := chunkCount - 1
+	if exists, err := lib.PathExists(o.deadLetterPath); !exists || err != nil {
+		os.MkdirAll(o.deadLetterPath, 0777)
+	}
 
-			for i := 0; i < chunkCount; i++ {
-				if !o.Processing() {
-					return
-				}
+	id, err := lib.NewUUID()
+	if err != nil {
+		return sendErr
+	}
+
+	t := time.Now()
+	filename := o.deadLetterPath + fmt.Sprintf("%d%02d%02dT%02d%02d%02dx%s.buf",
+		t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), id.String())
 
-				chunkStart = i * o.chunkLength
-				chunkEnd = lib.MinInt(chunkStart+o.chunkLength, mlen)
+	err = writeBufferFile(filename, events)
+	if err != nil {
+		return fmt.Errorf("%s. Cannot write dead letter file: %s", sendErr, err)
+	}
 
-				chunkLen = chunkEnd - chunkStart
-				if chunkLen > 0 {
-					chunk := make([]ByteArray, chunkLen)
-					copy(chunk, messages[chunkStart:chunkEnd])
+	atomic.AddUint64(&o.deadLetters, uint64(len(events)))
 
-					wg.Add(1)
-					go o.sendChunkAsync(chunk, destination, &wg)
-				}
+	l := o.GetLogger()
+	if l != nil {
+		l.Printf("* %s could not send %d messages (%s), moved to dead letter file '%s'.\n",
+			o.iotype, len(events), sendErr, filepath.Base(filename))
+	}
+	return nil
+}
 
-				if i == lastIndex || wg.Count() == o.concurrency {
-					wg.Wait()
-				}
+// trySendChunk sends the events with sendEventsFunc if the output needs more
+// than the records, as their tags and times
+func (o *outHandler) trySendChunk(events []*Event, destination string) (err error) {
+	if o.sendEventsFunc != nil || o.sendChunkFunc != nil {
+		if !o.breaker.allow(o.healthCheckFunc) {
+			return errCircuitOpen
+		}
+
+		defer func() {
+			if e := recover(); e != nil && err == nil {
+				err = fmt.Errorf("%s send failed: %v", o.iotype, e)
 			}
+			o.circuitResult(err)
+		}()
 
-			wg.Wait()
+		if o.sendEventsFunc != nil {
+			err = o.sendEventsFunc(events, destination)
 		} else {
-			for i := 0; i < chunkCount; i++ {
-				if !o.Processing() {
-					return
-				}
+			err = o.sendChunkFunc(EventRecords(events), destination)
+		}
+	}
+	return err
+}
+
+func (o *outHandler) circuitResult(err error) {
+	l := o.GetLogger()
+
+	if err == nil {
+		if o.breaker.success() && l != nil {
+			l.Printf("* %s circuit is closed, sending is resumed.\n", o.iotype)
+		}
+	} else if err != errOutputStopped {
+		if o.breaker.failure() && l != nil {
+			l.Printf("* %s circuit is opened, holding back messages for %s: %s\n", o.iotype, o.breaker.openWait, err)
+		}
+	}
+}
 
-				chunkStart = i * o.chunkLength
-				chunkEnd = lib.MinInt(chunkStart+o.chunkLength, mlen)
+func (o *outHandler) filterEvents(events []*Event) []*Event {
+	if o.filter == nil {
+		return events
+	}
+
+	var filtered []*Event
+	for _, e := range events {
+		if o.filter.Match(e.Record) {
+			filtered = append(filtered, e)
+		}
+	}
+	return filtered
+}
 
-				chunkLen = chunkEnd - chunkStart
-				if chunkLen > 0 {
-					chunk := make([]ByteArray, chunkLen)
-					copy(chunk, messages[chunkStart:chunkEnd])
+func (o *outHandler) limitEvents(events []*Event) []*Event {
+	if o.limiter == nil {
+		return events
+	}
 
-					o.sendChunk(chunk, destination)
-				}
+	var allowed []*Event
+	for _, e := range events {
+		if o.limiter.Allow(e.Record, o.Processing) {
+			allowed = append(allowed, e)
+		}
+	}
+	return allowed
+}
+
+func (o *outHandler) Send(events []*Event) error {
+	events = o.limitEvents(o.filterEvents(events))
+
+	mlen := len(events)
+	if mlen == 0 {
+		return nil
+	}
+
+	if !o.CanSend(EventRecords(events)) {
+		return fmt.Errorf("%s cannot send messages.", o.iotype)
+	}
+
+	result := &sendResult{}
+	defer func() {
+		if e := recover(); e != nil {
+			result.set(fmt.Errorf("%s send failed: %v", o.iotype, e))
+		}
+	}()
+
+	chunkCount := mlen / o.chunkLength
+	if mlen%o.chunkLength > 0 {
+		chunkCount++
+	}
+
+	var (
+		chunkLen, chunkStart, chunkEnd int
+	)
+
+	destination := o.GetDestination()
+	if o.concurrency > 1 && chunkCount > 1 {
+		wg := lib.WorkGroup{}
+		lastIndex := chunkCount - 1
+
+		for i := 0; i < chunkCount; i++ {
+			if !o.Processing() {
+				wg.Wait()
+				result.set(errOutputStopped)
+				return result.get()
+			}
+
+			chunkStart = i * o.chunkLength
+			chunkEnd = lib.MinInt(chunkStart+o.chunkLength, mlen)
+
+			chunkLen = chunkEnd - chunkStart
+			if chunkLen > 0 {
+				chunk := make([]*Event, chunkLen)
+				copy(chunk, events[chunkStart:chunkEnd])
+
+				wg.Add(1)
+				go o.sendChunkAsync(chunk, destination, &wg, result)
+			}
+
+			if i == lastIndex || wg.Count() == o.concurrency {
+				wg.Wait()
+			}
+		}
+
+		wg.Wait()
+	} else {
+		for i := 0; i < chunkCount; i++ {
+			if !o.Processing() {
+				result.set(errOutputStopped)
+				return result.get()
+			}
+
+			chunkStart = i * o.chunkLength
+			chunkEnd = lib.MinInt(chunkStart+o.chunkLength, mlen)
+
+			chunkLen = chunkEnd - chunkStart
+			if chunkLen > 0 {
+				chunk := make([]*Event, chunkLen)
+				copy(chunk, events[chunkStart:chunkEnd])
+
+				result.set(o.sendChunk(chunk, destination))
 			}
 		}
 	}
+	return result.get()
 }
 
 func (oh *outHandler) groupMessages(messages []ByteArray, primaryPath, secondaryPath *lib.JsonPath) map[string]map[string][]ByteArray {
+	groups := oh.groupMessageIndexes(messages, primaryPath, secondaryPath)
+	if groups == nil {
+		return nil
+	}
+
+	primaries := make(map[string]map[string][]ByteArray, len(groups))
+	for primary, secondaries := range groups {
+		primaryMap := make(map[string][]ByteArray, len(secondaries))
+		for secondary, indexes := range secondaries {
+			list := make([]ByteArray, 0, len(indexes))
+			for _, i := range indexes {
+				list = append(list, messages[i])
+			}
+			primaryMap[secondary] = list
+		}
+		primaries[primary] = primaryMap
+	}
+	return primaries
+}
+
+// groupMessageIndexes groups the positions of the messages as groupMessages
+// groups the messages, so the outputs can report the messages failed
+func (oh *outHandler) groupMessageIndexes(messages []ByteArray, primaryPath, secondaryPath *lib.JsonPath) map[string]map[string][]int {
 	defer recover()
 
-	var primaries map[string]map[string][]ByteArray
+	var primaries map[string]map[string][]int
 
 	if primaryPath.IsStatic() && secondaryPath.IsStatic() {
 		epath, err := primaryPath.Eval(nil, true)
@@ -181,10 +432,15 @@ func (oh *outHandler) groupMessages(messages []ByteArray, primaryPath, secondary
 			return nil
 		}
 
-		primaries = make(map[string]map[string][]ByteArray)
+		primaries = make(map[string]map[string][]int)
 
-		secondaries := make(map[string][]ByteArray)
-		secondaries[secondary] = messages
+		indexes := make([]int, len(messages))
+		for i := range indexes {
+			indexes[i] = i
+		}
+
+		secondaries := make(map[string][]int)
+		secondaries[secondary] = indexes
 
 		primaries[primary] = secondaries
 	} else {
@@ -215,20 +471,20 @@ func (oh *outHandler) groupMessages(messages []ByteArray, primaryPath, secondary
 				return nil
 			}
 			secondary, ok = path.(string)
-			if !ok || len(primary) == 0 {
+			if !ok || len(secondary) == 0 {
 				return nil
 			}
 		}
 
 		var (
 			path          interface{}
-			secondaryList []ByteArray
-			primaryMap    map[string][]ByteArray
+			secondaryList []int
+			primaryMap    map[string][]int
 		)
 
-		primaries = make(map[string]map[string][]ByteArray)
+		primaries = make(map[string]map[string][]int)
 
-		for _, msg := range messages {
+		for i, msg := range messages {
 			if len(msg) > 0 {
 				var data interface{}
 
@@ -239,7 +495,7 @@ func (oh *outHandler) groupMessages(messages []ByteArray, primaryPath, secondary
 
 				if !isPrimaryStatic {
 					path, err = primaryPath.Eval(data, true)
-					if err != nil || len(primary) == 0 {
+					if err != nil {
 						continue
 					}
 
@@ -263,12 +519,12 @@ func (oh *outHandler) groupMessages(messages []ByteArray, primaryPath, secondary
 
 				primaryMap, ok = primaries[primary]
 				if !ok || primaryMap == nil {
-					primaryMap = make(map[string][]ByteArray)
+					primaryMap = make(map[string][]int)
 					primaries[primary] = primaryMap
 				}
 
 				secondaryList, _ = primaryMap[secondary]
-				primaryMap[secondary] = append(secondaryList, msg)
+				primaryMap[secondary] = append(secondaryList, i)
 			}
 		}
 	}
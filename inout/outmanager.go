@@ -23,9 +23,9 @@
 package inout
 
 import (
-	"encoding/binary"
 	"encoding/json"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"reflect"
@@ -41,7 +41,10 @@ import (
 
 type OutSender interface {
 	IOClient
-	Send(messages []ByteArray)
+	MatchTag(tag string) bool
+	GetDeliveryInfo() *DeliveryInfo
+	GetCircuitInfo() *CircuitInfo
+	Send(events []*Event) error
 }
 
 type FuncNewOut func(manage InOutManager, params map[string]interface{}) OutSender
@@ -66,19 +69,35 @@ type OutManager struct {
 	outQ              *OutQueue
 	logger            log.Logger
 	outputs           map[lib.UUID]OutSender
+	filter            *lib.Filter
 	completed         chan bool
 	completedChansMux sync.Mutex
 	completedChans    []chan<- bool
+	filesMux          sync.Mutex
+	inflightFiles     map[string]*fileTracker
+	failedFiles       map[string]*failedFile
+	corruptRecords    uint64
+	checkpoint        *bufferCheckpoint
+	workers           map[lib.UUID]*outWorker
+	outputKeys        []string
 }
 
 type fileProcJob struct {
-	buffer   []byte
 	filename string
 }
 
+// failedFile is a buffer file which could not be delivered to all outputs,
+// it is replayed after a backoff growing with every failed attempt
+type failedFile struct {
+	attempts int
+	retryAt  time.Time
+}
+
 const (
-	minJobBufferSize = 1024
-	maxJobBufferSize = 1048576
+	checkpointFile          = ".checkpoint"
+	checkpointFlushInterval = time.Second
+	failedFileRetryWait     = 5 * time.Second
+	failedFileRetryMaxWait  = 5 * time.Minute
 )
 
 var (
@@ -111,11 +130,16 @@ func UnregisterOut(senderType string) {
 	}
 }
 
-func NewOutManager(config *config.FluentConfig, logger log.Logger) *OutManager {
+func NewOutManager(config *config.FluentConfig, logger log.Logger) (*OutManager, error) {
 	if logger == nil {
 		logger = log.NewDummyLogger()
 	}
 
+	filter, err := lib.NewFilter(config.Outputs.Filter)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid outputs filter. %s", err)
+	}
+
 	dataPath := (&config.Outputs).GetDataPath(&config.Inputs)
 
 	dataPattern := (&config.Outputs).GetDataPattern(&config.Inputs)
@@ -127,6 +151,10 @@ func NewOutManager(config *config.FluentConfig, logger log.Logger) *OutManager {
 		lastFlushTime:   time.Now(),
 		logger:          logger,
 		outputs:         make(map[lib.UUID]OutSender),
+		workers:         make(map[lib.UUID]*outWorker),
+		inflightFiles:   make(map[string]*fileTracker),
+		failedFiles:     make(map[string]*failedFile),
+		filter:          filter,
 		debug:           (&config.Outputs).GetDebugIsOn(),
 		timestampKey:    strings.TrimSpace(config.Outputs.TimestampKey),
 		timestampFormat: (&config.Outputs).GetTimestampFormat(),
@@ -139,9 +167,19 @@ func NewOutManager(config *config.FluentConfig, logger log.Logger) *OutManager {
 		outQ:            NewOutQueue((&config.Outputs.Queue).GetParams()),
 	}
 
-	manager.setOutputs(&config.Outputs)
+	if dataPath != "" {
+		manager.checkpoint = newBufferCheckpoint(dataPath + checkpointFile)
+	}
+
+	manager.outQ.overflow = ParseOverflowPolicy((&config.Outputs.Queue).GetOverflow(), OverflowBlock)
+	manager.outQ.spillFunc = manager.spillToFile
 
-	return manager
+	err = manager.setOutputs(&config.Outputs)
+	if err != nil {
+		return nil, err
+	}
+
+	return manager, nil
 }
 
 func (m *OutManager) GetOutputs() []InOutInfo {
@@ -149,14 +187,7 @@ func (m *OutManager) GetOutputs() []InOutInfo {
 		var outputs []InOutInfo
 
 		for _, out := range m.outputs {
-			outputs = append(outputs, InOutInfo{
-				ID:          out.ID().String(),
-				Name:        out.Name(),
-				Description: out.Description(),
-				IOType:      out.GetIOType(),
-				Enabled:     out.Enabled(),
-				Processing:  out.Processing(),
-			})
+			outputs = append(outputs, m.getOutputInfo(out))
 		}
 		return outputs
 	}
@@ -177,14 +208,10 @@ func (m *OutManager) GetOutputsWithType(typ string) []InOutInfo {
 			for _, out := range m.outputs {
 				otype = strings.ToUpper(out.GetIOType())
 				if typ == otype {
-					outputs = append(outputs, InOutInfo{
-						ID:          out.ID().String(),
-						Name:        out.Name(),
-						Description: out.Description(),
-						IOType:      otype,
-						Enabled:     out.Enabled(),
-						Processing:  out.Processing(),
-					})
+					info := m.getOutputInfo(out)
+					info.IOType = otype
+
+					outputs = append(outputs, info)
 				}
 			}
 			return outputs
@@ -193,6 +220,36 @@ func (m *OutManager) GetOutputsWithType(typ string) []InOutInfo {
 	return nil
 }
 
+func (m *OutManager) getOutputInfo(out OutSender) InOutInfo {
+	info := InOutInfo{
+		ID:          out.ID().String(),
+		Name:        out.Name(),
+		Description: out.Description(),
+		IOType:      out.GetIOType(),
+		Enabled:     out.Enabled(),
+		Processing:  out.Processing(),
+		Filter:      out.GetFilter().Info(),
+		RateLimit:   out.GetRateLimitInfo(),
+		Delivery:    out.GetDeliveryInfo(),
+		Circuit:     out.GetCircuitInfo(),
+	}
+
+	if w, ok := m.workers[out.ID()]; ok {
+		if info.Delivery != nil {
+			info.Delivery.Queued = w.Queued()
+			info.Delivery.Rejected = w.Rejected()
+		}
+
+		info.State = w.State()
+
+		if w.secondary != nil {
+			secondary := m.getOutputInfo(w.secondary)
+			info.Secondary = &secondary
+		}
+	}
+	return info
+}
+
 func (m *OutManager) FindInput(id string) IOClient {
 	return nil
 }
@@ -220,7 +277,7 @@ func (m *OutManager) GetInputs() []InOutInfo {
 	return nil
 }
 
-func (m *OutManager) setOutputs(config *config.OutputsConfig) {
+func (m *OutManager) setOutputs(config *config.OutputsConfig) error {
 	if config != nil {
 		outs := m.outputs
 		if outs == nil {
@@ -228,11 +285,35 @@ func (m *OutManager) setOutputs(config *config.OutputsConfig) {
 			m.outputs = outs
 		}
 
-		for _, o := range config.Consumers {
+		for i, o := range config.Consumers {
 			t := strings.ToLower(o.Type)
 
+			if _, err := lib.NewFilter(o.Filter); err != nil {
+				return fmt.Errorf("Invalid filter for output '%s' (%s). %s", o.Name, o.Type, err)
+			}
+
 			if fn, ok := outputMethods[t]; ok {
+				key := m.outputKey(o.Name, t, i)
+
+				var secondary OutSender
+				if o.Secondary != nil {
+					var err error
+					secondary, err = m.newSecondary(&o, key)
+					if err != nil {
+						return err
+					}
+				}
+
 				params := o.GetParamsMap()
+				if _, ok := params["deadLetterPath"]; !ok {
+					// The batches failed on the primary go to the secondary instead
+					if secondary != nil {
+						params["deadLetterPath"] = ""
+					} else if m.dataPath != "" {
+						params["deadLetterPath"] = m.deadLetterPath(key)
+					}
+				}
+
 				out := fn(m, params)
 
 				if out != nil {
@@ -242,17 +323,92 @@ func (m *OutManager) setOutputs(config *config.OutputsConfig) {
 						out.SetDescription(o.Description)
 
 						outs[out.ID()] = out
+
+						w := newOutWorker(key, out, m.logger)
+						w.secondary = secondary
+
+						m.workers[out.ID()] = w
+						m.outputKeys = append(m.outputKeys, key)
 					}
 				}
 			}
 		}
 	}
+	return nil
+}
+
+func (m *OutManager) deadLetterPath(key string) string {
+	return m.dataPath + "deadletter" + string(os.PathSeparator) + key + string(os.PathSeparator)
+}
+
+func (m *OutManager) newSecondary(primary *config.InOutConfig, key string) (OutSender, error) {
+	sc := primary.Secondary
+
+	t := strings.ToLower(sc.Type)
+
+	fn, ok := outputMethods[t]
+	if !ok {
+		return nil, fmt.Errorf("Unknown secondary output type '%s' for output '%s'.", sc.Type, primary.Name)
+	}
+
+	if _, err := lib.NewFilter(sc.Filter); err != nil {
+		return nil, fmt.Errorf("Invalid filter for secondary of output '%s' (%s). %s", primary.Name, sc.Type, err)
+	}
+
+	params := sc.GetParamsMap()
+	if _, ok := params["deadLetterPath"]; !ok && m.dataPath != "" {
+		params["deadLetterPath"] = m.deadLetterPath(key + "-secondary")
+	}
+
+	out := fn(m, params)
+	if out != nil {
+		v := reflect.ValueOf(out)
+		if v.Kind() != reflect.Ptr || !v.IsNil() {
+			name := strings.TrimSpace(sc.Name)
+			if name == "" {
+				name = strings.TrimSpace(primary.Name) + " (secondary)"
+			}
+
+			out.SetName(name)
+			out.SetDescription(sc.Description)
+
+			return out, nil
+		}
+	}
+	return nil, fmt.Errorf("Cannot create secondary output for output '%s'.", primary.Name)
+}
+
+// outputKey returns a stable key for the output, which is used to name its
+// dead letter directory and to keep its delivery progress across restarts
+func (m *OutManager) outputKey(name, typ string, index int) string {
+	key := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') ||
+			(r >= '0' && r <= '9') || r == '-' || r == '_' || r == '.' {
+			return r
+		}
+		return '_'
+	}, strings.TrimSpace(name))
+
+	if key == "" || strings.Trim(key, ".") == "" {
+		key = fmt.Sprintf("%s%d", typ, index)
+	}
+
+	for _, k := range m.outputKeys {
+		if k == key {
+			return fmt.Sprintf("%s-%d", key, index)
+		}
+	}
+	return key
 }
 
 func (m *OutManager) GetMaxMessageSize() int {
 	return m.maxMessageSize
 }
 
+func (m *OutManager) GetFilter() *lib.Filter {
+	return m.filter
+}
+
 func (m *OutManager) GetInQueue() *InQueue {
 	return nil
 }
@@ -347,6 +503,17 @@ func (m *OutManager) signalCompleted() {
 }
 
 func (m *OutManager) closeOutputs() {
+	for _, w := range m.workers {
+		w.Stop()
+
+		if w.secondary != nil {
+			func() {
+				defer recover()
+				w.secondary.Close()
+			}()
+		}
+	}
+
 	if len(m.outputs) > 0 {
 		for _, out := range m.outputs {
 			func() {
@@ -375,6 +542,7 @@ func (m *OutManager) feedOutputs() {
 		}
 
 		m.closeOutputs()
+		m.checkpoint.Flush()
 
 		if !allCompleted {
 			func(cmp chan bool) {
@@ -393,10 +561,21 @@ func (m *OutManager) feedOutputs() {
 	// Handle orphan files before async process start
 	m.handleOrphans()
 
+	if m.checkpoint != nil {
+		go m.flushCheckpoint()
+	}
+
 	if m.outputs != nil {
-		for _, out := range m.outputs {
+		for id, out := range m.outputs {
 			if out.Enabled() {
 				go out.Run()
+
+				if w, ok := m.workers[id]; ok {
+					if w.secondary != nil && w.secondary.Enabled() {
+						go w.secondary.Run()
+					}
+					w.Start()
+				}
 			}
 		}
 	}
@@ -436,11 +615,7 @@ func (m *OutManager) processFiles(filesProcessed chan<- bool) {
 			return
 		}
 
-		fileErrors := make(map[string]struct{})
-
-		job := &fileProcJob{
-			buffer: make([]byte, minJobBufferSize),
-		}
+		job := &fileProcJob{}
 
 		for m.Processing() {
 			if exists, _ := lib.PathExists(m.dataPath); !exists {
@@ -454,7 +629,11 @@ func (m *OutManager) processFiles(filesProcessed chan<- bool) {
 				continue
 			}
 
-			filenames = filenames[:lib.MinInt(10, len(filenames))]
+			filenames = m.pendingFiles(filenames, 10)
+			if len(filenames) == 0 {
+				time.Sleep(500 * time.Millisecond)
+				continue
+			}
 
 			lastSleepTime := time.Now()
 
@@ -463,28 +642,218 @@ func (m *OutManager) processFiles(filesProcessed chan<- bool) {
 					return
 				}
 
-				if _, ok := fileErrors[fname]; !ok {
-					if m.DoSleep(lastSleepTime) {
-						lastSleepTime = time.Now()
-					}
-
-					job.filename = fname
-					m.processFile(job)
-
-					if ok, _ := lib.FileExists(fname); ok {
-						fileErrors[fname] = struct{}{}
-					}
+				if m.DoSleep(lastSleepTime) {
+					lastSleepTime = time.Now()
 				}
+
+				job.filename = fname
+				m.processFile(job)
 			}
 		}
 	}
 }
 
+func (m *OutManager) pendingFiles(filenames []string, maxCount int) []string {
+	m.filesMux.Lock()
+	defer m.filesMux.Unlock()
+
+	var result []string
+	for _, fname := range filenames {
+		if _, ok := m.inflightFiles[fname]; ok {
+			continue
+		}
+		if ff, ok := m.failedFiles[fname]; ok && time.Now().Before(ff.retryAt) {
+			continue
+		}
+
+		result = append(result, fname)
+		if len(result) >= maxCount {
+			break
+		}
+	}
+	return result
+}
+
+func (m *OutManager) trackFile(filename string) *fileTracker {
+	ft := newFileTracker(filename, m.outputKeys, m.fileCompleted)
+	if m.checkpoint != nil {
+		ft.onProgress = m.fileProgress
+	}
+
+	m.filesMux.Lock()
+	m.inflightFiles[filename] = ft
+	m.filesMux.Unlock()
+
+	return ft
+}
+
+func (m *OutManager) fileFailed(filename string) time.Duration {
+	m.filesMux.Lock()
+	defer m.filesMux.Unlock()
+
+	return m.retryFileLater(filename)
+}
+
+// retryFileLater delays the replay of the failed file, the outputs which
+// failed resume from their checkpoint offsets on the next replay
+func (m *OutManager) retryFileLater(filename string) time.Duration {
+	ff, ok := m.failedFiles[filename]
+	if !ok {
+		ff = &failedFile{}
+		m.failedFiles[filename] = ff
+	}
+
+	wait := failedFileRetryWait
+	for i := 0; i < ff.attempts && wait < failedFileRetryMaxWait; i++ {
+		wait *= 2
+	}
+	if wait > failedFileRetryMaxWait {
+		wait = failedFileRetryMaxWait
+	}
+
+	ff.attempts++
+	ff.retryAt = time.Now().Add(wait)
+
+	return wait
+}
+
+func (m *OutManager) fileProgress(ft *fileTracker, output string, offset int64) {
+	m.checkpoint.Set(ft.filename, output, offset)
+}
+
+func (m *OutManager) flushCheckpoint() {
+	defer recover()
+
+	for m.Processing() {
+		time.Sleep(checkpointFlushInterval)
+
+		if err := m.checkpoint.Flush(); err != nil && m.logger != nil {
+			m.logger.Printf("* Cannot write buffer checkpoint: %s\n", err)
+		}
+	}
+}
+
+func (m *OutManager) fileCompleted(ft *fileTracker) {
+	defer recover()
+
+	var wait time.Duration
+
+	m.filesMux.Lock()
+	delete(m.inflightFiles, ft.filename)
+	if ft.Failed() {
+		wait = m.retryFileLater(ft.filename)
+	} else {
+		delete(m.failedFiles, ft.filename)
+	}
+	m.filesMux.Unlock()
+
+	if !ft.Failed() {
+		m.fileProcessed(ft.filename)
+		m.checkpoint.Remove(ft.filename)
+	} else if m.logger != nil {
+		m.logger.Printf("* Buffer file '%s' is not delivered to all outputs, it will be replayed in %s.\n", ft.filename, wait)
+	}
+}
+
+func (m *OutManager) quarantinePath() string {
+	return m.dataPath + "quarantine" + string(os.PathSeparator)
+}
+
+func (m *OutManager) quarantine(filename string, offset int64, segment []byte) {
+	defer recover()
+
+	atomic.AddUint64(&m.corruptRecords, 1)
+
+	if m.logger != nil {
+		m.logger.Printf("* Corrupt buffer record found in '%s' at offset %d, %d bytes skipped.\n",
+			filename, offset, len(segment))
+	}
+
+	dir := m.quarantinePath()
+	if exists, err := lib.PathExists(dir); !exists || err != nil {
+		os.MkdirAll(dir, 0777)
+	}
+
+	name := fmt.Sprintf("%s%s.%d.corrupt", dir, filepath.Base(filename), offset)
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+	if err == nil {
+		defer f.Close()
+		f.Write(segment)
+	}
+}
+
+// quarantineFile moves the whole buffer file into the quarantine directory
+func (m *OutManager) quarantineFile(filename string, reason error) {
+	defer recover()
+
+	dir := m.quarantinePath()
+	if exists, err := lib.PathExists(dir); !exists || err != nil {
+		os.MkdirAll(dir, 0777)
+	}
+
+	err := os.Rename(filename, dir+filepath.Base(filename))
+	if err != nil {
+		m.fileFailed(filename)
+	}
+
+	if m.logger != nil {
+		if err == nil {
+			m.logger.Printf("* Buffer file '%s' is moved into quarantine: %s\n", filename, reason)
+		} else {
+			m.logger.Printf("* Cannot move buffer file '%s' into quarantine: %s\n", filename, err)
+		}
+	}
+}
+
+func (m *OutManager) GetBufferInfo() *BufferInfo {
+	if m == nil {
+		return nil
+	}
+
+	info := &BufferInfo{
+		CorruptRecords: atomic.LoadUint64(&m.corruptRecords),
+	}
+
+	if m.dataPath != "" {
+		info.QuarantinePath = m.quarantinePath()
+	}
+	return info
+}
+
+// spillToFile writes the events overflowing the queue into a new buffer
+// file, which is replayed like the other buffer files
+func (m *OutManager) spillToFile(events []*Event) bool {
+	if m.dataPath == "" || !strings.Contains(m.dataPattern, "*") {
+		return false
+	}
+
+	id, err := lib.NewUUID()
+	if err != nil {
+		return false
+	}
+
+	t := time.Now()
+	unique := fmt.Sprintf("%d%02d%02dT%02dxspill-%s", t.Year(), t.Month(), t.Day(), t.Hour(), id.String())
+
+	err = writeBufferFile(strings.Replace(m.dataPattern, "*", unique, 1), events)
+	if err != nil && m.logger != nil {
+		m.logger.Printf("* Cannot spill %d messages into buffer: %s\n", len(events), err)
+	}
+	return err == nil
+}
+
+func (m *OutManager) GetQueueInfo() *QueueInfo {
+	if m != nil && m.outQ != nil {
+		return m.outQ.Info()
+	}
+	return nil
+}
+
 func (m *OutManager) waitForPush() {
 	i := 0
 	// wait for push
 	for m.Processing() &&
-		m.outQ != nil && !m.outQ.CanPush() {
+		m.outQ != nil && m.outQ.Overflow() == OverflowBlock && !m.outQ.CanPush() {
 
 		i++
 		time.Sleep(time.Duration(i) * time.Millisecond)
@@ -494,11 +863,15 @@ func (m *OutManager) waitForPush() {
 	}
 }
 
-func (m *OutManager) pushToQueue(data string) {
+func (m *OutManager) pushToQueue(event *Event) bool {
 	if m.outQ != nil && m.Processing() {
 		m.waitForPush()
-		m.outQ.Push(data)
+		if m.Processing() {
+			m.outQ.Push(event)
+			return true
+		}
 	}
+	return false
 }
 
 func (m *OutManager) processFile(job *fileProcJob) {
@@ -509,126 +882,105 @@ func (m *OutManager) processFile(job *fileProcJob) {
 	f, err := os.OpenFile(job.filename, os.O_RDONLY, 0666)
 	if err != nil || f == nil {
 		f = nil
+		if ok, _ := lib.FileExists(job.filename); ok {
+			m.fileFailed(job.filename)
+		}
+		return
+	}
+
+	var reader *bufferReader
+
+	st, err := f.Stat()
+	if err == nil && st.Size() >= 4 {
+		reader, err = newBufferReader(f, st.Size())
+	}
+
+	// A file of an unknown format is kept aside, not replayed nor deleted
+	if err != nil {
+		f.Close()
+
+		if _, ok := err.(*bufferVersionError); ok {
+			m.quarantineFile(job.filename, err)
+			return
+		}
+
+		if m.logger != nil {
+			m.logger.Printf("* Cannot read buffer file '%s': %s\n", job.filename, err)
+		}
+		m.fileFailed(job.filename)
 		return
 	}
 
+	// The reader holds the tracker until the whole file is queued, the
+	// file is released after every queued event is acknowledged
+	tracker := m.trackFile(job.filename)
+	completed := false
+
 	defer func() {
-		defer m.fileProcessed(job.filename)
+		defer tracker.done(completed)
 		if f != nil {
 			f.Close()
 		}
 	}()
 
-	st, err := f.Stat()
-	if err != nil {
+	// Too small to hold a record
+	if reader == nil {
+		completed = true
 		return
 	}
 
-	fsize := st.Size()
-	if fsize < 4 {
-		return
+	reader.corruptFunc = func(offset int64, segment []byte) {
+		m.quarantine(job.filename, offset, segment)
 	}
 
-	stamp := make([]byte, 4)
+	// Resume a partially replayed file from the last record delivered to all
+	// outputs, the records delivered to some of them are not sent to them again
+	if offsets := m.checkpoint.Offsets(job.filename); len(offsets) > 0 {
+		start := int64(-1)
+		for _, key := range m.outputKeys {
+			if offset := offsets[key]; start < 0 || offset < start {
+				start = offset
+			}
+		}
 
-	// Check the FILE_END stamp
-	n, err := f.ReadAt(stamp, fsize-4)
-	if err != nil || n != 4 {
-		return
+		if start > 0 && reader.SeekRecord(start) && m.logger != nil {
+			m.logger.Printf("* Resuming buffer file '%s' from offset %d.\n", job.filename, start)
+		}
+		tracker.setOffsets(offsets, reader.Offset())
 	}
 
-	f.Seek(0, 0)
-
 	var (
-		msg         string
-		data        []byte
-		ln          int
-		hasData     bool
-		start, stop uint32
+		ln    int
+		event *Event
 	)
 
 	for m.Processing() {
-		// Read record START stamp
-		n, err = f.Read(stamp)
-		if n == 0 || err != nil {
-			break
-		}
-
-		start = binary.BigEndian.Uint32(stamp)
-		if start != lib.RecStart {
-			break
-		}
-
-		// Read record length
-		n, err = f.Read(stamp)
-		if n == 0 || err != nil {
-			break
-		}
-
-		ln = int(binary.BigEndian.Uint32(stamp))
-		if ln > lib.InvalidMessageSize {
+		event, err = reader.Next()
+		if err != nil {
 			break
 		}
 
-		hasData = ln > 0
-		data = job.buffer
-
-		// Read message data
-		if hasData {
-			if m.maxMessageSize > 0 && ln > m.maxMessageSize {
-				data = nil
-
-				_, err = f.Seek(int64(ln), 1)
-				if err != nil {
-					break
-				}
-			} else {
-				if data == nil || ln > cap(data) {
-					capacity := 2*ln + minJobBufferSize
-					if capacity > maxJobBufferSize {
-						capacity = lib.MaxInt(maxJobBufferSize, ln+minJobBufferSize)
-					}
+		seq := tracker.addRecord(reader.Offset())
 
-					job.buffer = make([]byte, capacity)
-					data = job.buffer[0:ln]
-				} else {
-					data = job.buffer[0:ln]
-				}
+		ln = event.Len()
+		if ln > 0 && (m.maxMessageSize < 1 || ln <= m.maxMessageSize) {
+			event.Record = m.appendTimestamp(event.Record)
 
-				n, err = f.Read(data)
-				if n != ln || err != nil {
-					break
-				}
+			event.tracker = tracker
+			event.seq = seq
+			event.track(1)
 
-				data = m.appendTimestamp(data)
+			if !m.pushToQueue(event) {
+				event.ack(false)
 			}
-
-			hasData = len(data) > 0
-		}
-
-		// Read record STOP stamp
-		n, err = f.Read(stamp)
-		if n == 0 || err != nil {
-			break
-		}
-
-		stop = binary.BigEndian.Uint32(stamp)
-		if stop != lib.RecStop {
-			break
-		}
-
-		// Process message
-		if hasData {
-			msg = lib.BytesToString(data)
-			m.pushToQueue(msg)
-		}
-
-		if !m.Processing() {
-			return
+		} else {
+			tracker.recordDoneAll(seq)
 		}
 	}
 
-	return
+	// The file is done only if it is read to its end, a read error or a
+	// panic leaves it to be replayed
+	completed = err == io.EOF
 }
 
 func (m *OutManager) waitForPop() {
@@ -666,36 +1018,90 @@ func (m *OutManager) processQueue(queueProcessed chan<- bool) {
 				return
 			}
 
-			messages, ok := m.outQ.Pop(true)
-			if ok && len(messages) > 0 {
-				m.tryToSend(messages)
+			events, ok := m.outQ.Pop(true)
+			if ok && len(events) > 0 {
+				events = m.filterEvents(events)
+				if len(events) > 0 {
+					m.tryToSend(events)
+				}
 			}
 		}
 	}
 }
 
-func (m *OutManager) tryToSend(messages []ByteArray) {
-	defer recover()
+func (m *OutManager) filterEvents(events []*Event) []*Event {
+	if m.filter == nil {
+		return events
+	}
 
-	if m.Processing() && len(messages) > 0 {
-		func() {
-			wg := lib.WorkGroup{}
-			defer wg.Wait()
+	var filtered []*Event
+	for _, e := range events {
+		if m.filter.Match(e.Record) {
+			filtered = append(filtered, e)
+		} else {
+			e.complete()
+		}
+	}
+	return filtered
+}
 
-			for _, out := range m.outputs {
-				if out.Enabled() && m.Processing() {
-					wg.Add(1)
-					go m.send(out, messages, &wg)
-				}
+func (m *OutManager) matchEvents(out OutSender, key string, events []*Event) []*Event {
+	var matched []*Event
+	for i, e := range events {
+		if out.MatchTag(e.Tag) && !e.deliveredTo(key) {
+			if matched == nil {
+				matched = make([]*Event, 0, len(events)-i)
 			}
-		}()
+			matched = append(matched, e)
+		} else {
+			e.skipOutput(key)
+		}
 	}
+	return matched
 }
 
-func (m *OutManager) send(to OutSender, messages []ByteArray, wg *lib.WorkGroup) {
-	defer wg.Done()
-	if to != nil && m.Processing() {
-		to.Send(messages)
+func (m *OutManager) tryToSend(events []*Event) {
+	// Every target output holds a reference on the events queued for it,
+	// the queue's own reference is released after the events are dispatched
+	ok := false
+	defer func() {
+		recover()
+		ackEvents(events, ok)
+	}()
+
+	if m.Processing() && len(events) > 0 {
+		for id, out := range m.outputs {
+			w, wok := m.workers[id]
+			if !wok {
+				continue
+			}
+
+			if !out.Enabled() {
+				for _, e := range events {
+					e.skipOutput(w.key)
+				}
+				continue
+			}
+
+			matched := m.matchEvents(out, w.key, events)
+			if len(matched) == 0 {
+				continue
+			}
+
+			for _, e := range matched {
+				e.track(1)
+			}
+
+			// Do not wait for a stalled output, its events are deferred to be
+			// queued for it alone as it catches up, or until its backlog is full
+			if !w.Push(matched) {
+				if w.Deferred() == 0 && m.logger != nil {
+					m.logger.Printf("* Queue of '%s' is full, its messages are deferred until it catches up.\n", w.key)
+				}
+				w.Defer(matched)
+			}
+		}
+		ok = m.Processing()
 	}
 }
 
@@ -777,6 +1183,9 @@ func (m *OutManager) handleOrphans() {
 		return
 	}
 
+	// Forget the checkpoints of the files removed while handling orphans
+	defer m.checkpoint.Prune(m.dataPath)
+
 	// Delete all files
 	if m.orphanDelete {
 		m.doOrphanAction(m.dataPattern, "", true)
@@ -25,6 +25,7 @@ package inout
 import (
 	"math"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ocdogan/fluentgo/lib"
@@ -34,7 +35,7 @@ type outQNode struct {
 	id    uint32
 	prev  *outQNode
 	next  *outQNode
-	chunk []ByteArray
+	chunk []*Event
 }
 
 type privateQ struct {
@@ -54,6 +55,10 @@ type OutQueue struct {
 	waitPopForMillisec time.Duration
 	mainQ              *privateQ
 	spareQ             *privateQ
+	overflow           OverflowPolicy
+	spillFunc          func(events []*Event) bool
+	dropped            uint64
+	spilled            uint64
 }
 
 const (
@@ -73,6 +78,7 @@ func NewOutQueue(chunkSize, maxCount int, waitPopForMillisec time.Duration) *Out
 		chunkSize:          chunkSize,
 		waitPopForMillisec: waitPopForMillisec,
 		lastPop:            time.Now(),
+		overflow:           OverflowBlock,
 		mainQ: &privateQ{
 			maxChunkCount: maxCount,
 		},
@@ -122,10 +128,10 @@ func (pq *privateQ) append(n *outQNode, chunkSize int) *outQNode {
 		n = &outQNode{
 			id:    pq.nextID(),
 			prev:  pq.tail,
-			chunk: make([]ByteArray, 0, chunkSize),
+			chunk: make([]*Event, 0, chunkSize),
 		}
 	} else if len(n.chunk) == 0 {
-		n.chunk = make([]ByteArray, 0, chunkSize)
+		n.chunk = make([]*Event, 0, chunkSize)
 	}
 
 	if pq.tail == nil {
@@ -139,35 +145,76 @@ func (pq *privateQ) append(n *outQNode, chunkSize int) *outQNode {
 	return n
 }
 
-func (q *OutQueue) Push(data string) {
-	if len(data) > 0 {
+func (q *OutQueue) Push(event *Event) {
+	if event.Len() > 0 {
 		q.Lock()
 		defer q.Unlock()
 
-		q.put(data)
+		q.put(event)
 	}
 }
 
-func (q *OutQueue) put(data string) {
-	ln := len(data)
-	if ln == 0 {
+func (q *OutQueue) put(event *Event) {
+	if event.Len() == 0 {
 		return
 	}
 
 	mq := q.mainQ
 
+	if q.overflow == OverflowDropNewest && !q.pushReady() {
+		atomic.AddUint64(&q.dropped, 1)
+		event.complete()
+		return
+	}
+
 	n := mq.tail
 	if n == nil || len(n.chunk) >= q.chunkSize {
 		n = mq.append(q.spareQ.popFromQ(), q.chunkSize)
 	}
 
-	n.chunk = append(n.chunk, []byte(data))
+	n.chunk = append(n.chunk, event)
 	mq.chunkCount++
 
 	for mq.maxChunkCount > 0 &&
 		mq.chunkCount > 1 &&
 		mq.chunkCount > mq.maxChunkCount {
-		q.popData(true)
+		chunk, _ := q.popData(true)
+		q.overflowed(chunk)
+	}
+}
+
+func (q *OutQueue) overflowed(chunk []*Event) {
+	if len(chunk) == 0 {
+		return
+	}
+
+	if q.overflow == OverflowSpill && q.spillFunc != nil {
+		if q.spillFunc(chunk) {
+			atomic.AddUint64(&q.spilled, uint64(len(chunk)))
+			completeEvents(chunk)
+			return
+		}
+
+		// Keep the source buffer files to replay the events not spilled
+		atomic.AddUint64(&q.dropped, uint64(len(chunk)))
+		ackEvents(chunk, false)
+		return
+	}
+
+	atomic.AddUint64(&q.dropped, uint64(len(chunk)))
+	completeEvents(chunk)
+}
+
+func (q *OutQueue) Overflow() OverflowPolicy {
+	return q.overflow
+}
+
+func (q *OutQueue) Info() *QueueInfo {
+	return &QueueInfo{
+		Overflow: q.overflow.String(),
+		Count:    q.Count(),
+		Dropped:  atomic.LoadUint64(&q.dropped),
+		Spilled:  atomic.LoadUint64(&q.spilled),
 	}
 }
 
@@ -198,7 +245,7 @@ func (q *OutQueue) popReady() bool {
 			(q.waitPopForMillisec > 0 && time.Now().Sub(q.lastPop) >= q.waitPopForMillisec))
 }
 
-func (q *OutQueue) Pop(force bool) (chunk []ByteArray, ok bool) {
+func (q *OutQueue) Pop(force bool) (chunk []*Event, ok bool) {
 	q.Lock()
 	defer q.Unlock()
 
@@ -220,7 +267,7 @@ func (q *OutQueue) pushToSpareQ(n *outQNode) {
 	}
 }
 
-func (q *OutQueue) popData(force bool) (chunk []ByteArray, ok bool) {
+func (q *OutQueue) popData(force bool) (chunk []*Event, ok bool) {
 	if !(force || q.popReady()) {
 		return nil, false
 	}
@@ -241,13 +288,6 @@ func (q *OutQueue) popData(force bool) (chunk []ByteArray, ok bool) {
 
 		q.pushToSpareQ(n)
 
-		if len(chunk) > 0 {
-			data := chunk[0]
-			if len(data) > 0 {
-
-			}
-			data = chunk[len(chunk)-1]
-		}
 		return chunk, true
 	}
 	return nil, false
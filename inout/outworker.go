@@ -0,0 +1,418 @@
+//	The MIT License (MIT)
+//
+//	Copyright (c) 2016, Cagatay Dogan
+//
+//	Permission is hereby granted, free of charge, to any person obtaining a copy
+//	of this software and associated documentation files (the "Software"), to deal
+//	in the Software without restriction, including without limitation the rights
+//	to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+//	copies of the Software, and to permit persons to whom the Software is
+//	furnished to do so, subject to the following conditions:
+//
+//		The above copyright notice and this permission notice shall be included in
+//		all copies or substantial portions of the Software.
+//
+//		THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+//		IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+//		FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+//		AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+//		LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+//		OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+//		THE SOFTWARE.
+
+package inout
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ocdogan/fluentgo/config"
+	"github.com/ocdogan/fluentgo/log"
+)
+
+const (
+	defaultOutQueueLength = 100
+	defaultOutWorkerCount = 1
+	defaultOutQueueWait   = time.Second
+	defaultOutMaxDeferred = 100
+	defaultFailoverAfter  = 3
+	defaultFailbackWait   = 30 * time.Second
+	circuitHoldWait       = 500 * time.Millisecond
+)
+
+const (
+	OutStateHealthy     = "healthy"
+	OutStateDegraded    = "degraded"
+	OutStateFailingOver = "failing_over"
+)
+
+// outWorker feeds an output from its own bounded queue with its own
+// workers, so a slow output does not hold up the others
+type outWorker struct {
+	key         string
+	out         OutSender
+	queue       chan []*Event
+	queueWait   time.Duration
+	workerCount int
+	rejected    uint64
+	started     int32
+	stalled     int32
+	logger      log.Logger
+	stop        chan bool
+
+	// The batches which did not fit in the queue, the worker queues them as
+	// the output catches up without holding up the other outputs until the
+	// backlog reaches its limit
+	backlogMux    sync.Mutex
+	backlog       [][]*Event
+	backlogReady  chan struct{}
+	backlogRoom   *sync.Cond
+	backlogClosed bool
+	maxDeferred   int
+
+	// The secondary receives the batches while the primary keeps failing
+	secondary     OutSender
+	stateMux      sync.Mutex
+	failures      int
+	failoverAfter int
+	failbackWait  time.Duration
+	failingOver   bool
+	lastProbe     time.Time
+}
+
+func newOutWorker(key string, out OutSender, logger log.Logger) *outWorker {
+	params := out.GetParameters()
+
+	queueLength, ok := config.ParamAsIntWithLimit(params, "queueLength", 1, 10000)
+	if !ok {
+		queueLength = defaultOutQueueLength
+	}
+
+	workerCount, ok := config.ParamAsIntWithLimit(params, "workerCount", 1, 100)
+	if !ok {
+		workerCount = defaultOutWorkerCount
+	}
+
+	queueWait, ok := config.ParamAsDurationWithLimit(params, "queueWaitMSec", 0, 60000)
+	if ok {
+		queueWait *= time.Millisecond
+	} else {
+		queueWait = defaultOutQueueWait
+	}
+
+	maxDeferred, ok := config.ParamAsIntWithLimit(params, "maxDeferred", 1, 100000)
+	if !ok {
+		maxDeferred = defaultOutMaxDeferred
+	}
+
+	failoverAfter, ok := config.ParamAsIntWithLimit(params, "failoverAfter", 0, 10000)
+	if !ok {
+		failoverAfter = defaultFailoverAfter
+	}
+
+	failbackWait, ok := config.ParamAsDurationWithLimit(params, "failbackSec", 1, 86400)
+	if ok {
+		failbackWait *= time.Second
+	} else {
+		failbackWait = defaultFailbackWait
+	}
+
+	w := &outWorker{
+		key:         key,
+		out:         out,
+		queue:       make(chan []*Event, queueLength),
+		queueWait:   queueWait,
+		workerCount: workerCount,
+		logger:      logger,
+		stop:        make(chan bool),
+
+		backlogReady: make(chan struct{}, 1),
+		maxDeferred:  maxDeferred,
+
+		failoverAfter: failoverAfter,
+		failbackWait:  failbackWait,
+	}
+	w.backlogRoom = sync.NewCond(&w.backlogMux)
+
+	return w
+}
+
+func (w *outWorker) Start() {
+	if atomic.CompareAndSwapInt32(&w.started, 0, 1) {
+		for i := 0; i < w.workerCount; i++ {
+			go w.run()
+		}
+		go w.drainBacklog()
+	}
+}
+
+func (w *outWorker) Stop() {
+	defer recover()
+
+	if atomic.CompareAndSwapInt32(&w.started, 1, 2) {
+		close(w.stop)
+	}
+}
+
+// Push queues the events, waits for room in the queue for a while unless
+// the output is already stalled, returns false if the queue stays full
+func (w *outWorker) Push(events []*Event) bool {
+	if atomic.LoadInt32(&w.started) != 1 || w.Deferred() > 0 {
+		return false
+	}
+
+	select {
+	case w.queue <- events:
+		atomic.StoreInt32(&w.stalled, 0)
+		return true
+	default:
+	}
+
+	if w.queueWait > 0 && atomic.LoadInt32(&w.stalled) == 0 {
+		timer := time.NewTimer(w.queueWait)
+		defer timer.Stop()
+
+		select {
+		case w.queue <- events:
+			return true
+		case <-w.stop:
+		case <-timer.C:
+		}
+	}
+
+	atomic.StoreInt32(&w.stalled, 1)
+	atomic.AddUint64(&w.rejected, 1)
+
+	return false
+}
+
+func (w *outWorker) Queued() int {
+	return len(w.queue)
+}
+
+func (w *outWorker) Deferred() int {
+	w.backlogMux.Lock()
+	defer w.backlogMux.Unlock()
+
+	return len(w.backlog)
+}
+
+// Defer keeps the events rejected by Push to be queued by the worker when
+// the queue has room, the events fail for the output only if it is stopped.
+// While the backlog is full, it waits for the worker to drain it.
+func (w *outWorker) Defer(events []*Event) {
+	if len(events) == 0 {
+		return
+	}
+
+	w.backlogMux.Lock()
+	for !w.backlogClosed && len(w.backlog) >= w.maxDeferred {
+		w.backlogRoom.Wait()
+	}
+
+	if w.backlogClosed {
+		w.backlogMux.Unlock()
+
+		for _, e := range events {
+			e.ackOutput(w.key, false)
+		}
+		return
+	}
+	w.backlog = append(w.backlog, events)
+	w.backlogMux.Unlock()
+
+	select {
+	case w.backlogReady <- struct{}{}:
+	default:
+	}
+}
+
+func (w *outWorker) nextDeferred() []*Event {
+	w.backlogMux.Lock()
+	defer w.backlogMux.Unlock()
+
+	if len(w.backlog) == 0 {
+		return nil
+	}
+
+	events := w.backlog[0]
+	w.backlog[0] = nil
+	w.backlog = w.backlog[1:]
+
+	w.backlogRoom.Broadcast()
+
+	return events
+}
+
+func (w *outWorker) closeBacklog() {
+	w.backlogMux.Lock()
+	backlog := w.backlog
+	w.backlog = nil
+	w.backlogClosed = true
+	w.backlogRoom.Broadcast()
+	w.backlogMux.Unlock()
+
+	for _, events := range backlog {
+		for _, e := range events {
+			e.ackOutput(w.key, false)
+		}
+	}
+}
+
+func (w *outWorker) drainBacklog() {
+	defer w.closeBacklog()
+	defer recover()
+
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-w.backlogReady:
+		}
+
+		for events := w.nextDeferred(); events != nil; events = w.nextDeferred() {
+			select {
+			case w.queue <- events:
+			case <-w.stop:
+				for _, e := range events {
+					e.ackOutput(w.key, false)
+				}
+				return
+			}
+		}
+		atomic.StoreInt32(&w.stalled, 0)
+	}
+}
+
+func (w *outWorker) Rejected() uint64 {
+	return atomic.LoadUint64(&w.rejected)
+}
+
+func (w *outWorker) run() {
+	defer recover()
+
+	for {
+		select {
+		case <-w.stop:
+			return
+		case events := <-w.queue:
+			w.send(events)
+		}
+	}
+}
+
+func (w *outWorker) State() string {
+	w.stateMux.Lock()
+	defer w.stateMux.Unlock()
+
+	if w.failingOver {
+		return OutStateFailingOver
+	}
+	if w.failures > 0 {
+		return OutStateDegraded
+	}
+	return OutStateHealthy
+}
+
+// useSecondary returns true while failing over, except once in every
+// failback period when the primary is probed with the batch
+func (w *outWorker) useSecondary() bool {
+	if w.secondary == nil {
+		return false
+	}
+
+	w.stateMux.Lock()
+	defer w.stateMux.Unlock()
+
+	if !w.failingOver {
+		return false
+	}
+
+	if time.Now().Sub(w.lastProbe) >= w.failbackWait {
+		w.lastProbe = time.Now()
+		return false
+	}
+	return true
+}
+
+func (w *outWorker) primarySucceeded() {
+	w.stateMux.Lock()
+	defer w.stateMux.Unlock()
+
+	if w.failingOver && w.logger != nil {
+		w.logger.Printf("* Output '%s' is recovered, switching back from the secondary.\n", w.key)
+	}
+
+	w.failures = 0
+	w.failingOver = false
+}
+
+// primaryFailed returns true if the batch should be sent to the secondary
+func (w *outWorker) primaryFailed() bool {
+	w.stateMux.Lock()
+	defer w.stateMux.Unlock()
+
+	w.failures++
+
+	if w.secondary != nil && !w.failingOver && w.failures > w.failoverAfter {
+		w.failingOver = true
+		w.lastProbe = time.Now()
+
+		if w.logger != nil {
+			w.logger.Printf("* Output '%s' failed %d times, failing over to the secondary.\n", w.key, w.failures)
+		}
+	}
+	return w.failingOver
+}
+
+func (w *outWorker) send(events []*Event) {
+	var err error
+	defer func() {
+		if e := recover(); e != nil && err == nil {
+			err = fmt.Errorf("%v", e)
+		}
+
+		if err != nil && w.logger != nil {
+			w.logger.Printf("* Failed to send %d messages to '%s': %s\n", len(events), w.key, err)
+		}
+
+		for _, e := range events {
+			e.ackOutput(w.key, err == nil)
+		}
+	}()
+
+	if w.useSecondary() {
+		err = w.secondary.Send(events)
+		return
+	}
+
+	err = w.out.Send(events)
+
+	// Without a secondary, hold the batch until the circuit lets it through
+	for err == errCircuitOpen && w.secondary == nil && w.waitForCircuit() {
+		err = w.out.Send(events)
+	}
+
+	if err == nil {
+		w.primarySucceeded()
+		return
+	}
+
+	if err != errOutputStopped && (w.primaryFailed() || (err == errCircuitOpen && w.secondary != nil)) {
+		err = w.secondary.Send(events)
+	}
+}
+
+func (w *outWorker) waitForCircuit() bool {
+	timer := time.NewTimer(circuitHoldWait)
+	defer timer.Stop()
+
+	select {
+	case <-w.stop:
+		return false
+	case <-timer.C:
+		return w.out.Processing()
+	}
+}
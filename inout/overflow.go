@@ -0,0 +1,60 @@
+//	The MIT License (MIT)
+//
+//	Copyright (c) 2016, Cagatay Dogan
+//
+//	Permission is hereby granted, free of charge, to any person obtaining a copy
+//	of this software and associated documentation files (the "Software"), to deal
+//	in the Software without restriction, including without limitation the rights
+//	to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+//	copies of the Software, and to permit persons to whom the Software is
+//	furnished to do so, subject to the following conditions:
+//
+//		The above copyright notice and this permission notice shall be included in
+//		all copies or substantial portions of the Software.
+//
+//		THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+//		IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+//		FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+//		AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+//		LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+//		OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+//		THE SOFTWARE.
+
+package inout
+
+import "strings"
+
+type OverflowPolicy int
+
+const (
+	OverflowDropOldest OverflowPolicy = iota
+	OverflowDropNewest
+	OverflowBlock
+	OverflowSpill
+)
+
+func ParseOverflowPolicy(s string, defaultPolicy OverflowPolicy) OverflowPolicy {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "drop_oldest":
+		return OverflowDropOldest
+	case "drop_newest":
+		return OverflowDropNewest
+	case "block":
+		return OverflowBlock
+	case "spill":
+		return OverflowSpill
+	}
+	return defaultPolicy
+}
+
+func (p OverflowPolicy) String() string {
+	switch p {
+	case OverflowDropNewest:
+		return "drop_newest"
+	case OverflowBlock:
+		return "block"
+	case OverflowSpill:
+		return "spill"
+	}
+	return "drop_oldest"
+}
@@ -0,0 +1,377 @@
+//	The MIT License (MIT)
+//
+//	Copyright (c) 2016, Cagatay Dogan
+//
+//	Permission is hereby granted, free of charge, to any person obtaining a copy
+//	of this software and associated documentation files (the "Software"), to deal
+//	in the Software without restriction, including without limitation the rights
+//	to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+//	copies of the Software, and to permit persons to whom the Software is
+//	furnished to do so, subject to the following conditions:
+//
+//		The above copyright notice and this permission notice shall be included in
+//		all copies or substantial portions of the Software.
+//
+//		THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+//		IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+//		FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+//		AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+//		LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+//		OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+//		THE SOFTWARE.
+
+package inout
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ocdogan/fluentgo/config"
+	"github.com/ocdogan/fluentgo/lib"
+)
+
+// Parser turns a raw input payload into a JSON record
+type Parser interface {
+	Parse(data []byte) (map[string]interface{}, error)
+}
+
+type FuncNewParser func(params map[string]interface{}) (Parser, error)
+
+const defaultParserMessageKey = "message"
+
+var parserMethods = make(map[string]FuncNewParser)
+
+type inputParser struct {
+	sync.Mutex
+	parserType string
+	parser     Parser
+	messageKey string
+	errorPath  string
+	parsed     uint64
+	failed     uint64
+}
+
+type fieldType struct {
+	kind   string
+	layout string
+}
+
+func RegisterParser(parserType string, fn FuncNewParser) {
+	if fn != nil {
+		parserType = strings.TrimSpace(parserType)
+		if parserType != "" {
+			if parserMethods == nil {
+				parserMethods = make(map[string]FuncNewParser)
+			}
+
+			parserType = strings.ToLower(parserType)
+			parserMethods[parserType] = fn
+		}
+	}
+}
+
+func UnregisterParser(parserType string) {
+	if parserMethods != nil {
+		parserType = strings.TrimSpace(parserType)
+		if parserType != "" {
+			parserType = strings.ToLower(parserType)
+			if _, ok := parserMethods[parserType]; ok {
+				delete(parserMethods, parserType)
+			}
+		}
+	}
+}
+
+// newInputParser creates the parser set by the "parser" parameter of an
+// input, which is either the parser type or an object with a "type" and
+// the parser parameters
+func newInputParser(params map[string]interface{}) (*inputParser, error) {
+	value, ok := params["parser"]
+	if !ok || value == nil {
+		return nil, nil
+	}
+
+	var (
+		parserType   string
+		parserParams map[string]interface{}
+	)
+
+	switch v := value.(type) {
+	case string:
+		parserType = v
+		parserParams = make(map[string]interface{})
+	case map[string]interface{}:
+		parserType, _ = config.ParamAsString(v, "type")
+		parserParams = v
+	default:
+		return nil, fmt.Errorf("Parser should be a type name or an object.")
+	}
+
+	parserType = strings.ToLower(strings.TrimSpace(parserType))
+	if parserType == "" {
+		return nil, fmt.Errorf("Parser type is not set.")
+	}
+
+	fn, ok := parserMethods[parserType]
+	if !ok {
+		return nil, fmt.Errorf("Unknown parser type '%s'.", parserType)
+	}
+
+	parser, err := fn(parserParams)
+	if err != nil {
+		return nil, err
+	}
+	if parser == nil {
+		return nil, fmt.Errorf("Cannot create parser '%s'.", parserType)
+	}
+
+	messageKey, _ := config.ParamAsString(parserParams, "messageKey")
+	messageKey = strings.TrimSpace(messageKey)
+	if messageKey == "" {
+		messageKey = defaultParserMessageKey
+	}
+
+	errorPath, _ := config.ParamAsString(parserParams, "errorPath")
+	errorPath = strings.TrimSpace(errorPath)
+	if errorPath != "" {
+		errorPath = filepath.Clean(errorPath)
+	}
+
+	return &inputParser{
+		parserType: parserType,
+		parser:     parser,
+		messageKey: messageKey,
+		errorPath:  errorPath,
+	}, nil
+}
+
+// Parse returns the data as a JSON record, the lines failed to parse are
+// either wrapped into the message key or written to the error path
+func (ip *inputParser) Parse(data []byte) ([]byte, bool) {
+	if ip == nil {
+		return data, true
+	}
+
+	data = bytes.TrimRight(data, "\r\n")
+
+	record, err := ip.tryParse(data)
+	if err == nil {
+		var result []byte
+
+		result, err = json.Marshal(record)
+		if err == nil {
+			atomic.AddUint64(&ip.parsed, 1)
+			return result, true
+		}
+	}
+
+	atomic.AddUint64(&ip.failed, 1)
+
+	if ip.errorPath != "" {
+		ip.writeError(data)
+		return nil, false
+	}
+
+	result, err := json.Marshal(map[string]interface{}{ip.messageKey: string(data)})
+	if err != nil {
+		return nil, false
+	}
+	return result, true
+}
+
+func (ip *inputParser) tryParse(data []byte) (record map[string]interface{}, err error) {
+	defer func() {
+		if e := recover(); e != nil && err == nil {
+			err = fmt.Errorf("%v", e)
+		}
+	}()
+
+	record, err = ip.parser.Parse(data)
+	if err == nil && record == nil {
+		err = fmt.Errorf("Parser '%s' returned no record.", ip.parserType)
+	}
+	return record, err
+}
+
+func (ip *inputParser) writeError(data []byte) {
+	defer recover()
+
+	ip.Lock()
+	defer ip.Unlock()
+
+	dir := filepath.Dir(ip.errorPath)
+	if exists, err := lib.PathExists(dir); !exists || err != nil {
+		os.MkdirAll(dir, 0777)
+	}
+
+	f, err := os.OpenFile(ip.errorPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0666)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	f.Write(data)
+	if len(data) == 0 || data[len(data)-1] != '\n' {
+		f.Write([]byte{'\n'})
+	}
+}
+
+func (ip *inputParser) Info() *ParserInfo {
+	if ip == nil {
+		return nil
+	}
+
+	return &ParserInfo{
+		Type:      ip.parserType,
+		Parsed:    atomic.LoadUint64(&ip.parsed),
+		Failed:    atomic.LoadUint64(&ip.failed),
+		ErrorPath: ip.errorPath,
+	}
+}
+
+// parseFieldTypes reads the field types either from an object of field
+// names and types or from a "field:type,field:type" string, the time type
+// accepts a layout such as "time:02/Jan/2006:15:04:05 -0700"
+func parseFieldTypes(value interface{}) (map[string]*fieldType, error) {
+	types := make(map[string]*fieldType)
+
+	add := func(name, typ string) error {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			return fmt.Errorf("Field name is missing in types.")
+		}
+
+		ft, err := newFieldType(typ)
+		if err != nil {
+			return err
+		}
+		types[name] = ft
+		return nil
+	}
+
+	switch v := value.(type) {
+	case nil:
+	case string:
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				parts := strings.SplitN(s, ":", 2)
+				if len(parts) < 2 {
+					return nil, fmt.Errorf("Type of field '%s' is missing.", parts[0])
+				}
+
+				if err := add(parts[0], parts[1]); err != nil {
+					return nil, err
+				}
+			}
+		}
+	case map[string]interface{}:
+		for name, typ := range v {
+			s, ok := typ.(string)
+			if !ok {
+				return nil, fmt.Errorf("Type of field '%s' should be a string.", name)
+			}
+
+			if err := add(name, s); err != nil {
+				return nil, err
+			}
+		}
+	default:
+		return nil, fmt.Errorf("Types should be an object or a string.")
+	}
+	return types, nil
+}
+
+func newFieldType(s string) (*fieldType, error) {
+	kind := strings.TrimSpace(s)
+	layout := ""
+
+	if i := strings.Index(kind, ":"); i > -1 {
+		layout = kind[i+1:]
+		kind = strings.TrimSpace(kind[:i])
+	}
+
+	switch strings.ToLower(kind) {
+	case "string":
+		return &fieldType{kind: "string"}, nil
+	case "int", "integer", "long":
+		return &fieldType{kind: "int"}, nil
+	case "float", "double", "number":
+		return &fieldType{kind: "float"}, nil
+	case "bool", "boolean":
+		return &fieldType{kind: "bool"}, nil
+	case "time":
+		if layout == "" {
+			layout = time.RFC3339
+		}
+		return &fieldType{kind: "time", layout: layout}, nil
+	}
+	return nil, fmt.Errorf("Unknown field type '%s'.", s)
+}
+
+// convert returns the typed value, empty and "-" values are left out
+// for all types but string
+func (ft *fieldType) convert(s string, timeFormat string) (interface{}, bool, error) {
+	if ft == nil || ft.kind == "string" {
+		return s, true, nil
+	}
+
+	s = strings.TrimSpace(s)
+	if s == "" || s == "-" {
+		return nil, false, nil
+	}
+
+	switch ft.kind {
+	case "int":
+		i, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return nil, false, err
+		}
+		return i, true, nil
+	case "float":
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil, false, err
+		}
+		return f, true, nil
+	case "bool":
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return nil, false, err
+		}
+		return b, true, nil
+	case "time":
+		var (
+			t   time.Time
+			err error
+		)
+
+		switch ft.layout {
+		case "unix", "unixms":
+			var f float64
+			f, err = strconv.ParseFloat(s, 64)
+			if err == nil {
+				if ft.layout == "unixms" {
+					f /= 1000
+				}
+				sec := int64(f)
+				t = time.Unix(sec, int64((f-float64(sec))*float64(time.Second)))
+			}
+		default:
+			t, err = time.Parse(ft.layout, s)
+		}
+
+		if err != nil {
+			return nil, false, err
+		}
+		return t.Format(timeFormat), true, nil
+	}
+	return s, true, nil
+}
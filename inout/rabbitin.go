@@ -53,6 +53,8 @@ func newRabbitIn(manager InOutManager, params map[string]interface{}) InProvider
 		}
 
 		ri.iotype = "RABBITIN"
+		ri.setTagSource("queue", rio.queue)
+		ri.setTagSource("exchange", rio.exchange)
 
 		ri.runFunc = ri.funcReceive
 		ri.connFunc = ri.funcSubscribe
@@ -130,7 +132,8 @@ func (ri *rabbitIn) funcReceive() {
 
 			msg.Ack(false)
 			if len(msg.Body) > 0 && ri.validContentType(msg.ContentType) {
-				go ri.queueMessage(msg.Body, maxMessageSize)
+				go ri.queueMessageFrom(msg.Body, maxMessageSize,
+					map[string]interface{}{"routingKey": msg.RoutingKey})
 			}
 		}
 	}
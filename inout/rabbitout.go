@@ -23,6 +23,8 @@
 package inout
 
 import (
+	"fmt"
+
 	"github.com/ocdogan/fluentgo/config"
 	"github.com/ocdogan/fluentgo/lib"
 	"github.com/streadway/amqp"
@@ -92,15 +94,14 @@ func (ro *rabbitOut) funcChannel() string {
 	return "null"
 }
 
-func (ro *rabbitOut) putMessages(messages []ByteArray, exchange, queue string) {
+func (ro *rabbitOut) putMessages(messages []ByteArray, exchange, queue string) error {
 	if len(messages) == 0 {
-		return
+		return nil
 	}
-	defer recover()
 
 	m := ro.GetManager()
 	if m == nil {
-		return
+		return errOutputStopped
 	}
 
 	var (
@@ -110,20 +111,29 @@ func (ro *rabbitOut) putMessages(messages []ByteArray, exchange, queue string) {
 
 	var body []byte
 	for _, msg := range messages {
-		if !(err == nil && ro.Processing() && m.Processing()) {
-			break
+		if err != nil {
+			return err
+		}
+
+		if !(ro.Processing() && m.Processing()) {
+			return errOutputStopped
 		}
 
 		if len(msg) > 0 {
-			err = func() error {
-				var sendErr error
+			err = func() (sendErr error) {
 				defer func() {
-					sendErr, _ = recover().(error)
+					if e := recover(); e != nil {
+						sendErr = fmt.Errorf("%v", e)
+					}
 				}()
 
 				ro.Connect()
 
 				channel = ro.channel
+				if channel == nil {
+					return fmt.Errorf("Cannot connect to RABBITOUT channel.")
+				}
+
 				if channel != nil {
 					body = []byte(msg)
 					if ro.compressed {
@@ -146,22 +156,25 @@ func (ro *rabbitOut) putMessages(messages []ByteArray, exchange, queue string) {
 			}()
 		}
 	}
+	return err
 }
 
-func (ro *rabbitOut) funcPutMessages(messages []ByteArray, channel string) {
+func (ro *rabbitOut) funcPutMessages(messages []ByteArray, channel string) error {
 	if len(messages) == 0 {
-		return
+		return nil
 	}
-	defer recover()
 
 	exchanges := ro.groupMessages(messages, ro.exchangePath, ro.queuePath)
 	if len(exchanges) == 0 {
-		return
+		return fmt.Errorf("Cannot resolve RABBITOUT exchange for messages.")
 	}
 
 	for exchange, exchangeMap := range exchanges {
 		for queue, msgs := range exchangeMap {
-			ro.putMessages(msgs, exchange, queue)
+			if err := ro.putMessages(msgs, exchange, queue); err != nil {
+				return err
+			}
 		}
 	}
+	return nil
 }
@@ -0,0 +1,302 @@
+//	The MIT License (MIT)
+//
+//	Copyright (c) 2016, Cagatay Dogan
+//
+//	Permission is hereby granted, free of charge, to any person obtaining a copy
+//	of this software and associated documentation files (the "Software"), to deal
+//	in the Software without restriction, including without limitation the rights
+//	to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+//	copies of the Software, and to permit persons to whom the Software is
+//	furnished to do so, subject to the following conditions:
+//
+//		The above copyright notice and this permission notice shall be included in
+//		all copies or substantial portions of the Software.
+//
+//		THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+//		IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+//		FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+//		AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+//		LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+//		OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+//		THE SOFTWARE.
+
+package inout
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ocdogan/fluentgo/config"
+	"github.com/ocdogan/fluentgo/lib"
+)
+
+const (
+	RateLimitDelay = "delay"
+	RateLimitDrop  = "drop"
+)
+
+const (
+	defaultRateBurst = time.Second
+	maxRateKeys      = 1000
+	rateWaitStep     = 50 * time.Millisecond
+)
+
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+type rateBucket struct {
+	records *tokenBucket
+	bytes   *tokenBucket
+	delayed uint64
+	dropped uint64
+}
+
+// rateLimiter limits the records and bytes passing per second, with a
+// separate bucket for every value of the key path if one is given
+type rateLimiter struct {
+	sync.Mutex
+	mode          string
+	recordsPerSec float64
+	bytesPerSec   float64
+	burst         time.Duration
+	keyPath       *lib.JsonPath
+	buckets       map[string]*rateBucket
+	passed        uint64
+	delayed       uint64
+	dropped       uint64
+	delayedFor    time.Duration
+}
+
+func newTokenBucket(rate float64, burst time.Duration) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+
+	size := rate * burst.Seconds()
+	if size < 1 {
+		size = 1
+	}
+
+	return &tokenBucket{
+		rate:   rate,
+		burst:  size,
+		tokens: size,
+		last:   time.Now(),
+	}
+}
+
+func (tb *tokenBucket) refill(now time.Time) {
+	if tb != nil {
+		tb.tokens += now.Sub(tb.last).Seconds() * tb.rate
+		if tb.tokens > tb.burst {
+			tb.tokens = tb.burst
+		}
+		tb.last = now
+	}
+}
+
+// wait returns how long to wait until n tokens are available, requests
+// larger than the bucket are capped to let them pass eventually
+func (tb *tokenBucket) wait(n float64) time.Duration {
+	if tb == nil {
+		return 0
+	}
+
+	if n > tb.burst {
+		n = tb.burst
+	}
+
+	if tb.tokens >= n {
+		return 0
+	}
+	return time.Duration((n - tb.tokens) / tb.rate * float64(time.Second))
+}
+
+func (tb *tokenBucket) take(n float64) {
+	if tb != nil {
+		if n > tb.burst {
+			n = tb.burst
+		}
+		tb.tokens -= n
+	}
+}
+
+func newRateLimiter(params map[string]interface{}) *rateLimiter {
+	recordsPerSec, _ := config.ParamAsFloatWithLimit(params, "rateLimitRecords", 0, 1000000000)
+	bytesPerSec, _ := config.ParamAsFloatWithLimit(params, "rateLimitBytes", 0, 1000000000000)
+
+	if recordsPerSec <= 0 && bytesPerSec <= 0 {
+		return nil
+	}
+
+	burst, ok := config.ParamAsDurationWithLimit(params, "rateLimitBurstMSec", 1, 60000)
+	if ok {
+		burst *= time.Millisecond
+	} else {
+		burst = defaultRateBurst
+	}
+
+	mode, _ := config.ParamAsString(params, "rateLimitMode")
+	mode = strings.ToLower(strings.TrimSpace(mode))
+	if mode != RateLimitDrop {
+		mode = RateLimitDelay
+	}
+
+	var keyPath *lib.JsonPath
+
+	s, ok := config.ParamAsString(params, "rateLimitKey")
+	if s = strings.TrimSpace(s); ok && s != "" {
+		// Accept plain paths like $.service besides the %{...}% form
+		if !strings.Contains(s, "%{") {
+			s = "%{" + s + "}%"
+		}
+		keyPath = lib.NewJsonPath(s)
+	}
+
+	return &rateLimiter{
+		mode:          mode,
+		recordsPerSec: recordsPerSec,
+		bytesPerSec:   bytesPerSec,
+		burst:         burst,
+		keyPath:       keyPath,
+		buckets:       make(map[string]*rateBucket),
+	}
+}
+
+func (rl *rateLimiter) keyOf(data []byte) string {
+	if rl.keyPath == nil {
+		return ""
+	}
+
+	defer recover()
+
+	var jsonData interface{}
+	if !rl.keyPath.IsStatic() {
+		if err := json.Unmarshal(data, &jsonData); err != nil {
+			return ""
+		}
+	}
+
+	result, err := rl.keyPath.Eval(jsonData, true)
+	if err != nil || result == nil {
+		return ""
+	}
+
+	if s, ok := result.(string); ok {
+		return s
+	}
+	return fmt.Sprintf("%v", result)
+}
+
+func (rl *rateLimiter) bucket(key string) *rateBucket {
+	b, ok := rl.buckets[key]
+	if !ok {
+		// Records with too many distinct keys share the default bucket
+		if key != "" && len(rl.buckets) >= maxRateKeys {
+			return rl.bucket("")
+		}
+
+		b = &rateBucket{
+			records: newTokenBucket(rl.recordsPerSec, rl.burst),
+			bytes:   newTokenBucket(rl.bytesPerSec, rl.burst),
+		}
+		rl.buckets[key] = b
+	}
+	return b
+}
+
+// Allow returns false if the record is dropped, otherwise delays the
+// record as much as its bucket needs while the condition holds
+func (rl *rateLimiter) Allow(data []byte, cond func() bool) bool {
+	if rl == nil {
+		return true
+	}
+
+	key := rl.keyOf(data)
+	size := float64(len(data))
+
+	rl.Lock()
+
+	now := time.Now()
+	b := rl.bucket(key)
+
+	b.records.refill(now)
+	b.bytes.refill(now)
+
+	d := b.records.wait(1)
+	if bd := b.bytes.wait(size); bd > d {
+		d = bd
+	}
+
+	if d > 0 && rl.mode == RateLimitDrop {
+		b.dropped++
+		rl.dropped++
+		rl.Unlock()
+		return false
+	}
+
+	// Delayed records borrow from the bucket, so the ones that come
+	// after them wait in turn
+	b.records.take(1)
+	b.bytes.take(size)
+
+	rl.passed++
+	if d > 0 {
+		b.delayed++
+		rl.delayed++
+		rl.delayedFor += d
+	}
+
+	rl.Unlock()
+
+	deadline := now.Add(d)
+	for d > 0 && (cond == nil || cond()) {
+		if d > rateWaitStep {
+			d = rateWaitStep
+		}
+		time.Sleep(d)
+		d = deadline.Sub(time.Now())
+	}
+	return true
+}
+
+func (rl *rateLimiter) Info() *RateLimitInfo {
+	if rl == nil {
+		return nil
+	}
+
+	rl.Lock()
+	defer rl.Unlock()
+
+	info := &RateLimitInfo{
+		Mode:          rl.mode,
+		RecordsPerSec: rl.recordsPerSec,
+		BytesPerSec:   rl.bytesPerSec,
+		Passed:        rl.passed,
+		Delayed:       rl.delayed,
+		Dropped:       rl.dropped,
+		DelayedMSec:   int64(rl.delayedFor / time.Millisecond),
+	}
+
+	if rl.keyPath != nil {
+		info.Key = rl.keyPath.String()
+		info.Keys = make(map[string]*RateKeyInfo, len(rl.buckets))
+
+		for key, b := range rl.buckets {
+			if b.delayed > 0 || b.dropped > 0 {
+				info.Keys[key] = &RateKeyInfo{
+					Delayed: b.delayed,
+					Dropped: b.dropped,
+				}
+			}
+		}
+	}
+	return info
+}
@@ -69,6 +69,7 @@ func newRedisChanIn(manager InOutManager, params map[string]interface{}) InProvi
 		}
 
 		ri.iotype = "REDISCHANIN"
+		ri.setTagSource("channel", rio.channel)
 
 		ri.runFunc = ri.funcReceive
 		ri.connFunc = ri.funcInitPubSub
@@ -148,11 +149,13 @@ func (ri *redisChanIn) funcReceive() {
 			switch m := pConn.Receive().(type) {
 			case redis.Message:
 				if !completed {
-					ri.queueMessage(m.Data, maxMessageSize)
+					ri.queueMessageFrom(m.Data, maxMessageSize,
+						map[string]interface{}{"channel": m.Channel})
 				}
 			case redis.PMessage:
 				if !completed {
-					ri.queueMessage(m.Data, maxMessageSize)
+					ri.queueMessageFrom(m.Data, maxMessageSize,
+						map[string]interface{}{"channel": m.Channel, "pattern": m.Pattern})
 				}
 			case error:
 				if !completed {
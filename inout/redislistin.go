@@ -61,6 +61,7 @@ func newRedisListIn(manager InOutManager, params map[string]interface{}) InProvi
 		}
 
 		ri.iotype = "REDISLISTIN"
+		ri.setTagSource("channel", rio.channel)
 
 		ri.runFunc = ri.funcReceive
 		ri.connFunc = ri.funcPing
@@ -96,6 +97,11 @@ func (ri *redisListIn) funcReceive() {
 				return
 			}
 
+			// Stop fetching while the queue applies backpressure
+			if !ri.waitForQueue() {
+				continue
+			}
+
 			ri.Connect(true)
 
 			conn := ri.conn
@@ -122,14 +128,14 @@ func (ri *redisListIn) funcReceive() {
 			switch m := rep.(type) {
 			case []byte:
 				if !completed {
-					go ri.queueMessage(m, maxMessageSize)
+					ri.queueMessageAsync(m, maxMessageSize)
 				}
 			case string:
 				if !completed {
 					if ri.blockingCmd {
 						m = strings.SplitN(m, "\n", 2)[1]
 					}
-					go ri.queueMessage([]byte(m), maxMessageSize)
+					ri.queueMessageAsync([]byte(m), maxMessageSize)
 				}
 			case error:
 				if !completed {
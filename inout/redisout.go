@@ -24,6 +24,7 @@ package inout
 
 import (
 	"encoding/json"
+	"fmt"
 	"strings"
 
 	"math"
@@ -86,10 +87,21 @@ func newRedisOut(manager InOutManager, params map[string]interface{}) OutSender
 
 	ro.getDestinationFunc = ro.funcChannel
 	ro.sendChunkFunc = ro.funcSendMessagesChunk
+	ro.healthCheckFunc = ro.funcHealthCheck
 
 	return ro
 }
 
+func (ro *redisOut) funcHealthCheck() error {
+	ro.Connect(true)
+
+	conn := ro.conn
+	if conn == nil {
+		return fmt.Errorf("Cannot connect to REDISOUT server.")
+	}
+	return ro.ping(conn)
+}
+
 func (ro *redisOut) funcPing(conn redis.Conn) error {
 	var err error
 	defer func() {
@@ -109,15 +121,14 @@ func (ro *redisOut) funcChannel() string {
 	return "null"
 }
 
-func (ro *redisOut) putMessages(messages []ByteArray, channel string) {
+func (ro *redisOut) putMessages(messages []ByteArray, channel string) error {
 	if len(messages) == 0 {
-		return
+		return nil
 	}
-	defer recover()
 
 	m := ro.GetManager()
 	if m == nil {
-		return
+		return errOutputStopped
 	}
 
 	var (
@@ -127,20 +138,29 @@ func (ro *redisOut) putMessages(messages []ByteArray, channel string) {
 	)
 
 	for _, msg := range messages {
-		if !(err == nil && ro.Processing() && m.Processing()) {
-			break
+		if err != nil {
+			return err
+		}
+
+		if !(ro.Processing() && m.Processing()) {
+			return errOutputStopped
 		}
 
 		if len(msg) > 0 {
-			err = func() error {
-				var sendErr error
+			err = func() (sendErr error) {
 				defer func() {
-					sendErr, _ = recover().(error)
+					if e := recover(); e != nil {
+						sendErr = fmt.Errorf("%v", e)
+					}
 				}()
 
 				ro.Connect(true)
 
 				conn = ro.conn
+				if conn == nil {
+					return fmt.Errorf("Cannot connect to REDISOUT server.")
+				}
+
 				if conn != nil {
 					if ro.compressed {
 						rmsg = lib.BytesToString(lib.Compress([]byte(msg), ro.compressType))
@@ -148,7 +168,7 @@ func (ro *redisOut) putMessages(messages []ByteArray, channel string) {
 						rmsg = lib.BytesToString([]byte(msg))
 					}
 
-					sendErr = conn.Send(ro.command, channel, msg)
+					sendErr = conn.Send(ro.command, channel, rmsg)
 
 					if sendErr == nil && ro.trimSize > 0 {
 						func() {
@@ -161,26 +181,32 @@ func (ro *redisOut) putMessages(messages []ByteArray, channel string) {
 			}()
 		}
 	}
+
+	if err == nil && conn != nil {
+		// Flush the pipelined commands and wait for their replies
+		_, err = conn.Do("")
+	}
+	return err
 }
 
-func (ro *redisOut) funcSendMessagesChunk(messages []ByteArray, channel string) {
+func (ro *redisOut) funcSendMessagesChunk(messages []ByteArray, channel string) error {
 	if len(messages) == 0 {
-		return
+		return nil
 	}
-	defer recover()
 
 	if ro.channelPath.IsStatic() {
 		epath, err := ro.channelPath.Eval(nil, true)
 		if err != nil {
-			return
+			return err
 		}
 
 		if epath != nil {
 			channel, ok := epath.(string)
 			if ok {
-				ro.putMessages(messages, channel)
+				return ro.putMessages(messages, channel)
 			}
 		}
+		return fmt.Errorf("Cannot resolve REDISOUT channel.")
 	} else {
 		var (
 			channel     string
@@ -215,7 +241,10 @@ func (ro *redisOut) funcSendMessagesChunk(messages []ByteArray, channel string)
 		}
 
 		for channel, channelList = range channels {
-			ro.putMessages(messages, channel)
+			if err := ro.putMessages(messages, channel); err != nil {
+				return err
+			}
 		}
 	}
+	return nil
 }
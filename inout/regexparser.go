@@ -0,0 +1,118 @@
+//	The MIT License (MIT)
+//
+//	Copyright (c) 2016, Cagatay Dogan
+//
+//	Permission is hereby granted, free of charge, to any person obtaining a copy
+//	of this software and associated documentation files (the "Software"), to deal
+//	in the Software without restriction, including without limitation the rights
+//	to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+//	copies of the Software, and to permit persons to whom the Software is
+//	furnished to do so, subject to the following conditions:
+//
+//		The above copyright notice and this permission notice shall be included in
+//		all copies or substantial portions of the Software.
+//
+//		THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+//		IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+//		FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+//		AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+//		LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+//		OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+//		THE SOFTWARE.
+
+package inout
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/ocdogan/fluentgo/config"
+	"github.com/ocdogan/fluentgo/lib"
+)
+
+// regexParser maps the named capture groups of the expression to the
+// record fields, converting them to the given field types
+type regexParser struct {
+	expr       *regexp.Regexp
+	names      []string
+	types      map[string]*fieldType
+	timeFormat string
+}
+
+func init() {
+	RegisterParser("regex", newRegexParser)
+	RegisterParser("regexp", newRegexParser)
+}
+
+func newRegexParser(params map[string]interface{}) (Parser, error) {
+	expression, _ := config.ParamAsString(params, "expression")
+	if strings.TrimSpace(expression) == "" {
+		return nil, fmt.Errorf("Regex parser expression is not set.")
+	}
+
+	types, err := parseFieldTypes(params["types"])
+	if err != nil {
+		return nil, err
+	}
+
+	timeFormat, _ := config.ParamAsString(params, "timeFormat")
+	return newRegexParserWith(expression, types, timeFormat)
+}
+
+func newRegexParserWith(expression string, types map[string]*fieldType, timeFormat string) (*regexParser, error) {
+	expr, err := regexp.Compile(expression)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid regex parser expression. %s", err)
+	}
+
+	hasNames := false
+	for _, name := range expr.SubexpNames() {
+		if name != "" {
+			hasNames = true
+			break
+		}
+	}
+
+	if !hasNames {
+		return nil, fmt.Errorf("Regex parser expression has no named groups.")
+	}
+
+	timeFormat = strings.TrimSpace(timeFormat)
+	if timeFormat == "" {
+		timeFormat = lib.ISO8601Time
+	}
+
+	return &regexParser{
+		expr:       expr,
+		names:      expr.SubexpNames(),
+		types:      types,
+		timeFormat: timeFormat,
+	}, nil
+}
+
+func (rp *regexParser) Parse(data []byte) (map[string]interface{}, error) {
+	loc := rp.expr.FindSubmatchIndex(data)
+	if loc == nil {
+		return nil, fmt.Errorf("Data does not match the regex parser expression.")
+	}
+
+	record := make(map[string]interface{}, len(rp.names))
+
+	for i, name := range rp.names {
+		// Skip the groups of the optional parts not matched
+		if i == 0 || name == "" || 2*i+1 >= len(loc) || loc[2*i] < 0 {
+			continue
+		}
+
+		value, ok, err := rp.types[name].convert(string(data[loc[2*i]:loc[2*i+1]]), rp.timeFormat)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot convert field '%s'. %s", name, err)
+		}
+
+		if ok {
+			record[name] = value
+		}
+	}
+	return record, nil
+}
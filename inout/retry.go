@@ -0,0 +1,150 @@
+//	The MIT License (MIT)
+//
+//	Copyright (c) 2016, Cagatay Dogan
+//
+//	Permission is hereby granted, free of charge, to any person obtaining a copy
+//	of this software and associated documentation files (the "Software"), to deal
+//	in the Software without restriction, including without limitation the rights
+//	to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+//	copies of the Software, and to permit persons to whom the Software is
+//	furnished to do so, subject to the following conditions:
+//
+//		The above copyright notice and this permission notice shall be included in
+//		all copies or substantial portions of the Software.
+//
+//		THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+//		IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+//		FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+//		AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+//		LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+//		OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+//		THE SOFTWARE.
+
+package inout
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/ocdogan/fluentgo/config"
+	"github.com/ocdogan/fluentgo/lib"
+)
+
+const (
+	defaultRetryAttempts = 3
+	defaultRetryWait     = 100 * time.Millisecond
+	defaultRetryMaxWait  = 30 * time.Second
+	retryBudgetPeriod    = time.Minute
+)
+
+type retryPolicy struct {
+	sync.Mutex
+	attempts    int
+	wait        time.Duration
+	maxWait     time.Duration
+	budget      int
+	budgetUsed  int
+	budgetStart time.Time
+}
+
+func newRetryPolicy(params map[string]interface{}) *retryPolicy {
+	attempts, ok := config.ParamAsIntWithLimit(params, "retryAttempts", 1, 100)
+	if !ok {
+		attempts = defaultRetryAttempts
+	}
+
+	wait, ok := config.ParamAsDurationWithLimit(params, "retryWaitMSec", 1, 60000)
+	if ok {
+		wait *= time.Millisecond
+	} else {
+		wait = defaultRetryWait
+	}
+
+	maxWait, ok := config.ParamAsDurationWithLimit(params, "retryMaxWaitMSec", 1, 600000)
+	if ok {
+		maxWait *= time.Millisecond
+	} else {
+		maxWait = defaultRetryMaxWait
+	}
+
+	if maxWait < wait {
+		maxWait = wait
+	}
+
+	// Number of retries allowed in every minute, 0 means unlimited
+	budget, ok := config.ParamAsIntWithLimit(params, "retryBudget", 0, 1000000)
+	if !ok {
+		budget = 0
+	}
+
+	return &retryPolicy{
+		attempts:    attempts,
+		wait:        wait,
+		maxWait:     maxWait,
+		budget:      budget,
+		budgetStart: time.Now(),
+	}
+}
+
+func (rp *retryPolicy) Attempts() int {
+	return rp.attempts
+}
+
+// backoff returns an exponentially growing wait for the given retry
+// with half of it randomized to spread the retries of concurrent senders
+func (rp *retryPolicy) backoff(retry int) time.Duration {
+	d := rp.wait
+	for i := 1; i < retry && d < rp.maxWait; i++ {
+		d *= 2
+	}
+
+	if d > rp.maxWait {
+		d = rp.maxWait
+	}
+
+	half := int64(d / 2)
+	if half <= 0 {
+		return d
+	}
+	return time.Duration(half + rand.Int63n(half+1))
+}
+
+func (rp *retryPolicy) acquire() bool {
+	if rp.budget <= 0 {
+		return true
+	}
+
+	rp.Lock()
+	defer rp.Unlock()
+
+	now := time.Now()
+	if now.Sub(rp.budgetStart) >= retryBudgetPeriod {
+		rp.budgetStart = now
+		rp.budgetUsed = 0
+	}
+
+	if rp.budgetUsed < rp.budget {
+		rp.budgetUsed++
+		return true
+	}
+	return false
+}
+
+// waitFor sleeps before the given retry while the condition holds,
+// returns false if the retry is not allowed or the wait is interrupted
+func (rp *retryPolicy) waitFor(retry int, cond func() bool) bool {
+	if retry >= rp.attempts || !rp.acquire() {
+		return false
+	}
+
+	deadline := time.Now().Add(rp.backoff(retry))
+	for cond() {
+		d := deadline.Sub(time.Now())
+		if d <= 0 {
+			return true
+		}
+		time.Sleep(time.Duration(lib.MinInt64(int64(d), int64(50*time.Millisecond))))
+	}
+	return false
+}
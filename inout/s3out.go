@@ -45,6 +45,28 @@ type s3Out struct {
 	client   *s3.S3
 }
 
+// s3PutError reports the messages of the chunk whose objects could not be put,
+// so only they are sent again
+type s3PutError struct {
+	failed []int
+	err    error
+}
+
+func (e *s3PutError) Error() string {
+	return fmt.Sprintf("S3OUT failed to put %d messages: %s", len(e.failed), e.err)
+}
+
+func (e *s3PutError) Failed() []int {
+	return e.failed
+}
+
+func (e *s3PutError) add(indexes []int, err error) {
+	e.failed = append(e.failed, indexes...)
+	if e.err == nil {
+		e.err = err
+	}
+}
+
 var (
 	s3oIndex         uint64
 	s3oLastIndexDate = time.Now()
@@ -143,12 +165,10 @@ func (s3o *s3Out) getFilename(prefix string) string {
 		t.Hour(), t.Minute(), t.Second(), index)
 }
 
-func (s3o *s3Out) putMessages(messages []ByteArray, bucket, filename string) {
-	defer recover()
-
+func (s3o *s3Out) putMessages(messages []ByteArray, bucket, filename string) error {
 	client := s3o.getClient()
 	if client == nil {
-		return
+		return fmt.Errorf("Cannot create S3OUT client.")
 	}
 
 	paths := strings.Split(bucket,"/")
@@ -211,27 +231,41 @@ func (s3o *s3Out) putMessages(messages []ByteArray, bucket, filename string) {
 			params.ContentType = aws.String("text/plain")
 		}
 
-		client.PutObject(params)
+		_, err := client.PutObject(params)
+		return err
 	}
+	return nil
 }
 
-func (s3o *s3Out) funcPutMessages(messages []ByteArray, filename string) {
+func (s3o *s3Out) funcPutMessages(messages []ByteArray, filename string) error {
 	if len(messages) == 0 {
-		return
+		return nil
 	}
-	defer recover()
 
-	buckets := s3o.groupMessages(messages, s3o.bucket, s3o.prefix)
+	buckets := s3o.groupMessageIndexes(messages, s3o.bucket, s3o.prefix)
 	if buckets == nil {
-		return
+		return fmt.Errorf("Cannot resolve S3OUT bucket for messages.")
 	}
 
+	result := &s3PutError{}
 	for bucket, bucketMap := range buckets {
-		for prefix, msgs := range bucketMap {
+		for prefix, indexes := range bucketMap {
+			msgs := make([]ByteArray, len(indexes))
+			for i, index := range indexes {
+				msgs[i] = messages[index]
+			}
+
 			filename := s3o.getFilename(prefix)
-			s3o.putMessages(msgs, bucket, filename)
+			if err := s3o.putMessages(msgs, bucket, filename); err != nil {
+				result.add(indexes, err)
+			}
 		}
 	}
+
+	if len(result.failed) > 0 {
+		return result
+	}
+	return nil
 }
 
 func (s3o *s3Out) getClient() *s3.S3 {
@@ -24,6 +24,7 @@ package inout
 
 import (
 	"errors"
+	"path"
 	"sync"
 	"time"
 
@@ -76,6 +77,8 @@ func newSqsIn(manager InOutManager, params map[string]interface{}) InProvider {
 	}
 
 	si.iotype = "SQSIN"
+	si.setTagSource("queueURL", sio.queueURL)
+	si.setTagSource("queue", path.Base(sio.queueURL))
 
 	si.runFunc = si.funcReceive
 
@@ -128,6 +131,11 @@ func (si *sqsIn) funcReceive() {
 				return
 			}
 
+			// Stop fetching while the queue applies backpressure
+			if !si.waitForQueue() {
+				continue
+			}
+
 			si.Connect()
 
 			client := si.client
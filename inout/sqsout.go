@@ -24,6 +24,7 @@ package inout
 
 import (
 	"encoding/json"
+	"fmt"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/sqs"
@@ -92,15 +93,14 @@ func (sqso *sqsOut) funcGetObjectName() string {
 	return "null"
 }
 
-func (sqso *sqsOut) putMessages(messages []ByteArray, queueURL string) {
+func (sqso *sqsOut) putMessages(messages []ByteArray, queueURL string) error {
 	if len(messages) == 0 {
-		return
+		return nil
 	}
-	defer recover()
 
 	client := sqso.getClient()
 	if client == nil {
-		return
+		return fmt.Errorf("Cannot create SQSOUT client.")
 	}
 
 	for _, msg := range messages {
@@ -115,29 +115,32 @@ func (sqso *sqsOut) putMessages(messages []ByteArray, queueURL string) {
 				params.MessageAttributes = sqso.attributes
 			}
 
-			client.SendMessage(params)
+			if _, err := client.SendMessage(params); err != nil {
+				return err
+			}
 		}
 	}
+	return nil
 }
 
-func (sqso *sqsOut) funcPutMessages(messages []ByteArray, indexName string) {
+func (sqso *sqsOut) funcPutMessages(messages []ByteArray, indexName string) error {
 	if len(messages) == 0 {
-		return
+		return nil
 	}
-	defer recover()
 
 	if sqso.queuePath.IsStatic() {
 		epath, err := sqso.queuePath.Eval(nil, true)
 		if err != nil {
-			return
+			return err
 		}
 
 		if epath != nil {
 			queueURL, ok := epath.(string)
 			if ok {
-				sqso.putMessages(messages, queueURL)
+				return sqso.putMessages(messages, queueURL)
 			}
 		}
+		return fmt.Errorf("Cannot resolve SQSOUT queue.")
 	} else {
 		var (
 			epath     interface{}
@@ -172,9 +175,12 @@ func (sqso *sqsOut) funcPutMessages(messages []ByteArray, indexName string) {
 		}
 
 		for queueURL, queueList = range queues {
-			sqso.putMessages(messages, queueURL)
+			if err := sqso.putMessages(messages, queueURL); err != nil {
+				return err
+			}
 		}
 	}
+	return nil
 }
 
 func (sqso *sqsOut) getClient() *sqs.SQS {
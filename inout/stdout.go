@@ -61,14 +61,15 @@ func (stdo *stdOut) funcGetObjectName() string {
 	return "stdout"
 }
 
-func (stdo *stdOut) funcOutMessages(messages []ByteArray, indexName string) {
+func (stdo *stdOut) funcOutMessages(messages []ByteArray, indexName string) error {
 	if len(messages) > 0 {
-		defer recover()
-
 		for _, msg := range messages {
 			if len(msg) > 0 {
-				fmt.Println(string(msg))
+				if _, err := fmt.Println(string(msg)); err != nil {
+					return err
+				}
 			}
 		}
 	}
+	return nil
 }
@@ -0,0 +1,424 @@
+//	The MIT License (MIT)
+//
+//	Copyright (c) 2016, Cagatay Dogan
+//
+//	Permission is hereby granted, free of charge, to any person obtaining a copy
+//	of this software and associated documentation files (the "Software"), to deal
+//	in the Software without restriction, including without limitation the rights
+//	to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+//	copies of the Software, and to permit persons to whom the Software is
+//	furnished to do so, subject to the following conditions:
+//
+//		The above copyright notice and this permission notice shall be included in
+//		all copies or substantial portions of the Software.
+//
+//		THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+//		IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+//		FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+//		AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+//		LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+//		OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+//		THE SOFTWARE.
+
+package inout
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ocdogan/fluentgo/config"
+	"github.com/ocdogan/fluentgo/lib"
+)
+
+const (
+	syslogMaxFrameSize  = 1024 * 1024
+	syslogReadBufSize   = 64 * 1024
+	syslogMaxLengthSize = 10
+)
+
+// syslogIn receives syslog messages over UDP, TCP or TLS, the TCP streams
+// can be framed either by octet counting or by new lines (RFC6587)
+type syslogIn struct {
+	inHandler
+	tcpUDPIO
+	protocol    string
+	bufferSize  int
+	lck         sync.Mutex
+	connections []net.Conn
+	listener    *net.Listener
+	udpConn     *net.UDPConn
+}
+
+func init() {
+	RegisterIn("syslog", newSyslogIn)
+	RegisterIn("syslogin", newSyslogIn)
+}
+
+func newSyslogIn(manager InOutManager, params map[string]interface{}) InProvider {
+	tuio := newTCPUDPIO(manager, params)
+	if tuio == nil {
+		return nil
+	}
+
+	ih := newInHandler(manager, params)
+	if ih == nil {
+		return nil
+	}
+
+	protocol, _ := config.ParamAsString(params, "protocol")
+	protocol = strings.ToLower(strings.TrimSpace(protocol))
+
+	switch protocol {
+	case "":
+		protocol = "udp"
+	case "udp", "tcp":
+	case "tls":
+		// Do not fall back to plain text when the certificate is missing
+		if ih.certFile == "" || ih.keyFile == "" {
+			return nil
+		}
+		protocol = "tcp"
+	default:
+		return nil
+	}
+
+	bufferSize, ok := config.ParamAsIntWithLimit(params, "bufferSize", 1024, math.MaxInt16)
+	if !ok {
+		bufferSize = int(math.MaxInt16)
+	}
+
+	// Parse the messages as syslog unless another parser is set
+	if ih.parser == nil {
+		parser, err := newInputParser(map[string]interface{}{"parser": "syslog"})
+		if err != nil {
+			return nil
+		}
+		ih.parser = parser
+	}
+
+	sin := &syslogIn{
+		inHandler:  *ih,
+		tcpUDPIO:   *tuio,
+		protocol:   protocol,
+		bufferSize: bufferSize,
+	}
+
+	sin.iotype = "SYSLOGIN"
+	sin.setTagSource("host", tuio.host)
+
+	sin.runFunc = sin.funcReceive
+	sin.afterCloseFunc = sin.funcAfterClose
+	sin.loadTLSFunc = sin.loadServerCert
+
+	return sin
+}
+
+func (sin *syslogIn) funcAfterClose() {
+	defer recover()
+
+	if sin.listener != nil {
+		listener := *sin.listener
+		sin.listener = nil
+
+		listener.Close()
+	}
+
+	if sin.udpConn != nil {
+		conn := sin.udpConn
+		sin.udpConn = nil
+
+		conn.Close()
+	}
+
+	sin.lck.Lock()
+	conns := sin.connections
+	sin.connections = nil
+	sin.lck.Unlock()
+
+	for _, conn := range conns {
+		sin.tryToCloseConn(conn)
+	}
+}
+
+func (sin *syslogIn) loadServerCert() (secure bool, config *tls.Config, err error) {
+	if sin.protocol != "tcp" {
+		return false, nil, nil
+	}
+
+	config, err = lib.LoadServerCert(sin.certFile, sin.keyFile, sin.caFile, sin.verifySsl)
+	secure = (err == nil) && (config != nil)
+	return
+}
+
+func (sin *syslogIn) funcReceive() {
+	defer sin.InformStop()
+	sin.InformStart()
+
+	err := sin.loadCert()
+	if err != nil {
+		return
+	}
+
+	completed := false
+	var (
+		chanOpen    bool
+		listenEnded chan bool
+	)
+
+	for !completed {
+		if !chanOpen {
+			listenEnded = make(chan bool)
+		}
+
+		if sin.protocol == "tcp" {
+			go sin.listenTCP(listenEnded)
+		} else {
+			go sin.listenUDP(listenEnded)
+		}
+
+		select {
+		case <-sin.completed:
+			completed = true
+			sin.Close()
+			return
+		case _, chanOpen = <-listenEnded:
+			if completed {
+				return
+			}
+		}
+	}
+}
+
+func (sin *syslogIn) listenTCP(listenEnded chan bool) {
+	lg := sin.logger
+	if lg != nil {
+		defer lg.Printf("'SYSLOGIN' completed listening at 'tcp://%s'.\n", sin.host)
+		lg.Printf("'SYSLOGIN' starting to listen at 'tcp://%s'...\n", sin.host)
+	}
+
+	var (
+		err      error
+		listener net.Listener
+	)
+
+	if sin.secure && sin.tlsConfig != nil {
+		listener, err = tls.Listen("tcp", sin.host, sin.tlsConfig)
+	} else {
+		listener, err = net.Listen("tcp", sin.host)
+	}
+
+	if err != nil {
+		if lg != nil {
+			lg.Printf("'SYSLOGIN' cannot listen at 'tcp://%s': %s\n", sin.host, err)
+		}
+
+		time.Sleep(time.Second)
+		close(listenEnded)
+		return
+	}
+
+	// Close the listener when the application closes.
+	defer func(l net.Listener, ch chan bool) {
+		defer recover()
+		l.Close()
+		close(ch)
+	}(listener, listenEnded)
+
+	sin.listener = &listener
+	sin.acceptTCP(listener)
+}
+
+func (sin *syslogIn) acceptTCP(listener net.Listener) {
+	acceptTCP(listener, sin.iotype, sin.Processing, sin.logger, func(conn net.Conn) {
+		sin.lck.Lock()
+		sin.connections = append(sin.connections, conn)
+		sin.lck.Unlock()
+
+		go sin.onNewConnection(conn)
+	})
+}
+
+func (sin *syslogIn) remove(conn net.Conn) {
+	sin.lck.Lock()
+	defer sin.lck.Unlock()
+
+	for index, c := range sin.connections {
+		if c == conn {
+			sin.connections = append(sin.connections[:index], sin.connections[index+1:]...)
+			break
+		}
+	}
+}
+
+func (sin *syslogIn) onNewConnection(conn net.Conn) {
+	defer func() {
+		recover()
+		sin.tryToCloseConn(conn)
+		sin.remove(conn)
+	}()
+
+	maxMessageSize := sin.getMaxMessageSize()
+
+	maxFrameSize := maxMessageSize
+	if maxFrameSize < 1 {
+		maxFrameSize = syslogMaxFrameSize
+	}
+
+	source := map[string]interface{}{"remote": conn.RemoteAddr().String()}
+	reader := bufio.NewReaderSize(conn, syslogReadBufSize)
+
+	for sin.Processing() {
+		frame, err := readSyslogFrame(reader, maxFrameSize)
+		if len(frame) > 0 {
+			sin.queueMessageFrom(frame, maxMessageSize, source)
+		}
+
+		if err != nil {
+			l := sin.logger
+			if l != nil {
+				if err == io.EOF {
+					l.Printf("Closing connection on 'SYSLOGIN' %s\n", conn.LocalAddr())
+				} else {
+					l.Printf("Error on 'SYSLOGIN' reading, closing connection %s: %s\n", conn.LocalAddr(), err)
+				}
+			}
+			return
+		}
+	}
+}
+
+// readSyslogFrame reads the next message which is either prefixed with its
+// length and a space (octet counting) or ends with a new line, a message cut
+// by an error is dropped except the last line of the stream at EOF
+func readSyslogFrame(reader *bufio.Reader, maxFrameSize int) ([]byte, error) {
+	for i := 1; i <= syslogMaxLengthSize+1; i++ {
+		b, err := reader.Peek(i)
+		if err != nil {
+			if len(b) > 0 && err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+
+		c := b[i-1]
+		if c == ' ' && i > 1 {
+			frameLen, err := strconv.Atoi(string(b[:i-1]))
+			if err != nil || frameLen > maxFrameSize {
+				return nil, fmt.Errorf("Invalid syslog frame length '%s'.", b[:i-1])
+			}
+
+			reader.Discard(i)
+
+			frame := make([]byte, frameLen)
+			if _, err = io.ReadFull(reader, frame); err != nil {
+				return nil, err
+			}
+			return frame, nil
+		}
+
+		if c < '0' || c > '9' || (i == 1 && c == '0') {
+			break
+		}
+	}
+
+	var (
+		frame []byte
+		err   error
+		line  []byte
+	)
+
+	for {
+		line, err = reader.ReadSlice('\n')
+		if len(frame)+len(line) > maxFrameSize {
+			return nil, fmt.Errorf("Syslog message exceeds %d bytes.", maxFrameSize)
+		}
+
+		frame = append(frame, line...)
+		if err != bufio.ErrBufferFull {
+			break
+		}
+	}
+
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	frame = bytes.TrimRight(frame, "\r\n\x00")
+	return frame, err
+}
+
+func (sin *syslogIn) listenUDP(listenEnded chan bool) {
+	lg := sin.logger
+	if lg != nil {
+		defer lg.Printf("'SYSLOGIN' completed listening at 'udp://%s'.\n", sin.host)
+		lg.Printf("'SYSLOGIN' starting to listen at 'udp://%s'...\n", sin.host)
+	}
+
+	udpAddr, err := net.ResolveUDPAddr("udp", sin.host)
+	if err == nil {
+		var conn *net.UDPConn
+
+		conn, err = net.ListenUDP("udp", udpAddr)
+		if err == nil {
+			// Close the connection when the application closes.
+			defer func(c *net.UDPConn, ch chan bool) {
+				defer recover()
+				c.Close()
+				close(ch)
+			}(conn, listenEnded)
+
+			sin.udpConn = conn
+			sin.acceptUDP(conn)
+			return
+		}
+	}
+
+	if lg != nil {
+		lg.Printf("'SYSLOGIN' cannot listen at 'udp://%s': %s\n", sin.host, err)
+	}
+
+	time.Sleep(time.Second)
+	close(listenEnded)
+}
+
+func (sin *syslogIn) acceptUDP(conn *net.UDPConn) {
+	buffer := make([]byte, sin.bufferSize)
+	maxMessageSize := sin.getMaxMessageSize()
+
+	lg := sin.logger
+	for sin.Processing() {
+		reqLen, addr, err := conn.ReadFromUDP(buffer)
+		if err != nil {
+			errStr := err.Error()
+			if strings.Contains(errStr, "closed network") {
+				return
+			}
+
+			if lg != nil {
+				lg.Println("Error on 'SYSLOGIN' reading: ", errStr)
+			}
+			continue
+		}
+
+		if reqLen > 0 {
+			msg := make([]byte, reqLen)
+			copy(msg, buffer[:reqLen])
+
+			var source map[string]interface{}
+			if addr != nil {
+				source = map[string]interface{}{"remote": addr.String()}
+			}
+
+			go sin.queueMessageFrom(msg, maxMessageSize, source)
+		}
+	}
+}
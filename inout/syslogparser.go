@@ -0,0 +1,277 @@
+//	The MIT License (MIT)
+//
+//	Copyright (c) 2016, Cagatay Dogan
+//
+//	Permission is hereby granted, free of charge, to any person obtaining a copy
+//	of this software and associated documentation files (the "Software"), to deal
+//	in the Software without restriction, including without limitation the rights
+//	to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+//	copies of the Software, and to permit persons to whom the Software is
+//	furnished to do so, subject to the following conditions:
+//
+//		The above copyright notice and this permission notice shall be included in
+//		all copies or substantial portions of the Software.
+//
+//		THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+//		IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+//		FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+//		AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+//		LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+//		OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+//		THE SOFTWARE.
+
+package inout
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ocdogan/fluentgo/config"
+	"github.com/ocdogan/fluentgo/lib"
+)
+
+const rfc3164TimeLayout = "Jan _2 15:04:05"
+
+var (
+	syslogFacilities = []string{
+		"kern", "user", "mail", "daemon", "auth", "syslog", "lpr", "news",
+		"uucp", "cron", "authpriv", "ftp", "ntp", "security", "console", "solaris-cron",
+		"local0", "local1", "local2", "local3", "local4", "local5", "local6", "local7",
+	}
+
+	syslogSeverities = []string{
+		"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug",
+	}
+
+	utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+)
+
+// syslogParser parses the RFC5424 and RFC3164 syslog messages
+type syslogParser struct {
+	timeFormat string
+}
+
+func init() {
+	RegisterParser("syslog", newSyslogParser)
+}
+
+func newSyslogParser(params map[string]interface{}) (Parser, error) {
+	timeFormat, _ := config.ParamAsString(params, "timeFormat")
+	timeFormat = strings.TrimSpace(timeFormat)
+	if timeFormat == "" {
+		timeFormat = lib.ISO8601Time
+	}
+
+	return &syslogParser{timeFormat: timeFormat}, nil
+}
+
+func (sp *syslogParser) Parse(data []byte) (map[string]interface{}, error) {
+	data = bytes.TrimRight(data, "\r\n\x00")
+
+	record := make(map[string]interface{})
+
+	rest, err := sp.parsePriority(data, record)
+	if err != nil {
+		return nil, err
+	}
+
+	// RFC5424 messages have a version after the priority
+	if len(rest) > 1 && rest[0] >= '1' && rest[0] <= '9' && rest[1] == ' ' {
+		record["version"] = int(rest[0] - '0')
+		err = sp.parseRFC5424(rest[2:], record)
+	} else {
+		sp.parseRFC3164(rest, record)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+func (sp *syslogParser) parsePriority(data []byte, record map[string]interface{}) ([]byte, error) {
+	if len(data) < 3 || data[0] != '<' {
+		return nil, fmt.Errorf("Syslog priority is missing.")
+	}
+
+	end := bytes.IndexByte(data[:lib.MinInt(len(data), 5)], '>')
+	if end < 2 {
+		return nil, fmt.Errorf("Invalid syslog priority.")
+	}
+
+	pri, err := strconv.Atoi(string(data[1:end]))
+	if err != nil || pri < 0 || pri > 191 {
+		return nil, fmt.Errorf("Invalid syslog priority.")
+	}
+
+	record["facility"] = syslogFacilities[pri/8]
+	record["severity"] = syslogSeverities[pri%8]
+
+	return data[end+1:], nil
+}
+
+// nextField returns the next space separated field and the rest
+func nextField(data []byte) ([]byte, []byte) {
+	if i := bytes.IndexByte(data, ' '); i > -1 {
+		return data[:i], data[i+1:]
+	}
+	return data, nil
+}
+
+func setSyslogField(record map[string]interface{}, name string, value []byte) {
+	if len(value) > 0 && !(len(value) == 1 && value[0] == '-') {
+		record[name] = string(value)
+	}
+}
+
+func (sp *syslogParser) parseRFC5424(data []byte, record map[string]interface{}) error {
+	var field []byte
+
+	field, data = nextField(data)
+	if len(field) > 0 && string(field) != "-" {
+		t, err := time.Parse(time.RFC3339, string(field))
+		if err != nil {
+			return fmt.Errorf("Invalid syslog timestamp. %s", err)
+		}
+		record["time"] = t.Format(sp.timeFormat)
+	}
+
+	for _, name := range []string{"host", "app", "procid", "msgid"} {
+		field, data = nextField(data)
+		setSyslogField(record, name, field)
+	}
+
+	if len(data) > 0 && data[0] == '[' {
+		sd, rest, err := parseStructuredData(data)
+		if err != nil {
+			return err
+		}
+
+		record["sd"] = sd
+		data = rest
+	} else {
+		// Nil structured data
+		_, data = nextField(data)
+	}
+
+	data = bytes.TrimPrefix(bytes.TrimLeft(data, " "), utf8BOM)
+	if len(data) > 0 {
+		record["message"] = string(data)
+	}
+	return nil
+}
+
+// parseStructuredData turns [id name="value" ...] elements into an object
+// of elements by their ids with the params as their fields
+func parseStructuredData(data []byte) (map[string]interface{}, []byte, error) {
+	sd := make(map[string]interface{})
+	errInvalid := fmt.Errorf("Invalid syslog structured data.")
+
+	for len(data) > 0 && data[0] == '[' {
+		data = data[1:]
+
+		i := bytes.IndexAny(data, " ]")
+		if i < 1 {
+			return nil, nil, errInvalid
+		}
+
+		params := make(map[string]interface{})
+		sd[string(data[:i])] = params
+		data = data[i:]
+
+		for len(data) > 0 && data[0] == ' ' {
+			data = data[1:]
+
+			eq := bytes.IndexByte(data, '=')
+			if eq < 1 || len(data) < eq+2 || data[eq+1] != '"' {
+				return nil, nil, errInvalid
+			}
+
+			name := string(data[:eq])
+			data = data[eq+2:]
+
+			var (
+				value   []byte
+				escaped bool
+				closed  bool
+			)
+
+			for j, c := range data {
+				if escaped {
+					// Only ", \ and ] are escaped, keep the backslash for the others
+					if c != '"' && c != '\\' && c != ']' {
+						value = append(value, '\\')
+					}
+					value = append(value, c)
+					escaped = false
+				} else if c == '\\' {
+					escaped = true
+				} else if c == '"' {
+					data = data[j+1:]
+					closed = true
+					break
+				} else {
+					value = append(value, c)
+				}
+			}
+
+			if !closed {
+				return nil, nil, errInvalid
+			}
+			params[name] = string(value)
+		}
+
+		if len(data) == 0 || data[0] != ']' {
+			return nil, nil, errInvalid
+		}
+		data = data[1:]
+	}
+	return sd, data, nil
+}
+
+// parseRFC3164 parses the BSD syslog messages, leaving the parts which
+// are not in the expected form in the message
+func (sp *syslogParser) parseRFC3164(data []byte, record map[string]interface{}) {
+	if len(data) >= len(rfc3164TimeLayout) {
+		t, err := time.ParseInLocation(rfc3164TimeLayout, string(data[:len(rfc3164TimeLayout)]), time.Local)
+		if err == nil {
+			now := time.Now()
+
+			// The year is not sent, a timestamp in the future belongs to the last year
+			t = t.AddDate(now.Year(), 0, 0)
+			if t.After(now.Add(24 * time.Hour)) {
+				t = t.AddDate(-1, 0, 0)
+			}
+
+			record["time"] = t.Format(sp.timeFormat)
+			data = bytes.TrimLeft(data[len(rfc3164TimeLayout):], " ")
+
+			// Some senders omit the host name, so the tag comes first
+			field, rest := nextField(data)
+			if len(field) > 0 && !bytes.ContainsAny(field, ":[") {
+				record["host"] = string(field)
+				data = rest
+			}
+		}
+	}
+
+	field, rest := nextField(data)
+	if n := len(field); n > 1 && field[n-1] == ':' {
+		tag := field[:n-1]
+
+		if i := bytes.IndexByte(tag, '['); i > 0 && tag[len(tag)-1] == ']' {
+			setSyslogField(record, "procid", tag[i+1:len(tag)-1])
+			tag = tag[:i]
+		}
+
+		setSyslogField(record, "app", tag)
+		data = rest
+	}
+
+	if len(data) > 0 {
+		record["message"] = string(data)
+	}
+}
@@ -0,0 +1,577 @@
+//	The MIT License (MIT)
+//
+//	Copyright (c) 2016, Cagatay Dogan
+//
+//	Permission is hereby granted, free of charge, to any person obtaining a copy
+//	of this software and associated documentation files (the "Software"), to deal
+//	in the Software without restriction, including without limitation the rights
+//	to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+//	copies of the Software, and to permit persons to whom the Software is
+//	furnished to do so, subject to the following conditions:
+//
+//		The above copyright notice and this permission notice shall be included in
+//		all copies or substantial portions of the Software.
+//
+//		THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+//		IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+//		FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+//		AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+//		LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+//		OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+//		THE SOFTWARE.
+
+package inout
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ocdogan/fluentgo/config"
+	"github.com/ocdogan/fluentgo/lib"
+)
+
+const (
+	defaultTailPollWait    = 250 * time.Millisecond
+	defaultTailRefreshWait = 10 * time.Second
+	tailFlushWait          = time.Second
+	tailReadBufSize        = 64 * 1024
+	tailMaxReadSize        = 8 * 1024 * 1024
+	tailMaxLineSize        = 1024 * 1024
+)
+
+type tailFile struct {
+	path    string
+	file    *os.File
+	info    os.FileInfo
+	inode   uint64
+	offset  int64
+	readPos int64
+	partial []byte
+	lines   *tailOffsets
+}
+
+// tailIn follows the files matching the glob paths line by line, across
+// rename and copytruncate rotations, keeping the read offsets in a
+// position file
+type tailIn struct {
+	inHandler
+	paths        []string
+	excludes     []string
+	positions    *tailPositions
+	readFromHead bool
+	readGzip     bool
+	wrap         bool
+	pollWait     time.Duration
+	refreshWait  time.Duration
+	files        map[string]*tailFile
+	gzipFiles    map[string]*tailOffsets
+	readBuf      []byte
+}
+
+func init() {
+	RegisterIn("tail", newTailIn)
+	RegisterIn("tailin", newTailIn)
+}
+
+func splitTailPatterns(s string) []string {
+	var patterns []string
+	for _, p := range strings.Split(s, ";") {
+		p = strings.TrimSpace(p)
+		if p != "" {
+			patterns = append(patterns, p)
+		}
+	}
+	return patterns
+}
+
+func newTailIn(manager InOutManager, params map[string]interface{}) InProvider {
+	s, ok := config.ParamAsString(params, "path")
+	if !ok || s == "" {
+		return nil
+	}
+
+	var paths []string
+	for _, p := range splitTailPatterns(s) {
+		paths = append(paths, lib.PrepareFile(p))
+	}
+
+	if len(paths) == 0 {
+		return nil
+	}
+
+	ih := newInHandler(manager, params)
+	if ih == nil {
+		return nil
+	}
+
+	var excludes []string
+
+	s, ok = config.ParamAsString(params, "exclude")
+	if ok && s != "" {
+		excludes = splitTailPatterns(s)
+	}
+
+	posFile, _ := config.ParamAsString(params, "posFile")
+	posFile = strings.TrimSpace(posFile)
+	if posFile != "" {
+		posFile = lib.PrepareFile(posFile)
+	}
+
+	readFromHead, _ := config.ParamAsBool(params, "readFromHead")
+	readGzip, _ := config.ParamAsBool(params, "readGzip")
+
+	// Lines are wrapped into JSON unless a parser or multiline is set
+	wrap, ok := config.ParamAsBool(params, "wrap")
+	if !ok {
+		wrap = ih.parser == nil && ih.multiline == nil
+	}
+
+	pollWait, ok := config.ParamAsDurationWithLimit(params, "pollIntervalMSec", 10, 60000)
+	if ok {
+		pollWait *= time.Millisecond
+	} else {
+		pollWait = defaultTailPollWait
+	}
+
+	refreshWait, ok := config.ParamAsDurationWithLimit(params, "refreshIntervalSec", 1, 3600)
+	if ok {
+		refreshWait *= time.Second
+	} else {
+		refreshWait = defaultTailRefreshWait
+	}
+
+	tin := &tailIn{
+		inHandler:    *ih,
+		paths:        paths,
+		excludes:     excludes,
+		positions:    newTailPositions(posFile),
+		readFromHead: readFromHead,
+		readGzip:     readGzip,
+		wrap:         wrap,
+		pollWait:     pollWait,
+		refreshWait:  refreshWait,
+		files:        make(map[string]*tailFile),
+		gzipFiles:    make(map[string]*tailOffsets),
+		readBuf:      make([]byte, tailReadBufSize),
+	}
+
+	tin.iotype = "TAILIN"
+
+	tin.runFunc = tin.funcReceive
+	tin.afterCloseFunc = tin.funcAfterClose
+
+	return tin
+}
+
+func (tin *tailIn) funcAfterClose() {
+	defer recover()
+	tin.positions.Flush()
+}
+
+func (tin *tailIn) funcReceive() {
+	defer func() {
+		recover()
+
+		for _, tf := range tin.files {
+			tin.closeFile(tf)
+		}
+		tin.positions.Flush()
+
+		tin.InformStop()
+	}()
+	tin.InformStart()
+
+	var (
+		lastRefresh time.Time
+		lastFlush   time.Time
+		first       = true
+	)
+
+	maxMessageSize := tin.getMaxMessageSize()
+
+	for {
+		now := time.Now()
+		if now.Sub(lastRefresh) >= tin.refreshWait {
+			tin.refresh(first, maxMessageSize)
+
+			first = false
+			lastRefresh = now
+		}
+
+		// Stop reading while the queue applies backpressure
+		if tin.waitForQueue() {
+			for _, tf := range tin.files {
+				tin.follow(tf, maxMessageSize)
+			}
+		}
+
+		if now.Sub(lastFlush) >= tailFlushWait {
+			if err := tin.positions.Flush(); err != nil {
+				l := tin.GetLogger()
+				if l != nil {
+					l.Printf("Cannot write 'TAILIN' position file: %s\n", err)
+				}
+			}
+			lastFlush = now
+		}
+
+		select {
+		case <-tin.completed:
+			tin.Close()
+			return
+		case <-time.After(tin.pollWait):
+		}
+	}
+}
+
+func (tin *tailIn) excluded(path string) bool {
+	base := filepath.Base(path)
+	for _, pattern := range tin.excludes {
+		if ok, _ := filepath.Match(pattern, path); ok {
+			return true
+		}
+		if ok, _ := filepath.Match(pattern, base); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (tin *tailIn) watching(path string, inode uint64) bool {
+	if tf, ok := tin.files[path]; ok && tf.inode == inode {
+		return true
+	}
+
+	if inode != 0 {
+		for _, tf := range tin.files {
+			if tf.inode == inode {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// refresh starts following the new files matching the paths, the files
+// found on the first run start from their ends unless read from head
+func (tin *tailIn) refresh(first bool, maxMessageSize int) {
+	for _, pattern := range tin.paths {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			continue
+		}
+
+		for _, path := range matches {
+			if _, ok := tin.files[path]; ok || tin.excluded(path) {
+				continue
+			}
+
+			fi, err := os.Stat(path)
+			if err != nil || fi.IsDir() {
+				continue
+			}
+
+			if strings.HasSuffix(path, ".gz") {
+				if tin.readGzip {
+					tin.readGzipFile(path, fi, maxMessageSize)
+				}
+				continue
+			}
+
+			inode := fileInode(fi)
+			if tin.watching(path, inode) {
+				continue
+			}
+
+			var offset int64
+
+			pos, ok := tin.positions.Get(path, inode)
+			if ok {
+				// The file is truncated while not followed
+				if pos.Offset <= fi.Size() {
+					offset = pos.Offset
+				}
+			} else if first && !tin.readFromHead {
+				offset = fi.Size()
+			}
+
+			tin.openFile(path, offset)
+		}
+	}
+
+	tin.positions.Prune(tin.watching)
+}
+
+func (tin *tailIn) openFile(path string, offset int64) *tailFile {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil
+	}
+
+	if offset > fi.Size() {
+		offset = 0
+	}
+
+	tf := &tailFile{
+		path:    path,
+		file:    f,
+		info:    fi,
+		inode:   fileInode(fi),
+		offset:  offset,
+		readPos: offset,
+	}
+
+	tf.lines = tin.newOffsets(path, tf.inode, offset)
+
+	tin.files[path] = tf
+	tin.positions.Set(path, tf.inode, offset, false)
+
+	l := tin.GetLogger()
+	if l != nil {
+		l.Printf("'TAILIN' following '%s' from offset %d.\n", path, offset)
+	}
+	return tf
+}
+
+// newOffsets moves the position of the file as its lines are buffered, the
+// lines dropped are read again only if the in queue blocks when it is full,
+// else the queue evicts them by its policy and the position passes them
+func (tin *tailIn) newOffsets(path string, inode uint64, offset int64) *tailOffsets {
+	rewind := false
+	if m := tin.GetManager(); m != nil {
+		if q := m.GetInQueue(); q != nil {
+			rewind = q.Overflow() == OverflowBlock
+		}
+	}
+
+	return newTailOffsets(offset, rewind, func(offset int64, done bool) {
+		tin.positions.Set(path, inode, offset, done)
+	})
+}
+
+func (tin *tailIn) closeFile(tf *tailFile) {
+	if tf.file != nil {
+		defer recover()
+
+		f := tf.file
+		tf.file = nil
+
+		f.Close()
+	}
+}
+
+// follow reads the new lines of the file, drains the old file and opens
+// the new one if the file is rotated and starts over if it is truncated
+func (tin *tailIn) follow(tf *tailFile, maxMessageSize int) {
+	if tf.file == nil {
+		delete(tin.files, tf.path)
+		return
+	}
+
+	// Read again from the first line which could not be buffered
+	if offset, ok := tf.lines.Rewind(); ok {
+		l := tin.GetLogger()
+		if l != nil {
+			l.Printf("'TAILIN' could not buffer all lines of '%s', reading again from offset %d.\n", tf.path, offset)
+		}
+
+		tf.offset = offset
+		tf.readPos = offset
+		tf.partial = nil
+	}
+
+	fi, err := os.Stat(tf.path)
+	if err != nil || !os.SameFile(fi, tf.info) {
+		tin.readLines(tf, true, maxMessageSize)
+		tin.closeFile(tf)
+
+		delete(tin.files, tf.path)
+		if err == nil {
+			tin.openFile(tf.path, 0)
+		}
+		return
+	}
+
+	if fi.Size() < tf.readPos {
+		l := tin.GetLogger()
+		if l != nil {
+			l.Printf("'TAILIN' file '%s' is truncated, reading from the start.\n", tf.path)
+		}
+
+		tf.offset = 0
+		tf.readPos = 0
+		tf.partial = nil
+
+		tf.lines.Reset(0)
+	}
+
+	if fi.Size() > tf.readPos {
+		tin.readLines(tf, false, maxMessageSize)
+	}
+}
+
+// readLines pushes the complete lines, the offset of the file moves after
+// the last complete line, the incomplete line is pushed only on flush
+func (tin *tailIn) readLines(tf *tailFile, flush bool, maxMessageSize int) {
+	defer recover()
+
+	read := 0
+	for read < tailMaxReadSize && tin.Processing() {
+		n, err := tf.file.ReadAt(tin.readBuf, tf.readPos)
+		if n > 0 {
+			chunk := tin.readBuf[:n]
+			chunkPos := tf.readPos
+
+			for len(chunk) > 0 {
+				i := bytes.IndexByte(chunk, '\n')
+				if i < 0 {
+					tf.partial = append(tf.partial, chunk...)
+					break
+				}
+
+				line := chunk[:i]
+				if len(tf.partial) > 0 {
+					line = append(tf.partial, line...)
+					tf.partial = nil
+				}
+
+				chunkPos += int64(i + 1)
+				tf.offset = chunkPos
+				chunk = chunk[i+1:]
+
+				tin.pushLine(tf.path, line, maxMessageSize, tf.lines.Add(tf.offset))
+			}
+
+			// Push the too long lines in parts
+			if len(tf.partial) >= tailMaxLineSize {
+				partial := tf.partial
+				tf.partial = nil
+				tf.offset = tf.readPos + int64(n)
+
+				tin.pushLine(tf.path, partial, maxMessageSize, tf.lines.Add(tf.offset))
+			}
+
+			tf.readPos += int64(n)
+			read += n
+		}
+
+		if err != nil || n == 0 {
+			break
+		}
+	}
+
+	if flush && len(tf.partial) > 0 {
+		partial := tf.partial
+		tf.partial = nil
+		tf.offset = tf.readPos
+
+		tin.pushLine(tf.path, partial, maxMessageSize, tf.lines.Add(tf.offset))
+	}
+}
+
+// pushLine calls buffered once the line is written into the disk buffer
+// or dropped, the empty lines count as buffered
+func (tin *tailIn) pushLine(path string, line []byte, maxMessageSize int, buffered func(ok bool)) {
+	line = bytes.TrimRight(line, "\r")
+	if len(line) == 0 {
+		buffered(true)
+		return
+	}
+
+	data := line
+	if tin.wrap {
+		var err error
+
+		data, err = json.Marshal(map[string]interface{}{"message": string(line), "path": path})
+		if err != nil {
+			buffered(true)
+			return
+		}
+	} else {
+		// The queue keeps the data, so the read buffer cannot be shared
+		data = make([]byte, len(line))
+		copy(data, line)
+	}
+
+	tin.queueMessageBuffered(data, maxMessageSize, map[string]interface{}{"path": path}, buffered)
+}
+
+// readGzipFile reads the rotated and compressed files once, the position
+// keeps the uncompressed offset until the whole file is buffered
+func (tin *tailIn) readGzipFile(path string, fi os.FileInfo, maxMessageSize int) {
+	// Wait for the lines of the last read before reading the file again
+	if lines, ok := tin.gzipFiles[path]; ok {
+		if lines.Pending() {
+			return
+		}
+		delete(tin.gzipFiles, path)
+	}
+
+	inode := fileInode(fi)
+
+	var offset int64
+
+	pos, ok := tin.positions.Get(path, inode)
+	if ok {
+		if pos.Done {
+			return
+		}
+		offset = pos.Offset
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		l := tin.GetLogger()
+		if l != nil {
+			l.Printf("Cannot read 'TAILIN' gzip file '%s': %s\n", path, err)
+		}
+		tin.positions.Set(path, inode, 0, true)
+		return
+	}
+	defer zr.Close()
+
+	if offset > 0 {
+		if _, err = io.CopyN(ioutil.Discard, zr, offset); err != nil {
+			tin.positions.Set(path, inode, offset, true)
+			return
+		}
+	}
+
+	lines := tin.newOffsets(path, inode, offset)
+	tin.gzipFiles[path] = lines
+
+	reader := bufio.NewReaderSize(zr, tailReadBufSize)
+	for tin.Processing() {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			offset += int64(len(line))
+
+			tin.pushLine(path, bytes.TrimRight(line, "\n"), maxMessageSize, lines.Add(offset))
+		}
+
+		if err != nil {
+			lines.Finish(offset)
+			return
+		}
+	}
+}
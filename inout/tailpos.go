@@ -0,0 +1,325 @@
+//	The MIT License (MIT)
+//
+//	Copyright (c) 2016, Cagatay Dogan
+//
+//	Permission is hereby granted, free of charge, to any person obtaining a copy
+//	of this software and associated documentation files (the "Software"), to deal
+//	in the Software without restriction, including without limitation the rights
+//	to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+//	copies of the Software, and to permit persons to whom the Software is
+//	furnished to do so, subject to the following conditions:
+//
+//		The above copyright notice and this permission notice shall be included in
+//		all copies or substantial portions of the Software.
+//
+//		THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+//		IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+//		FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+//		AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+//		LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+//		OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+//		THE SOFTWARE.
+
+package inout
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+type tailPosition struct {
+	Path   string `json:"path"`
+	Inode  uint64 `json:"inode,omitempty"`
+	Offset int64  `json:"offset"`
+	Done   bool   `json:"done,omitempty"`
+}
+
+// tailPositions keeps the read offsets of the tailed files by their
+// inodes, so a renamed file is resumed from where it is left
+type tailPositions struct {
+	sync.Mutex
+	filename  string
+	positions map[string]*tailPosition
+	dirty     bool
+}
+
+func newTailPositions(filename string) *tailPositions {
+	tp := &tailPositions{
+		filename:  filename,
+		positions: make(map[string]*tailPosition),
+	}
+	tp.load()
+
+	return tp
+}
+
+func tailPositionKey(path string, inode uint64) string {
+	if inode != 0 {
+		return strconv.FormatUint(inode, 10)
+	}
+	return path
+}
+
+func (tp *tailPositions) load() {
+	if tp.filename == "" {
+		return
+	}
+
+	defer recover()
+
+	data, err := ioutil.ReadFile(tp.filename)
+	if err != nil || len(data) == 0 {
+		return
+	}
+
+	var positions map[string]*tailPosition
+	if err = json.Unmarshal(data, &positions); err == nil && positions != nil {
+		tp.positions = positions
+	}
+}
+
+func (tp *tailPositions) Get(path string, inode uint64) (*tailPosition, bool) {
+	tp.Lock()
+	defer tp.Unlock()
+
+	pos, ok := tp.positions[tailPositionKey(path, inode)]
+	if !ok || pos == nil {
+		return nil, false
+	}
+
+	result := *pos
+	return &result, true
+}
+
+func (tp *tailPositions) Set(path string, inode uint64, offset int64, done bool) {
+	tp.Lock()
+	defer tp.Unlock()
+
+	key := tailPositionKey(path, inode)
+
+	pos, ok := tp.positions[key]
+	if !ok || pos == nil {
+		pos = &tailPosition{Inode: inode}
+		tp.positions[key] = pos
+	}
+
+	if pos.Path != path || pos.Offset != offset || pos.Done != done {
+		pos.Path = path
+		pos.Offset = offset
+		pos.Done = done
+		tp.dirty = true
+	}
+}
+
+// Prune removes the positions of the files which neither are watched
+// nor exist with the same inode
+func (tp *tailPositions) Prune(watched func(path string, inode uint64) bool) {
+	tp.Lock()
+	defer tp.Unlock()
+
+	for key, pos := range tp.positions {
+		if pos == nil {
+			delete(tp.positions, key)
+			tp.dirty = true
+			continue
+		}
+
+		if watched(pos.Path, pos.Inode) {
+			continue
+		}
+
+		fi, err := os.Stat(pos.Path)
+		if err != nil || fileInode(fi) != pos.Inode {
+			delete(tp.positions, key)
+			tp.dirty = true
+		}
+	}
+}
+
+// Flush writes the positions into the position file if they are changed,
+// the file is fsynced before it replaces the previous one
+func (tp *tailPositions) Flush() error {
+	tp.Lock()
+	defer tp.Unlock()
+
+	if !tp.dirty || tp.filename == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(tp.positions)
+	if err != nil {
+		return err
+	}
+
+	os.MkdirAll(filepath.Dir(tp.filename), 0777)
+
+	tmpName := tp.filename + ".tmp"
+
+	f, err := os.OpenFile(tmpName, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmpName, tp.filename)
+	}
+
+	if err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+
+	tp.dirty = false
+	return nil
+}
+
+type tailLine struct {
+	end  int64
+	done bool
+	ok   bool
+}
+
+// tailOffsets follows the lines read but not buffered yet, the position
+// moves to the end of a line once it and all the lines before it are
+// buffered, a dropped line holds the position to be read again if rewind
+// is set, else it counts as buffered
+type tailOffsets struct {
+	sync.Mutex
+	gen       int
+	committed int64
+	end       int64
+	ended     bool
+	failed    bool
+	rewind    bool
+	lines     []*tailLine
+	setFunc   func(offset int64, done bool)
+}
+
+func newTailOffsets(offset int64, rewind bool, setFunc func(offset int64, done bool)) *tailOffsets {
+	return &tailOffsets{
+		committed: offset,
+		rewind:    rewind,
+		setFunc:   setFunc,
+	}
+}
+
+// Add follows the line ending at the offset, the returned function is
+// called once with the result of buffering the line
+func (to *tailOffsets) Add(end int64) func(ok bool) {
+	to.Lock()
+	defer to.Unlock()
+
+	line := &tailLine{end: end}
+	to.lines = append(to.lines, line)
+
+	gen := to.gen
+	return func(ok bool) {
+		to.resolve(gen, line, ok)
+	}
+}
+
+func (to *tailOffsets) resolve(gen int, line *tailLine, ok bool) {
+	to.Lock()
+	defer to.Unlock()
+
+	// The line is read before the file is truncated or rewound
+	if gen != to.gen || line.done {
+		return
+	}
+
+	// The line is dropped by the in queue and will not be read again
+	if !to.rewind {
+		ok = true
+	}
+
+	line.done, line.ok = true, ok
+	if !ok {
+		to.failed = true
+	}
+	to.commit()
+}
+
+func (to *tailOffsets) commit() {
+	n := 0
+	for n < len(to.lines) && to.lines[n].done && to.lines[n].ok {
+		n++
+	}
+
+	if n > 0 {
+		to.committed = to.lines[n-1].end
+		for i := 0; i < n; i++ {
+			to.lines[i] = nil
+		}
+		to.lines = to.lines[n:]
+	}
+
+	if to.setFunc != nil {
+		to.setFunc(to.committed, to.ended && len(to.lines) == 0 && to.committed >= to.end)
+	}
+}
+
+// Finish marks the end of a file read once, the position is done when all
+// the lines till the end are buffered
+func (to *tailOffsets) Finish(end int64) {
+	to.Lock()
+	defer to.Unlock()
+
+	to.end, to.ended = end, true
+	to.commit()
+}
+
+// Reset forgets the lines not buffered yet and moves the position to the
+// offset, their results are ignored when they arrive
+func (to *tailOffsets) Reset(offset int64) {
+	to.Lock()
+	defer to.Unlock()
+
+	to.reset(offset)
+}
+
+func (to *tailOffsets) reset(offset int64) {
+	to.gen++
+	to.lines = nil
+	to.failed = false
+	to.ended = false
+	to.committed = offset
+
+	if to.setFunc != nil {
+		to.setFunc(offset, false)
+	}
+}
+
+// Rewind returns the offset to read the file again from if a line could
+// not be buffered
+func (to *tailOffsets) Rewind() (int64, bool) {
+	to.Lock()
+	defer to.Unlock()
+
+	if !to.failed {
+		return 0, false
+	}
+
+	offset := to.committed
+	to.reset(offset)
+
+	return offset, true
+}
+
+func (to *tailOffsets) Pending() bool {
+	to.Lock()
+	defer to.Unlock()
+
+	return len(to.lines) > 0
+}
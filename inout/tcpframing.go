@@ -0,0 +1,236 @@
+//	The MIT License (MIT)
+//
+//	Copyright (c) 2016, Cagatay Dogan
+//
+//	Permission is hereby granted, free of charge, to any person obtaining a copy
+//	of this software and associated documentation files (the "Software"), to deal
+//	in the Software without restriction, including without limitation the rights
+//	to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+//	copies of the Software, and to permit persons to whom the Software is
+//	furnished to do so, subject to the following conditions:
+//
+//		The above copyright notice and this permission notice shall be included in
+//		all copies or substantial portions of the Software.
+//
+//		THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+//		IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+//		FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+//		AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+//		LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+//		OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+//		THE SOFTWARE.
+
+package inout
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/ocdogan/fluentgo/config"
+	"github.com/ocdogan/fluentgo/lib"
+)
+
+type tcpFraming int
+
+const (
+	// FluentGO framing, as start marker + 4 bytes length + message + end marker
+	framingFluentGo tcpFraming = iota
+	// Messages end with a new line
+	framingNewline
+	// Messages are prefixed with their length and a space (RFC6587)
+	framingOctetCounting
+	// Messages end with a NUL character
+	framingNulTerminated
+)
+
+const (
+	tcpMaxFrameSize  = 4 * 1024 * 1024
+	tcpReadBufSize   = 64 * 1024
+	tcpMaxLengthSize = 10
+)
+
+var (
+	tcpMsgStart = []byte(lib.TCPUDPMsgStart)
+	tcpMsgEnd   = []byte(lib.TCPUDPMsgEnd)
+)
+
+func (f tcpFraming) String() string {
+	switch f {
+	case framingNewline:
+		return "newline"
+	case framingOctetCounting:
+		return "octet-counting"
+	case framingNulTerminated:
+		return "nul-terminated"
+	}
+	return "fluentgo"
+}
+
+func parseTCPFraming(params map[string]interface{}) (tcpFraming, bool) {
+	s, _ := config.ParamAsString(params, "framing")
+
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "fluentgo":
+		return framingFluentGo, true
+	case "newline":
+		return framingNewline, true
+	case "octet-counting":
+		return framingOctetCounting, true
+	case "nul-terminated":
+		return framingNulTerminated, true
+	}
+	return framingFluentGo, false
+}
+
+// binarySafe reports if the framing can carry binary messages, as the
+// compressed ones
+func (f tcpFraming) binarySafe() bool {
+	return f == framingFluentGo || f == framingOctetCounting
+}
+
+func (f tcpFraming) appendFrame(b []byte, data []byte) []byte {
+	switch f {
+	case framingNewline:
+		b = append(b, data...)
+		return append(b, '\n')
+	case framingOctetCounting:
+		b = strconv.AppendInt(b, int64(len(data)), 10)
+		b = append(b, ' ')
+		return append(b, data...)
+	case framingNulTerminated:
+		b = append(b, data...)
+		return append(b, 0)
+	}
+
+	stamp := make([]byte, 4)
+	binary.BigEndian.PutUint32(stamp, uint32(len(data)))
+
+	b = append(b, tcpMsgStart...)
+	b = append(b, stamp...)
+	b = append(b, data...)
+	return append(b, tcpMsgEnd...)
+}
+
+// readFrame returns the next message as a new slice, the partial frames are
+// completed by the following reads of the connection. A frame cut by an
+// error is dropped, except the last message of a delimited stream at EOF.
+func (f tcpFraming) readFrame(reader *bufio.Reader, maxFrameSize int) ([]byte, error) {
+	switch f {
+	case framingNewline:
+		frame, err := readDelimitedFrame(reader, '\n', maxFrameSize)
+		return bytes.TrimRight(frame, "\r\n"), err
+	case framingOctetCounting:
+		return readOctetCountedFrame(reader, maxFrameSize)
+	case framingNulTerminated:
+		frame, err := readDelimitedFrame(reader, 0, maxFrameSize)
+		return bytes.TrimRight(frame, "\x00"), err
+	}
+	return readFluentGoFrame(reader, maxFrameSize)
+}
+
+func readDelimitedFrame(reader *bufio.Reader, delim byte, maxFrameSize int) ([]byte, error) {
+	var (
+		frame []byte
+		line  []byte
+		err   error
+	)
+
+	for {
+		line, err = reader.ReadSlice(delim)
+		if len(frame)+len(line) > maxFrameSize {
+			return nil, fmt.Errorf("Message exceeds %d bytes.", maxFrameSize)
+		}
+
+		frame = append(frame, line...)
+		if err != bufio.ErrBufferFull {
+			break
+		}
+	}
+
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return frame, err
+}
+
+func readOctetCountedFrame(reader *bufio.Reader, maxFrameSize int) ([]byte, error) {
+	var frameLen int
+
+	for i := 0; ; i++ {
+		c, err := reader.ReadByte()
+		if err != nil {
+			if i > 0 && err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+
+		if c == ' ' && i > 0 {
+			break
+		}
+
+		if c < '0' || c > '9' || i >= tcpMaxLengthSize {
+			return nil, fmt.Errorf("Invalid message length character '%c'.", c)
+		}
+
+		frameLen = frameLen*10 + int(c-'0')
+	}
+
+	if frameLen > maxFrameSize {
+		return nil, fmt.Errorf("Message length %d exceeds %d bytes.", frameLen, maxFrameSize)
+	}
+
+	frame := make([]byte, frameLen)
+	if _, err := io.ReadFull(reader, frame); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+// readFluentGoFrame skips the bytes up to the next start marker, so the
+// stream can recover from a broken frame
+func readFluentGoFrame(reader *bufio.Reader, maxFrameSize int) ([]byte, error) {
+	window := make([]byte, 0, len(tcpMsgStart))
+
+	for {
+		window = window[:0]
+		for !bytes.Equal(window, tcpMsgStart) {
+			c, err := reader.ReadByte()
+			if err != nil {
+				if len(window) > 0 && err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				return nil, err
+			}
+
+			if len(window) == len(tcpMsgStart) {
+				window = append(window[:0], window[1:]...)
+			}
+			window = append(window, c)
+		}
+
+		stamp := make([]byte, 4)
+		if _, err := io.ReadFull(reader, stamp); err != nil {
+			return nil, err
+		}
+
+		frameLen := int(binary.BigEndian.Uint32(stamp))
+		if frameLen > maxFrameSize {
+			return nil, fmt.Errorf("Message length %d exceeds %d bytes.", frameLen, maxFrameSize)
+		}
+
+		frame := make([]byte, frameLen+len(tcpMsgEnd))
+		if _, err := io.ReadFull(reader, frame); err != nil {
+			return nil, err
+		}
+
+		if bytes.Equal(frame[frameLen:], tcpMsgEnd) {
+			return frame[:frameLen], nil
+		}
+	}
+}
@@ -23,24 +23,28 @@
 package inout
 
 import (
-	"bytes"
+	"bufio"
 	"crypto/tls"
-	"encoding/binary"
 	"io"
 	"net"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/ocdogan/fluentgo/config"
 	"github.com/ocdogan/fluentgo/lib"
+	"github.com/ocdogan/fluentgo/log"
 )
 
 type tcpIn struct {
 	inHandler
 	tcpUDPIO
-	lck         sync.Mutex
-	connections []net.Conn
-	listener    *net.Listener
+	framing        tcpFraming
+	idleTimeout    time.Duration
+	maxConnections int
+	lck            sync.Mutex
+	connections    []net.Conn
+	listener       *net.Listener
 }
 
 func init() {
@@ -59,12 +63,28 @@ func newTCPIn(manager InOutManager, params map[string]interface{}) InProvider {
 		return nil
 	}
 
+	framing, ok := parseTCPFraming(params)
+	if !ok {
+		return nil
+	}
+
+	idleTimeout, ok := config.ParamAsDurationWithLimit(params, "idleTimeoutSec", 0, 86400)
+	if ok {
+		idleTimeout *= time.Second
+	}
+
+	maxConnections, _ := config.ParamAsIntWithLimit(params, "maxConnections", 0, 100000)
+
 	tin := &tcpIn{
-		inHandler: *ih,
-		tcpUDPIO:  *tuio,
+		inHandler:      *ih,
+		tcpUDPIO:       *tuio,
+		framing:        framing,
+		idleTimeout:    idleTimeout,
+		maxConnections: maxConnections,
 	}
 
 	tin.iotype = "TCPIN"
+	tin.setTagSource("host", tuio.host)
 
 	tin.runFunc = tin.funcReceive
 	tin.afterCloseFunc = tin.funcAfterClose
@@ -74,14 +94,23 @@ func newTCPIn(manager InOutManager, params map[string]interface{}) InProvider {
 }
 
 func (tin *tcpIn) funcAfterClose() {
-	if tin.listener != nil {
-		defer recover()
+	defer recover()
 
+	if tin.listener != nil {
 		listener := *tin.listener
 		tin.listener = nil
 
 		listener.Close()
 	}
+
+	tin.lck.Lock()
+	conns := tin.connections
+	tin.connections = nil
+	tin.lck.Unlock()
+
+	for _, conn := range conns {
+		tin.tryToCloseConn(conn)
+	}
 }
 
 func (tin *tcpIn) loadServerCert() (secure bool, config *tls.Config, err error) {
@@ -129,11 +158,38 @@ func (tin *tcpIn) accept() {
 		return
 	}
 
-	listener := *tin.listener
+	lg := tin.logger
+	acceptTCP(*tin.listener, tin.iotype, tin.Processing, lg, func(conn net.Conn) {
+		accepted := func(tin *tcpIn, conn net.Conn) bool {
+			defer tin.lck.Unlock()
+
+			tin.lck.Lock()
+			if tin.maxConnections > 0 && len(tin.connections) >= tin.maxConnections {
+				return false
+			}
+
+			tin.connections = append(tin.connections, conn)
+			return true
+		}(tin, conn)
+
+		if !accepted {
+			if lg != nil {
+				lg.Printf("'TCPIN' reached the maximum %d connections, rejecting %s\n", tin.maxConnections, conn.RemoteAddr())
+			}
+			tin.tryToCloseConn(conn)
+			return
+		}
+
+		go tin.onNewConnection(conn)
+	})
+}
+
+// acceptTCP hands the connections accepted on the listener to the onAccept
+// function until the input stops processing or the listener is closed
+func acceptTCP(listener net.Listener, iotype string, processing func() bool, lg log.Logger, onAccept func(conn net.Conn)) {
 	tcpL, _ := listener.(*net.TCPListener)
 
-	lg := tin.logger
-	for tin.Processing() {
+	for processing() {
 		// Listen for an incoming connection.
 		if tcpL != nil {
 			tcpL.SetDeadline(time.Now().Add(10 * time.Second))
@@ -152,21 +208,14 @@ func (tin *tcpIn) accept() {
 			}
 
 			if lg != nil {
-				lg.Println("Error on 'TCPIN' accepting: ", errStr)
+				lg.Printf("Error on '%s' accepting: %s\n", iotype, errStr)
 			}
 			continue
 		}
 
 		// Handle connections in a new goroutine.
 		if conn != nil {
-			func(tin *tcpIn, conn net.Conn) {
-				defer tin.lck.Unlock()
-
-				tin.lck.Lock()
-				tin.connections = append(tin.connections, conn)
-			}(tin, conn)
-
-			go tin.onNewConnection(conn)
+			onAccept(conn)
 		}
 	}
 }
@@ -233,105 +282,42 @@ func (tin *tcpIn) remove(conn net.Conn) {
 func (tin *tcpIn) onNewConnection(conn net.Conn) {
 	defer func() {
 		recover()
+		tin.tryToCloseConn(conn)
 		tin.remove(conn)
 	}()
 
-	// Make a buffer to hold incoming data.
-	byt := make([]byte, 512)
-	buf := bytes.NewBuffer(nil)
+	maxMessageSize := tin.getMaxMessageSize()
 
-	start := -1
-	expectedLen := -1
+	maxFrameSize := maxMessageSize
+	if maxFrameSize < 1 {
+		maxFrameSize = tcpMaxFrameSize
+	}
 
-	endChars := []byte(lib.TCPUDPMsgEnd)
-	startChars := []byte(lib.TCPUDPMsgStart)
+	reader := bufio.NewReaderSize(conn, tcpReadBufSize)
 
-	maxMessageSize := tin.getMaxMessageSize()
+	for tin.Processing() {
+		if tin.idleTimeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(tin.idleTimeout))
+		}
 
-	for {
-		reqLen, err := conn.Read(byt)
-		if err != nil {
-			l := tin.logger
-			if err == io.EOF {
-				if l != nil {
-					l.Printf("Closing connection on 'TCPIN' %s\n", conn.LocalAddr())
-				}
-				return
-			}
-			if l != nil {
-				l.Println("Error on 'TCPIN' reading: ", err.Error())
-			}
-			continue
+		frame, err := tin.framing.readFrame(reader, maxFrameSize)
+		if len(frame) > 0 {
+			tin.queueMessageAsync(frame, maxMessageSize)
 		}
 
-		if reqLen == 0 {
+		if err != nil {
 			l := tin.logger
 			if l != nil {
-				l.Printf("Closing connection on 'TCPIN' %s\n", conn.LocalAddr())
-			}
-			conn.Close()
-			return
-		}
-
-		buf.Write(byt)
-
-		if start == 0 {
-			b := buf.Bytes()
-
-			if expectedLen == -1 {
-				if len(b) >= len(startChars)+4 {
-					expectedLen = int(binary.BigEndian.Uint32(b[len(startChars) : len(startChars)+4]))
-					if expectedLen > maxMessageSize {
-						l := tin.logger
-						if err == io.EOF {
-							if l != nil {
-								l.Printf("Unxpected message size %d. Closing connection on 'TCPIN' %s\n",
-									expectedLen, conn.LocalAddr())
-							}
-							return
-						}
-					}
-				}
-				continue
-			}
-
-			end := bytes.Index(b, endChars)
-			if end > -1 {
-				buf.Reset()
-				start = -1
-
-				dataLen := expectedLen
-				expectedLen = -1
-
-				if end > len(startChars) {
-					if end == dataLen+len(startChars) {
-						bNext := b[end+len(endChars):]
-						if len(bNext) > 0 {
-							buf.Write(bNext)
-						}
-
-						data := b[len(startChars):end]
-						if len(data) > 4 {
-							go tin.queueMessage(data[4:], maxMessageSize)
-						}
-					}
-				}
-			}
-		} else {
-			b := buf.Bytes()
-
-			start = bytes.Index(b, startChars)
-			if start != 0 {
-				end := bytes.Index(b, endChars)
-				if end > -1 {
-					buf.Reset()
-
-					bNext := b[end+len(endChars):]
-					if len(bNext) > 0 {
-						buf.Write(bNext)
-					}
+				switch {
+				case err == io.EOF:
+					l.Printf("Closing connection on 'TCPIN' %s\n", conn.LocalAddr())
+				case lib.IsTimeoutError(err):
+					l.Printf("Closing idle connection on 'TCPIN' %s\n", conn.LocalAddr())
+				default:
+					l.Printf("Error on 'TCPIN' reading, closing connection %s: %s\n", conn.LocalAddr(), err)
 				}
 			}
+			return
 		}
 	}
 }
@@ -24,7 +24,7 @@ package inout
 
 import (
 	"crypto/tls"
-	"encoding/binary"
+	"fmt"
 	"net"
 	"reflect"
 	"time"
@@ -36,6 +36,7 @@ import (
 type tcpOut struct {
 	outHandler
 	tcpUDPIO
+	framing        tcpFraming
 	connTimeoutSec int
 	conn           net.Conn
 }
@@ -56,11 +57,22 @@ func newTCPOut(manager InOutManager, params map[string]interface{}) OutSender {
 		return nil
 	}
 
+	framing, ok := parseTCPFraming(params)
+	if !ok {
+		return nil
+	}
+
+	// The compressed messages can contain the delimiters
+	if oh.compressed && !framing.binarySafe() {
+		return nil
+	}
+
 	connTimeoutSec, _ := config.ParamAsIntWithLimit(params, "connTimeoutSec", 0, 60)
 
 	tout := &tcpOut{
 		outHandler:     *oh,
 		tcpUDPIO:       *tuio,
+		framing:        framing,
 		connTimeoutSec: connTimeoutSec,
 	}
 
@@ -156,55 +168,60 @@ func (tout *tcpOut) funcWait() {
 	<-tout.completed
 }
 
-func (tout *tcpOut) funcSendMessagesChunk(messages []ByteArray, channel string) {
+func (tout *tcpOut) funcSendMessagesChunk(messages []ByteArray, channel string) error {
 	if len(messages) > 0 {
 		m := tout.GetManager()
 		if m == nil {
-			return
+			return errOutputStopped
 		}
 
-		defer recover()
-
 		var (
 			err  error
 			body []byte
 		)
 
-		stamp := make([]byte, 4)
-
 		for _, msg := range messages {
-			if !(err == nil && tout.Processing() && m.Processing()) {
-				break
+			if err != nil {
+				return err
+			}
+
+			if !(tout.Processing() && m.Processing()) {
+				return errOutputStopped
 			}
 
 			if len(msg) > 0 {
-				err = func() error {
-					var sendErr error
+				err = func() (sendErr error) {
 					defer func() {
-						sendErr, _ = recover().(error)
+						if e := recover(); e != nil {
+							sendErr = fmt.Errorf("%v", e)
+						}
 					}()
 
 					tout.Connect()
 
 					conn := tout.conn
+					if conn == nil {
+						return fmt.Errorf("Cannot connect to TCPOUT '%s'.", tout.host)
+					}
+
 					if conn != nil {
 						body = []byte(msg)
 						if tout.compressed {
 							body = lib.Compress(body, tout.compressType)
 						}
 
-						conn.Write([]byte(lib.TCPUDPMsgStart))
-
-						binary.BigEndian.PutUint32(stamp, uint32(len(body)))
-						conn.Write(stamp)
+						frame := tout.framing.appendFrame(make([]byte, 0, len(body)+32), body)
 
-						conn.Write(body)
-
-						conn.Write([]byte(lib.TCPUDPMsgEnd))
+						if _, sendErr = conn.Write(frame); sendErr != nil {
+							tout.conn = nil
+							tout.tryToCloseConn(conn)
+						}
 					}
 					return sendErr
 				}()
 			}
 		}
+		return err
 	}
+	return nil
 }
@@ -77,6 +77,7 @@ func newUDPIn(manager InOutManager, params map[string]interface{}) InProvider {
 	}
 
 	uin.iotype = "UDPIN"
+	uin.setTagSource("host", tuio.host)
 
 	uin.runFunc = uin.funcReceive
 	uin.afterCloseFunc = uin.funcAfterClose
@@ -171,7 +172,14 @@ func (uin *udpIn) accept() {
 
 		if reqLen > 0 && reqLen <= maxMessageSize {
 			buf := make([]byte, reqLen)
-			go uin.onNewMessage(buf)
+			copy(buf, buffer[:reqLen])
+
+			// Lines should be kept in order to be combined
+			if uin.multiline != nil {
+				uin.onNewMessage(buf)
+			} else {
+				go uin.onNewMessage(buf)
+			}
 		}
 	}
 }
@@ -25,6 +25,7 @@ package inout
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
 	"net"
 	"reflect"
 
@@ -130,15 +131,13 @@ func (uout *udpOut) funcWait() {
 	<-uout.completed
 }
 
-func (uout *udpOut) funcSendMessagesChunk(messages []ByteArray, channel string) {
+func (uout *udpOut) funcSendMessagesChunk(messages []ByteArray, channel string) error {
 	if len(messages) > 0 {
 		m := uout.GetManager()
 		if m == nil {
-			return
+			return errOutputStopped
 		}
 
-		defer recover()
-
 		var (
 			err  error
 			body []byte
@@ -147,20 +146,29 @@ func (uout *udpOut) funcSendMessagesChunk(messages []ByteArray, channel string)
 		stamp := make([]byte, 4)
 
 		for _, msg := range messages {
-			if !(err == nil && uout.Processing() && m.Processing()) {
-				break
+			if err != nil {
+				return err
+			}
+
+			if !(uout.Processing() && m.Processing()) {
+				return errOutputStopped
 			}
 
 			if len(msg) > 0 {
-				err = func() error {
-					var sendErr error
+				err = func() (sendErr error) {
 					defer func() {
-						sendErr, _ = recover().(error)
+						if e := recover(); e != nil {
+							sendErr = fmt.Errorf("%v", e)
+						}
 					}()
 
 					uout.Connect()
 
 					conn := uout.conn
+					if conn == nil {
+						return fmt.Errorf("Cannot connect to UDPOUT '%s'.", uout.host)
+					}
+
 					if conn != nil {
 						body = []byte(msg)
 						if uout.compressed {
@@ -175,11 +183,13 @@ func (uout *udpOut) funcSendMessagesChunk(messages []ByteArray, channel string)
 						b.Write(body)
 						b.Write([]byte(lib.TCPUDPMsgEnd))
 
-						conn.Write(b.Bytes())
+						_, sendErr = conn.Write(b.Bytes())
 					}
 					return sendErr
 				}()
 			}
 		}
+		return err
 	}
+	return nil
 }
@@ -39,8 +39,12 @@ const (
 	BlPop           = "BLPOP"
 	PSubscribechars = "*?[]"
 
-	RecStart uint32 = 12345
-	RecStop  uint32 = 54321
+	RecStart    uint32 = 12345
+	RecStop     uint32 = 54321
+	RecTagStart uint32 = 12346
+
+	BufHeader  uint32 = 24680
+	BufVersion uint32 = 3
 
 	MinBufferSize  = 8 * 1024
 	MaxBufferSize  = 10 * 1024 * 1024
@@ -0,0 +1,782 @@
+//	The MIT License (MIT)
+//
+//	Copyright (c) 2016, Cagatay Dogan
+//
+//	Permission is hereby granted, free of charge, to any person obtaining a copy
+//	of this software and associated documentation files (the "Software"), to deal
+//	in the Software without restriction, including without limitation the rights
+//	to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+//	copies of the Software, and to permit persons to whom the Software is
+//	furnished to do so, subject to the following conditions:
+//
+//		The above copyright notice and this permission notice shall be included in
+//		all copies or substantial portions of the Software.
+//
+//		THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+//		IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+//		FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+//		AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+//		LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+//		OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+//		THE SOFTWARE.
+
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/oliveagle/jsonpath"
+)
+
+type Filter struct {
+	expr     string
+	root     filterNode
+	accepted uint64
+	dropped  uint64
+}
+
+type FilterInfo struct {
+	Expression string `json:"expression,omitempty"`
+	Accepted   uint64 `json:"accepted"`
+	Dropped    uint64 `json:"dropped"`
+}
+
+type filterNode interface {
+	eval(data interface{}) interface{}
+}
+
+type filterLiteral struct {
+	value interface{}
+}
+
+type filterPath struct {
+	path  string
+	steps []interface{}
+}
+
+type filterArray struct {
+	items []filterNode
+}
+
+type filterRegex struct {
+	rx *regexp.Regexp
+}
+
+type filterNot struct {
+	node filterNode
+}
+
+type filterLogical struct {
+	and         bool
+	left, right filterNode
+}
+
+type filterCompare struct {
+	op          string
+	left, right filterNode
+}
+
+type filterTokenType int
+
+const (
+	ftEOF filterTokenType = iota
+	ftPath
+	ftString
+	ftNumber
+	ftRegex
+	ftIdent
+	ftOperator
+)
+
+type filterToken struct {
+	typ filterTokenType
+	val string
+	pos int
+}
+
+type filterParser struct {
+	expr   string
+	tokens []filterToken
+	index  int
+}
+
+func NewFilter(expr string) (*Filter, error) {
+	expr = strings.TrimSpace(expr)
+	if expr == "" {
+		return nil, nil
+	}
+
+	tokens, err := tokenizeFilter(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &filterParser{expr: expr, tokens: tokens}
+
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	if t := p.peek(); t.typ != ftEOF {
+		return nil, fmt.Errorf("Unexpected '%s' at position %d in filter: %s.", t.val, t.pos, expr)
+	}
+
+	return &Filter{
+		expr: expr,
+		root: root,
+	}, nil
+}
+
+func (f *Filter) String() string {
+	if f == nil {
+		return ""
+	}
+	return f.expr
+}
+
+func (f *Filter) Accepted() uint64 {
+	if f == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&f.accepted)
+}
+
+func (f *Filter) Dropped() uint64 {
+	if f == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&f.dropped)
+}
+
+func (f *Filter) Info() *FilterInfo {
+	if f == nil {
+		return nil
+	}
+
+	return &FilterInfo{
+		Expression: f.expr,
+		Accepted:   f.Accepted(),
+		Dropped:    f.Dropped(),
+	}
+}
+
+func (f *Filter) Eval(data interface{}) (result bool) {
+	if f == nil || f.root == nil {
+		return true
+	}
+
+	defer func() {
+		if err := recover(); err != nil {
+			result = false
+		}
+	}()
+
+	return filterTruth(f.root.eval(data))
+}
+
+func (f *Filter) Match(data []byte) bool {
+	if f == nil {
+		return true
+	}
+
+	var j interface{}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &j); err != nil {
+			j = nil
+		}
+	}
+
+	if f.Eval(j) {
+		atomic.AddUint64(&f.accepted, 1)
+		return true
+	}
+
+	atomic.AddUint64(&f.dropped, 1)
+	return false
+}
+
+func (n *filterLiteral) eval(data interface{}) interface{} {
+	return n.value
+}
+
+func (n *filterPath) eval(data interface{}) interface{} {
+	if data == nil {
+		return nil
+	}
+
+	if n.steps == nil {
+		res, err := jsonpath.JsonPathLookup(data, n.path)
+		if err != nil {
+			return nil
+		}
+		return res
+	}
+
+	for _, step := range n.steps {
+		switch s := step.(type) {
+		case string:
+			m, ok := data.(map[string]interface{})
+			if !ok {
+				return nil
+			}
+			data = m[s]
+		case int:
+			a, ok := data.([]interface{})
+			if !ok {
+				return nil
+			}
+
+			if s < 0 {
+				s += len(a)
+			}
+			if s < 0 || s >= len(a) {
+				return nil
+			}
+			data = a[s]
+		}
+	}
+	return data
+}
+
+// Simple paths like $.a.b[0]['c'] are resolved without the jsonpath package,
+// anything else falls back to jsonpath.JsonPathLookup.
+func compileFilterPath(path string) (steps []interface{}, simple bool) {
+	if path == "" || path[0] != '$' {
+		return nil, false
+	}
+
+	steps = make([]interface{}, 0)
+
+	i, ln := 1, len(path)
+	for i < ln {
+		switch path[i] {
+		case '.':
+			start := i + 1
+			i = start
+			for i < ln && path[i] != '.' && path[i] != '[' {
+				i++
+			}
+
+			key := path[start:i]
+			if key == "" || strings.ContainsAny(key, "*?()@:,") {
+				return nil, false
+			}
+			steps = append(steps, key)
+		case '[':
+			end := strings.IndexByte(path[i:], ']')
+			if end == -1 {
+				return nil, false
+			}
+
+			inner := strings.TrimSpace(path[i+1 : i+end])
+			i += end + 1
+
+			if len(inner) > 1 && (inner[0] == '\'' || inner[0] == '"') && inner[len(inner)-1] == inner[0] {
+				steps = append(steps, inner[1:len(inner)-1])
+				continue
+			}
+
+			idx, err := strconv.Atoi(inner)
+			if err != nil {
+				return nil, false
+			}
+			steps = append(steps, idx)
+		default:
+			return nil, false
+		}
+	}
+	return steps, true
+}
+
+func (n *filterArray) eval(data interface{}) interface{} {
+	result := make([]interface{}, len(n.items))
+	for i, item := range n.items {
+		result[i] = item.eval(data)
+	}
+	return result
+}
+
+func (n *filterRegex) eval(data interface{}) interface{} {
+	return n.rx
+}
+
+func (n *filterNot) eval(data interface{}) interface{} {
+	return !filterTruth(n.node.eval(data))
+}
+
+func (n *filterLogical) eval(data interface{}) interface{} {
+	left := filterTruth(n.left.eval(data))
+	if n.and {
+		return left && filterTruth(n.right.eval(data))
+	}
+	return left || filterTruth(n.right.eval(data))
+}
+
+func (n *filterCompare) eval(data interface{}) interface{} {
+	left := n.left.eval(data)
+	right := n.right.eval(data)
+
+	switch n.op {
+	case "==":
+		return filterEquals(left, right)
+	case "!=":
+		return !filterEquals(left, right)
+	case "<", "<=", ">", ">=":
+		return filterOrdered(n.op, left, right)
+	case "=~":
+		return filterRegexMatch(left, right)
+	case "!~":
+		return !filterRegexMatch(left, right)
+	case "in":
+		return filterContains(right, left)
+	case "not in":
+		return !filterContains(right, left)
+	}
+	return false
+}
+
+func filterTruth(v interface{}) bool {
+	switch t := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return t
+	case float64:
+		return t != 0
+	case string:
+		return t != ""
+	case []interface{}:
+		return len(t) > 0
+	case map[string]interface{}:
+		return len(t) > 0
+	}
+	return true
+}
+
+func filterEquals(left, right interface{}) bool {
+	switch l := left.(type) {
+	case nil:
+		return right == nil
+	case bool:
+		r, ok := right.(bool)
+		return ok && l == r
+	case float64:
+		r, ok := right.(float64)
+		return ok && l == r
+	case string:
+		r, ok := right.(string)
+		return ok && l == r
+	}
+	return false
+}
+
+func filterOrdered(op string, left, right interface{}) bool {
+	var cmp int
+
+	switch l := left.(type) {
+	case float64:
+		r, ok := right.(float64)
+		if !ok {
+			return false
+		}
+
+		if l < r {
+			cmp = -1
+		} else if l > r {
+			cmp = 1
+		}
+	case string:
+		r, ok := right.(string)
+		if !ok {
+			return false
+		}
+		cmp = strings.Compare(l, r)
+	default:
+		return false
+	}
+
+	switch op {
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	}
+	return false
+}
+
+func filterRegexMatch(left, right interface{}) bool {
+	var s string
+
+	switch l := left.(type) {
+	case string:
+		s = l
+	case float64, bool:
+		s = fmt.Sprint(l)
+	default:
+		return false
+	}
+
+	switch r := right.(type) {
+	case *regexp.Regexp:
+		return r.MatchString(s)
+	case string:
+		rx, err := regexp.Compile(r)
+		return err == nil && rx.MatchString(s)
+	}
+	return false
+}
+
+func filterContains(container, item interface{}) bool {
+	switch c := container.(type) {
+	case []interface{}:
+		for _, v := range c {
+			if filterEquals(item, v) {
+				return true
+			}
+		}
+	case map[string]interface{}:
+		if s, ok := item.(string); ok {
+			_, ok = c[s]
+			return ok
+		}
+	case string:
+		if s, ok := item.(string); ok {
+			return strings.Contains(c, s)
+		}
+	}
+	return false
+}
+
+func tokenizeFilter(expr string) ([]filterToken, error) {
+	var tokens []filterToken
+
+	i, ln := 0, len(expr)
+	for i < ln {
+		c := expr[i]
+
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '%' && i+1 < ln && expr[i+1] == '{':
+			end := strings.Index(expr[i:], "}%")
+			if end == -1 {
+				return nil, fmt.Errorf("Unterminated path at position %d in filter: %s.", i, expr)
+			}
+
+			path := strings.TrimSpace(expr[i+2 : i+end])
+			if path == "" || path[0] != '$' {
+				return nil, fmt.Errorf("Invalid path at position %d in filter: %s.", i, expr)
+			}
+
+			tokens = append(tokens, filterToken{typ: ftPath, val: path, pos: i})
+			i += end + 2
+		case c == '$':
+			start := i
+			for i < ln && !strings.ContainsRune(" \t\r\n=!<>&|(),", rune(expr[i])) {
+				i++
+			}
+			tokens = append(tokens, filterToken{typ: ftPath, val: expr[start:i], pos: start})
+		case c == '"' || c == '\'' || c == '/':
+			start := i
+			s, next, err := scanFilterQuoted(expr, i)
+			if err != nil {
+				return nil, err
+			}
+
+			typ := ftString
+			if c == '/' {
+				typ = ftRegex
+			}
+
+			tokens = append(tokens, filterToken{typ: typ, val: s, pos: start})
+			i = next
+		case c == '-' || (c >= '0' && c <= '9'):
+			start := i
+			i++
+			for i < ln && strings.ContainsRune("0123456789.eE+-", rune(expr[i])) {
+				if (expr[i] == '+' || expr[i] == '-') && !(expr[i-1] == 'e' || expr[i-1] == 'E') {
+					break
+				}
+				i++
+			}
+			tokens = append(tokens, filterToken{typ: ftNumber, val: expr[start:i], pos: start})
+		case c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z'):
+			start := i
+			for i < ln && (expr[i] == '_' || (expr[i] >= 'a' && expr[i] <= 'z') ||
+				(expr[i] >= 'A' && expr[i] <= 'Z') || (expr[i] >= '0' && expr[i] <= '9')) {
+				i++
+			}
+			tokens = append(tokens, filterToken{typ: ftIdent, val: strings.ToLower(expr[start:i]), pos: start})
+		default:
+			op := ""
+			if i+1 < ln {
+				switch expr[i : i+2] {
+				case "==", "!=", "<=", ">=", "=~", "!~", "&&", "||":
+					op = expr[i : i+2]
+				}
+			}
+
+			if op == "" {
+				switch c {
+				case '<', '>', '!', '(', ')', '[', ']', ',':
+					op = string(c)
+				default:
+					return nil, fmt.Errorf("Unexpected character '%c' at position %d in filter: %s.", c, i, expr)
+				}
+			}
+
+			tokens = append(tokens, filterToken{typ: ftOperator, val: op, pos: i})
+			i += len(op)
+		}
+	}
+
+	return append(tokens, filterToken{typ: ftEOF, pos: ln}), nil
+}
+
+func scanFilterQuoted(expr string, start int) (string, int, error) {
+	quote := expr[start]
+
+	var b []byte
+	for i := start + 1; i < len(expr); i++ {
+		c := expr[i]
+		if c == '\\' && i+1 < len(expr) {
+			i++
+			if quote == '/' && expr[i] != '/' {
+				b = append(b, '\\')
+				b = append(b, expr[i])
+				continue
+			}
+
+			switch expr[i] {
+			case 'n':
+				b = append(b, '\n')
+			case 't':
+				b = append(b, '\t')
+			case 'r':
+				b = append(b, '\r')
+			default:
+				b = append(b, expr[i])
+			}
+			continue
+		}
+
+		if c == quote {
+			return string(b), i + 1, nil
+		}
+		b = append(b, c)
+	}
+
+	return "", 0, fmt.Errorf("Unterminated literal at position %d in filter: %s.", start, expr)
+}
+
+func (p *filterParser) peek() filterToken {
+	return p.tokens[p.index]
+}
+
+func (p *filterParser) next() filterToken {
+	t := p.tokens[p.index]
+	if t.typ != ftEOF {
+		p.index++
+	}
+	return t
+}
+
+func (p *filterParser) isOperator(vals ...string) bool {
+	t := p.peek()
+	if t.typ == ftOperator || t.typ == ftIdent {
+		for _, v := range vals {
+			if t.val == v {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (p *filterParser) unexpected(t filterToken) error {
+	if t.typ == ftEOF {
+		return fmt.Errorf("Unexpected end of filter: %s.", p.expr)
+	}
+	return fmt.Errorf("Unexpected '%s' at position %d in filter: %s.", t.val, t.pos, p.expr)
+}
+
+func (p *filterParser) parseOr() (filterNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.isOperator("||", "or") {
+		p.next()
+
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &filterLogical{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseAnd() (filterNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.isOperator("&&", "and") {
+		p.next()
+
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &filterLogical{and: true, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseUnary() (filterNode, error) {
+	if p.isOperator("!", "not") {
+		p.next()
+
+		node, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &filterNot{node: node}, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *filterParser) parseComparison() (filterNode, error) {
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	var op string
+
+	switch {
+	case p.isOperator("==", "!=", "<", "<=", ">", ">=", "=~", "!~", "in"):
+		op = p.next().val
+	case p.isOperator("not"):
+		t := p.next()
+		if !p.isOperator("in") {
+			return nil, p.unexpected(t)
+		}
+		p.next()
+		op = "not in"
+	default:
+		return left, nil
+	}
+
+	right, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	if op == "=~" || op == "!~" {
+		if lit, ok := right.(*filterLiteral); ok {
+			s, ok := lit.value.(string)
+			if !ok {
+				return nil, fmt.Errorf("Regular expression expected after '%s' in filter: %s.", op, p.expr)
+			}
+
+			rx, err := regexp.Compile(s)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid regular expression '%s' in filter: %s.", s, p.expr)
+			}
+			right = &filterRegex{rx: rx}
+		}
+	}
+
+	return &filterCompare{op: op, left: left, right: right}, nil
+}
+
+func (p *filterParser) parseOperand() (filterNode, error) {
+	t := p.next()
+
+	switch t.typ {
+	case ftPath:
+		node := &filterPath{path: t.val}
+		if steps, ok := compileFilterPath(t.val); ok {
+			node.steps = steps
+		}
+		return node, nil
+	case ftString:
+		return &filterLiteral{value: t.val}, nil
+	case ftNumber:
+		f, err := strconv.ParseFloat(t.val, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid number '%s' at position %d in filter: %s.", t.val, t.pos, p.expr)
+		}
+		return &filterLiteral{value: f}, nil
+	case ftRegex:
+		rx, err := regexp.Compile(t.val)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid regular expression '%s' at position %d in filter: %s.", t.val, t.pos, p.expr)
+		}
+		return &filterRegex{rx: rx}, nil
+	case ftIdent:
+		switch t.val {
+		case "true":
+			return &filterLiteral{value: true}, nil
+		case "false":
+			return &filterLiteral{value: false}, nil
+		case "null", "nil":
+			return &filterLiteral{value: nil}, nil
+		}
+	case ftOperator:
+		switch t.val {
+		case "(":
+			node, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+
+			if !p.isOperator(")") {
+				return nil, p.unexpected(p.peek())
+			}
+			p.next()
+
+			return node, nil
+		case "[":
+			arr := &filterArray{}
+			if p.isOperator("]") {
+				p.next()
+				return arr, nil
+			}
+
+			for {
+				item, err := p.parseOperand()
+				if err != nil {
+					return nil, err
+				}
+				arr.items = append(arr.items, item)
+
+				if p.isOperator("]") {
+					p.next()
+					return arr, nil
+				}
+
+				if !p.isOperator(",") {
+					return nil, p.unexpected(p.peek())
+				}
+				p.next()
+			}
+		}
+	}
+
+	return nil, p.unexpected(t)
+}
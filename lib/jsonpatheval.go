@@ -100,6 +100,9 @@ func init() {
 	rgx = regexp.MustCompile(`\%\{[^}%]*\}\%`)
 }
 
+// NewJsonPath parses a template like "logs-%{$.app}%-%{$.env}%". Each
+// %{...}% is replaced by the string, number or bool found at that path
+// and the text before, between and after the paths is kept as is.
 func NewJsonPath(s string) *JsonPath {
 	jp := &JsonPath{Type: JPStatic}
 
@@ -138,6 +141,7 @@ func NewJsonPath(s string) *JsonPath {
 
 			for i, m := range mi {
 				if i == 0 {
+					s1 = s[0:m[0]]
 					if len(s1) > 0 {
 						ep := JsonPathPart{
 							Data:  s1,
@@ -179,7 +183,7 @@ func NewJsonPath(s string) *JsonPath {
 			last := mi[len(mi)-1]
 			lastLen := len(s) - last[1]
 
-			if lastLen > 1 {
+			if lastLen > 0 {
 				s1 = s[last[1]:len(s)]
 
 				ep := JsonPathPart{
@@ -227,9 +231,7 @@ func (jp *JsonPath) evalJson(jsonData interface{}, trimSpace bool) (result strin
 						b.WriteString(jpath)
 					} else {
 						switch res.(type) {
-						case string:
-						case float64:
-						case bool:
+						case string, float64, bool:
 							jpath = fmt.Sprint(res)
 							if trimSpace {
 								jpath = strings.TrimSpace(jpath)
@@ -0,0 +1,268 @@
+//	The MIT License (MIT)
+//
+//	Copyright (c) 2016, Cagatay Dogan
+//
+//	Permission is hereby granted, free of charge, to any person obtaining a copy
+//	of this software and associated documentation files (the "Software"), to deal
+//	in the Software without restriction, including without limitation the rights
+//	to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+//	copies of the Software, and to permit persons to whom the Software is
+//	furnished to do so, subject to the following conditions:
+//
+//		The above copyright notice and this permission notice shall be included in
+//		all copies or substantial portions of the Software.
+//
+//		THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+//		IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+//		FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+//		AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+//		LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+//		OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+//		THE SOFTWARE.
+
+package lib
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+)
+
+// KPLMagic is the header of the records aggregated in the Kinesis Producer
+// Library format, which is followed by the AggregatedRecord protobuf message
+// and the MD5 digest of the message
+var KPLMagic = []byte{0xF3, 0x89, 0x9A, 0xC2}
+
+// KPLMaxRecordSize is the limit of a Kinesis record, data and partition key
+const KPLMaxRecordSize = 1024 * 1024
+
+// KPLRecord is a user record of an aggregated record
+type KPLRecord struct {
+	PartitionKey    string
+	ExplicitHashKey string
+	Data            []byte
+}
+
+// KPLAggregator packs the records of a partition key into a single
+// aggregated record
+type KPLAggregator struct {
+	partitionKey string
+	records      [][]byte
+	size         int
+}
+
+func NewKPLAggregator(partitionKey string) *KPLAggregator {
+	a := &KPLAggregator{partitionKey: partitionKey}
+	a.Reset()
+
+	return a
+}
+
+func protoFieldSize(n int) int {
+	return 1 + protoVarintSize(uint64(n)) + n
+}
+
+func protoVarintSize(v uint64) int {
+	n := 1
+	for v >= 0x80 {
+		v >>= 7
+		n++
+	}
+	return n
+}
+
+// kplRecordSize is the size of the Record message with the partition key
+// index 0 and the data
+func kplRecordSize(data []byte) int {
+	return 2 + protoFieldSize(len(data))
+}
+
+func (a *KPLAggregator) Reset() {
+	a.records = nil
+	a.size = len(KPLMagic) + md5.Size + protoFieldSize(len(a.partitionKey))
+}
+
+func (a *KPLAggregator) Count() int {
+	return len(a.records)
+}
+
+// Size returns the size of the aggregated record with its partition key
+func (a *KPLAggregator) Size() int {
+	return a.size + len(a.partitionKey)
+}
+
+// SizeWith returns the size of the aggregated record if the data is added
+func (a *KPLAggregator) SizeWith(data []byte) int {
+	return a.Size() + protoFieldSize(kplRecordSize(data))
+}
+
+func (a *KPLAggregator) Add(data []byte) {
+	a.records = append(a.records, data)
+	a.size += protoFieldSize(kplRecordSize(data))
+}
+
+// Bytes returns the aggregated record of the records added
+func (a *KPLAggregator) Bytes() []byte {
+	buf := make([]byte, 0, a.size)
+	buf = append(buf, KPLMagic...)
+
+	start := len(buf)
+	buf = appendProtoBytes(buf, 1, []byte(a.partitionKey))
+
+	for _, data := range a.records {
+		buf = appendProtoTag(buf, 3, 2)
+		buf = appendProtoVarint(buf, uint64(kplRecordSize(data)))
+
+		buf = appendProtoTag(buf, 1, 0)
+		buf = appendProtoVarint(buf, 0)
+		buf = appendProtoBytes(buf, 3, data)
+	}
+
+	digest := md5.Sum(buf[start:])
+	return append(buf, digest[:]...)
+}
+
+func appendProtoTag(buf []byte, field int, wireType int) []byte {
+	return appendProtoVarint(buf, uint64(field<<3|wireType))
+}
+
+func appendProtoVarint(buf []byte, v uint64) []byte {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(b[:], v)
+	return append(buf, b[:n]...)
+}
+
+func appendProtoBytes(buf []byte, field int, data []byte) []byte {
+	buf = appendProtoTag(buf, field, 2)
+	buf = appendProtoVarint(buf, uint64(len(data)))
+	return append(buf, data...)
+}
+
+// protoField reads the next field of the message, value is the varint or
+// the fixed value and data is the length delimited value
+func protoField(buf []byte) (field int, value uint64, data []byte, n int, ok bool) {
+	tag, tn := binary.Uvarint(buf)
+	if tn <= 0 {
+		return 0, 0, nil, 0, false
+	}
+
+	field = int(tag >> 3)
+	n = tn
+
+	switch tag & 7 {
+	case 0:
+		value, tn = binary.Uvarint(buf[n:])
+		if tn <= 0 {
+			return 0, 0, nil, 0, false
+		}
+		n += tn
+	case 1:
+		if len(buf) < n+8 {
+			return 0, 0, nil, 0, false
+		}
+		value = binary.LittleEndian.Uint64(buf[n:])
+		n += 8
+	case 2:
+		size, tn := binary.Uvarint(buf[n:])
+		if tn <= 0 || uint64(len(buf)-n-tn) < size {
+			return 0, 0, nil, 0, false
+		}
+		n += tn
+		data = buf[n : n+int(size)]
+		n += int(size)
+	case 5:
+		if len(buf) < n+4 {
+			return 0, 0, nil, 0, false
+		}
+		value = uint64(binary.LittleEndian.Uint32(buf[n:]))
+		n += 4
+	default:
+		return 0, 0, nil, 0, false
+	}
+	return field, value, data, n, true
+}
+
+// KPLDeaggregate returns the user records of the data if it is an aggregated
+// record, the data not starting with the magic or not matching its digest is
+// not aggregated
+func KPLDeaggregate(data []byte) ([]KPLRecord, bool) {
+	if len(data) < len(KPLMagic)+md5.Size || !bytes.HasPrefix(data, KPLMagic) {
+		return nil, false
+	}
+
+	msg := data[len(KPLMagic) : len(data)-md5.Size]
+
+	digest := md5.Sum(msg)
+	if !bytes.Equal(digest[:], data[len(data)-md5.Size:]) {
+		return nil, false
+	}
+
+	type kplIndexes struct {
+		partitionKey    uint64
+		explicitHashKey uint64
+		hasHashKey      bool
+		data            []byte
+	}
+
+	var (
+		partitionKeys []string
+		hashKeys      []string
+		indexes       []kplIndexes
+	)
+
+	for len(msg) > 0 {
+		field, _, value, n, ok := protoField(msg)
+		if !ok {
+			return nil, false
+		}
+		msg = msg[n:]
+
+		switch field {
+		case 1:
+			partitionKeys = append(partitionKeys, string(value))
+		case 2:
+			hashKeys = append(hashKeys, string(value))
+		case 3:
+			var rec kplIndexes
+			for len(value) > 0 {
+				rfield, rvalue, rdata, rn, ok := protoField(value)
+				if !ok {
+					return nil, false
+				}
+				value = value[rn:]
+
+				switch rfield {
+				case 1:
+					rec.partitionKey = rvalue
+				case 2:
+					rec.explicitHashKey = rvalue
+					rec.hasHashKey = true
+				case 3:
+					rec.data = rdata
+				}
+			}
+			indexes = append(indexes, rec)
+		}
+	}
+
+	records := make([]KPLRecord, 0, len(indexes))
+	for _, rec := range indexes {
+		if rec.partitionKey >= uint64(len(partitionKeys)) {
+			return nil, false
+		}
+
+		r := KPLRecord{
+			PartitionKey: partitionKeys[rec.partitionKey],
+			Data:         rec.data,
+		}
+
+		if rec.hasHashKey {
+			if rec.explicitHashKey >= uint64(len(hashKeys)) {
+				return nil, false
+			}
+			r.ExplicitHashKey = hashKeys[rec.explicitHashKey]
+		}
+		records = append(records, r)
+	}
+	return records, true
+}
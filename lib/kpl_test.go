@@ -0,0 +1,135 @@
+//	The MIT License (MIT)
+//
+//	Copyright (c) 2016, Cagatay Dogan
+//
+//	Permission is hereby granted, free of charge, to any person obtaining a copy
+//	of this software and associated documentation files (the "Software"), to deal
+//	in the Software without restriction, including without limitation the rights
+//	to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+//	copies of the Software, and to permit persons to whom the Software is
+//	furnished to do so, subject to the following conditions:
+//
+//		The above copyright notice and this permission notice shall be included in
+//		all copies or substantial portions of the Software.
+//
+//		THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+//		IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+//		FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+//		AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+//		LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+//		OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+//		THE SOFTWARE.
+
+package lib
+
+import (
+	"bytes"
+	"crypto/md5"
+	"testing"
+)
+
+func TestKPLRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		key     string
+		records [][]byte
+	}{
+		{"single record", "pk", [][]byte{[]byte("hello")}},
+		{"many records", "key-1", [][]byte{[]byte("a"), []byte("bb"), []byte("ccc")}},
+		{"empty record", "pk", [][]byte{{}, []byte("x")}},
+		{"large record", "pk", [][]byte{bytes.Repeat([]byte("z"), 70000)}},
+	}
+
+	for _, tt := range tests {
+		a := NewKPLAggregator(tt.key)
+		for _, data := range tt.records {
+			want := a.SizeWith(data)
+			a.Add(data)
+
+			if a.Size() != want {
+				t.Errorf("%s: size %d after add, want %d", tt.name, a.Size(), want)
+			}
+		}
+
+		if a.Count() != len(tt.records) {
+			t.Errorf("%s: count %d, want %d", tt.name, a.Count(), len(tt.records))
+		}
+
+		data := a.Bytes()
+		if a.Size() != len(data)+len(tt.key) {
+			t.Errorf("%s: size %d, want %d", tt.name, a.Size(), len(data)+len(tt.key))
+		}
+
+		records, ok := KPLDeaggregate(data)
+		if !ok {
+			t.Errorf("%s: cannot deaggregate", tt.name)
+			continue
+		}
+
+		if len(records) != len(tt.records) {
+			t.Errorf("%s: got %d records, want %d", tt.name, len(records), len(tt.records))
+			continue
+		}
+
+		for i, r := range records {
+			if r.PartitionKey != tt.key || !bytes.Equal(r.Data, tt.records[i]) {
+				t.Errorf("%s: record %d is %q/%q, want %q/%q", tt.name, i, r.PartitionKey, r.Data, tt.key, tt.records[i])
+			}
+		}
+	}
+}
+
+func TestKPLReset(t *testing.T) {
+	a := NewKPLAggregator("pk")
+	empty := a.Size()
+
+	a.Add([]byte("data"))
+	a.Reset()
+
+	if a.Count() != 0 || a.Size() != empty {
+		t.Errorf("count %d and size %d after reset, want 0 and %d", a.Count(), a.Size(), empty)
+	}
+}
+
+func kplWithDigest(msg []byte) []byte {
+	digest := md5.Sum(msg)
+
+	data := append([]byte{}, KPLMagic...)
+	data = append(data, msg...)
+	return append(data, digest[:]...)
+}
+
+func TestKPLNotAggregated(t *testing.T) {
+	a := NewKPLAggregator("pk")
+	a.Add([]byte("hello"))
+	a.Add([]byte("world"))
+	valid := a.Bytes()
+
+	corruptBody := append([]byte{}, valid...)
+	corruptBody[len(KPLMagic)+3] ^= 1
+
+	corruptDigest := append([]byte{}, valid...)
+	corruptDigest[len(corruptDigest)-1] ^= 1
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"plain record", []byte(`{"message":"hello"}`)},
+		{"magic only", KPLMagic},
+		{"digest mismatch in body", corruptBody},
+		{"digest mismatch in digest", corruptDigest},
+		{"truncated", valid[:len(valid)-1]},
+		{"invalid wire type", kplWithDigest([]byte{0x0f, 0x01})},
+		{"truncated field", kplWithDigest([]byte{0x0a, 0x05, 'a'})},
+		{"truncated varint", kplWithDigest([]byte{0x1a, 0x80})},
+		{"partition key index out of range", kplWithDigest([]byte{0x1a, 0x02, 0x08, 0x01})},
+	}
+
+	for _, tt := range tests {
+		if records, ok := KPLDeaggregate(tt.data); ok {
+			t.Errorf("%s: deaggregated %d records", tt.name, len(records))
+		}
+	}
+}
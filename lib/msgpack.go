@@ -0,0 +1,533 @@
+//	The MIT License (MIT)
+//
+//	Copyright (c) 2016, Cagatay Dogan
+//
+//	Permission is hereby granted, free of charge, to any person obtaining a copy
+//	of this software and associated documentation files (the "Software"), to deal
+//	in the Software without restriction, including without limitation the rights
+//	to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+//	copies of the Software, and to permit persons to whom the Software is
+//	furnished to do so, subject to the following conditions:
+//
+//		The above copyright notice and this permission notice shall be included in
+//		all copies or substantial portions of the Software.
+//
+//		THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+//		IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+//		FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+//		AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+//		LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+//		OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+//		THE SOFTWARE.
+
+package lib
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"strconv"
+	"time"
+)
+
+// MsgpackExt is a msgpack extension value which has no Go counterpart
+type MsgpackExt struct {
+	Type int8
+	Data []byte
+}
+
+// MsgpackEventTimeType is the extension type of the Fluentd EventTime
+const MsgpackEventTimeType int8 = 0
+
+// MsgpackMaxDepth is the deepest nesting of the arrays and maps decoded
+const MsgpackMaxDepth = 64
+
+// NewMsgpackEventTime returns the time as a Fluentd EventTime extension
+func NewMsgpackEventTime(t time.Time) MsgpackExt {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint32(data, uint32(t.Unix()))
+	binary.BigEndian.PutUint32(data[4:], uint32(t.Nanosecond()))
+
+	return MsgpackExt{Type: MsgpackEventTimeType, Data: data}
+}
+
+// Time returns the time if the extension is a Fluentd EventTime
+func (ext MsgpackExt) Time() (time.Time, bool) {
+	if ext.Type != MsgpackEventTimeType || len(ext.Data) != 8 {
+		return time.Time{}, false
+	}
+
+	sec := binary.BigEndian.Uint32(ext.Data)
+	nsec := binary.BigEndian.Uint32(ext.Data[4:])
+
+	return time.Unix(int64(sec), int64(nsec)), true
+}
+
+// MsgpackDecoder reads msgpack values from a stream, the maps are decoded
+// as map[string]interface{}, strings as string, binaries as []byte, integers
+// as int64 or uint64 and the arrays as []interface{}
+type MsgpackDecoder struct {
+	r        *bufio.Reader
+	maxSize  int
+	consumed int
+	depth    int
+	buf      [8]byte
+}
+
+// NewMsgpackDecoder returns a decoder which rejects the values, and the
+// strings, binaries and containers in them, larger than maxSize, maxSize < 1
+// means no limit, the values nested deeper than MsgpackMaxDepth are rejected
+func NewMsgpackDecoder(r io.Reader, maxSize int) *MsgpackDecoder {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+
+	return &MsgpackDecoder{
+		r:       br,
+		maxSize: maxSize,
+	}
+}
+
+// Decode returns io.EOF only if the stream ends before a new value starts
+func (d *MsgpackDecoder) Decode() (interface{}, error) {
+	d.consumed, d.depth = 0, 0
+
+	c, err := d.readByte()
+	if err != nil {
+		return nil, err
+	}
+
+	v, err := d.decodeValue(c)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return v, err
+}
+
+func (d *MsgpackDecoder) next() (interface{}, error) {
+	c, err := d.readByte()
+	if err != nil {
+		return nil, err
+	}
+	return d.decodeValue(c)
+}
+
+// consume counts the bytes of the value being decoded against maxSize
+func (d *MsgpackDecoder) consume(n int) error {
+	d.consumed += n
+	if d.maxSize > 0 && d.consumed > d.maxSize {
+		return fmt.Errorf("Msgpack value exceeds the size limit %d.", d.maxSize)
+	}
+	return nil
+}
+
+func (d *MsgpackDecoder) readByte() (byte, error) {
+	if err := d.consume(1); err != nil {
+		return 0, err
+	}
+	return d.r.ReadByte()
+}
+
+func (d *MsgpackDecoder) read(n int) ([]byte, error) {
+	b := d.buf[:n]
+	if err := d.consume(n); err != nil {
+		return b, err
+	}
+
+	_, err := io.ReadFull(d.r, b)
+	return b, err
+}
+
+func (d *MsgpackDecoder) readLen(n int) (int, error) {
+	b, err := d.read(n)
+	if err != nil {
+		return 0, err
+	}
+
+	var ln uint64
+	switch n {
+	case 1:
+		ln = uint64(b[0])
+	case 2:
+		ln = uint64(binary.BigEndian.Uint16(b))
+	default:
+		ln = uint64(binary.BigEndian.Uint32(b))
+	}
+
+	if (d.maxSize > 0 && ln > uint64(d.maxSize)) || ln > math.MaxInt32 {
+		return 0, fmt.Errorf("Msgpack length %d exceeds the limit.", ln)
+	}
+	return int(ln), nil
+}
+
+func (d *MsgpackDecoder) readBytes(n int) ([]byte, error) {
+	if err := d.consume(n); err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, n)
+	_, err := io.ReadFull(d.r, b)
+	return b, err
+}
+
+func (d *MsgpackDecoder) readExt(n int) (interface{}, error) {
+	t, err := d.readByte()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := d.readBytes(n)
+	if err != nil {
+		return nil, err
+	}
+	return MsgpackExt{Type: int8(t), Data: data}, nil
+}
+
+// enter returns a function to leave the container, or an error if the
+// container is nested too deep
+func (d *MsgpackDecoder) enter() (func(), error) {
+	if d.depth >= MsgpackMaxDepth {
+		return nil, fmt.Errorf("Msgpack value is nested deeper than %d.", MsgpackMaxDepth)
+	}
+
+	d.depth++
+	return func() { d.depth-- }, nil
+}
+
+func (d *MsgpackDecoder) readArray(n int) (interface{}, error) {
+	leave, err := d.enter()
+	if err != nil {
+		return nil, err
+	}
+	defer leave()
+
+	arr := make([]interface{}, 0, MinInt(n, 1024))
+	for i := 0; i < n; i++ {
+		v, err := d.next()
+		if err != nil {
+			return nil, err
+		}
+		arr = append(arr, v)
+	}
+	return arr, nil
+}
+
+func (d *MsgpackDecoder) readMap(n int) (interface{}, error) {
+	leave, err := d.enter()
+	if err != nil {
+		return nil, err
+	}
+	defer leave()
+
+	m := make(map[string]interface{}, MinInt(n, 1024))
+	for i := 0; i < n; i++ {
+		k, err := d.next()
+		if err != nil {
+			return nil, err
+		}
+
+		v, err := d.next()
+		if err != nil {
+			return nil, err
+		}
+
+		switch key := k.(type) {
+		case string:
+			m[key] = v
+		case []byte:
+			m[string(key)] = v
+		default:
+			m[fmt.Sprint(key)] = v
+		}
+	}
+	return m, nil
+}
+
+func (d *MsgpackDecoder) decodeValue(c byte) (interface{}, error) {
+	switch {
+	case c <= 0x7f:
+		return int64(c), nil
+	case c >= 0xe0:
+		return int64(int8(c)), nil
+	case c >= 0x80 && c <= 0x8f:
+		return d.readMap(int(c & 0x0f))
+	case c >= 0x90 && c <= 0x9f:
+		return d.readArray(int(c & 0x0f))
+	case c >= 0xa0 && c <= 0xbf:
+		b, err := d.readBytes(int(c & 0x1f))
+		return string(b), err
+	}
+
+	switch c {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6:
+		n, err := d.readLen(1 << uint(c-0xc4))
+		if err != nil {
+			return nil, err
+		}
+		return d.readBytes(n)
+	case 0xd9, 0xda, 0xdb:
+		n, err := d.readLen(1 << uint(c-0xd9))
+		if err != nil {
+			return nil, err
+		}
+
+		b, err := d.readBytes(n)
+		return string(b), err
+	case 0xc7, 0xc8, 0xc9:
+		n, err := d.readLen(1 << uint(c-0xc7))
+		if err != nil {
+			return nil, err
+		}
+		return d.readExt(n)
+	case 0xca:
+		b, err := d.read(4)
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), err
+	case 0xcb:
+		b, err := d.read(8)
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), err
+	case 0xcc:
+		b, err := d.read(1)
+		return int64(b[0]), err
+	case 0xcd:
+		b, err := d.read(2)
+		return int64(binary.BigEndian.Uint16(b)), err
+	case 0xce:
+		b, err := d.read(4)
+		return int64(binary.BigEndian.Uint32(b)), err
+	case 0xcf:
+		b, err := d.read(8)
+		u := binary.BigEndian.Uint64(b)
+		if u <= math.MaxInt64 {
+			return int64(u), err
+		}
+		return u, err
+	case 0xd0:
+		b, err := d.read(1)
+		return int64(int8(b[0])), err
+	case 0xd1:
+		b, err := d.read(2)
+		return int64(int16(binary.BigEndian.Uint16(b))), err
+	case 0xd2:
+		b, err := d.read(4)
+		return int64(int32(binary.BigEndian.Uint32(b))), err
+	case 0xd3:
+		b, err := d.read(8)
+		return int64(binary.BigEndian.Uint64(b)), err
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8:
+		return d.readExt(1 << uint(c-0xd4))
+	case 0xdc, 0xdd:
+		n, err := d.readLen(2 << uint(c-0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return d.readArray(n)
+	case 0xde, 0xdf:
+		n, err := d.readLen(2 << uint(c-0xde))
+		if err != nil {
+			return nil, err
+		}
+		return d.readMap(n)
+	}
+	return nil, fmt.Errorf("Invalid msgpack type 0x%x.", c)
+}
+
+// MsgpackMarshal encodes the value as msgpack, the numbers decoded from JSON
+// as float64 are encoded as integers when they have no fraction
+func MsgpackMarshal(v interface{}) ([]byte, error) {
+	return AppendMsgpack(make([]byte, 0, 256), v)
+}
+
+func AppendMsgpack(b []byte, v interface{}) ([]byte, error) {
+	var err error
+
+	switch val := v.(type) {
+	case nil:
+		return append(b, 0xc0), nil
+	case bool:
+		if val {
+			return append(b, 0xc3), nil
+		}
+		return append(b, 0xc2), nil
+	case int:
+		return appendMsgpackInt(b, int64(val)), nil
+	case int8:
+		return appendMsgpackInt(b, int64(val)), nil
+	case int16:
+		return appendMsgpackInt(b, int64(val)), nil
+	case int32:
+		return appendMsgpackInt(b, int64(val)), nil
+	case int64:
+		return appendMsgpackInt(b, val), nil
+	case uint:
+		return appendMsgpackUint(b, uint64(val)), nil
+	case uint8:
+		return appendMsgpackUint(b, uint64(val)), nil
+	case uint16:
+		return appendMsgpackUint(b, uint64(val)), nil
+	case uint32:
+		return appendMsgpackUint(b, uint64(val)), nil
+	case uint64:
+		return appendMsgpackUint(b, val), nil
+	case float32:
+		return appendMsgpackFloat(b, float64(val)), nil
+	case float64:
+		return appendMsgpackFloat(b, val), nil
+	case json.Number:
+		if i, err := val.Int64(); err == nil {
+			return appendMsgpackInt(b, i), nil
+		}
+		f, err := strconv.ParseFloat(string(val), 64)
+		if err != nil {
+			return b, err
+		}
+		return appendMsgpackFloat(b, f), nil
+	case string:
+		b = appendMsgpackHeader(b, len(val), 0xa0, 31, 0xd9, 0xda, 0xdb)
+		return append(b, val...), nil
+	case []byte:
+		b = appendMsgpackHeader(b, len(val), 0, -1, 0xc4, 0xc5, 0xc6)
+		return append(b, val...), nil
+	case MsgpackExt:
+		return appendMsgpackExt(b, val), nil
+	case time.Time:
+		return appendMsgpackExt(b, NewMsgpackEventTime(val)), nil
+	case []interface{}:
+		b = appendMsgpackHeader(b, len(val), 0x90, 15, 0, 0xdc, 0xdd)
+		for _, item := range val {
+			if b, err = AppendMsgpack(b, item); err != nil {
+				return b, err
+			}
+		}
+		return b, nil
+	case map[string]interface{}:
+		b = appendMsgpackHeader(b, len(val), 0x80, 15, 0, 0xde, 0xdf)
+		for k, item := range val {
+			b = appendMsgpackHeader(b, len(k), 0xa0, 31, 0xd9, 0xda, 0xdb)
+			b = append(b, k...)
+
+			if b, err = AppendMsgpack(b, item); err != nil {
+				return b, err
+			}
+		}
+		return b, nil
+	}
+
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Array:
+		b = appendMsgpackHeader(b, rv.Len(), 0x90, 15, 0, 0xdc, 0xdd)
+		for i := 0; i < rv.Len(); i++ {
+			if b, err = AppendMsgpack(b, rv.Index(i).Interface()); err != nil {
+				return b, err
+			}
+		}
+		return b, nil
+	case reflect.Map:
+		if rv.Type().Key().Kind() == reflect.String {
+			b = appendMsgpackHeader(b, rv.Len(), 0x80, 15, 0, 0xde, 0xdf)
+			for _, k := range rv.MapKeys() {
+				if b, err = AppendMsgpack(b, k.String()); err != nil {
+					return b, err
+				}
+				if b, err = AppendMsgpack(b, rv.MapIndex(k).Interface()); err != nil {
+					return b, err
+				}
+			}
+			return b, nil
+		}
+	}
+	return b, fmt.Errorf("Cannot encode %T as msgpack.", v)
+}
+
+// appendMsgpackHeader appends the type and length of a string, binary or
+// container, fixMax is the maximum length of its fix type if it has one
+func appendMsgpackHeader(b []byte, n int, fix byte, fixMax int, c8, c16, c32 byte) []byte {
+	switch {
+	case n <= fixMax:
+		return append(b, fix|byte(n))
+	case c8 != 0 && n <= math.MaxUint8:
+		return append(b, c8, byte(n))
+	case n <= math.MaxUint16:
+		return append(b, c16, byte(n>>8), byte(n))
+	}
+	return append(b, c32, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+}
+
+func appendMsgpackInt(b []byte, i int64) []byte {
+	if i >= 0 {
+		return appendMsgpackUint(b, uint64(i))
+	}
+
+	switch {
+	case i >= -32:
+		return append(b, byte(int8(i)))
+	case i >= math.MinInt8:
+		return append(b, 0xd0, byte(int8(i)))
+	case i >= math.MinInt16:
+		return append(b, 0xd1, byte(i>>8), byte(i))
+	case i >= math.MinInt32:
+		return append(b, 0xd2, byte(i>>24), byte(i>>16), byte(i>>8), byte(i))
+	}
+
+	b = append(b, 0xd3)
+	return appendUint64(b, uint64(i))
+}
+
+func appendMsgpackUint(b []byte, u uint64) []byte {
+	switch {
+	case u <= 0x7f:
+		return append(b, byte(u))
+	case u <= math.MaxUint8:
+		return append(b, 0xcc, byte(u))
+	case u <= math.MaxUint16:
+		return append(b, 0xcd, byte(u>>8), byte(u))
+	case u <= math.MaxUint32:
+		return append(b, 0xce, byte(u>>24), byte(u>>16), byte(u>>8), byte(u))
+	}
+
+	b = append(b, 0xcf)
+	return appendUint64(b, u)
+}
+
+func appendMsgpackFloat(b []byte, f float64) []byte {
+	if f == math.Trunc(f) && f >= math.MinInt64 && f < math.MaxInt64 {
+		return appendMsgpackInt(b, int64(f))
+	}
+
+	b = append(b, 0xcb)
+	return appendUint64(b, math.Float64bits(f))
+}
+
+func appendMsgpackExt(b []byte, ext MsgpackExt) []byte {
+	n := len(ext.Data)
+
+	switch n {
+	case 1, 2, 4, 8, 16:
+		code := byte(0xd4)
+		for size := 1; size < n; size <<= 1 {
+			code++
+		}
+		b = append(b, code)
+	default:
+		b = appendMsgpackHeader(b, n, 0, -1, 0xc7, 0xc8, 0xc9)
+	}
+
+	b = append(b, byte(ext.Type))
+	return append(b, ext.Data...)
+}
+
+func appendUint64(b []byte, u uint64) []byte {
+	return append(b, byte(u>>56), byte(u>>48), byte(u>>40), byte(u>>32),
+		byte(u>>24), byte(u>>16), byte(u>>8), byte(u))
+}
@@ -0,0 +1,166 @@
+//	The MIT License (MIT)
+//
+//	Copyright (c) 2016, Cagatay Dogan
+//
+//	Permission is hereby granted, free of charge, to any person obtaining a copy
+//	of this software and associated documentation files (the "Software"), to deal
+//	in the Software without restriction, including without limitation the rights
+//	to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+//	copies of the Software, and to permit persons to whom the Software is
+//	furnished to do so, subject to the following conditions:
+//
+//		The above copyright notice and this permission notice shall be included in
+//		all copies or substantial portions of the Software.
+//
+//		THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+//		IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+//		FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+//		AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+//		LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+//		OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+//		THE SOFTWARE.
+
+package lib
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMsgpackRoundTrip(t *testing.T) {
+	eventTime := time.Unix(1500000000, 123456789)
+
+	tests := []struct {
+		name string
+		in   interface{}
+		want interface{}
+	}{
+		{"nil", nil, nil},
+		{"true", true, true},
+		{"false", false, false},
+		{"positive fixint", 7, int64(7)},
+		{"negative fixint", -5, int64(-5)},
+		{"int8", -100, int64(-100)},
+		{"uint16", 300, int64(300)},
+		{"int64", int64(-1 << 40), int64(-1 << 40)},
+		{"uint64", uint64(1 << 63), uint64(1 << 63)},
+		{"float", 1.5, 1.5},
+		{"float without fraction", float64(42), int64(42)},
+		{"empty string", "", ""},
+		{"fixstr", "hello", "hello"},
+		{"str8", strings.Repeat("a", 40), strings.Repeat("a", 40)},
+		{"str16", strings.Repeat("b", 300), strings.Repeat("b", 300)},
+		{"str32", strings.Repeat("c", 70000), strings.Repeat("c", 70000)},
+		{"binary", []byte{0, 1, 2}, []byte{0, 1, 2}},
+		{"ext", MsgpackExt{Type: 5, Data: []byte{1, 2, 3}}, MsgpackExt{Type: 5, Data: []byte{1, 2, 3}}},
+		{"event time", eventTime, NewMsgpackEventTime(eventTime)},
+		{"array", []interface{}{1, "a", nil}, []interface{}{int64(1), "a", nil}},
+		{"array16", make([]interface{}, 20), make([]interface{}, 20)},
+		{"map", map[string]interface{}{"a": 1, "b": []interface{}{true}},
+			map[string]interface{}{"a": int64(1), "b": []interface{}{true}}},
+		{"string slice", []string{"x", "y"}, []interface{}{"x", "y"}},
+	}
+
+	for _, tt := range tests {
+		data, err := MsgpackMarshal(tt.in)
+		if err != nil {
+			t.Errorf("%s: cannot marshal: %s", tt.name, err)
+			continue
+		}
+
+		got, err := NewMsgpackDecoder(bytes.NewReader(data), 0).Decode()
+		if err != nil {
+			t.Errorf("%s: cannot decode: %s", tt.name, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %#v, want %#v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMsgpackEventTime(t *testing.T) {
+	want := time.Unix(1500000000, 123456789)
+
+	got, ok := NewMsgpackEventTime(want).Time()
+	if !ok || !got.Equal(want) {
+		t.Errorf("got %v %v, want %v", got, ok, want)
+	}
+
+	if _, ok = (MsgpackExt{Type: 1, Data: make([]byte, 8)}).Time(); ok {
+		t.Error("an extension of another type is not an event time")
+	}
+}
+
+func TestMsgpackStream(t *testing.T) {
+	var data []byte
+	for _, v := range []interface{}{"a", 1, nil} {
+		data, _ = AppendMsgpack(data, v)
+	}
+
+	dec := NewMsgpackDecoder(bytes.NewReader(data), 0)
+	for _, want := range []interface{}{"a", int64(1), nil} {
+		got, err := dec.Decode()
+		if err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("got %#v %v, want %#v", got, err, want)
+		}
+	}
+
+	if _, err := dec.Decode(); err != io.EOF {
+		t.Errorf("got %v at the end of the stream, want EOF", err)
+	}
+}
+
+func TestMsgpackMalformed(t *testing.T) {
+	deep := append(bytes.Repeat([]byte{0x91}, MsgpackMaxDepth+1), 0xc0)
+	nested := append(bytes.Repeat([]byte{0x91}, MsgpackMaxDepth), 0xc0)
+
+	tests := []struct {
+		name    string
+		data    []byte
+		maxSize int
+		err     error
+	}{
+		{"empty", nil, 0, io.EOF},
+		{"truncated string", []byte{0xa5, 'a', 'b'}, 0, io.ErrUnexpectedEOF},
+		{"truncated int", []byte{0xcd, 0x01}, 0, io.ErrUnexpectedEOF},
+		{"truncated map", []byte{0x82, 0xa1, 'a', 0x01}, 0, io.ErrUnexpectedEOF},
+		{"truncated ext", []byte{0xd6, 0x00, 0x01}, 0, io.ErrUnexpectedEOF},
+		{"invalid type", []byte{0xc1}, 0, nil},
+		{"length over limit", []byte{0xda, 0xff, 0xff}, 1024, nil},
+		{"array length over limit", []byte{0xdd, 0xff, 0xff, 0xff, 0xff}, 1024, nil},
+		{"value over limit", append([]byte{0x9f}, bytes.Repeat([]byte{0x01}, 15)...), 10, nil},
+		{"nested too deep", deep, 0, nil},
+		{"huge nesting", bytes.Repeat([]byte{0x91}, 1024*1024), 0, nil},
+	}
+
+	for _, tt := range tests {
+		_, err := NewMsgpackDecoder(bytes.NewReader(tt.data), tt.maxSize).Decode()
+		if err == nil {
+			t.Errorf("%s: decoded without an error", tt.name)
+			continue
+		}
+
+		if tt.err != nil && err != tt.err {
+			t.Errorf("%s: got error %v, want %v", tt.name, err, tt.err)
+		}
+	}
+
+	if _, err := NewMsgpackDecoder(bytes.NewReader(nested), 0).Decode(); err != nil {
+		t.Errorf("nesting at the limit: %s", err)
+	}
+}
+
+func TestMsgpackUnsupported(t *testing.T) {
+	if _, err := MsgpackMarshal(struct{}{}); err == nil {
+		t.Error("a struct is encoded")
+	}
+	if _, err := MsgpackMarshal(map[int]interface{}{1: 1}); err == nil {
+		t.Error("a map with int keys is encoded")
+	}
+}
@@ -0,0 +1,142 @@
+//	The MIT License (MIT)
+//
+//	Copyright (c) 2016, Cagatay Dogan
+//
+//	Permission is hereby granted, free of charge, to any person obtaining a copy
+//	of this software and associated documentation files (the "Software"), to deal
+//	in the Software without restriction, including without limitation the rights
+//	to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+//	copies of the Software, and to permit persons to whom the Software is
+//	furnished to do so, subject to the following conditions:
+//
+//		The above copyright notice and this permission notice shall be included in
+//		all copies or substantial portions of the Software.
+//
+//		THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+//		IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+//		FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+//		AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+//		LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+//		OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+//		THE SOFTWARE.
+
+package lib
+
+import (
+	"path"
+	"strings"
+)
+
+type tagPattern struct {
+	parts []string
+}
+
+type TagMatcher struct {
+	patterns []tagPattern
+}
+
+func NewTagMatcher(s string) *TagMatcher {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil
+	}
+
+	tm := &TagMatcher{}
+
+	fields := strings.FieldsFunc(s, func(r rune) bool {
+		return r == ' ' || r == '\t' || r == '\n' || r == '\r'
+	})
+
+	for _, field := range fields {
+		for _, p := range expandTagPattern(field) {
+			if p != "" {
+				tm.patterns = append(tm.patterns, tagPattern{
+					parts: strings.Split(p, "."),
+				})
+			}
+		}
+	}
+
+	if len(tm.patterns) == 0 {
+		return nil
+	}
+	return tm
+}
+
+func expandTagPattern(s string) []string {
+	start := strings.IndexByte(s, '{')
+	if start == -1 {
+		return []string{s}
+	}
+
+	end := strings.IndexByte(s[start:], '}')
+	if end == -1 {
+		return []string{s}
+	}
+	end += start
+
+	var result []string
+
+	prefix, suffix := s[:start], s[end+1:]
+	for _, alt := range strings.Split(s[start+1:end], ",") {
+		result = append(result, expandTagPattern(prefix+strings.TrimSpace(alt)+suffix)...)
+	}
+	return result
+}
+
+func (tm *TagMatcher) Match(tag string) bool {
+	if tm == nil {
+		return true
+	}
+
+	tagParts := strings.Split(tag, ".")
+	for _, p := range tm.patterns {
+		if matchTagParts(p.parts, tagParts) {
+			return true
+		}
+	}
+	return false
+}
+
+func (tm *TagMatcher) String() string {
+	if tm == nil {
+		return ""
+	}
+
+	patterns := make([]string, 0, len(tm.patterns))
+	for _, p := range tm.patterns {
+		patterns = append(patterns, strings.Join(p.parts, "."))
+	}
+	return strings.Join(patterns, " ")
+}
+
+func matchTagParts(pattern, tag []string) bool {
+	for len(pattern) > 0 {
+		p := pattern[0]
+
+		if p == "**" {
+			rest := pattern[1:]
+			if len(rest) == 0 {
+				return true
+			}
+
+			for i := 0; i <= len(tag); i++ {
+				if matchTagParts(rest, tag[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+
+		if len(tag) == 0 {
+			return false
+		}
+
+		if ok, err := path.Match(p, tag[0]); !ok || err != nil {
+			return false
+		}
+
+		pattern, tag = pattern[1:], tag[1:]
+	}
+	return len(tag) == 0
+}